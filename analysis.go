@@ -0,0 +1,165 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+)
+
+// vietnameseWordsText is the dictionary of multi-syllable words indexed as one token
+//
+//go:embed data/vn_words.txt
+var vietnameseWordsText string
+
+// vietnameseSynonymsText lists the marketplace slang expanded when searching
+//
+//go:embed data/vn_synonyms.txt
+var vietnameseSynonymsText string
+
+// maxCompoundSyllables is the longest dictionary word, in syllables, that is recognized
+const maxCompoundSyllables = 4
+
+// vietnameseContentFields are the content fields searched together: the unaccented field
+// matches, exact accents (and slang synonyms) and dictionary words rank higher, prefixes
+// match words being typed
+var vietnameseContentFields = []string{"content", "content.accented^1.5", "content.words^2", "content.prefix^0.3"}
+
+// dataLines returns the lines of a bundled list, without blank lines and # comments
+func dataLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// compoundTokens returns the dictionary words as content.words indexes them:
+// lowercase, unaccented, syllables joined with "_"
+func compoundTokens() []string {
+	seen := map[string]bool{}
+	var tokens []string
+	for _, word := range dataLines(vietnameseWordsText) {
+		syllables := strings.Fields(strings.ToLower(foldVietnamese(word)))
+		if len(syllables) < 2 || len(syllables) > maxCompoundSyllables {
+			continue
+		}
+		token := strings.Join(syllables, "_")
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// vietnameseAnalysis returns the analysis settings of indices with Vietnamese content.
+// Synonyms only expand accented queries: folded, short slang like "dế" or "cũ" would
+// also expand common syllables ("để", "củ").
+func vietnameseAnalysis() map[string]interface{} {
+	custom := func(filters ...string) map[string]interface{} {
+		return map[string]interface{}{"type": "custom", "tokenizer": "standard", "filter": filters}
+	}
+	return map[string]interface{}{
+		"filter": map[string]interface{}{
+			"vietnamese_synonyms": map[string]interface{}{
+				"type":     "synonym_graph",
+				"synonyms": dataLines(vietnameseSynonymsText),
+				"lenient":  true,
+			},
+			"vietnamese_shingles": map[string]interface{}{
+				"type":             "shingle",
+				"min_shingle_size": 2,
+				"max_shingle_size": maxCompoundSyllables,
+				"output_unigrams":  false,
+				"token_separator":  "_",
+			},
+			"vietnamese_dictionary": map[string]interface{}{
+				"type":       "keep",
+				"keep_words": compoundTokens(),
+			},
+			"vietnamese_edge_ngram": map[string]interface{}{
+				"type":     "edge_ngram",
+				"min_gram": 2,
+				"max_gram": 15,
+			},
+		},
+		"analyzer": map[string]interface{}{
+			"vietnamese_analyzer":                 custom("lowercase", "asciifolding"),
+			"vietnamese_accented_analyzer":        custom("lowercase"),
+			"vietnamese_accented_search_analyzer": custom("lowercase", "vietnamese_synonyms"),
+			"vietnamese_words_analyzer":           custom("lowercase", "asciifolding", "vietnamese_shingles", "vietnamese_dictionary"),
+			"vietnamese_prefix_analyzer":          custom("lowercase", "asciifolding", "vietnamese_edge_ngram"),
+		},
+	}
+}
+
+// vietnameseTextField returns the mapping of a Vietnamese text field: unaccented, with
+// an accented subfield, a subfield of dictionary words and an edge n-gram subfield
+func vietnameseTextField() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "text",
+		"analyzer": "vietnamese_analyzer",
+		"fields": map[string]interface{}{
+			"accented": map[string]interface{}{
+				"type":            "text",
+				"analyzer":        "vietnamese_accented_analyzer",
+				"search_analyzer": "vietnamese_accented_search_analyzer",
+			},
+			"words": map[string]interface{}{
+				"type":     "text",
+				"analyzer": "vietnamese_words_analyzer",
+			},
+			"prefix": map[string]interface{}{
+				"type":            "text",
+				"analyzer":        "vietnamese_prefix_analyzer",
+				"search_analyzer": "vietnamese_analyzer",
+			},
+		},
+	}
+}
+
+// withVietnameseAnalysis adds the Vietnamese analysis settings to an index body and maps
+// the given fields as Vietnamese text
+func withVietnameseAnalysis(mapping string, fields ...string) string {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+		panic("invalid mapping: " + err.Error())
+	}
+
+	settings, _ := body["settings"].(map[string]interface{})
+	if settings == nil {
+		settings = map[string]interface{}{}
+		body["settings"] = settings
+	}
+	settings["analysis"] = vietnameseAnalysis()
+
+	mappings, _ := body["mappings"].(map[string]interface{})
+	properties, _ := mappings["properties"].(map[string]interface{})
+	if properties == nil {
+		panic("invalid mapping: no properties")
+	}
+	for _, field := range fields {
+		properties[field] = vietnameseTextField()
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		panic("invalid mapping: " + err.Error())
+	}
+	return string(data)
+}
+
+// vietnameseContentQuery matches text against the content fields, adding the scores of
+// every field that matches
+func vietnameseContentQuery(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"multi_match": map[string]interface{}{
+			"query":  text,
+			"type":   "most_fields",
+			"fields": vietnameseContentFields,
+		},
+	}
+}
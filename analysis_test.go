@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+func TestDataLines(t *testing.T) {
+	text := "# comment\n\nip, iphone\n  ss, samsung  \n\t\n  # indented comment\nlap => laptop"
+	want := []string{"ip, iphone", "ss, samsung", "lap => laptop"}
+	if got := dataLines(text); !slices.Equal(got, want) {
+		t.Errorf("dataLines = %q, want %q", got, want)
+	}
+	if got := dataLines("# only comments\n\n"); len(got) != 0 {
+		t.Errorf("dataLines of comments = %q, want nothing", got)
+	}
+}
+
+func TestCompoundTokens(t *testing.T) {
+	previous := vietnameseWordsText
+	t.Cleanup(func() { vietnameseWordsText = previous })
+
+	vietnameseWordsText = strings.Join([]string{
+		"# Phones",
+		"Điện Thoại",
+		"dien thoai", // the unaccented form of a word already listed
+		"máy tính bảng",
+		"xe",                // one syllable
+		"xe   máy",          // extra spaces
+		"điều hòa nhiệt độ", // four syllables
+		"máy giặt cửa trước lồng ngang", // over maxCompoundSyllables
+	}, "\n")
+	want := []string{"dien_thoai", "may_tinh_bang", "xe_may", "dieu_hoa_nhiet_do"}
+	if got := compoundTokens(); !slices.Equal(got, want) {
+		t.Errorf("compoundTokens = %q, want %q", got, want)
+	}
+}
+
+func TestBundledCompoundTokens(t *testing.T) {
+	tokens := compoundTokens()
+	if !slices.Contains(tokens, "dien_thoai") {
+		t.Errorf("compoundTokens misses dien_thoai")
+	}
+	seen := map[string]bool{}
+	for _, token := range tokens {
+		if seen[token] {
+			t.Errorf("%q is listed twice", token)
+		}
+		seen[token] = true
+		if token != strings.ToLower(foldVietnamese(token)) {
+			t.Errorf("%q is not lowercase and unaccented", token)
+		}
+		if n := strings.Count(token, "_") + 1; n < 2 || n > maxCompoundSyllables {
+			t.Errorf("%q has %d syllables", token, n)
+		}
+	}
+}
+
+func TestWithVietnameseAnalysis(t *testing.T) {
+	mapping := `{
+		"settings": { "number_of_shards": 1 },
+		"mappings": {
+			"properties": {
+				"content": { "type": "text" },
+				"title": { "type": "text" },
+				"category": { "type": "keyword" }
+			}
+		}
+	}`
+	var body struct {
+		Settings struct {
+			Shards   int `json:"number_of_shards"`
+			Analysis struct {
+				Analyzer map[string]struct {
+					Filter []string `json:"filter"`
+				} `json:"analyzer"`
+				Filter map[string]interface{} `json:"filter"`
+			} `json:"analysis"`
+		} `json:"settings"`
+		Mappings struct {
+			Properties map[string]struct {
+				Type           string `json:"type"`
+				Analyzer       string `json:"analyzer"`
+				SearchAnalyzer string `json:"search_analyzer"`
+				Fields         map[string]struct {
+					SearchAnalyzer string `json:"search_analyzer"`
+				} `json:"fields"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(withVietnameseAnalysis(mapping, "content", "title")), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Settings.Shards != 1 {
+		t.Errorf("number_of_shards = %d, want the setting kept", body.Settings.Shards)
+	}
+	for _, name := range []string{"vietnamese_analyzer", "vietnamese_accented_search_analyzer", "vietnamese_words_analyzer", "vietnamese_prefix_analyzer"} {
+		if _, ok := body.Settings.Analysis.Analyzer[name]; !ok {
+			t.Errorf("analyzer %s missing", name)
+		}
+	}
+	// Folded slang would expand common syllables, "dế" (phone) those of "để"
+	for name, analyzer := range body.Settings.Analysis.Analyzer {
+		if slices.Contains(analyzer.Filter, "vietnamese_synonyms") &&
+			(name != "vietnamese_accented_search_analyzer" || slices.Contains(analyzer.Filter, "asciifolding")) {
+			t.Errorf("%s expands synonyms: %v", name, analyzer.Filter)
+		}
+	}
+	if body.Settings.Analysis.Filter["vietnamese_synonyms"] == nil || body.Settings.Analysis.Filter["vietnamese_dictionary"] == nil {
+		t.Errorf("filters = %v, want the synonyms and dictionary", body.Settings.Analysis.Filter)
+	}
+	for _, field := range []string{"content", "title"} {
+		property := body.Mappings.Properties[field]
+		if property.Analyzer != "vietnamese_analyzer" || len(property.Fields) != 3 {
+			t.Errorf("%s = %+v, want Vietnamese text with its subfields", field, property)
+		}
+		if property.SearchAnalyzer != "" || property.Fields["accented"].SearchAnalyzer != "vietnamese_accented_search_analyzer" {
+			t.Errorf("%s = %+v, want synonyms on the accented subfield only", field, property)
+		}
+	}
+	if category := body.Mappings.Properties["category"]; category.Type != "keyword" || category.Analyzer != "" {
+		t.Errorf("category = %+v, want it left alone", category)
+	}
+
+	// A body without settings gets them
+	if !strings.Contains(withVietnameseAnalysis(`{"mappings": {"properties": {}}}`), `"vietnamese_analyzer"`) {
+		t.Error("analysis missing from a mapping without settings")
+	}
+
+	for _, invalid := range []string{`{`, `{"settings": {}}`, `{"mappings": {}}`} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("withVietnameseAnalysis(%s) did not panic", invalid)
+				}
+			}()
+			withVietnameseAnalysis(invalid, "content")
+		}()
+	}
+}
+
+// analysisCorpus is the test corpus of the Vietnamese analysis
+type analysisCorpus struct {
+	Documents []struct {
+		ID      string `json:"id"`
+		Content string `json:"content"`
+	} `json:"documents"`
+	// Analyze cases list the tokens a field produces for a text, in any order
+	Analyze []struct {
+		Field  string   `json:"field"`
+		Text   string   `json:"text"`
+		Tokens []string `json:"tokens"`
+	} `json:"analyze"`
+	// Query cases are run like a chat search: expected documents must match, excluded
+	// ones must not, and top must be the best match when set
+	Queries []struct {
+		Query   string   `json:"query"`
+		Expect  []string `json:"expect"`
+		Exclude []string `json:"exclude"`
+		Top     string   `json:"top"`
+	} `json:"queries"`
+}
+
+// TestVietnameseAnalysisCorpus indexes the corpus in a scratch index with the chat
+// messages mapping of the Elasticsearch running on localhost:9200, and checks every case
+func TestVietnameseAnalysisCorpus(t *testing.T) {
+	data, err := os.ReadFile("data/vn_analysis_corpus.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corpus analysisCorpus
+	if err := json.Unmarshal(data, &corpus); err != nil {
+		t.Fatalf("invalid corpus: %v", err)
+	}
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{"http://localhost:9200"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pingCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	res, err := client.Info(client.Info.WithContext(pingCtx))
+	if err != nil {
+		t.Skipf("Elasticsearch unreachable: %v", err)
+	}
+	res.Body.Close()
+
+	previousClient, previousIndexer := ElasticClient, searchIndexer
+	ElasticClient, searchIndexer = client, NewBulkIndexer(client, BulkIndexerConfigFromEnv())
+	t.Cleanup(func() {
+		searchIndexer.Close(context.Background())
+		ElasticClient, searchIndexer = previousClient, previousIndexer
+	})
+
+	ctx := context.Background()
+	index := fmt.Sprintf("analysis_check_%d", time.Now().UnixNano())
+	if err := createIndexIfMissing(index, chatMessagesMapping); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := deleteIndex(ctx, index); err != nil {
+			t.Logf("Error deleting %s: %v", index, err)
+		}
+	})
+
+	docs := make([]bulkDocument, 0, len(corpus.Documents))
+	for _, doc := range corpus.Documents {
+		docs = append(docs, bulkDocument{ID: doc.ID, Source: ChatMessageIndex{ID: doc.ID, Content: doc.Content}})
+	}
+	if err := searchIndexer.IndexBatch(ctx, index, docs); err != nil {
+		t.Fatal(err)
+	}
+	if err := refreshIndex(ctx, index); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range corpus.Analyze {
+		tokens, err := analyzeText(ctx, index, tc.Field, tc.Text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameTokens(tokens, tc.Tokens) {
+			t.Errorf("analyze %s %q = %v, want %v", tc.Field, tc.Text, tokens, tc.Tokens)
+		}
+	}
+
+	for _, tc := range corpus.Queries {
+		ids, err := searchCorpus(ctx, index, tc.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range tc.Expect {
+			if !slices.Contains(ids, id) {
+				t.Errorf("query %q: %s not matched, got %v", tc.Query, id, ids)
+			}
+		}
+		for _, id := range tc.Exclude {
+			if slices.Contains(ids, id) {
+				t.Errorf("query %q: %s matched, got %v", tc.Query, id, ids)
+			}
+		}
+		if tc.Top != "" && (len(ids) == 0 || ids[0] != tc.Top) {
+			t.Errorf("query %q: %s is not the best match, got %v", tc.Query, tc.Top, ids)
+		}
+	}
+}
+
+// analyzeText returns the tokens a field of an index produces for a text
+func analyzeText(ctx context.Context, index, field, text string) ([]string, error) {
+	data, err := json.Marshal(map[string]interface{}{"field": field, "text": text})
+	if err != nil {
+		return nil, err
+	}
+	req := esapi.IndicesAnalyzeRequest{Index: index, Body: bytes.NewReader(data)}
+	res, err := req.Do(ctx, ElasticClient)
+	if err != nil {
+		return nil, fmt.Errorf("error analyzing text: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error analyzing text: %s", res.String())
+	}
+	var result struct {
+		Tokens []struct {
+			Token string `json:"token"`
+		} `json:"tokens"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing analyze response: %w", err)
+	}
+	tokens := make([]string, 0, len(result.Tokens))
+	for _, token := range result.Tokens {
+		tokens = append(tokens, token.Token)
+	}
+	return tokens, nil
+}
+
+// searchCorpus returns the IDs of the documents matching a chat search, best first
+func searchCorpus(ctx context.Context, index, query string) ([]string, error) {
+	data, err := json.Marshal(map[string]interface{}{"query": chatMessageTextQuery(query), "size": 100})
+	if err != nil {
+		return nil, err
+	}
+	res, err := ElasticClient.Search(
+		ElasticClient.Search.WithContext(ctx),
+		ElasticClient.Search.WithIndex(index),
+		ElasticClient.Search.WithBody(bytes.NewReader(data)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error searching: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error searching: %s", res.String())
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing search response: %w", err)
+	}
+	ids := make([]string, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		ids = append(ids, hit.ID)
+	}
+	return ids, nil
+}
+
+// sameTokens tells whether two token lists hold the same tokens, ignoring order
+func sameTokens(got, want []string) bool {
+	got, want = slices.Clone(got), slices.Clone(want)
+	slices.Sort(got)
+	slices.Sort(want)
+	return slices.Equal(got, want)
+}
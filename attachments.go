@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// maxAttachments bounds the images of a post or a message, and of one upload request
+	maxAttachments = 10
+	// maxImagePixels rejects images that would take too much memory to decode
+	maxImagePixels = 40_000_000
+	// thumbnailSize is the bounding box of thumbnails, in pixels
+	thumbnailSize = 320
+	// jpegQuality is used when images are re-encoded
+	jpegQuality = 85
+)
+
+// uploadMaxBytes is the maximum size of one uploaded file (UPLOAD_MAX_BYTES, default 10 MB)
+var uploadMaxBytes = func() int64 {
+	n, err := strconv.ParseInt(getEnv("UPLOAD_MAX_BYTES", "10485760"), 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Warning: Invalid UPLOAD_MAX_BYTES, using 10 MB")
+		return 10 << 20
+	}
+	return n
+}()
+
+// mediaBaseURL prefixes the URLs of uploaded files (MEDIA_BASE_URL, the public URL of this server)
+var mediaBaseURL = strings.TrimRight(getEnv("MEDIA_BASE_URL", "http://localhost:8080"), "/")
+
+// allowedImageTypes maps the accepted sniffed MIME types to the stored format.
+// WebP is stored as JPEG, there is no WebP encoder in the standard library.
+var allowedImageTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/webp": "jpeg",
+}
+
+var (
+	ErrUnsupportedImage   = errors.New("unsupported file type, only JPEG, PNG and WebP images are accepted")
+	ErrImageTooLarge      = errors.New("file is too large")
+	ErrUnknownAttachment  = errors.New("unknown attachment")
+	ErrTooManyAttachments = fmt.Errorf("at most %d attachments are allowed", maxAttachments)
+)
+
+// Attachment struct
+// An uploaded image; posts and messages embed a copy of the ones they reference
+type Attachment struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	UserID       primitive.ObjectID `bson:"userId" json:"-"`
+	Key          string             `bson:"key" json:"-"`
+	ThumbnailKey string             `bson:"thumbnailKey" json:"-"`
+	URL          string             `bson:"url" json:"url"`
+	ThumbnailURL string             `bson:"thumbnailUrl" json:"thumbnailUrl"`
+	ContentType  string             `bson:"contentType" json:"contentType"`
+	Size         int                `bson:"size" json:"size"`
+	Width        int                `bson:"width" json:"width"`
+	Height       int                `bson:"height" json:"height"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// processedImage is an upload after validation, ready to be stored
+type processedImage struct {
+	format        string
+	data          []byte
+	thumbnail     []byte
+	width, height int
+}
+
+// contentType returns the MIME type of the stored format
+func (pi *processedImage) contentType() string {
+	return "image/" + pi.format
+}
+
+// processImage validates an uploaded image and re-encodes it. Re-encoding drops EXIF and
+// any other metadata, so the camera orientation is applied to the pixels first.
+func processImage(data []byte) (*processedImage, error) {
+	format, ok := allowedImageTypes[http.DetectContentType(data)]
+	if !ok {
+		return nil, ErrUnsupportedImage
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	img = applyOrientation(img, jpegOrientation(data))
+
+	result := &processedImage{format: format, width: img.Bounds().Dx(), height: img.Bounds().Dy()}
+	if result.data, err = encodeImage(img, format); err != nil {
+		return nil, err
+	}
+	if result.thumbnail, err = encodeImage(thumbnail(img, thumbnailSize), format); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// encodeImage writes an image as JPEG or PNG. JPEG has no alpha channel, so transparent
+// pixels are flattened on white.
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	if format == "png" {
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), err
+	}
+
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: jpegQuality})
+	return buf.Bytes(), err
+}
+
+// thumbnail scales an image down to fit in a size x size box, keeping its aspect ratio
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w >= h {
+		w, h = size, max(1, h*size/w)
+	} else {
+		w, h = max(1, w*size/h), size
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag (1-8) of a JPEG file; 1 when absent
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Image data starts, EXIF comes before it
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// applyOrientation turns the stored pixels the way the EXIF orientation says they are displayed
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Orientations 5-8 swap width and height
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// newBlobName returns a random name for the files of an upload
+func newBlobName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// mediaURL is the public URL of a stored blob, served by handleGetMedia
+func mediaURL(key string) string {
+	return mediaBaseURL + "/media/" + key
+}
+
+// SaveAttachment validates, stores and records an uploaded image of a user
+func SaveAttachment(ctx context.Context, db *mongo.Database, userID primitive.ObjectID, data []byte) (*Attachment, error) {
+	if int64(len(data)) > uploadMaxBytes {
+		return nil, ErrImageTooLarge
+	}
+	img, err := processImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := newBlobName()
+	if err != nil {
+		return nil, err
+	}
+	ext := "jpg"
+	if img.format == "png" {
+		ext = "png"
+	}
+	// Spread the files over directories by the first characters of the name
+	prefix := "images/" + name[:2] + "/" + name
+	attachment := &Attachment{
+		ID:           primitive.NewObjectID(),
+		UserID:       userID,
+		Key:          prefix + "." + ext,
+		ThumbnailKey: prefix + "/thumb." + ext,
+		ContentType:  img.contentType(),
+		Size:         len(img.data),
+		Width:        img.width,
+		Height:       img.height,
+		CreatedAt:    time.Now(),
+	}
+	attachment.URL = mediaURL(attachment.Key)
+	attachment.ThumbnailURL = mediaURL(attachment.ThumbnailKey)
+
+	if err := blobStore.Put(ctx, attachment.Key, attachment.ContentType, img.data); err != nil {
+		return nil, err
+	}
+	if err := blobStore.Put(ctx, attachment.ThumbnailKey, attachment.ContentType, img.thumbnail); err != nil {
+		return nil, err
+	}
+	if _, err := db.Collection("attachments").InsertOne(ctx, attachment); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// resolveAttachments loads the attachments a user references by ID, in the given order.
+// Only the user's own uploads can be referenced.
+func resolveAttachments(ctx context.Context, db *mongo.Database, userID primitive.ObjectID, ids []string) ([]Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if len(ids) > maxAttachments {
+		return nil, ErrTooManyAttachments
+	}
+
+	objectIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownAttachment, id)
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	cursor, err := db.Collection("attachments").Find(ctx, bson.M{"_id": bson.M{"$in": objectIDs}, "userId": userID})
+	if err != nil {
+		return nil, err
+	}
+	var found []Attachment
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	byID := make(map[primitive.ObjectID]Attachment, len(found))
+	for _, a := range found {
+		byID[a.ID] = a
+	}
+
+	attachments := make([]Attachment, 0, len(objectIDs))
+	for i, id := range objectIDs {
+		a, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownAttachment, ids[i])
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// attachmentIDs lists the IDs of attachments, for edit history
+func attachmentIDs(attachments []Attachment) []string {
+	ids := make([]string, 0, len(attachments))
+	for _, a := range attachments {
+		ids = append(ids, a.ID.Hex())
+	}
+	return ids
+}
+
+// writeAttachmentError maps upload and reference errors to HTTP responses
+func writeAttachmentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrUnsupportedImage):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrUnknownAttachment), errors.Is(err, ErrTooManyAttachments):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment", "detail": err.Error()})
+	}
+}
+
+// handleUpload stores the images of a multipart form (field "files", one or more) and
+// returns their attachments, to be referenced by ID from posts and messages
+func handleUpload(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachments*uploadMaxBytes+1<<20)
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart form", "detail": err.Error()})
+		return
+	}
+	files := form.File["files"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return
+	}
+	if len(files) > maxAttachments {
+		writeAttachmentError(c, ErrTooManyAttachments)
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := currentUser(c).ID
+	attachments := make([]*Attachment, 0, len(files))
+	for _, fh := range files {
+		if fh.Size > uploadMaxBytes {
+			writeAttachmentError(c, fmt.Errorf("%w: %s", ErrImageTooLarge, fh.Filename))
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file", "detail": err.Error()})
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(f, uploadMaxBytes+1))
+		f.Close()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file", "detail": err.Error()})
+			return
+		}
+
+		attachment, err := SaveAttachment(ctx, mongoDB, userID, data)
+		if err != nil {
+			writeAttachmentError(c, err)
+			return
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"attachments": attachments})
+}
+
+// handleGetMedia serves a stored file. Names are random and never reused, so they are cached for good.
+func handleGetMedia(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	body, contentType, err := blobStore.Get(c.Request.Context(), key)
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file", "detail": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, -1, contentType, body, nil)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// exifJPEG returns a small JPEG carrying an EXIF orientation tag in the given byte order
+func exifJPEG(t *testing.T, orientation int, order binary.ByteOrder) []byte {
+	t.Helper()
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// TIFF header, one IFD with the orientation entry, no next IFD
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112) // Orientation
+	order.PutUint16(tiff[12:], 3)      // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(2+len(segment)))
+	app1 = append(app1, segment...)
+
+	data := img.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if got := jpegOrientation(exifJPEG(t, orientation, order)); got != orientation {
+				t.Errorf("jpegOrientation(%d, %v) = %d", orientation, order, got)
+			}
+		}
+	}
+
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 2, 2)), nil)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no EXIF", plain.Bytes()},
+		{"out of range tag", exifJPEG(t, 9, binary.BigEndian)},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"truncated", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x10}},
+		{"empty", nil},
+	}
+	for _, tt := range tests {
+		if got := jpegOrientation(tt.data); got != 1 {
+			t.Errorf("jpegOrientation(%s) = %d, want 1", tt.name, got)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// The stored image is 3x2:
+	//   a b c
+	//   d e f
+	// and each orientation lists the displayed rows
+	tests := []struct {
+		orientation int
+		want        []string
+	}{
+		{1, []string{"abc", "def"}},
+		{2, []string{"cba", "fed"}},
+		{3, []string{"fed", "cba"}},
+		{4, []string{"def", "abc"}},
+		{5, []string{"ad", "be", "cf"}},
+		{6, []string{"da", "eb", "fc"}},
+		{7, []string{"fc", "eb", "da"}},
+		{8, []string{"cf", "be", "ad"}},
+	}
+
+	pixel := func(name byte) color.NRGBA {
+		return color.NRGBA{R: name, G: 0, B: 0, A: 255}
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y, row := range []string{"abc", "def"} {
+		for x := range row {
+			src.SetNRGBA(x, y, pixel(row[x]))
+		}
+	}
+
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+		b := got.Bounds()
+		if b.Dx() != len(tt.want[0]) || b.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: size %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x := range row {
+				if c := color.NRGBAModel.Convert(got.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA); c != pixel(row[x]) {
+					t.Errorf("orientation %d: pixel (%d,%d) = %q, want %q", tt.orientation, x, y, c.R, row[x])
+				}
+			}
+		}
+	}
+}
+
+// pngHeader returns the signature and IHDR chunk of a PNG of the given size, enough for
+// image.DecodeConfig
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 4+13)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // RGBA
+
+	chunk := binary.BigEndian.AppendUint32(nil, 13)
+	chunk = append(chunk, ihdr...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(ihdr))
+	return append([]byte("\x89PNG\r\n\x1a\n"), chunk...)
+}
+
+func TestProcessImage(t *testing.T) {
+	var pngData, jpegData bytes.Buffer
+	png.Encode(&pngData, image.NewNRGBA(image.Rect(0, 0, 640, 480)))
+	jpeg.Encode(&jpegData, image.NewGray(image.Rect(0, 0, 400, 300)), nil)
+
+	tests := []struct {
+		name          string
+		data          []byte
+		err           error
+		format        string
+		width, height int
+	}{
+		{"png", pngData.Bytes(), nil, "png", 640, 480},
+		{"jpeg", jpegData.Bytes(), nil, "jpeg", 400, 300},
+		{"rotated jpeg", exifJPEG(t, 6, binary.LittleEndian), nil, "jpeg", 2, 4},
+		{"text", []byte("hello, not an image"), ErrUnsupportedImage, "", 0, 0},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), ErrUnsupportedImage, "", 0, 0},
+		{"pdf", []byte("%PDF-1.4\n"), ErrUnsupportedImage, "", 0, 0},
+		{"broken png", append(pngHeader(10, 10), "garbage"...), ErrUnsupportedImage, "", 0, 0},
+		{"too many pixels", pngHeader(10000, 5000), ErrImageTooLarge, "", 0, 0},
+	}
+	for _, tt := range tests {
+		got, err := processImage(tt.data)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.format != tt.format || got.width != tt.width || got.height != tt.height {
+			t.Errorf("%s: got %s %dx%d, want %s %dx%d", tt.name, got.format, got.width, got.height, tt.format, tt.width, tt.height)
+		}
+		if len(got.data) == 0 || len(got.thumbnail) == 0 {
+			t.Errorf("%s: empty image or thumbnail", tt.name)
+		}
+	}
+
+	// The thumbnail fits in the thumbnail box and keeps the aspect ratio
+	got, err := processImage(pngData.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := png.DecodeConfig(bytes.NewReader(got.thumbnail))
+	if err != nil || thumb.Width != thumbnailSize || thumb.Height != 240 {
+		t.Errorf("thumbnail = %dx%d (%v), want %dx240", thumb.Width, thumb.Height, err, thumbnailSize)
+	}
+}
+
+func TestSaveAttachmentRejections(t *testing.T) {
+	previous := uploadMaxBytes
+	uploadMaxBytes = 1024
+	t.Cleanup(func() { uploadMaxBytes = previous })
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"over the upload limit", bytes.Repeat([]byte{0xFF}, 1025), ErrImageTooLarge},
+		{"unsupported type", []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"/>"), ErrUnsupportedImage},
+	}
+	for _, tt := range tests {
+		// Rejected uploads never reach the blob store or the database
+		if _, err := SaveAttachment(context.Background(), nil, primitive.NewObjectID(), tt.data); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessionTTL is how long a session token stays valid after login
+const sessionTTL = 30 * 24 * time.Hour
+
+// currentUserKey is the gin context key holding the authenticated User
+const currentUserKey = "currentUser"
+
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+// Session struct
+// Only the SHA-256 hash of the token is stored, the raw token is returned once at login
+type Session struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TokenHash string             `bson:"tokenHash" json:"-"`
+	UserID    primitive.ObjectID `bson:"userId" json:"userId"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt" json:"expiresAt"`
+}
+
+// EnsureSessionIndexes creates the token lookup index and lets Mongo purge expired sessions
+func EnsureSessionIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("sessions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession issues a new opaque session token for the user
+func CreateSession(ctx context.Context, db *mongo.Database, userID primitive.ObjectID) (string, *Session, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	now := time.Now()
+	session := Session{
+		ID:        primitive.NewObjectID(),
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionTTL),
+	}
+	if _, err := db.Collection("sessions").InsertOne(ctx, session); err != nil {
+		return "", nil, err
+	}
+	return token, &session, nil
+}
+
+// ResolveSession returns the user owning a valid session token
+func ResolveSession(ctx context.Context, db *mongo.Database, token string) (*User, error) {
+	var session Session
+	err := db.Collection("sessions").FindOne(ctx, bson.M{
+		"tokenHash": hashToken(token),
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	err = db.Collection("users").FindOne(ctx, bson.M{"_id": session.UserID}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// DeleteSession revokes a session token
+func DeleteSession(ctx context.Context, db *mongo.Database, token string) error {
+	_, err := db.Collection("sessions").DeleteOne(ctx, bson.M{"tokenHash": hashToken(token)})
+	return err
+}
+
+// tokenQueryPath is the only route taking the token as a query param: WebSocket clients
+// cannot set headers. Elsewhere it would end up in access logs and Referer headers.
+const tokenQueryPath = "/chat/ws"
+
+// sessionToken reads the token from the Authorization header, falling back to the
+// "token" query param on tokenQueryPath
+func sessionToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	if c.FullPath() == tokenQueryPath {
+		return c.Query("token")
+	}
+	return ""
+}
+
+// AuthRequired resolves the current user from the session token or aborts with 401
+func AuthRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := sessionToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+
+		user, err := ResolveSession(c.Request.Context(), mongoDB, token)
+		if err != nil {
+			if errors.Is(err, ErrInvalidSession) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			}
+			return
+		}
+
+		c.Set(currentUserKey, *user)
+		c.Next()
+	}
+}
+
+// currentUser returns the user set by AuthRequired
+func currentUser(c *gin.Context) User {
+	return c.MustGet(currentUserKey).(User)
+}
+
+// IsParticipant reports whether the user is the buyer or the seller of the room
+func (room *ChatRoom) IsParticipant(userID primitive.ObjectID) bool {
+	return room.BuyerID == userID || room.SellerID == userID
+}
+
+// loadRoomForParticipant loads a chat room and checks the user takes part in it.
+// On failure it writes the 404/403/500 response and returns nil.
+func loadRoomForParticipant(c *gin.Context, roomID, userID primitive.ObjectID) *ChatRoom {
+	var room ChatRoom
+	if err := chatroomCollection.FindOne(c.Request.Context(), bson.M{"_id": roomID}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat room not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return nil
+	}
+	if !room.IsParticipant(userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this chat room"})
+		return nil
+	}
+	return &room
+}
+
+// handleGetMe returns the authenticated user
+func handleGetMe(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"user": currentUser(c)})
+}
+
+// handleLogout revokes the current session token
+func handleLogout(c *gin.Context) {
+	if err := DeleteSession(c.Request.Context(), mongoDB, sessionToken(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSessionToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	echo := func(c *gin.Context) { c.String(http.StatusOK, sessionToken(c)) }
+	r.GET(tokenQueryPath, echo)
+	r.GET("/auth/me", echo)
+
+	tests := []struct {
+		url    string
+		header string
+		want   string
+	}{
+		{"/auth/me", "Bearer abc", "abc"},
+		{"/auth/me", "Bearer  abc ", "abc"},
+		{"/auth/me?token=abc", "", ""},
+		{"/auth/me", "Basic abc", ""},
+		{"/chat/ws?token=abc", "", "abc"},
+		{"/chat/ws?token=abc", "Bearer def", "def"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s with %q: token %q, want %q", tt.url, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	user := User{ID: primitive.NewObjectID(), Username: "lan"}
+	session := Session{ID: primitive.NewObjectID(), TokenHash: hashToken("good"), UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+
+	// serve runs a request through AuthRequired on the mocked database
+	serve := func(mt *mtest.T, method, url, token string) *httptest.ResponseRecorder {
+		previous := mongoDB
+		mongoDB = mt.DB
+		mt.Cleanup(func() { mongoDB = previous })
+
+		r := gin.New()
+		authorized := r.Group("/")
+		authorized.Use(AuthRequired())
+		authorized.GET("/auth/me", handleGetMe)
+		authorized.POST("/auth/logout", handleLogout)
+
+		req := httptest.NewRequest(method, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	ns := func(mt *mtest.T, coll string) string { return mt.DB.Name() + "." + coll }
+
+	mt.Run("no token", func(mt *mtest.T) {
+		if w := serve(mt, http.MethodGet, "/auth/me", ""); w.Code != http.StatusUnauthorized {
+			mt.Errorf("status = %d, want 401", w.Code)
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			mt.Errorf("commands = %d, want no lookup", len(events))
+		}
+	})
+
+	mt.Run("query token", func(mt *mtest.T) {
+		if w := serve(mt, http.MethodGet, "/auth/me?token=good", ""); w.Code != http.StatusUnauthorized {
+			mt.Errorf("status = %d, want 401 outside the WebSocket route", w.Code)
+		}
+	})
+
+	mt.Run("valid session", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns(mt, "sessions"), mtest.FirstBatch, mockDocument(mt, session)),
+			mtest.CreateCursorResponse(0, ns(mt, "users"), mtest.FirstBatch, mockDocument(mt, user)),
+		)
+		w := serve(mt, http.MethodGet, "/auth/me", "good")
+		if w.Code != http.StatusOK {
+			mt.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		if filter.Lookup("tokenHash").StringValue() != hashToken("good") {
+			mt.Errorf("filter = %v, want the token hash", filter)
+		}
+		if _, err := filter.LookupErr("expiresAt", "$gt"); err != nil {
+			mt.Errorf("filter = %v, want expired sessions excluded", filter)
+		}
+	})
+
+	mt.Run("expired or unknown session", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns(mt, "sessions"), mtest.FirstBatch))
+		if w := serve(mt, http.MethodGet, "/auth/me", "old"); w.Code != http.StatusUnauthorized {
+			mt.Errorf("status = %d, want 401", w.Code)
+		}
+	})
+
+	mt.Run("deleted user", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns(mt, "sessions"), mtest.FirstBatch, mockDocument(mt, session)),
+			mtest.CreateCursorResponse(0, ns(mt, "users"), mtest.FirstBatch),
+		)
+		if w := serve(mt, http.MethodGet, "/auth/me", "good"); w.Code != http.StatusUnauthorized {
+			mt.Errorf("status = %d, want 401", w.Code)
+		}
+	})
+
+	mt.Run("logout revokes the token", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns(mt, "sessions"), mtest.FirstBatch, mockDocument(mt, session)),
+			mtest.CreateCursorResponse(0, ns(mt, "users"), mtest.FirstBatch, mockDocument(mt, user)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			// The revoked session is not found anymore
+			mtest.CreateCursorResponse(0, ns(mt, "sessions"), mtest.FirstBatch),
+		)
+		if w := serve(mt, http.MethodPost, "/auth/logout", "good"); w.Code != http.StatusOK {
+			mt.Fatalf("logout status = %d, want 200: %s", w.Code, w.Body)
+		}
+		events := mt.GetAllStartedEvents()
+		deleted := events[len(events)-1]
+		if deleted.CommandName != "delete" {
+			mt.Fatalf("last command = %s, want delete", deleted.CommandName)
+		}
+		filter := deleted.Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q").Document()
+		if filter.Lookup("tokenHash").StringValue() != hashToken("good") {
+			mt.Errorf("delete filter = %v, want the token hash", filter)
+		}
+
+		if w := serve(mt, http.MethodGet, "/auth/me", "good"); w.Code != http.StatusUnauthorized {
+			mt.Errorf("status after logout = %d, want 401", w.Code)
+		}
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned by Get when a key is not stored
+var ErrBlobNotFound = errors.New("blob not found")
+
+// blobKeyPattern restricts keys to generated names, so they are safe as file paths and URLs
+var blobKeyPattern = regexp.MustCompile(`^[a-z0-9]+(/[a-z0-9]+)*\.[a-z0-9]+$`)
+
+// BlobStore stores uploaded files under slash separated keys
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	// Get returns the content and its type; the caller closes the reader
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// blobStore is the storage for attachments, selected in main by NewBlobStoreFromEnv
+var blobStore BlobStore = NewLocalBlobStore("uploads")
+
+// NewBlobStoreFromEnv selects the storage from the BLOB_STORE variable: "local" (default,
+// files under BLOB_DIR) or "s3" (any S3 compatible service, e.g. MinIO)
+func NewBlobStoreFromEnv() (BlobStore, error) {
+	switch store := getEnv("BLOB_STORE", "local"); store {
+	case "local":
+		return NewLocalBlobStore(getEnv("BLOB_DIR", "uploads")), nil
+	case "s3":
+		endpoint := os.Getenv("S3_ENDPOINT")
+		bucket := os.Getenv("S3_BUCKET")
+		accessKey := os.Getenv("S3_ACCESS_KEY_ID")
+		secretKey := os.Getenv("S3_SECRET_ACCESS_KEY")
+		if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+			return nil, errors.New("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set")
+		}
+		return NewS3BlobStore(endpoint, getEnv("S3_REGION", "us-east-1"), bucket, accessKey, secretKey), nil
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", store)
+	}
+}
+
+// LocalBlobStore keeps blobs as files under a directory
+type LocalBlobStore struct {
+	dir string
+}
+
+// NewLocalBlobStore creates a store writing under dir; the directory is created on first write
+func NewLocalBlobStore(dir string) *LocalBlobStore {
+	return &LocalBlobStore{dir: dir}
+}
+
+func (ls *LocalBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(ls.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob through a temporary file, so readers never see a partial file
+func (ls *LocalBlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	name, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Get opens the blob; the content type is derived from the key extension
+func (ls *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	name, err := ls.path(key)
+	if err != nil {
+		return nil, "", ErrBlobNotFound
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return f, mime.TypeByExtension(path.Ext(key)), nil
+}
+
+// Delete removes the blob; missing blobs are not an error
+func (ls *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	name, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// S3BlobStore stores blobs in a bucket of an S3 compatible service, using path style
+// URLs and Signature Version 4
+type S3BlobStore struct {
+	client    *http.Client
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+}
+
+// NewS3BlobStore creates a store for bucket at endpoint, e.g. "http://localhost:9000"
+func NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey string) *S3BlobStore {
+	return &S3BlobStore{
+		client:    &http.Client{Timeout: 30 * time.Second},
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+	}
+}
+
+// Put uploads the blob with PutObject
+func (ss *S3BlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	req, err := ss.newRequest(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error uploading blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return s3Error("uploading", resp)
+	}
+	return nil
+}
+
+// Get downloads the blob with GetObject
+func (ss *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return nil, "", ErrBlobNotFound
+	}
+	req, err := ss.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("error downloading blob: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, "", ErrBlobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, "", s3Error("downloading", resp)
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// Delete removes the blob with DeleteObject
+func (ss *S3BlobStore) Delete(ctx context.Context, key string) error {
+	req, err := ss.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error deleting blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return s3Error("deleting", resp)
+	}
+	return nil
+}
+
+// newRequest builds a request for an object, signed with AWS Signature Version 4
+func (ss *S3BlobStore) newRequest(ctx context.Context, method, key string, body []byte) (*http.Request, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+	objectPath := "/" + ss.bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, method, ss.endpoint+objectPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{method, objectPath, "", canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + ss.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+ss.secretKey), date)
+	signingKey = hmacSHA256(signingKey, ss.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		ss.accessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error reads the error document of a failed S3 response
+func s3Error(action string, resp *http.Response) error {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("error %s blob: %s: %s", action, resp.Status, strings.TrimSpace(string(detail)))
+}
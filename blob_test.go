@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory stand-in for the object API of an S3 bucket
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	// fail makes every request answer 500
+	fail bool
+}
+
+type fakeS3Object struct {
+	contentType string
+	data        []byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail {
+		http.Error(w, "<Error><Code>InternalError</Code></Error>", http.StatusInternalServerError)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		http.Error(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[r.URL.Path] = fakeS3Object{contentType: r.Header.Get("Content-Type"), data: body}
+	case http.MethodGet:
+		object, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Write(object.data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	fake := &fakeS3{objects: map[string]fakeS3Object{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store := NewS3BlobStore(server.URL+"/", "ap-southeast-1", "media", "access", "secret")
+	ctx := context.Background()
+	key := "ab/cdef.jpg"
+	data := []byte("jpeg bytes")
+
+	if err := store.Put(ctx, key, "image/jpeg", data); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	fake.mu.Lock()
+	_, stored := fake.objects["/media/"+key]
+	fake.mu.Unlock()
+	if !stored {
+		t.Fatalf("object not stored at a path style URL")
+	}
+
+	body, contentType, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(got, data) || contentType != "image/jpeg" {
+		t.Errorf("Get = %q (%s), want %q (image/jpeg)", got, contentType, data)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := store.Get(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Get after Delete: err = %v, want ErrBlobNotFound", err)
+	}
+	// Deleting a missing blob is not an error
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing blob: %v", err)
+	}
+
+	// Keys are validated before any request
+	if err := store.Put(ctx, "../secret.txt", "text/plain", data); err == nil {
+		t.Errorf("Put with an invalid key succeeded")
+	}
+	if _, _, err := store.Get(ctx, "../secret.txt"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Get with an invalid key: err = %v, want ErrBlobNotFound", err)
+	}
+
+	fake.mu.Lock()
+	fake.fail = true
+	fake.mu.Unlock()
+	if err := store.Put(ctx, key, "image/jpeg", data); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Errorf("Put on a failing server: err = %v, want the S3 error document", err)
+	}
+	if _, _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Get on a failing server: err = %v, want a server error", err)
+	}
+}
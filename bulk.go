@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+const (
+	// bulkMaxRetries is the number of times a bulk request is sent again after a
+	// connection error or a 429/5xx response, and a rejected document is queued again
+	bulkMaxRetries = 3
+	// bulkRetryDelay is the delay before the first retry, doubled for the next ones
+	bulkRetryDelay = 500 * time.Millisecond
+	// bulkRequestTimeout bounds one bulk request
+	bulkRequestTimeout = 30 * time.Second
+	// bulkRateWindow is the number of seconds the throughput is averaged over
+	bulkRateWindow = 60
+)
+
+// ErrBulkIndexerClosed is returned for operations added after the indexer was closed
+var ErrBulkIndexerClosed = errors.New("bulk indexer is closed")
+
+// BulkIndexerConfig holds when the queued operations are sent
+type BulkIndexerConfig struct {
+	// FlushDocs and FlushBytes send a bulk request once that many operations are batched
+	FlushDocs  int
+	FlushBytes int
+	// FlushInterval sends a non-empty batch at least that often
+	FlushInterval time.Duration
+	// QueueSize bounds the operations waiting to be batched; adding blocks when it is full
+	QueueSize int
+}
+
+// BulkIndexerConfigFromEnv reads BULK_FLUSH_DOCS (default 500), BULK_FLUSH_BYTES
+// (default 5 MB), BULK_FLUSH_INTERVAL (default 1s) and BULK_QUEUE_SIZE (default 10000)
+func BulkIndexerConfigFromEnv() BulkIndexerConfig {
+	positiveInt := func(key string, fallback int) int {
+		n, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+		if err != nil || n <= 0 {
+			log.Printf("Warning: Invalid %s, using %d", key, fallback)
+			return fallback
+		}
+		return n
+	}
+	interval, err := time.ParseDuration(getEnv("BULK_FLUSH_INTERVAL", "1s"))
+	if err != nil || interval <= 0 {
+		log.Printf("Warning: Invalid BULK_FLUSH_INTERVAL, using 1s")
+		interval = time.Second
+	}
+	return BulkIndexerConfig{
+		FlushDocs:     positiveInt("BULK_FLUSH_DOCS", 500),
+		FlushBytes:    positiveInt("BULK_FLUSH_BYTES", 5<<20),
+		FlushInterval: interval,
+		QueueSize:     positiveInt("BULK_QUEUE_SIZE", 10000),
+	}
+}
+
+// BulkIndexerStats reports the activity of the bulk indexer
+type BulkIndexerStats struct {
+	Queued        int    `json:"queued"`
+	QueueCapacity int    `json:"queueCapacity"`
+	Added         uint64 `json:"added"`
+	Indexed       uint64 `json:"indexed"`
+	Deleted       uint64 `json:"deleted"`
+	Failed        uint64 `json:"failed"`
+	Retried       uint64 `json:"retried"`
+	Flushes       uint64 `json:"flushes"`
+	FailedFlushes uint64 `json:"failedFlushes"`
+	// DocsPerSecond is the number of operations applied per second over the last minute
+	DocsPerSecond  float64    `json:"docsPerSecond"`
+	AvgFlushMillis float64    `json:"avgFlushMillis"`
+	LastFlushAt    *time.Time `json:"lastFlushAt,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+}
+
+// bulkOperation is one document to index or delete, with the function told its result
+type bulkOperation struct {
+	action string // "index" or "delete"
+	index  string
+	id     string
+	source []byte
+	// attempts counts the times the document was rejected with a 429
+	attempts int
+	done     func(error)
+}
+
+// size is the number of bytes the operation adds to a bulk request body
+func (op *bulkOperation) size() int {
+	return len(op.index) + len(op.id) + len(op.source) + 48
+}
+
+// BulkIndexer batches index and delete operations into bulk requests, sent when a batch
+// is large enough or FlushInterval elapsed. Documents become searchable with the next
+// index refresh instead of forcing one per document.
+type BulkIndexer struct {
+	client *elasticsearch.Client
+	config BulkIndexerConfig
+	queue  chan *bulkOperation
+
+	// closeMu guards closed: adding holds it for reading so no operation is queued
+	// once Close started draining
+	closeMu sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	done    chan struct{}
+
+	statsMu    sync.Mutex
+	stats      BulkIndexerStats
+	flushTotal time.Duration
+	rate       [bulkRateWindow]struct{ second, count int64 }
+}
+
+// searchIndexer sends every document write to Elasticsearch, started by InitElasticsearch
+var searchIndexer *BulkIndexer
+
+// NewBulkIndexer starts a bulk indexer sending to client
+func NewBulkIndexer(client *elasticsearch.Client, config BulkIndexerConfig) *BulkIndexer {
+	b := &BulkIndexer{
+		client:  client,
+		config:  config,
+		queue:   make(chan *bulkOperation, config.QueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// add queues an operation, waiting while the queue is full
+func (b *BulkIndexer) add(ctx context.Context, op *bulkOperation) error {
+	b.closeMu.RLock()
+	defer b.closeMu.RUnlock()
+	if b.closed {
+		return ErrBulkIndexerClosed
+	}
+
+	select {
+	case b.queue <- op:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	b.statsMu.Lock()
+	b.stats.Added++
+	b.statsMu.Unlock()
+	return nil
+}
+
+// addAndWait queues an operation and waits until its bulk request was sent
+func (b *BulkIndexer) addAndWait(ctx context.Context, op *bulkOperation) error {
+	result := make(chan error, 1)
+	op.done = func(err error) { result <- err }
+	if err := b.add(ctx, op); err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Index creates or replaces a document and waits until it is written. It is meant for
+// the outbox worker, which retries failures: request handlers record outbox events instead
+// of waiting for Elasticsearch.
+func (b *BulkIndexer) Index(ctx context.Context, index, id string, doc interface{}) error {
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("error marshaling document %s: %w", id, err)
+	}
+	return b.addAndWait(ctx, &bulkOperation{action: "index", index: index, id: id, source: source})
+}
+
+// Delete removes a document and waits until it is gone, like Index. A missing document is not an error.
+func (b *BulkIndexer) Delete(ctx context.Context, index, id string) error {
+	return b.addAndWait(ctx, &bulkOperation{action: "delete", index: index, id: id})
+}
+
+// IndexBatch creates or replaces documents and waits until all of them are written
+func (b *BulkIndexer) IndexBatch(ctx context.Context, index string, docs []bulkDocument) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed, first := 0, ""
+	for _, doc := range docs {
+		source, err := json.Marshal(doc.Source)
+		if err != nil {
+			wg.Wait()
+			return fmt.Errorf("error marshaling document %s: %w", doc.ID, err)
+		}
+		id := doc.ID
+		wg.Add(1)
+		op := &bulkOperation{action: "index", index: index, id: id, source: source, done: func(err error) {
+			if err != nil {
+				mu.Lock()
+				if failed == 0 {
+					first = fmt.Sprintf("%s: %v", id, err)
+				}
+				failed++
+				mu.Unlock()
+			}
+			wg.Done()
+		}}
+		if err := b.add(ctx, op); err != nil {
+			wg.Done()
+			wg.Wait()
+			return err
+		}
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d documents failed to index, first %s", failed, len(docs), first)
+	}
+	return nil
+}
+
+// Close stops accepting operations and sends the queued ones, until ctx is done
+func (b *BulkIndexer) Close(ctx context.Context) error {
+	b.closeMu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.closing)
+	}
+	b.closeMu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("bulk indexer not drained, %d operations left: %w", len(b.queue), ctx.Err())
+	}
+}
+
+// Stats returns the counters and current throughput of the indexer
+func (b *BulkIndexer) Stats() BulkIndexerStats {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+
+	stats := b.stats
+	stats.Queued = len(b.queue)
+	stats.QueueCapacity = cap(b.queue)
+	if stats.Flushes > 0 {
+		stats.AvgFlushMillis = float64(b.flushTotal.Milliseconds()) / float64(stats.Flushes)
+	}
+	now := time.Now().Unix()
+	var recent int64
+	for _, slot := range b.rate {
+		if now-slot.second < bulkRateWindow {
+			recent += slot.count
+		}
+	}
+	stats.DocsPerSecond = float64(recent) / bulkRateWindow
+	return stats
+}
+
+// run batches queued operations until the indexer is closed and drained
+func (b *BulkIndexer) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*bulkOperation
+	size := 0
+	push := func(op *bulkOperation) {
+		batch = append(batch, op)
+		size += op.size()
+		if len(batch) >= b.config.FlushDocs || size >= b.config.FlushBytes {
+			batch = b.flush(batch)
+			size = batchSize(batch)
+		}
+	}
+
+	for {
+		select {
+		case op := <-b.queue:
+			push(op)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				batch = b.flush(batch)
+				size = batchSize(batch)
+			}
+		case <-b.closing:
+			// Nothing is added anymore: send what is queued, retries included
+			for {
+				select {
+				case op := <-b.queue:
+					push(op)
+					continue
+				default:
+				}
+				if len(batch) == 0 {
+					return
+				}
+				batch = b.flush(batch)
+				size = batchSize(batch)
+			}
+		}
+	}
+}
+
+// batchSize is the body size of a batch
+func batchSize(batch []*bulkOperation) int {
+	size := 0
+	for _, op := range batch {
+		size += op.size()
+	}
+	return size
+}
+
+// flush sends a batch and reports each operation's result. Documents rejected because
+// the cluster is overloaded are returned to be sent with the next batch.
+func (b *BulkIndexer) flush(batch []*bulkOperation) []*bulkOperation {
+	var body bytes.Buffer
+	for _, op := range batch {
+		meta, _ := json.Marshal(map[string]interface{}{op.action: map[string]interface{}{"_index": op.index, "_id": op.id}})
+		body.Write(meta)
+		body.WriteByte('\n')
+		if op.action == "index" {
+			body.Write(op.source)
+			body.WriteByte('\n')
+		}
+	}
+
+	start := time.Now()
+	results, err := b.send(body.Bytes())
+	elapsed := time.Since(start)
+	if err == nil && len(results) != len(batch) {
+		err = fmt.Errorf("bulk response has %d items for %d operations", len(results), len(batch))
+	}
+
+	var retry []*bulkOperation
+	var indexed, deleted, failed, retried int64
+	for i, op := range batch {
+		opErr := err
+		if err == nil {
+			opErr = results[i]
+		}
+		var status *bulkItemError
+		if errors.As(opErr, &status) && status.status == 429 && op.attempts < bulkMaxRetries {
+			op.attempts++
+			retry = append(retry, op)
+			retried++
+			continue
+		}
+		switch {
+		case opErr != nil:
+			failed++
+		case op.action == "delete":
+			deleted++
+		default:
+			indexed++
+		}
+		if op.done != nil {
+			op.done(opErr)
+		}
+	}
+
+	b.statsMu.Lock()
+	b.stats.Flushes++
+	b.flushTotal += elapsed
+	flushedAt := time.Now()
+	b.stats.LastFlushAt = &flushedAt
+	b.stats.Indexed += uint64(indexed)
+	b.stats.Deleted += uint64(deleted)
+	b.stats.Failed += uint64(failed)
+	b.stats.Retried += uint64(retried)
+	if err != nil {
+		b.stats.FailedFlushes++
+		b.stats.LastError = err.Error()
+	}
+	slot := &b.rate[flushedAt.Unix()%bulkRateWindow]
+	if slot.second != flushedAt.Unix() {
+		slot.second, slot.count = flushedAt.Unix(), 0
+	}
+	slot.count += indexed + deleted
+	b.statsMu.Unlock()
+
+	if err != nil {
+		log.Printf("Warning: Bulk request of %d operations failed: %v", len(batch), err)
+	} else if failed > 0 {
+		log.Printf("Warning: %d of %d bulk operations failed", failed, len(batch))
+	}
+	if len(retry) > 0 {
+		time.Sleep(bulkRetryDelay)
+	}
+	return retry
+}
+
+// bulkItemError is the error of one operation of a bulk request
+type bulkItemError struct {
+	status int
+	reason json.RawMessage
+}
+
+func (e *bulkItemError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.status, e.reason)
+}
+
+// send posts a bulk body, retried with backoff while the cluster is unreachable or
+// overloaded, and returns the error of each operation in order
+func (b *BulkIndexer) send(body []byte) ([]error, error) {
+	delay := bulkRetryDelay
+	for attempt := 0; ; attempt++ {
+		results, retryable, err := b.sendOnce(body)
+		if err == nil || !retryable || attempt == bulkMaxRetries {
+			return results, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// sendOnce posts a bulk body once and tells whether a failure is worth retrying
+func (b *BulkIndexer) sendOnce(body []byte) ([]error, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkRequestTimeout)
+	defer cancel()
+
+	req := esapi.BulkRequest{Body: bytes.NewReader(body)}
+	res, err := req.Do(ctx, b.client)
+	if err != nil {
+		return nil, true, fmt.Errorf("error sending bulk request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		retryable := res.StatusCode == 429 || res.StatusCode >= 500
+		return nil, retryable, fmt.Errorf("error sending bulk request: %s", res.String())
+	}
+
+	// The request succeeds as a whole even when documents fail
+	var result struct {
+		Items []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, false, fmt.Errorf("error parsing bulk response: %w", err)
+	}
+	results := make([]error, len(result.Items))
+	for i, item := range result.Items {
+		for action, op := range item {
+			// A document that was never indexed is already gone
+			if op.Status >= 300 && !(action == "delete" && op.Status == 404) {
+				results[i] = &bulkItemError{status: op.Status, reason: op.Error}
+			}
+		}
+	}
+	return results, false, nil
+}
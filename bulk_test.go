@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// fakeElasticsearch is a stand-in for the bulk API of Elasticsearch
+type fakeElasticsearch struct {
+	mu sync.Mutex
+	// requests lists the IDs of the operations of each bulk request
+	requests [][]string
+	// rejects is the number of times a document ID is answered 429 before being accepted
+	rejects map[string]int
+	// failures answers a document ID with that status every time
+	failures map[string]int
+	// status answers whole requests with that status when set
+	status int
+	// started is told when a request arrives, which then waits for release when set
+	started     chan struct{}
+	release     chan struct{}
+	releaseOnce sync.Once
+}
+
+func newFakeElasticsearch() *fakeElasticsearch {
+	return &fakeElasticsearch{rejects: map[string]int{}, failures: map[string]int{}}
+}
+
+func (f *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost || r.URL.Path != "/_bulk" {
+		http.Error(w, `{"error": "unexpected request"}`, http.StatusBadRequest)
+		return
+	}
+	if f.started != nil {
+		f.started <- struct{}{}
+	}
+	if f.release != nil {
+		<-f.release
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		w.Write([]byte(`{"error": "unavailable"}`))
+		return
+	}
+
+	var ids []string
+	var items []map[string]interface{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var meta map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+			http.Error(w, `{"error": "invalid bulk body"}`, http.StatusBadRequest)
+			return
+		}
+		for action, op := range meta {
+			if action == "index" {
+				scanner.Scan() // the source
+			}
+			ids = append(ids, op.ID)
+			status := http.StatusOK
+			if f.rejects[op.ID] > 0 {
+				f.rejects[op.ID]--
+				status = http.StatusTooManyRequests
+			} else if f.failures[op.ID] != 0 {
+				status = f.failures[op.ID]
+			}
+			item := map[string]interface{}{"status": status}
+			if status >= 300 {
+				item["error"] = map[string]string{"type": "rejected"}
+			}
+			items = append(items, map[string]interface{}{action: item})
+		}
+	}
+	f.requests = append(f.requests, ids)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+}
+
+// unblock lets the waiting and next requests through
+func (f *fakeElasticsearch) unblock() {
+	if f.release != nil {
+		f.releaseOnce.Do(func() { close(f.release) })
+	}
+}
+
+// batches returns the IDs sent in each bulk request
+func (f *fakeElasticsearch) batches() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests)
+}
+
+// newTestBulkIndexer starts an indexer sending to fake, closed at the end of the test
+func newTestBulkIndexer(t *testing.T, fake *fakeElasticsearch, config BulkIndexerConfig) *BulkIndexer {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBulkIndexer(client, config)
+	t.Cleanup(func() {
+		// Unblock requests left waiting by a failed test
+		fake.unblock()
+		b.Close(context.Background())
+	})
+	return b
+}
+
+// testDocuments returns documents with the given IDs
+func testDocuments(ids ...string) []bulkDocument {
+	docs := make([]bulkDocument, 0, len(ids))
+	for _, id := range ids {
+		docs = append(docs, bulkDocument{ID: id, Source: map[string]string{"content": "xe máy " + id}})
+	}
+	return docs
+}
+
+// sameBatches tells whether the bulk requests sent hold these IDs, in order
+func sameBatches(got, want [][]string) bool {
+	return slices.EqualFunc(got, want, func(a, b []string) bool { return slices.Equal(a, b) })
+}
+
+func TestBulkIndexerFlush(t *testing.T) {
+	// The size of a test document in a bulk body
+	docSize := (&bulkOperation{index: "test", id: "a", source: []byte(`{"content":"xe máy a"}`)}).size()
+
+	tests := []struct {
+		name   string
+		config BulkIndexerConfig
+		ids    []string
+		want   [][]string
+	}{
+		{
+			"flush docs",
+			BulkIndexerConfig{FlushDocs: 3, FlushBytes: 1 << 20, FlushInterval: time.Hour, QueueSize: 10},
+			[]string{"a", "b", "c", "d", "e", "f"},
+			[][]string{{"a", "b", "c"}, {"d", "e", "f"}},
+		},
+		{
+			"flush bytes",
+			BulkIndexerConfig{FlushDocs: 100, FlushBytes: 2 * docSize, FlushInterval: time.Hour, QueueSize: 10},
+			[]string{"a", "b", "c", "d"},
+			[][]string{{"a", "b"}, {"c", "d"}},
+		},
+		{
+			"flush interval",
+			BulkIndexerConfig{FlushDocs: 100, FlushBytes: 1 << 20, FlushInterval: 20 * time.Millisecond, QueueSize: 10},
+			[]string{"a"},
+			[][]string{{"a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeElasticsearch()
+			b := newTestBulkIndexer(t, fake, tt.config)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := b.IndexBatch(ctx, "test", testDocuments(tt.ids...)); err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.batches(); !sameBatches(got, tt.want) {
+				t.Errorf("bulk requests = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBulkIndexerAddBlocks(t *testing.T) {
+	fake := newFakeElasticsearch()
+	fake.started = make(chan struct{}, 10)
+	fake.release = make(chan struct{})
+	b := newTestBulkIndexer(t, fake, BulkIndexerConfig{FlushDocs: 1, FlushBytes: 1 << 20, FlushInterval: time.Hour, QueueSize: 1})
+
+	ctx := context.Background()
+	add := func(ctx context.Context, id string) error {
+		return b.add(ctx, &bulkOperation{action: "delete", index: "test", id: id})
+	}
+	if err := add(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// a is being sent, b fills the queue
+	<-fake.started
+	if err := add(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := add(timeout, "c"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("add to a full queue = %v, want the context error", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("add returned after %v, want it to wait for room in the queue", waited)
+	}
+	if stats := b.Stats(); stats.Queued != 1 || stats.QueueCapacity != 1 || stats.Added != 2 {
+		t.Errorf("stats = %+v, want b queued and c not added", stats)
+	}
+
+	fake.unblock()
+	if err := b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fake.batches(), [][]string{{"a"}, {"b"}}; !sameBatches(got, want) {
+		t.Errorf("bulk requests = %q, want %q", got, want)
+	}
+	if err := add(ctx, "d"); !errors.Is(err, ErrBulkIndexerClosed) {
+		t.Errorf("add after Close = %v, want ErrBulkIndexerClosed", err)
+	}
+}
+
+func TestBulkIndexerCloseDrains(t *testing.T) {
+	fake := newFakeElasticsearch()
+	fake.rejects["b"] = 2
+	b := newTestBulkIndexer(t, fake, BulkIndexerConfig{FlushDocs: 100, FlushBytes: 1 << 20, FlushInterval: time.Hour, QueueSize: 10})
+
+	var mu sync.Mutex
+	results := map[string]error{}
+	for _, id := range []string{"a", "b", "c"} {
+		id := id
+		op := &bulkOperation{action: "index", index: "test", id: id, source: []byte(`{}`), done: func(err error) {
+			mu.Lock()
+			results[id] = err
+			mu.Unlock()
+		}}
+		if err := b.add(context.Background(), op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is sent before the interval, Close sends it all
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fake.batches(), [][]string{{"a", "b", "c"}, {"b"}, {"b"}}; !sameBatches(got, want) {
+		t.Errorf("bulk requests = %q, want %q", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(results) != 3 || results["a"] != nil || results["b"] != nil || results["c"] != nil {
+		t.Errorf("results = %v, want all written", results)
+	}
+	if stats := b.Stats(); stats.Retried != 2 || stats.Indexed != 3 || stats.Failed != 0 || stats.Flushes != 3 {
+		t.Errorf("stats = %+v, want b retried twice", stats)
+	}
+}
+
+func TestBulkIndexerStats(t *testing.T) {
+	t.Run("operations", func(t *testing.T) {
+		fake := newFakeElasticsearch()
+		fake.failures["bad"] = http.StatusBadRequest
+		fake.failures["gone"] = http.StatusNotFound
+		b := newTestBulkIndexer(t, fake, BulkIndexerConfig{FlushDocs: 5, FlushBytes: 1 << 20, FlushInterval: time.Hour, QueueSize: 10})
+
+		// The five operations are sent in one request
+		ctx := context.Background()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.IndexBatch(ctx, "test", testDocuments("a", "b", "bad"))
+			if err == nil || !strings.Contains(err.Error(), "1 of 3") {
+				t.Errorf("IndexBatch = %v, want bad reported", err)
+			}
+		}()
+		for _, id := range []string{"c", "gone"} {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				// A document that was never indexed is already deleted
+				if err := b.Delete(ctx, "test", id); err != nil {
+					t.Errorf("Delete(%s) = %v", id, err)
+				}
+			}(id)
+		}
+		wg.Wait()
+
+		stats := b.Stats()
+		if stats.Added != 5 || stats.Indexed != 2 || stats.Deleted != 2 || stats.Failed != 1 ||
+			stats.Flushes != 1 || stats.FailedFlushes != 0 || stats.Queued != 0 || stats.QueueCapacity != 10 {
+			t.Errorf("stats = %+v", stats)
+		}
+		if stats.LastFlushAt == nil || stats.DocsPerSecond != 4.0/bulkRateWindow {
+			t.Errorf("lastFlushAt = %v, docsPerSecond = %v, want 4 operations over the window", stats.LastFlushAt, stats.DocsPerSecond)
+		}
+	})
+
+	t.Run("failed request", func(t *testing.T) {
+		fake := newFakeElasticsearch()
+		// Not retried: only connection errors, 429 and 5xx are
+		fake.status = http.StatusBadRequest
+		b := newTestBulkIndexer(t, fake, BulkIndexerConfig{FlushDocs: 2, FlushBytes: 1 << 20, FlushInterval: time.Hour, QueueSize: 10})
+
+		if err := b.IndexBatch(context.Background(), "test", testDocuments("a", "b")); err == nil {
+			t.Error("IndexBatch succeeded on a failed request")
+		}
+		stats := b.Stats()
+		if stats.Flushes != 1 || stats.FailedFlushes != 1 || stats.Failed != 2 || stats.Indexed != 0 || stats.LastError == "" {
+			t.Errorf("stats = %+v, want the request failed", stats)
+		}
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChatRoomSummary is a chat room as listed for one of its participants
+type ChatRoomSummary struct {
+	ID          primitive.ObjectID `json:"id"`
+	PostID      primitive.ObjectID `json:"postId"`
+	Title       string             `json:"title"`
+	Type        string             `json:"type"` // role of the requesting user: buyer | seller
+	Counterpart User               `json:"counterpart"`
+	LastMessage *Message           `json:"lastMessage,omitempty"`
+	UnreadCount int64              `json:"unreadCount"`
+	UpdatedAt   time.Time          `json:"updatedAt"`
+}
+
+// EnsureChatRoomIndexes creates the indexes the chat room endpoints rely on
+func EnsureChatRoomIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("chatrooms").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// One room per (buyer, seller, post) triple
+			Keys:    bson.D{{Key: "buyerId", Value: 1}, {Key: "sellerId", Value: 1}, {Key: "postId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "buyerId", Value: 1}, {Key: "lastMessageAt", Value: -1}}},
+		{Keys: bson.D{{Key: "sellerId", Value: 1}, {Key: "lastMessageAt", Value: -1}}},
+	})
+	return err
+}
+
+// FindOrCreateChatRoom returns the chat room for the (buyer, seller, post) triple,
+// creating it if needed. The boolean is true when the room was created by this call.
+func FindOrCreateChatRoom(ctx context.Context, db *mongo.Database, buyerID, sellerID primitive.ObjectID, post Post) (*ChatRoom, bool, error) {
+	now := time.Now()
+	filter := bson.M{"buyerId": buyerID, "sellerId": sellerID, "postId": post.ID}
+	update := bson.M{"$setOnInsert": bson.M{
+		"buyerId":       buyerID,
+		"sellerId":      sellerID,
+		"postId":        post.ID,
+		"createdAt":     now,
+		"lastMessageAt": now,
+	}}
+
+	// The upsert together with the unique index makes concurrent creates converge on one room
+	result, err := db.Collection("chatrooms").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, false, err
+	}
+	created := result.UpsertedID != nil
+
+	var room ChatRoom
+	if err := db.Collection("chatrooms").FindOne(ctx, filter).Decode(&room); err != nil {
+		return nil, false, err
+	}
+	return &room, created, nil
+}
+
+// storeMessage inserts a message, bumps its room and records its indexing in the outbox,
+// in one transaction where possible
+func storeMessage(ctx context.Context, db *mongo.Database, room *ChatRoom, msg Message) (*mongo.InsertOneResult, error) {
+	var result *mongo.InsertOneResult
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if result, err = InsertMessage(ctx, db, msg); err != nil {
+			return err
+		}
+
+		// The sender has read everything up to their own message
+		_, err = db.Collection("chatrooms").UpdateOne(
+			ctx,
+			bson.M{"_id": room.ID},
+			bson.M{"$set": bson.M{
+				"lastMessageAt":                    msg.CreatedAt,
+				"lastReadAt." + msg.SenderID.Hex(): msg.CreatedAt,
+			}},
+		)
+		if err != nil {
+			return fmt.Errorf("error updating chat room: %w", err)
+		}
+		return enqueueOutbox(ctx, db, OutboxIndexMessage, msg.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	wakeOutbox()
+	return result, nil
+}
+
+// SendMessage stores a message of a participant and pushes it to the room
+func SendMessage(ctx context.Context, db *mongo.Database, room *ChatRoom, msg Message) (*mongo.InsertOneResult, error) {
+	result, err := storeMessage(ctx, db, room, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Push the message to connected participants, and by FCM to the others
+	chatHub.PublishMessage(msg)
+	notifyOfflineParticipants(room, msg)
+	if recipient := room.recipientOf(&msg); chatHub.IsOnline(recipient) {
+		if _, err := MarkDelivered(ctx, db, room.ID, recipient, msg.CreatedAt); err != nil {
+			log.Printf("Warning: Error marking room %s delivered: %v", room.ID.Hex(), err)
+		}
+	}
+	return result, nil
+}
+
+// handleCreateChatRoom creates or reuses the chat room between a buyer and a seller about a post.
+// A new room is seeded with the post content as its first message.
+func handleCreateChatRoom(c *gin.Context) {
+	var req struct {
+		BuyerID  string `json:"buyerId" binding:"required"`
+		SellerID string `json:"sellerId" binding:"required"`
+		PostID   string `json:"postId" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	buyerID, err := primitive.ObjectIDFromHex(req.BuyerID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid buyer ID"})
+		return
+	}
+
+	sellerID, err := primitive.ObjectIDFromHex(req.SellerID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid seller ID"})
+		return
+	}
+
+	postID, err := primitive.ObjectIDFromHex(req.PostID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
+		return
+	}
+
+	if buyerID == sellerID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Buyer and seller must be different users"})
+		return
+	}
+
+	// Only the buyer or the seller may open the room
+	if userID := currentUser(c).ID; userID != buyerID && userID != sellerID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You must be the buyer or the seller"})
+		return
+	}
+
+	ctx := context.Background()
+
+	var post Post
+	if err := postCollection.FindOne(ctx, bson.M{"_id": postID}).Decode(&post); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+
+	// The post owner is the seller of a "ban" post and the buyer of a "mua" post
+	if (post.Type == "ban" && post.UserID != sellerID) || (post.Type == "mua" && post.UserID != buyerID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Post owner does not match buyer/seller"})
+		return
+	}
+
+	count, err := userCollection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": []primitive.ObjectID{buyerID, sellerID}}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count != 2 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	room, created, err := FindOrCreateChatRoom(ctx, mongoDB, buyerID, sellerID, post)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat room", "detail": err.Error()})
+		return
+	}
+
+	if created {
+		// Seed the room with the post as its first message, sent by the post owner
+		msg := Message{
+			ID:        primitive.NewObjectID(),
+			RoomID:    room.ID,
+			SenderID:  post.UserID,
+			Content:   post.Content,
+			CreatedAt: time.Now(),
+		}
+
+		if _, err := storeMessage(ctx, mongoDB, room, msg); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create first message", "detail": err.Error()})
+			return
+		}
+		room.LastMessageAt = msg.CreatedAt
+
+		// Deliver the new room to participants that are already connected
+		chatHub.SubscribeUser(buyerID, room.ID)
+		chatHub.SubscribeUser(sellerID, room.ID)
+		chatHub.PublishMessage(msg)
+
+		// Start the deal between the participants
+		if _, err := EnsureDeal(ctx, mongoDB, room, currentUser(c).ID); err != nil {
+			log.Printf("Warning: Error starting deal for room %s: %v", room.ID.Hex(), err)
+		}
+
+		// Text the post owner that someone picked their post
+		notifyChatRoomCreated(post, currentUser(c))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"chatRoom": room, "created": created})
+}
+
+// handleGetChatRooms lists the chat rooms of the current user, most recently active first
+func handleGetChatRooms(c *gin.Context) {
+	userID := currentUser(c).ID
+	ctx := context.Background()
+
+	cursor, err := chatroomCollection.Find(
+		ctx,
+		bson.M{"$or": []bson.M{{"buyerId": userID}, {"sellerId": userID}}},
+		options.Find().SetSort(bson.D{{Key: "lastMessageAt", Value: -1}, {Key: "_id", Value: -1}}),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat rooms"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var rooms []ChatRoom
+	if err := cursor.All(ctx, &rooms); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse chat rooms"})
+		return
+	}
+
+	summaries, err := summarizeChatRooms(ctx, userID, rooms)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load chat room details", "detail": err.Error()})
+		return
+	}
+
+	var unreadTotal int64
+	for _, summary := range summaries {
+		unreadTotal += summary.UnreadCount
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rooms": summaries, "unreadTotal": unreadTotal})
+}
+
+// summarizeChatRooms attaches the counterpart, last message and unread count to each room
+func summarizeChatRooms(ctx context.Context, userID primitive.ObjectID, rooms []ChatRoom) ([]ChatRoomSummary, error) {
+	summaries := make([]ChatRoomSummary, 0, len(rooms))
+	if len(rooms) == 0 {
+		return summaries, nil
+	}
+
+	roomIDs := make([]primitive.ObjectID, 0, len(rooms))
+	counterpartIDs := make([]primitive.ObjectID, 0, len(rooms))
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, room.ID)
+		if room.BuyerID == userID {
+			counterpartIDs = append(counterpartIDs, room.SellerID)
+		} else {
+			counterpartIDs = append(counterpartIDs, room.BuyerID)
+		}
+	}
+
+	// Counterparts in one batched lookup
+	users := make(map[primitive.ObjectID]User)
+	userCursor, err := userCollection.Find(ctx, bson.M{"_id": bson.M{"$in": counterpartIDs}})
+	if err != nil {
+		return nil, err
+	}
+	var found []User
+	if err := userCursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	for _, u := range found {
+		users[u.ID] = u
+	}
+
+	// Last message of every room in one aggregation
+	lastMessages := make(map[primitive.ObjectID]Message)
+	aggCursor, err := messageCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"roomId": bson.M{"$in": roomIDs}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$roomId", "message": bson.M{"$first": "$$ROOT"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var grouped []struct {
+		Message Message `bson:"message"`
+	}
+	if err := aggCursor.All(ctx, &grouped); err != nil {
+		return nil, err
+	}
+	for _, g := range grouped {
+		lastMessages[g.Message.RoomID] = g.Message
+	}
+
+	for i, room := range rooms {
+		summary := ChatRoomSummary{
+			ID:          room.ID,
+			PostID:      room.PostID,
+			Type:        "seller",
+			Counterpart: users[counterpartIDs[i]],
+			UpdatedAt:   room.LastMessageAt,
+		}
+		if room.BuyerID == userID {
+			summary.Type = "buyer"
+		}
+		if summary.UpdatedAt.IsZero() {
+			summary.UpdatedAt = room.CreatedAt
+		}
+		summary.Title = summary.Counterpart.Username
+		if summary.Title == "" {
+			summary.Title = summary.Counterpart.Email
+		}
+
+		if msg, ok := lastMessages[room.ID]; ok {
+			summary.LastMessage = &msg
+		}
+
+		// Unread: messages from the other side after the user's read cursor
+		summary.UnreadCount, err = countUnread(ctx, &rooms[i], userID)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+var ErrNoAPIKey = errors.New("OPENAI_API_KEY not set")
+
+// Classifier extracts structured post information from free-text content
+type Classifier interface {
+	Classify(ctx context.Context, content string) (*PostInfo, error)
+}
+
+// postClassifier is the backend used by ClassifyPost, selected in main by NewClassifierFromEnv
+var postClassifier Classifier = NewRuleClassifier()
+
+// ClassifyPost phân tích nội dung tin đăng bằng classifier đã cấu hình,
+// rồi chuẩn hóa giá bằng bộ phân tích giá tiếng Việt và địa điểm theo danh mục hành chính
+func ClassifyPost(ctx context.Context, content string) (*PostInfo, error) {
+	info, err := postClassifier.Classify(ctx, content)
+	if err != nil {
+		return nil, err
+	}
+	applyParsedPrice(info, content)
+	applyLocation(info, content)
+	return info, nil
+}
+
+// NewClassifierFromEnv selects the classifier backend from the CLASSIFIER variable:
+// "openai", "rules", or "auto" (default: OpenAI when OPENAI_API_KEY is set, rules otherwise)
+func NewClassifierFromEnv() (Classifier, error) {
+	apiKey := os.Getenv("OPENAI_API_KEY")
+
+	switch backend := getEnv("CLASSIFIER", "auto"); backend {
+	case "openai":
+		if apiKey == "" {
+			return nil, ErrNoAPIKey
+		}
+		return NewOpenAIClassifier(apiKey, getEnv("OPENAI_MODEL", openai.GPT4o)), nil
+	case "rules":
+		return NewRuleClassifier(), nil
+	case "auto":
+		if apiKey == "" {
+			return NewRuleClassifier(), nil
+		}
+		return NewOpenAIClassifier(apiKey, getEnv("OPENAI_MODEL", openai.GPT4o)), nil
+	default:
+		return nil, fmt.Errorf("unknown classifier backend %q", backend)
+	}
+}
+
+// OpenAIClassifier classifies posts with an OpenAI chat model
+type OpenAIClassifier struct {
+	client *openai.Client
+	model  string
+}
+
+// NewOpenAIClassifier creates an OpenAI backed classifier
+func NewOpenAIClassifier(apiKey, model string) *OpenAIClassifier {
+	return &OpenAIClassifier{
+		client: openai.NewClient(apiKey),
+		model:  model,
+	}
+}
+
+// Classify sử dụng OpenAI để phân tích nội dung tin đăng
+func (oc *OpenAIClassifier) Classify(ctx context.Context, content string) (*PostInfo, error) {
+	systemContent := "Bạn là một AI phân loại tin đăng mua bán. Hãy trích xuất các trường dưới dạng JSON: type (mua|bán), category, location, price (số nguyên, nếu không có thì để 0), condition, keywords (mảng 3-5 từ khóa). Nếu không có trường nào thì để rỗng hoặc 0."
+	userContent := "Nội dung tin đăng: " + content + "\nHãy trả về kết quả JSON."
+
+	resp, err := oc.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: oc.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: systemContent,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: userContent,
+			},
+		},
+		Temperature: 0.3,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("empty response from OpenAI")
+	}
+
+	var info PostInfo
+	jsonStr := resp.Choices[0].Message.Content
+	jsonStr = strings.TrimSpace(jsonStr)
+	// The model sometimes wraps the JSON in a markdown code fence
+	jsonStr = strings.TrimPrefix(jsonStr, "```json")
+	jsonStr = strings.TrimPrefix(jsonStr, "```")
+	jsonStr = strings.TrimSuffix(jsonStr, "```")
+	err = json.Unmarshal([]byte(strings.TrimSpace(jsonStr)), &info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Posts store the type without accents
+	info.Type = normalizePostType(info.Type)
+
+	return &info, nil
+}
+
+// normalizePostType maps the type variants returned by classifiers to "mua" or "ban"
+func normalizePostType(t string) string {
+	switch foldVietnamese(strings.ToLower(strings.TrimSpace(t))) {
+	case "mua", "buy":
+		return "mua"
+	case "ban", "sell":
+		return "ban"
+	default:
+		return ""
+	}
+}
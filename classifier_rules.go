@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// RuleClassifier is a deterministic, dictionary based classifier for Vietnamese posts.
+// It needs no network access, which makes it suitable for development and tests.
+type RuleClassifier struct{}
+
+// NewRuleClassifier creates the offline Vietnamese classifier
+func NewRuleClassifier() *RuleClassifier {
+	return &RuleClassifier{}
+}
+
+// typePhrase maps a phrase to the post type it signals
+type typePhrase struct {
+	phrase   string
+	postType string
+}
+
+// typePhrases are matched in order, longer phrases first, and matched words are consumed,
+// so "ai bán" (someone looking for a seller) is not counted as "bán"
+var typePhrases = []typePhrase{
+	{"ai bán", "mua"},
+	{"ai có", "mua"},
+	{"ai pass", "mua"},
+	{"ai thanh lý", "mua"},
+	{"cần mua", "mua"},
+	{"muốn mua", "mua"},
+	{"tìm mua", "mua"},
+	{"thu mua", "mua"},
+	{"hỏi mua", "mua"},
+	{"cần tìm", "mua"},
+	{"đang tìm", "mua"},
+	{"mua", "mua"},
+	{"cần bán", "ban"},
+	{"muốn bán", "ban"},
+	{"bán gấp", "ban"},
+	{"thanh lý", "ban"},
+	{"pass lại", "ban"},
+	{"nhượng lại", "ban"},
+	{"sang nhượng", "ban"},
+	{"để lại", "ban"},
+	{"cần ra đi", "ban"},
+	{"dư dùng", "ban"},
+	{"bán", "ban"},
+	{"pass", "ban"},
+}
+
+// categoryTerms lists the common marketplace categories and the words that signal them
+var categoryTerms = []struct {
+	category string
+	terms    []string
+}{
+	{"điện thoại", []string{"điện thoại", "đt", "smartphone", "iphone", "samsung", "galaxy", "oppo", "xiaomi", "redmi", "vivo", "realme", "nokia", "pixel"}},
+	{"máy tính bảng", []string{"máy tính bảng", "ipad", "tablet", "galaxy tab"}},
+	{"laptop", []string{"laptop", "máy tính xách tay", "macbook", "thinkpad", "dell", "asus", "acer", "lenovo", "hp", "msi", "vivobook", "zenbook"}},
+	{"máy tính", []string{"máy tính", "pc", "máy bàn", "màn hình", "vga", "card màn hình", "cpu", "ram", "ssd"}},
+	{"xe máy", []string{"xe máy", "honda", "yamaha", "suzuki", "wave", "dream", "vision", "air blade", "sh", "lead", "exciter", "winner", "sirius", "vespa", "xe số", "xe ga", "xe côn"}},
+	{"ô tô", []string{"ô tô", "xe hơi", "oto", "toyota", "vios", "innova", "mazda", "kia", "hyundai", "ford", "vinfast", "mercedes"}},
+	{"xe đạp", []string{"xe đạp", "xe đạp điện", "xe điện"}},
+	{"nhà đất", []string{"nhà", "căn hộ", "chung cư", "đất", "lô đất", "nhà phố", "biệt thự", "mặt bằng", "phòng trọ"}},
+	{"đồ điện tử", []string{"tivi", "tv", "loa", "tai nghe", "airpods", "máy ảnh", "camera", "máy chơi game", "ps5", "ps4", "nintendo", "đồng hồ thông minh", "apple watch"}},
+	{"đồ gia dụng", []string{"tủ lạnh", "máy giặt", "điều hòa", "máy lạnh", "nồi cơm", "bếp", "lò vi sóng", "quạt", "máy lọc nước", "bàn ghế", "tủ", "giường", "sofa"}},
+	{"thời trang", []string{"áo", "quần", "váy", "đầm", "giày", "dép", "túi xách", "balo", "đồng hồ", "kính"}},
+	{"mẹ và bé", []string{"xe đẩy", "bỉm", "sữa", "đồ chơi", "nôi"}},
+	{"thú cưng", []string{"chó", "mèo", "poodle", "corgi", "mèo anh lông ngắn"}},
+}
+
+// conditionPhrases are checked in order; "like new" must win over "mới"
+var conditionPhrases = []struct {
+	condition string
+	phrases   []string
+}{
+	{"like new", []string{"like new", "likenew", "như mới", "99%", "98%", "keng"}},
+	{"mới", []string{"mới", "new", "nguyên seal", "chưa sử dụng", "chưa dùng", "fullbox", "full box"}},
+	{"cũ", []string{"cũ", "đã qua sử dụng", "đã sử dụng", "2hand", "second hand", "secondhand", "đã dùng"}},
+}
+
+// ruleStopwords are never returned as keywords
+var ruleStopwords = map[string]bool{
+	"ở": true, "tại": true, "giá": true, "cần": true, "mình": true, "em": true, "anh": true, "chị": true,
+	"tôi": true, "có": true, "cho": true, "của": true, "và": true, "với": true, "là": true, "một": true,
+	"cái": true, "con": true, "chiếc": true, "này": true, "nhé": true, "ạ": true, "ib": true, "inbox": true,
+	"liên": true, "hệ": true, "lh": true, "sđt": true, "zalo": true, "khu": true, "vực": true, "ai": true,
+	"được": true, "không": true, "thì": true, "hay": true, "còn": true, "rất": true, "lại": true, "ra": true,
+	"đi": true, "muốn": true, "tìm": true, "nhu": true, "cầu": true, "nào": true, "bao": true, "nhiêu": true,
+	"tầm": true, "khoảng": true, "dưới": true, "trên": true, "từ": true, "đến": true, "tới": true, "các": true,
+	"những": true, "ship": true, "cod": true, "gấp": true, "mn": true, "mọi": true, "người": true,
+	"đồng": true, "vnđ": true, "vnd": true, "đ": true, "k": true, "tr": true, "triệu": true, "củ": true, "tỷ": true,
+}
+
+// foldedStopwords lets unaccented content ("o", "tam") be filtered too
+var foldedStopwords = func() map[string]bool {
+	folded := make(map[string]bool, len(ruleStopwords))
+	for word := range ruleStopwords {
+		folded[foldVietnamese(word)] = true
+	}
+	return folded
+}()
+
+// maxRuleKeywords bounds the number of keywords returned
+const maxRuleKeywords = 5
+
+// Classify extracts type, category, location, price, condition and keywords
+func (rc *RuleClassifier) Classify(ctx context.Context, content string) (*PostInfo, error) {
+	text := newVietnameseText(content)
+
+	place := detectLocation(text)
+	info := &PostInfo{
+		Type:         detectPostType(text),
+		Location:     place.Province,
+		LocationCode: place.ProvinceCode,
+		District:     place.District,
+		DistrictCode: place.DistrictCode,
+		Condition:    detectCondition(text),
+	}
+	var productTerms []string
+	info.Category, productTerms = detectCategory(text)
+	info.Keywords = extractKeywords(text, productTerms)
+
+	return info, nil
+}
+
+// detectPostType returns "mua" or "ban". Without any signal the content is treated as
+// a buyer searching for a product, which is what a bare query like "laptop dell" means.
+func detectPostType(text *vietnameseText) string {
+	scores := map[string]int{}
+	for _, tp := range typePhrases {
+		if n := text.find(tp.phrase, true); n > 0 {
+			// Multi-word phrases are stronger signals than a single "mua"/"bán"
+			scores[tp.postType] += n * len(strings.Fields(tp.phrase))
+		}
+	}
+	if scores["ban"] > scores["mua"] {
+		return "ban"
+	}
+	return "mua"
+}
+
+// detectCategory returns the category with the most matching terms and the matched terms
+func detectCategory(text *vietnameseText) (string, []string) {
+	best, bestScore := "", 0
+	var bestTerms []string
+	for _, ct := range categoryTerms {
+		score := 0
+		var matched []string
+		for _, term := range ct.terms {
+			if n := text.find(term, false); n > 0 {
+				score += n * len(strings.Fields(term))
+				matched = append(matched, term)
+			}
+		}
+		if score > bestScore {
+			best, bestScore, bestTerms = ct.category, score, matched
+		}
+	}
+	// Consume the winning terms so their words are not repeated as keywords;
+	// terms inside a longer match ("tủ" in "tủ lạnh") are dropped
+	terms := bestTerms[:0]
+	for _, term := range bestTerms {
+		if text.find(term, true) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	return best, terms
+}
+
+// detectLocation returns the most specific place of the gazetteer found in the content
+func detectLocation(text *vietnameseText) Place {
+	place, _ := findPlace(text)
+	return place
+}
+
+// detectCondition returns "like new", "mới", "cũ" or ""
+func detectCondition(text *vietnameseText) string {
+	for _, cp := range conditionPhrases {
+		for _, phrase := range cp.phrases {
+			// Percentages lose their "%" in tokenization, so look at the raw text
+			if strings.HasSuffix(phrase, "%") {
+				if strings.Contains(text.raw, phrase) {
+					return cp.condition
+				}
+				continue
+			}
+			if text.find(phrase, true) > 0 {
+				return cp.condition
+			}
+		}
+	}
+	return ""
+}
+
+// extractKeywords returns the product terms followed by the remaining meaningful words
+func extractKeywords(text *vietnameseText, productTerms []string) []string {
+	keywords := make([]string, 0, maxRuleKeywords)
+	seen := map[string]bool{}
+	add := func(word string) {
+		if len(keywords) < maxRuleKeywords && !seen[word] {
+			seen[word] = true
+			keywords = append(keywords, word)
+		}
+	}
+
+	for _, term := range productTerms {
+		add(term)
+	}
+	for i, word := range text.words {
+		if text.used[i] || ruleStopwords[word] || (!text.accented && foldedStopwords[word]) || len([]rune(word)) < 2 {
+			continue
+		}
+		// Amounts are returned as the price, not as keywords: "15tr", "15 triệu"
+		amount := word
+		if i+1 < len(text.words) {
+			amount += " " + text.words[i+1]
+		}
+		if startsWithDigit(word) && !ParsePrice(amount).IsZero() {
+			continue
+		}
+		add(word)
+	}
+	return keywords
+}
+
+// vietnameseText is content split into lowercase words, with an accent-free copy of each word
+type vietnameseText struct {
+	raw      string
+	words    []string
+	folded   []string
+	used     []bool
+	accented bool
+}
+
+func newVietnameseText(content string) *vietnameseText {
+	raw := strings.ToLower(norm.NFC.String(content))
+	words := strings.FieldsFunc(raw, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != ','
+	})
+
+	text := &vietnameseText{raw: raw}
+	for _, word := range words {
+		// Keep decimal separators inside numbers only ("1.5tr"), drop them elsewhere
+		word = strings.Trim(word, ".,")
+		if word == "" {
+			continue
+		}
+		if !startsWithDigit(word) {
+			word = strings.NewReplacer(".", "", ",", "").Replace(word)
+		}
+		folded := foldVietnamese(word)
+		if folded != word {
+			text.accented = true
+		}
+		text.words = append(text.words, word)
+		text.folded = append(text.folded, folded)
+	}
+	text.used = make([]bool, len(text.words))
+	return text
+}
+
+func startsWithDigit(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+// find counts occurrences of a phrase and optionally marks its words as used.
+// Accent-free matching is only applied to unaccented content or to multi-word
+// phrases, because single words become ambiguous without accents (mua/mùa, bán/bạn).
+func (t *vietnameseText) find(phrase string, consume bool) int {
+	phraseWords := strings.Fields(strings.ToLower(phrase))
+	if len(phraseWords) == 0 {
+		return 0
+	}
+	phraseFolded := make([]string, len(phraseWords))
+	for i, w := range phraseWords {
+		phraseFolded[i] = foldVietnamese(w)
+	}
+	useFolded := !t.accented || len(phraseWords) > 1
+
+	count := 0
+	for i := 0; i+len(phraseWords) <= len(t.words); i++ {
+		matched := true
+		for j := range phraseWords {
+			k := i + j
+			if t.used[k] || (t.words[k] != phraseWords[j] && !(useFolded && t.folded[k] == phraseFolded[j])) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		count++
+		if consume {
+			for j := range phraseWords {
+				t.used[i+j] = true
+			}
+			i += len(phraseWords) - 1
+		}
+	}
+	return count
+}
+
+// foldVietnamese removes Vietnamese diacritics: "Điện thoại" -> "Dien thoai"
+func foldVietnamese(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case r == 'đ':
+			b.WriteRune('d')
+		case r == 'Đ':
+			b.WriteRune('D')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestNormalizePostType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"mua", "mua"},
+		{"Mua", "mua"},
+		{" bán ", "ban"},
+		{"BÁN", "ban"},
+		{"ban", "ban"},
+		{"buy", "mua"},
+		{"sell", "ban"},
+		{"", ""},
+		{"trao đổi", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizePostType(tt.in); got != tt.want {
+			t.Errorf("normalizePostType(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewClassifierFromEnv(t *testing.T) {
+	tests := []struct {
+		backend string
+		apiKey  string
+		want    string // "openai", "rules" or "" for an error
+	}{
+		{"", "", "rules"},
+		{"", "sk-test", "openai"},
+		{"auto", "", "rules"},
+		{"auto", "sk-test", "openai"},
+		{"rules", "sk-test", "rules"},
+		{"openai", "sk-test", "openai"},
+		{"openai", "", ""},
+		{"bayes", "", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("CLASSIFIER", tt.backend)
+		t.Setenv("OPENAI_API_KEY", tt.apiKey)
+
+		classifier, err := NewClassifierFromEnv()
+		got := ""
+		switch classifier.(type) {
+		case *OpenAIClassifier:
+			got = "openai"
+		case *RuleClassifier:
+			got = "rules"
+		}
+		if got != tt.want {
+			t.Errorf("CLASSIFIER=%q OPENAI_API_KEY=%q: got %q (%v), want %q", tt.backend, tt.apiKey, got, err, tt.want)
+		}
+		if (err != nil) != (tt.want == "") {
+			t.Errorf("CLASSIFIER=%q OPENAI_API_KEY=%q: unexpected error %v", tt.backend, tt.apiKey, err)
+		}
+	}
+}
+
+func TestClassifyPostWithRules(t *testing.T) {
+	tests := []struct {
+		content   string
+		postType  string
+		category  string
+		location  string
+		district  string
+		condition string
+		priceMin  int
+		priceMax  int
+		keyword   string
+	}{
+		{
+			content:   "Cần bán iphone 13 pro max 256gb, máy cũ 99%, giá 15tr, ở quận 1 HCM",
+			postType:  "ban",
+			category:  "điện thoại",
+			location:  "TP. Hồ Chí Minh",
+			district:  "Quận 1",
+			condition: "like new",
+			priceMin:  15000000,
+			priceMax:  15000000,
+			keyword:   "iphone",
+		},
+		{
+			content:   "Ai bán xe máy honda vision cũ tầm 20 triệu ở Hà Nội không",
+			postType:  "mua",
+			category:  "xe máy",
+			location:  "Hà Nội",
+			condition: "cũ",
+			priceMin:  20000000,
+			priceMax:  20000000,
+			keyword:   "honda",
+		},
+		{
+			content:   "Thanh lý tủ lạnh Samsung mới 100% giá 5tr thương lượng, Đà Nẵng",
+			postType:  "ban",
+			category:  "đồ gia dụng",
+			location:  "Đà Nẵng",
+			condition: "mới",
+			priceMin:  5000000,
+			priceMax:  5000000,
+			keyword:   "samsung",
+		},
+		{
+			content:   "can mua laptop dell cu duoi 10tr o ha noi",
+			postType:  "mua",
+			category:  "laptop",
+			location:  "Hà Nội",
+			condition: "cũ",
+			priceMax:  10000000,
+			keyword:   "dell",
+		},
+	}
+
+	previous := postClassifier
+	postClassifier = NewRuleClassifier()
+	t.Cleanup(func() { postClassifier = previous })
+
+	for _, tt := range tests {
+		info, err := ClassifyPost(context.Background(), tt.content)
+		if err != nil {
+			t.Fatalf("ClassifyPost(%q): %v", tt.content, err)
+		}
+		if info.Type != tt.postType || info.Category != tt.category || info.Condition != tt.condition {
+			t.Errorf("ClassifyPost(%q) = type %q, category %q, condition %q; want %q, %q, %q",
+				tt.content, info.Type, info.Category, info.Condition, tt.postType, tt.category, tt.condition)
+		}
+		if info.Location != tt.location || info.District != tt.district {
+			t.Errorf("ClassifyPost(%q) location = %q/%q, want %q/%q", tt.content, info.Location, info.District, tt.location, tt.district)
+		}
+		if info.PriceMin != tt.priceMin || info.PriceMax != tt.priceMax {
+			t.Errorf("ClassifyPost(%q) price = %d-%d, want %d-%d", tt.content, info.PriceMin, info.PriceMax, tt.priceMin, tt.priceMax)
+		}
+		if !slices.Contains(info.Keywords, tt.keyword) {
+			t.Errorf("ClassifyPost(%q) keywords = %v, want %q among them", tt.content, info.Keywords, tt.keyword)
+		}
+	}
+}
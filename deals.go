@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deal states, from the first message to the end of the transaction
+const (
+	DealStateNegotiating     = "negotiating"
+	DealStateAgreed          = "agreed"
+	DealStateMeetupScheduled = "meetup_scheduled"
+	DealStateCompleted       = "completed"
+	DealStateCancelled       = "cancelled"
+	DealStateDisputed        = "disputed"
+)
+
+// dealTransitions lists the states a deal may move to from each state. Completed and
+// cancelled are final; a meetup can be rescheduled, a dispute ends completed or cancelled.
+var dealTransitions = map[string][]string{
+	DealStateNegotiating:     {DealStateAgreed, DealStateCancelled},
+	DealStateAgreed:          {DealStateMeetupScheduled, DealStateCompleted, DealStateCancelled, DealStateDisputed},
+	DealStateMeetupScheduled: {DealStateMeetupScheduled, DealStateCompleted, DealStateCancelled, DealStateDisputed},
+	DealStateDisputed:        {DealStateCompleted, DealStateCancelled},
+}
+
+// dealMutualStates are the states both participants must confirm before the deal moves
+// to them; either side alone can schedule, cancel or dispute
+var dealMutualStates = map[string]bool{
+	DealStateAgreed:    true,
+	DealStateCompleted: true,
+}
+
+var (
+	ErrInvalidDealTransition = errors.New("deal state transition not allowed")
+	ErrDealChanged           = errors.New("deal was modified concurrently")
+	ErrDealNeedsPrice        = errors.New("an agreed deal needs a price")
+	ErrDealNeedsMeetup       = errors.New("a meetup needs a time in the future")
+)
+
+// Deal struct
+// The transaction between the two participants of a chat room
+type Deal struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID   primitive.ObjectID `bson:"roomId" json:"roomId"`
+	PostID   primitive.ObjectID `bson:"postId" json:"postId"`
+	BuyerID  primitive.ObjectID `bson:"buyerId" json:"buyerId"`
+	SellerID primitive.ObjectID `bson:"sellerId" json:"sellerId"`
+	State    string             `bson:"state" json:"state"`
+	Price    int                `bson:"price,omitempty" json:"price,omitempty"`
+	Meetup   *DealMeetup        `bson:"meetup,omitempty" json:"meetup,omitempty"`
+	History  []DealTransition   `bson:"history" json:"history"`
+	// Confirmations holds each side's acceptance of the mutual states, pending or reached
+	Confirmations []DealConfirmation `bson:"confirmations,omitempty" json:"confirmations,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+// DealMeetup is where and when the participants meet to hand over the item
+type DealMeetup struct {
+	At    time.Time `bson:"at" json:"at"`
+	Place string    `bson:"place,omitempty" json:"place,omitempty"`
+}
+
+// DealConfirmation records that a participant accepted a mutual state, at a price for agreed
+type DealConfirmation struct {
+	State  string             `bson:"state" json:"state"`
+	UserID primitive.ObjectID `bson:"userId" json:"userId"`
+	Price  int                `bson:"price,omitempty" json:"price,omitempty"`
+	At     time.Time          `bson:"at" json:"at"`
+}
+
+// DealTransition records who moved a deal to a state, and when
+type DealTransition struct {
+	From    string             `bson:"from,omitempty" json:"from,omitempty"`
+	To      string             `bson:"to" json:"to"`
+	ActorID primitive.ObjectID `bson:"actorId" json:"actorId"`
+	At      time.Time          `bson:"at" json:"at"`
+	Note    string             `bson:"note,omitempty" json:"note,omitempty"`
+}
+
+// DealUpdate is a requested transition with the details its target state needs
+type DealUpdate struct {
+	State       string     `json:"state" binding:"required,oneof=agreed meetup_scheduled completed cancelled disputed"`
+	Price       int        `json:"price"`
+	MeetupAt    *time.Time `json:"meetupAt"`
+	MeetupPlace string     `json:"meetupPlace"`
+	Note        string     `json:"note"`
+}
+
+// EnsureDealIndexes creates the indexes used by the deal endpoints and stats
+func EnsureDealIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("deals").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// One deal per chat room
+			Keys:    bson.D{{Key: "roomId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "buyerId", Value: 1}, {Key: "updatedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "sellerId", Value: 1}, {Key: "updatedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+	})
+	return err
+}
+
+// canTransitionDeal reports whether a deal may move from one state to another
+func canTransitionDeal(from, to string) bool {
+	for _, allowed := range dealTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmation returns the confirmation of a state by a participant, nil if they did not confirm it
+func (d *Deal) confirmation(state string, userID primitive.ObjectID) *DealConfirmation {
+	for i := range d.Confirmations {
+		if d.Confirmations[i].State == state && d.Confirmations[i].UserID == userID {
+			return &d.Confirmations[i]
+		}
+	}
+	return nil
+}
+
+// confirmedByBoth reports whether the buyer and the seller both confirmed a state
+func (d *Deal) confirmedByBoth(state string) bool {
+	return d.confirmation(state, d.BuyerID) != nil && d.confirmation(state, d.SellerID) != nil
+}
+
+// reached reports whether the deal has been in a state
+func (d *Deal) reached(state string) bool {
+	for _, t := range d.History {
+		if t.To == state {
+			return true
+		}
+	}
+	return false
+}
+
+// counterpart returns the other participant of the deal
+func (d *Deal) counterpart(userID primitive.ObjectID) primitive.ObjectID {
+	if userID == d.BuyerID {
+		return d.SellerID
+	}
+	return d.BuyerID
+}
+
+// EnsureDeal returns the deal of a chat room, starting it in negotiation on behalf of actorID
+// if needed. Rooms opened before deals existed get theirs on first access.
+func EnsureDeal(ctx context.Context, db *mongo.Database, room *ChatRoom, actorID primitive.ObjectID) (*Deal, error) {
+	now := time.Now()
+	_, err := db.Collection("deals").UpdateOne(ctx,
+		bson.M{"roomId": room.ID},
+		bson.M{"$setOnInsert": bson.M{
+			"roomId":    room.ID,
+			"postId":    room.PostID,
+			"buyerId":   room.BuyerID,
+			"sellerId":  room.SellerID,
+			"state":     DealStateNegotiating,
+			"history":   []DealTransition{{To: DealStateNegotiating, ActorID: actorID, At: now}},
+			"createdAt": now,
+			"updatedAt": now,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var deal Deal
+	if err := db.Collection("deals").FindOne(ctx, bson.M{"roomId": room.ID}).Decode(&deal); err != nil {
+		return nil, err
+	}
+	return &deal, nil
+}
+
+// TransitionDeal moves the deal of a room to a new state on behalf of a participant
+// and records the transition. Agreed and completed are only reached once both
+// participants asked for them, agreed at the same price; until then the request is
+// recorded as a confirmation and the deal keeps its state. The post follows the deal,
+// see syncDealPost.
+func TransitionDeal(ctx context.Context, db *mongo.Database, room *ChatRoom, actorID primitive.ObjectID, update DealUpdate) (*Deal, error) {
+	deal, err := EnsureDeal(ctx, db, room, actorID)
+	if err != nil {
+		return nil, err
+	}
+	from, to := deal.State, update.State
+	if !canTransitionDeal(from, to) {
+		return nil, ErrInvalidDealTransition
+	}
+
+	now := time.Now()
+	set := bson.M{"state": to, "updatedAt": now}
+	price := 0
+	switch to {
+	case DealStateAgreed:
+		price = update.Price
+		if price <= 0 {
+			price = room.AgreedPrice
+		}
+		if price <= 0 {
+			return nil, ErrDealNeedsPrice
+		}
+		set["price"] = price
+	case DealStateMeetupScheduled:
+		if update.MeetupAt == nil || !update.MeetupAt.After(now) {
+			return nil, ErrDealNeedsMeetup
+		}
+		set["meetup"] = DealMeetup{At: *update.MeetupAt, Place: strings.TrimSpace(update.MeetupPlace)}
+	}
+
+	filter := bson.M{"_id": deal.ID, "state": from}
+	moved := true
+	if dealMutualStates[to] {
+		// updatedAt guards the confirmations read against a concurrent one
+		filter["updatedAt"] = deal.UpdatedAt
+		// The actor's confirmation replaces their previous one for the same state
+		confirmations := []DealConfirmation{{State: to, UserID: actorID, Price: price, At: now}}
+		for _, c := range deal.Confirmations {
+			if c.State != to || c.UserID != actorID {
+				confirmations = append(confirmations, c)
+			}
+		}
+		other := deal.confirmation(to, deal.counterpart(actorID))
+		moved = other != nil && other.Price == price
+		if moved {
+			set["confirmations"] = reachedConfirmations(deal, confirmations, to)
+		} else {
+			set = bson.M{"confirmations": confirmations, "updatedAt": now}
+		}
+	} else if len(deal.Confirmations) > 0 {
+		set["confirmations"] = reachedConfirmations(deal, deal.Confirmations, to)
+	}
+	change := bson.M{"$set": set}
+	if moved {
+		transition := DealTransition{From: from, To: to, ActorID: actorID, At: now, Note: strings.TrimSpace(update.Note)}
+		change["$push"] = bson.M{"history": transition}
+	}
+
+	err = db.Collection("deals").FindOneAndUpdate(ctx, filter, change,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(deal)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrDealChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if moved {
+		syncDealPost(ctx, db, deal, from)
+		if deal.State == DealStateCompleted {
+			updateDealReputations(ctx, db, deal)
+		}
+	}
+	chatHub.Publish(room.ID, ChatEvent{Type: "deal", RoomID: room.ID.Hex(), Deal: deal})
+	return deal, nil
+}
+
+// reachedConfirmations drops the confirmations of states the deal did not reach when it
+// moves to a new state, so a dispute or a reschedule asks both sides again
+func reachedConfirmations(deal *Deal, confirmations []DealConfirmation, to string) []DealConfirmation {
+	kept := []DealConfirmation{}
+	for _, c := range confirmations {
+		if c.State == to || deal.reached(c.State) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// syncDealPost mirrors a deal on its post: an agreed deal reserves it, a completed deal
+// sells it and a cancelled one releases the reservation. Reserving and selling need the
+// post owner's confirmation: a counterpart cannot take someone else's post off the market.
+// Failures are logged: the post may have been closed by its owner in the meantime.
+func syncDealPost(ctx context.Context, db *mongo.Database, deal *Deal, from string) {
+	var target string
+	switch {
+	case deal.State == DealStateAgreed:
+		target = PostStatusReserved
+	case deal.State == DealStateCompleted:
+		target = PostStatusSold
+	case deal.State == DealStateCancelled && from != DealStateNegotiating:
+		target = PostStatusActive
+	default:
+		return
+	}
+
+	var post Post
+	if err := db.Collection("posts").FindOne(ctx, bson.M{"_id": deal.PostID}).Decode(&post); err != nil {
+		log.Printf("Warning: Error loading post of deal %s: %v", deal.ID.Hex(), err)
+		return
+	}
+	if statusOf(&post) == target {
+		return
+	}
+	if target != PostStatusActive && deal.confirmation(deal.State, post.UserID) == nil {
+		log.Printf("Warning: Deal %s is %s without the confirmation of the owner of post %s", deal.ID.Hex(), deal.State, post.ID.Hex())
+		return
+	}
+	if target == PostStatusActive {
+		// Only release a reservation no other deal on the post still holds
+		if statusOf(&post) != PostStatusReserved {
+			return
+		}
+		held, err := db.Collection("deals").CountDocuments(ctx, bson.M{
+			"postId": deal.PostID,
+			"_id":    bson.M{"$ne": deal.ID},
+			"state":  bson.M{"$in": bson.A{DealStateAgreed, DealStateMeetupScheduled, DealStateDisputed}},
+		})
+		if err != nil || held > 0 {
+			return
+		}
+	}
+	if err := SetPostStatus(ctx, db, &post, target); err != nil {
+		log.Printf("Warning: Error moving post %s to %s after deal %s: %v", post.ID.Hex(), target, deal.ID.Hex(), err)
+	}
+}
+
+// agreeDealOnOffer moves the deal of a room to agreed when an offer is accepted: the
+// proposer and the participant accepting the offer both confirm its price
+func agreeDealOnOffer(ctx context.Context, db *mongo.Database, room *ChatRoom, proposerID, acceptorID primitive.ObjectID, price int) {
+	for _, actorID := range []primitive.ObjectID{proposerID, acceptorID} {
+		deal, err := TransitionDeal(ctx, db, room, actorID, DealUpdate{State: DealStateAgreed, Price: price, Note: "offer accepted"})
+		if err != nil {
+			log.Printf("Warning: Error moving deal of room %s to agreed: %v", room.ID.Hex(), err)
+			return
+		}
+		if deal.State == DealStateAgreed {
+			// The other side had already confirmed this price
+			return
+		}
+	}
+}
+
+// DealStats is the conversion funnel from a match to a sale over a period
+type DealStats struct {
+	Since      time.Time          `json:"since"`
+	Matches    int64              `json:"matches"`
+	ChatRooms  int64              `json:"chatRooms"`
+	Deals      map[string]int64   `json:"deals"` // current state -> count
+	Agreed     int64              `json:"agreed"`
+	Completed  int64              `json:"completed"`
+	Conversion map[string]float64 `json:"conversion"`
+}
+
+// ratio returns part/whole, 0 when whole is 0
+func ratio(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole)
+}
+
+// GetDealStats counts matches, chats and deals created since a time
+func GetDealStats(ctx context.Context, db *mongo.Database, since time.Time) (*DealStats, error) {
+	stats := &DealStats{Since: since, Deals: map[string]int64{}}
+	created := bson.M{"createdAt": bson.M{"$gte": since}}
+
+	var err error
+	if stats.Matches, err = db.Collection("matches").CountDocuments(ctx, created); err != nil {
+		return nil, err
+	}
+	if stats.ChatRooms, err = db.Collection("chatrooms").CountDocuments(ctx, created); err != nil {
+		return nil, err
+	}
+
+	cursor, err := db.Collection("deals").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: created}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$state",
+			"count": bson.M{"$sum": 1},
+			// A deal reached agreement if it ever went through the agreed state
+			"agreed": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$in": bson.A{DealStateAgreed, "$history.to"}}, 1, 0}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		State  string `bson:"_id"`
+		Count  int64  `bson:"count"`
+		Agreed int64  `bson:"agreed"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		stats.Deals[g.State] = g.Count
+		stats.Agreed += g.Agreed
+	}
+	stats.Completed = stats.Deals[DealStateCompleted]
+
+	stats.Conversion = map[string]float64{
+		"matchToChat":       ratio(stats.ChatRooms, stats.Matches),
+		"chatToAgreed":      ratio(stats.Agreed, stats.ChatRooms),
+		"agreedToCompleted": ratio(stats.Completed, stats.Agreed),
+		"matchToSale":       ratio(stats.Completed, stats.Matches),
+	}
+	return stats, nil
+}
+
+// writeDealError maps deal errors to HTTP responses
+func writeDealError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidDealTransition), errors.Is(err, ErrDealChanged):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrDealNeedsPrice), errors.Is(err, ErrDealNeedsMeetup):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update deal", "detail": err.Error()})
+	}
+}
+
+// loadRoomFromParam loads the chat room of the :id param for the current user
+func loadRoomFromParam(c *gin.Context) *ChatRoom {
+	roomID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return nil
+	}
+	return loadRoomForParticipant(c, roomID, currentUser(c).ID)
+}
+
+// handleGetDeal returns the deal of a chat room
+func handleGetDeal(c *gin.Context) {
+	room := loadRoomFromParam(c)
+	if room == nil {
+		return
+	}
+
+	deal, err := EnsureDeal(c.Request.Context(), mongoDB, room, currentUser(c).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load deal", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deal": deal})
+}
+
+// handleTransitionDeal moves the deal of a chat room to a new state.
+// Body: {"state": "agreed" | "meetup_scheduled" | "completed" | "cancelled" | "disputed",
+// "price": 15000000, "meetupAt": "2024-05-01T10:00:00+07:00", "meetupPlace": "...", "note": "..."}
+func handleTransitionDeal(c *gin.Context) {
+	var req DealUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	room := loadRoomFromParam(c)
+	if room == nil {
+		return
+	}
+
+	deal, err := TransitionDeal(c.Request.Context(), mongoDB, room, currentUser(c).ID, req)
+	if err != nil {
+		writeDealError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deal": deal})
+}
+
+// handleGetDeals lists the deals of the current user, most recently updated first.
+// Query param state filters on the current state.
+func handleGetDeals(c *gin.Context) {
+	userID := currentUser(c).ID
+	filter := bson.M{"$or": []bson.M{{"buyerId": userID}, {"sellerId": userID}}}
+	if state := c.Query("state"); state != "" {
+		filter["state"] = state
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := mongoDB.Collection("deals").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "updatedAt", Value: -1}}).SetLimit(100))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	deals := []Deal{}
+	if err := cursor.All(ctx, &deals); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deals": deals})
+}
+
+// handleGetDealStats reports the conversion from match to sale.
+// Query param days: period to report on (default 30)
+func handleGetDealStats(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 1 || days > 365 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 365"})
+		return
+	}
+
+	stats, err := GetDealStats(c.Request.Context(), mongoDB, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute stats", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
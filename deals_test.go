@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCanTransitionDeal(t *testing.T) {
+	states := []string{DealStateNegotiating, DealStateAgreed, DealStateMeetupScheduled, DealStateCompleted, DealStateCancelled, DealStateDisputed}
+	// allowed lists every permitted move; any other pair must be refused
+	allowed := map[[2]string]bool{
+		{DealStateNegotiating, DealStateAgreed}:              true,
+		{DealStateNegotiating, DealStateCancelled}:           true,
+		{DealStateAgreed, DealStateMeetupScheduled}:          true,
+		{DealStateAgreed, DealStateCompleted}:                true,
+		{DealStateAgreed, DealStateCancelled}:                true,
+		{DealStateAgreed, DealStateDisputed}:                 true,
+		{DealStateMeetupScheduled, DealStateMeetupScheduled}: true,
+		{DealStateMeetupScheduled, DealStateCompleted}:       true,
+		{DealStateMeetupScheduled, DealStateCancelled}:       true,
+		{DealStateMeetupScheduled, DealStateDisputed}:        true,
+		{DealStateDisputed, DealStateCompleted}:              true,
+		{DealStateDisputed, DealStateCancelled}:              true,
+	}
+	for _, from := range states {
+		for _, to := range states {
+			want := allowed[[2]string{from, to}]
+			if got := canTransitionDeal(from, to); got != want {
+				t.Errorf("canTransitionDeal(%q, %q) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestWriteDealError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrInvalidDealTransition, http.StatusConflict},
+		{ErrDealChanged, http.StatusConflict},
+		{ErrDealNeedsPrice, http.StatusBadRequest},
+		{ErrDealNeedsMeetup, http.StatusBadRequest},
+		{errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeDealError(c, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("writeDealError(%v) = %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
+
+func TestTransitionDealConfirmations(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	buyerID, sellerID, ownerID := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	room := &ChatRoom{ID: primitive.NewObjectID(), BuyerID: buyerID, SellerID: sellerID, PostID: primitive.NewObjectID()}
+	updatedAt := time.Now().Truncate(time.Millisecond)
+	newDeal := func(state string, confirmations ...DealConfirmation) Deal {
+		return Deal{
+			ID: primitive.NewObjectID(), RoomID: room.ID, PostID: room.PostID, BuyerID: buyerID, SellerID: sellerID,
+			State:         state,
+			History:       []DealTransition{{To: DealStateNegotiating, ActorID: buyerID, At: updatedAt}},
+			Confirmations: confirmations,
+			UpdatedAt:     updatedAt,
+		}
+	}
+	// respond mocks EnsureDeal loading the deal before the update, then the deal as
+	// stored after it, then the post lookups
+	respond := func(mt *mtest.T, before, after Deal, more ...bson.D) {
+		ns := mt.DB.Name() + ".deals"
+		responses := []bson.D{
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, mockDocument(mt, before)),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, after)}),
+		}
+		mt.AddMockResponses(append(responses, more...)...)
+	}
+	// sentUpdate returns the filter and the update of the findAndModify command
+	sentUpdate := func(mt *mtest.T) (bson.Raw, bson.Raw) {
+		for _, e := range mt.GetAllStartedEvents() {
+			if e.CommandName == "findAndModify" {
+				return e.Command.Lookup("query").Document(), e.Command.Lookup("update").Document()
+			}
+		}
+		mt.Fatalf("no findAndModify sent")
+		return nil, nil
+	}
+
+	tests := []struct {
+		name   string
+		deal   Deal
+		actor  primitive.ObjectID
+		update DealUpdate
+		// moved tells whether the state changes, or only a confirmation is saved
+		moved bool
+		// owner owns the post; reserves tells whether the post is reserved
+		owner    primitive.ObjectID
+		reserves bool
+	}{
+		{
+			name:   "first side to agree",
+			deal:   newDeal(DealStateNegotiating),
+			actor:  buyerID,
+			update: DealUpdate{State: DealStateAgreed, Price: 15000000},
+		},
+		{
+			name:     "other side agrees on the same price",
+			deal:     newDeal(DealStateNegotiating, DealConfirmation{State: DealStateAgreed, UserID: buyerID, Price: 15000000}),
+			actor:    sellerID,
+			update:   DealUpdate{State: DealStateAgreed, Price: 15000000},
+			moved:    true,
+			owner:    sellerID,
+			reserves: true,
+		},
+		{
+			name:   "agreed without the post owner",
+			deal:   newDeal(DealStateNegotiating, DealConfirmation{State: DealStateAgreed, UserID: buyerID, Price: 15000000}),
+			actor:  sellerID,
+			update: DealUpdate{State: DealStateAgreed, Price: 15000000},
+			moved:  true,
+			owner:  ownerID,
+		},
+		{
+			name:   "other side agrees on another price",
+			deal:   newDeal(DealStateNegotiating, DealConfirmation{State: DealStateAgreed, UserID: buyerID, Price: 15000000}),
+			actor:  sellerID,
+			update: DealUpdate{State: DealStateAgreed, Price: 16000000},
+		},
+		{
+			name:   "same side agrees again",
+			deal:   newDeal(DealStateNegotiating, DealConfirmation{State: DealStateAgreed, UserID: buyerID, Price: 15000000}),
+			actor:  buyerID,
+			update: DealUpdate{State: DealStateAgreed, Price: 15000000},
+		},
+		{
+			name:   "first side to complete",
+			deal:   newDeal(DealStateAgreed),
+			actor:  sellerID,
+			update: DealUpdate{State: DealStateCompleted},
+		},
+		{
+			name:   "one side cancels",
+			deal:   newDeal(DealStateNegotiating, DealConfirmation{State: DealStateAgreed, UserID: buyerID, Price: 15000000}),
+			actor:  sellerID,
+			update: DealUpdate{State: DealStateCancelled},
+			moved:  true,
+		},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			stored := tt.deal
+			if tt.moved {
+				stored.State = tt.update.State
+				stored.Confirmations = append(stored.Confirmations, DealConfirmation{State: tt.update.State, UserID: tt.actor, Price: tt.update.Price})
+			}
+			post := Post{ID: room.PostID, UserID: tt.owner, Status: PostStatusActive}
+			reserved := post
+			reserved.Status = PostStatusReserved
+			respond(mt, tt.deal, stored,
+				mtest.CreateCursorResponse(0, mt.DB.Name()+".posts", mtest.FirstBatch, mockDocument(mt, post)),
+				mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, reserved)}),
+			)
+
+			if _, err := TransitionDeal(context.Background(), mt.DB, room, tt.actor, tt.update); err != nil {
+				mt.Fatalf("TransitionDeal: %v", err)
+			}
+
+			filter, update := sentUpdate(mt)
+			set := update.Lookup("$set").Document()
+			_, pushed := update.Lookup("$push").DocumentOK()
+			_, setState := set.Lookup("state").StringValueOK()
+			if pushed != tt.moved || setState != tt.moved {
+				mt.Errorf("update = %v, want moved = %v", update, tt.moved)
+			}
+			if dealMutualStates[tt.update.State] {
+				if _, ok := filter.Lookup("updatedAt").TimeOK(); !ok {
+					mt.Errorf("filter = %v, want guarded by updatedAt", filter)
+				}
+				var confirmations []DealConfirmation
+				if err := set.Lookup("confirmations").Unmarshal(&confirmations); err != nil {
+					mt.Fatalf("confirmations: %v", err)
+				}
+				deal := Deal{BuyerID: buyerID, SellerID: sellerID, Confirmations: confirmations}
+				if c := deal.confirmation(tt.update.State, tt.actor); c == nil || c.Price != tt.update.Price {
+					mt.Errorf("confirmations = %+v, want the actor's at %d", confirmations, tt.update.Price)
+				}
+				if n := len(confirmations); n > 2 {
+					mt.Errorf("confirmations = %+v, want at most one per side", confirmations)
+				}
+			}
+
+			// Only the owner's confirmation reserves the post
+			reserves := false
+			for _, e := range mt.GetAllStartedEvents() {
+				if e.CommandName == "findAndModify" && e.Command.Lookup("findAndModify").StringValue() == "posts" {
+					reserves = true
+				}
+			}
+			if reserves != tt.reserves {
+				mt.Errorf("post reserved = %v, want %v", reserves, tt.reserves)
+			}
+		})
+	}
+}
+
+func TestDealConfirmedByBoth(t *testing.T) {
+	buyerID, sellerID := primitive.NewObjectID(), primitive.NewObjectID()
+	tests := []struct {
+		name          string
+		confirmations []DealConfirmation
+		want          bool
+	}{
+		{"nobody", nil, false},
+		{"buyer only", []DealConfirmation{{State: DealStateCompleted, UserID: buyerID}}, false},
+		{"agreed only", []DealConfirmation{{State: DealStateAgreed, UserID: buyerID}, {State: DealStateAgreed, UserID: sellerID}}, false},
+		{"both", []DealConfirmation{{State: DealStateCompleted, UserID: sellerID}, {State: DealStateCompleted, UserID: buyerID}}, true},
+	}
+	for _, tt := range tests {
+		deal := Deal{BuyerID: buyerID, SellerID: sellerID, Confirmations: tt.confirmations}
+		if got := deal.confirmedByBoth(DealStateCompleted); got != tt.want {
+			t.Errorf("%s: confirmedByBoth = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
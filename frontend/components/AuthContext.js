@@ -5,39 +5,55 @@ const AuthContext = createContext();
 
 export function AuthProvider({ children }) {
   const [user, setUser] = useState(null);
+  const [token, setToken] = useState(null);
   const [loading, setLoading] = useState(true);
 
   useEffect(() => {
-    // Check if there's a user in localStorage
+    // Check if there's a user and session token in localStorage
     const storedUser = localStorage.getItem('user');
-    if (storedUser) {
+    const storedToken = localStorage.getItem('token');
+    if (storedUser && storedToken) {
       try {
         setUser(JSON.parse(storedUser));
+        setToken(storedToken);
+        axios.defaults.headers.common['Authorization'] = `Bearer ${storedToken}`;
       } catch (e) {
         console.error('Failed to parse stored user', e);
         localStorage.removeItem('user');
+        localStorage.removeItem('token');
       }
     }
     setLoading(false);
   }, []);
 
   const login = async () => {
-    // Redirect to Facebook login on the server
-    window.location.href = '/auth/facebook';
+    // Redirect to Facebook login on the server, coming back to the chat page
+    window.location.href = '/api/auth/facebook?redirect=/chat';
   };
 
-  const logout = () => {
+  const logout = async () => {
+    try {
+      await axios.post('/api/auth/logout');
+    } catch (e) {
+      console.error('Failed to revoke session', e);
+    }
     localStorage.removeItem('user');
+    localStorage.removeItem('token');
+    delete axios.defaults.headers.common['Authorization'];
     setUser(null);
+    setToken(null);
   };
 
-  const setUserData = (userData) => {
+  const setUserData = (userData, sessionToken) => {
     localStorage.setItem('user', JSON.stringify(userData));
+    localStorage.setItem('token', sessionToken);
+    axios.defaults.headers.common['Authorization'] = `Bearer ${sessionToken}`;
     setUser(userData);
+    setToken(sessionToken);
   };
 
   return (
-    <AuthContext.Provider value={{ user, loading, login, logout, setUserData }}>
+    <AuthContext.Provider value={{ user, token, loading, login, logout, setUserData }}>
       {children}
     </AuthContext.Provider>
   );
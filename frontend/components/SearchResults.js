@@ -3,6 +3,26 @@ import axios from 'axios';
 import { useRouter } from 'next/router';
 import { useAuth } from './AuthContext';
 
+// Format a post's price range; a zero max with a min means "from min"
+function formatPriceRange({ priceMin, priceMax }) {
+  const vnd = (n) => `${n.toLocaleString()} VND`;
+  if (priceMin > 0 && priceMax > 0) {
+    return priceMin === priceMax ? vnd(priceMin) : `${vnd(priceMin)} - ${vnd(priceMax)}`;
+  }
+  return priceMin > 0 ? `From ${vnd(priceMin)}` : `Up to ${vnd(priceMax)}`;
+}
+
+// Labels of the criteria returned in a match breakdown
+const MATCH_FIELD_LABELS = {
+  category: 'Category',
+  location: 'Location',
+  district: 'District',
+  condition: 'Condition',
+  price: 'Price',
+  keywords: 'Keywords',
+  content: 'Description',
+};
+
 export default function SearchResults({ results, onClose, onChatRoomCreated }) {
   const { user } = useAuth();
   const [isLoading, setIsLoading] = useState(false);
@@ -101,15 +121,31 @@ export default function SearchResults({ results, onClose, onChatRoomCreated }) {
                           📍 {result.post.location}
                         </span>
                       )}
-                      {result.post.price > 0 && (
+                      {(result.post.priceMin > 0 || result.post.priceMax > 0) && (
+                        <span className="text-xs bg-gray-100 px-2 py-1 rounded">
+                          💰 {formatPriceRange(result.post)}
+                        </span>
+                      )}
+                      {result.post.negotiable && (
                         <span className="text-xs bg-gray-100 px-2 py-1 rounded">
-                          💰 {result.post.price.toLocaleString()} VND
+                          Negotiable
                         </span>
                       )}
                     </div>
                     <div className="mt-3 flex justify-between items-center">
                       <div className="text-xs text-gray-500">
-                        Score: {Math.round(result.score * 100)}% match
+                        <div>{result.matchPercent}% match</div>
+                        <div className="mt-1 flex flex-wrap gap-1">
+                          {(result.breakdown || []).map((clause) => (
+                            <span
+                              key={clause.field}
+                              title={`${clause.contribution}%`}
+                              className={clause.matched ? 'text-green-600' : 'text-gray-400 line-through'}
+                            >
+                              {MATCH_FIELD_LABELS[clause.field] || clause.field}
+                            </span>
+                          ))}
+                        </div>
                       </div>
                       {loadingItemId === result.post.id && (
                         <span className="text-xs text-primary flex items-center">
@@ -1,8 +1,8 @@
 // API route to handle Facebook authentication
 export default function handler(req, res) {
-  // In a production app, we would set proper CORS headers and validate the request
-
-  // Redirect to the backend Facebook OAuth endpoint
-  const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
-  res.redirect(302, `${backendUrl}/auth/facebook`);
-}
\ No newline at end of file
+  // The backend generates the OAuth state and PKCE challenge and sets the state cookie,
+  // so the browser must be sent there directly rather than proxied.
+  const backendUrl = process.env.NEXT_PUBLIC_BACKEND_URL || process.env.BACKEND_URL || 'http://localhost:8080';
+  const redirect = typeof req.query.redirect === 'string' ? req.query.redirect : '/chat';
+  res.redirect(302, `${backendUrl}/auth/facebook?redirect=${encodeURIComponent(redirect)}`);
+}
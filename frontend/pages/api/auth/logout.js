@@ -0,0 +1,22 @@
+import axios from 'axios';
+
+export default async function handler(req, res) {
+  if (req.method !== 'POST') {
+    return res.status(405).json({ error: 'Method not allowed' });
+  }
+
+  try {
+    const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
+    const response = await axios.post(`${backendUrl}/auth/logout`, {}, {
+      headers: { Authorization: req.headers.authorization }
+    });
+
+    return res.status(200).json(response.data);
+  } catch (error) {
+    console.error('Error logging out:', error);
+    return res.status(error.response?.status || 500).json({
+      error: 'Failed to log out',
+      details: error.response?.data || error.message
+    });
+  }
+}
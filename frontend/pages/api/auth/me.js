@@ -0,0 +1,18 @@
+import axios from 'axios';
+
+export default async function handler(req, res) {
+  try {
+    const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
+    const response = await axios.get(`${backendUrl}/auth/me`, {
+      headers: { Authorization: req.headers.authorization }
+    });
+
+    return res.status(200).json(response.data);
+  } catch (error) {
+    console.error('Error fetching current user:', error);
+    return res.status(error.response?.status || 500).json({
+      error: 'Failed to fetch current user',
+      details: error.response?.data || error.message
+    });
+  }
+}
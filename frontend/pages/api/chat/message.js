@@ -5,9 +5,9 @@ export default async function handler(req, res) {
     return res.status(405).json({ error: 'Method not allowed' });
   }
 
-  const { roomId, senderId, content } = req.body;
+  const { roomId, content } = req.body;
   
-  if (!roomId || !senderId || !content) {
+  if (!roomId || !content) {
     return res.status(400).json({ error: 'Missing required fields' });
   }
 
@@ -15,8 +15,9 @@ export default async function handler(req, res) {
     const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
     const response = await axios.post(`${backendUrl}/chat/message`, {
       roomId,
-      senderId,
       content
+    }, {
+      headers: { Authorization: req.headers.authorization }
     });
 
     return res.status(200).json(response.data);
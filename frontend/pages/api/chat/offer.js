@@ -0,0 +1,32 @@
+import axios from 'axios';
+
+// Creates an offer ({roomId, price}) or answers one ({roomId, offerId, action, price})
+export default async function handler(req, res) {
+  if (req.method !== 'POST') {
+    return res.status(405).json({ error: 'Method not allowed' });
+  }
+
+  const { roomId, offerId, action, price, expiresInHours } = req.body;
+
+  if (!roomId || (!offerId && !price)) {
+    return res.status(400).json({ error: 'Missing required fields' });
+  }
+
+  try {
+    const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
+    const url = offerId
+      ? `${backendUrl}/chat/room/${roomId}/offers/${offerId}/respond`
+      : `${backendUrl}/chat/room/${roomId}/offers`;
+    const response = await axios.post(url, { action, price, expiresInHours }, {
+      headers: { Authorization: req.headers.authorization }
+    });
+
+    return res.status(200).json(response.data);
+  } catch (error) {
+    console.error('Error sending offer:', error);
+    return res.status(error.response?.status || 500).json({
+      error: 'Failed to send offer',
+      details: error.response?.data || error.message
+    });
+  }
+}
@@ -0,0 +1,29 @@
+import axios from 'axios';
+
+// Marks a chat room read up to a message ({roomId, messageId}); without messageId, up to the last one
+export default async function handler(req, res) {
+  if (req.method !== 'POST') {
+    return res.status(405).json({ error: 'Method not allowed' });
+  }
+
+  const { roomId, messageId } = req.body;
+
+  if (!roomId) {
+    return res.status(400).json({ error: 'Missing room ID' });
+  }
+
+  try {
+    const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
+    const response = await axios.post(`${backendUrl}/chat/room/${roomId}/read`, { messageId }, {
+      headers: { Authorization: req.headers.authorization }
+    });
+
+    return res.status(200).json(response.data);
+  } catch (error) {
+    console.error('Error marking chat room read:', error);
+    return res.status(error.response?.status || 500).json({
+      error: 'Failed to mark chat room read',
+      details: error.response?.data || error.message
+    });
+  }
+}
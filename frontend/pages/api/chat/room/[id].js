@@ -1,7 +1,8 @@
 import axios from 'axios';
 
+// Fetches a chat room with a page of its messages; before, after and limit are passed through
 export default async function handler(req, res) {
-  const { id } = req.query;
+  const { id, before, after, limit } = req.query;
   
   if (!id) {
     return res.status(400).json({ error: 'Missing room ID' });
@@ -9,7 +10,10 @@ export default async function handler(req, res) {
 
   try {
     const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
-    const response = await axios.get(`${backendUrl}/chat/room/${id}`);
+    const response = await axios.get(`${backendUrl}/chat/room/${id}`, {
+      params: { before, after, limit },
+      headers: { Authorization: req.headers.authorization }
+    });
 
     return res.status(200).json(response.data);
   } catch (error) {
@@ -17,6 +17,8 @@ export default async function handler(req, res) {
       buyerId,
       sellerId,
       postId
+    }, {
+      headers: { Authorization: req.headers.authorization }
     });
 
     return res.status(200).json(response.data);
@@ -1,16 +1,10 @@
 import axios from 'axios';
 
 export default async function handler(req, res) {
-  const { userId } = req.query;
-  
-  if (!userId) {
-    return res.status(400).json({ error: 'Missing user ID' });
-  }
-
   try {
     const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
     const response = await axios.get(`${backendUrl}/chat/rooms`, {
-      params: { userId }
+      headers: { Authorization: req.headers.authorization }
     });
 
     return res.status(200).json(response.data);
@@ -5,18 +5,19 @@ export default async function handler(req, res) {
     return res.status(405).json({ error: 'Method not allowed' });
   }
 
-  const { userId, content, type } = req.body;
+  const { content, type } = req.body;
   
-  if (!userId || !content || !type) {
+  if (!content || !type) {
     return res.status(400).json({ error: 'Missing required fields' });
   }
 
   try {
     const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080';
     const response = await axios.post(`${backendUrl}/post/create`, {
-      userId,
       content,
       type
+    }, {
+      headers: { Authorization: req.headers.authorization }
     });
 
     return res.status(200).json(response.data);
@@ -10,23 +10,30 @@ export default function Callback() {
 
   useEffect(() => {
     const handleCallback = async () => {
-      // Get the callback data from query params
-      const { code, state } = router.query;
+      // The backend sends the session token in the URL fragment
+      const hash = new URLSearchParams(window.location.hash.slice(1));
+      const token = hash.get('token');
 
-      if (!code || !state) {
-        return; // Wait for the query params to be populated
+      if (!token) {
+        setError('Missing session token. Please try logging in again.');
+        return;
       }
 
       try {
-        // Exchange the code for user data
-        const response = await axios.get(`/api/auth/callback?code=${code}&state=${state}`);
-        const userData = response.data.user;
+        // Load the user the token belongs to
+        const response = await axios.get('/api/auth/me', {
+          headers: { Authorization: `Bearer ${token}` }
+        });
 
-        // Save the user data to context
-        setUserData(userData);
-        
-        // Redirect to chat page
-        router.push('/chat');
+        // Save the user data and session token to context
+        setUserData(response.data.user, token);
+
+        // Only follow redirects within the app
+        const { redirect } = router.query;
+        const target = typeof redirect === 'string' && redirect.startsWith('/') && !redirect.startsWith('//')
+          ? redirect
+          : '/chat';
+        router.replace(target);
       } catch (err) {
         console.error('Authentication error:', err);
         setError('Failed to authenticate with Facebook. Please try again.');
@@ -5,8 +5,28 @@ import axios from 'axios';
 import { useAuth } from '../components/AuthContext';
 import SearchResults from '../components/SearchResults';
 
+const OFFER_STATUS_LABELS = {
+  pending: 'Đang chờ',
+  accepted: 'Đã chấp nhận',
+  rejected: 'Đã từ chối',
+  countered: 'Đã trả giá',
+  expired: 'Hết hạn'
+};
+
+const formatVND = (amount) => `${amount.toLocaleString('vi-VN')}đ`;
+
+// Ticks shown under the user's own messages
+const MESSAGE_STATUS_TICKS = {
+  sent: '✓',
+  delivered: '✓✓',
+  read: '✓✓'
+};
+
+// The typing indicator is hidden when no typing event came for this long
+const TYPING_TIMEOUT = 5000;
+
 export default function Chat() {
-  const { user, loading, logout } = useAuth();
+  const { user, token, loading, logout } = useAuth();
   const router = useRouter();
   const [message, setMessage] = useState('');
   const [messages, setMessages] = useState([]);
@@ -16,7 +36,16 @@ export default function Chat() {
   const [searchText, setSearchText] = useState('');
   const [searchResults, setSearchResults] = useState(null);
   const [showSearchResults, setShowSearchResults] = useState(false);
+  const [matchAlert, setMatchAlert] = useState(null);
+  const [counterpartTyping, setCounterpartTyping] = useState(false);
+  // Cursor of the oldest loaded message, while older ones remain
+  const [olderCursor, setOlderCursor] = useState(null);
   const messagesEndRef = useRef(null);
+  const activeRoomRef = useRef(null);
+  const lastMessageIdRef = useRef(null);
+  const socketRef = useRef(null);
+  const typingTimerRef = useRef(null);
+  const lastTypingSentRef = useRef(0);
 
   // If not logged in, redirect to home
   useEffect(() => {
@@ -28,6 +57,100 @@ export default function Chat() {
     }
   }, [loading, user, router]);
 
+  // Push notifications deep-link to a room with /chat?room=<id>
+  useEffect(() => {
+    if (user && router.query.room) {
+      loadChatRoom(router.query.room);
+    }
+  }, [user, router.query.room]);
+
+  useEffect(() => {
+    activeRoomRef.current = activeRoom;
+    setCounterpartTyping(false);
+  }, [activeRoom]);
+
+  // Receive new messages in real time, reconnecting with the last seen message ID
+  useEffect(() => {
+    if (!user || !token) return;
+
+    let socket;
+    let retryTimer;
+    let retryDelay = 1000;
+    let closed = false;
+
+    const connect = () => {
+      const wsUrl = process.env.NEXT_PUBLIC_WS_URL || 'ws://localhost:8080/chat/ws';
+      const params = new URLSearchParams({ token });
+      if (lastMessageIdRef.current) {
+        params.set('lastMessageId', lastMessageIdRef.current);
+      }
+      socket = new WebSocket(`${wsUrl}?${params.toString()}`);
+      socketRef.current = socket;
+
+      socket.onopen = () => {
+        retryDelay = 1000;
+      };
+
+      socket.onmessage = (event) => {
+        const data = JSON.parse(event.data);
+        // A new post matched one of the user's saved searches
+        if (data.type === 'match' && data.match) {
+          setMatchAlert(data.match);
+          return;
+        }
+        // An offer was answered or expired: replace it in place
+        if (data.type === 'offer' && data.message) {
+          setMessages((prev) => prev.map((m) => (m.id === data.message.id ? data.message : m)));
+          return;
+        }
+        // The other participant received or read messages of the open room
+        if (data.type === 'receipt' && data.receipt) {
+          if (activeRoomRef.current?.id === data.roomId && data.userId !== user.id) {
+            setMessages((prev) => applyReceipt(prev, data.receipt));
+          }
+          return;
+        }
+        if (data.type === 'typing') {
+          if (activeRoomRef.current?.id === data.roomId && data.userId !== user.id) {
+            clearTimeout(typingTimerRef.current);
+            setCounterpartTyping(Boolean(data.typing));
+            if (data.typing) {
+              typingTimerRef.current = setTimeout(() => setCounterpartTyping(false), TYPING_TIMEOUT);
+            }
+          }
+          return;
+        }
+        if (data.type !== 'message' || !data.message) return;
+
+        lastMessageIdRef.current = data.message.id;
+        if (activeRoomRef.current?.id !== data.roomId) return;
+
+        if (data.message.senderId !== user.id) {
+          setCounterpartTyping(false);
+          markRead(data.roomId, data.message.id);
+        }
+        setMessages((prev) =>
+          prev.some((m) => m.id === data.message.id) ? prev : [...prev, data.message]
+        );
+      };
+
+      socket.onclose = () => {
+        if (closed) return;
+        retryTimer = setTimeout(connect, retryDelay);
+        retryDelay = Math.min(retryDelay * 2, 30000);
+      };
+    };
+
+    connect();
+
+    return () => {
+      closed = true;
+      clearTimeout(retryTimer);
+      socketRef.current = null;
+      socket?.close();
+    };
+  }, [user, token]);
+
   // Scroll to bottom when messages change
   useEffect(() => {
     scrollToBottom();
@@ -41,7 +164,7 @@ export default function Chat() {
   const fetchChatRooms = async () => {
     try {
       setIsLoading(true);
-      const response = await axios.get(`/api/chat/rooms?userId=${user.id}`);
+      const response = await axios.get('/api/chat/rooms');
       setChatRooms(response.data.rooms || []);
       setIsLoading(false);
     } catch (error) {
@@ -57,13 +180,63 @@ export default function Chat() {
       const response = await axios.get(`/api/chat/room/${roomId}`);
       setActiveRoom(response.data.chatRoom);
       setMessages(response.data.messages || []);
+      setOlderCursor(response.data.hasMore ? response.data.before : null);
       setIsLoading(false);
+      markRead(roomId);
     } catch (error) {
       console.error('Failed to load chat room:', error);
       setIsLoading(false);
     }
   };
 
+  // Prepend the page of messages before the oldest loaded one
+  const loadOlderMessages = async () => {
+    if (!activeRoom || !olderCursor) return;
+
+    try {
+      const response = await axios.get(`/api/chat/room/${activeRoom.id}`, { params: { before: olderCursor } });
+      const older = response.data.messages || [];
+      setMessages((prev) => [...older.filter((m) => !prev.some((p) => p.id === m.id)), ...prev]);
+      setOlderCursor(response.data.hasMore ? response.data.before : null);
+    } catch (error) {
+      console.error('Failed to load older messages:', error);
+    }
+  };
+
+  // Move the read cursor of a room and clear its unread badge
+  const markRead = async (roomId, messageId) => {
+    try {
+      await axios.post('/api/chat/read', { roomId, messageId });
+      setChatRooms((prev) => prev.map((r) => (r.id === roomId ? { ...r, unreadCount: 0 } : r)));
+    } catch (error) {
+      console.error('Failed to mark chat room read:', error);
+    }
+  };
+
+  // Upgrade the status of the user's messages covered by a receipt of the other participant
+  const applyReceipt = (prev, receipt) => {
+    const readAt = receipt.readAt && new Date(receipt.readAt);
+    const deliveredAt = receipt.deliveredAt && new Date(receipt.deliveredAt);
+    return prev.map((m) => {
+      if (m.senderId !== user.id || m.status === 'read') return m;
+      const createdAt = new Date(m.createdAt);
+      if (readAt && createdAt <= readAt) return { ...m, status: 'read' };
+      if (deliveredAt && createdAt <= deliveredAt && m.status !== 'delivered') return { ...m, status: 'delivered' };
+      return m;
+    });
+  };
+
+  // Tell the other participant the user is typing, at most every 2 seconds
+  const handleMessageChange = (e) => {
+    setMessage(e.target.value);
+    const socket = socketRef.current;
+    if (!activeRoom || socket?.readyState !== WebSocket.OPEN) return;
+    const typing = e.target.value.length > 0;
+    if (typing && Date.now() - lastTypingSentRef.current < 2000) return;
+    lastTypingSentRef.current = typing ? Date.now() : 0;
+    socket.send(JSON.stringify({ type: 'typing', roomId: activeRoom.id, typing }));
+  };
+
   // Send a message
   const sendMessage = async (e) => {
     e.preventDefault();
@@ -72,7 +245,6 @@ export default function Chat() {
     try {
       const response = await axios.post('/api/chat/message', {
         roomId: activeRoom.id,
-        senderId: user.id,
         content: message
       });
 
@@ -81,16 +253,64 @@ export default function Chat() {
         id: response.data.messageId,
         content: message,
         senderId: user.id,
+        status: 'sent',
         createdAt: new Date().toISOString()
       };
 
-      setMessages([...messages, newMessage]);
+      setMessages((prev) =>
+        prev.some((m) => m.id === newMessage.id) ? prev : [...prev, newMessage]
+      );
       setMessage('');
+      lastTypingSentRef.current = 0;
     } catch (error) {
       console.error('Failed to send message:', error);
     }
   };
 
+  // Propose a price to the seller
+  const makeOffer = async () => {
+    const price = parseInt(prompt('Your offer (VND):'), 10);
+    if (!price || !activeRoom) return;
+
+    try {
+      const response = await axios.post('/api/chat/offer', { roomId: activeRoom.id, price });
+      const offer = response.data.message;
+      setMessages((prev) => (prev.some((m) => m.id === offer.id) ? prev : [...prev, offer]));
+    } catch (error) {
+      alert(error.response?.data?.details?.error || 'Failed to send offer.');
+    }
+  };
+
+  // Accept, reject or counter an offer of the other participant
+  const respondToOffer = async (offer, action) => {
+    let price;
+    if (action === 'counter') {
+      price = parseInt(prompt('Your counter-offer (VND):'), 10);
+      if (!price) return;
+    }
+
+    try {
+      const response = await axios.post('/api/chat/offer', {
+        roomId: activeRoom.id,
+        offerId: offer.id,
+        action,
+        price
+      });
+      // The answered offer, or the counter-offer; the countered one is updated by the WebSocket event
+      const updated = response.data.message;
+      setMessages((prev) =>
+        prev.some((m) => m.id === updated.id)
+          ? prev.map((m) => (m.id === updated.id ? updated : m))
+          : [...prev, updated]
+      );
+      if (response.data.chatRoom) {
+        setActiveRoom(response.data.chatRoom);
+      }
+    } catch (error) {
+      alert(error.response?.data?.details?.error || 'Failed to answer offer.');
+    }
+  };
+
   // Create a new post (buy or sell)
   const createPost = async (type) => {
     try {
@@ -98,7 +318,6 @@ export default function Chat() {
       if (!content) return;
 
       const response = await axios.post('/api/post/create', {
-        userId: user.id,
         content,
         type
       });
@@ -148,7 +367,7 @@ export default function Chat() {
 
   // Handle a chat room being created from search results
   const handleChatRoomCreated = (newRoom) => {
-    setChatRooms([...chatRooms, newRoom]);
+    fetchChatRooms();
     setActiveRoom(newRoom);
     loadChatRoom(newRoom.id);
   };
@@ -192,6 +411,20 @@ export default function Chat() {
             </button>
           </div>
 
+          {matchAlert && (
+            <div className="p-3 bg-green-50 border-b border-green-200 text-sm">
+              <div className="flex justify-between">
+                <span className="font-medium text-green-700">
+                  New match ({matchAlert.matchPercent}%)
+                </span>
+                <button onClick={() => setMatchAlert(null)} className="text-gray-400 hover:text-gray-600">
+                  ×
+                </button>
+              </div>
+              <p className="text-gray-700 mt-1 truncate">{matchAlert.post?.content}</p>
+            </div>
+          )}
+
           {/* Search and post creation */}
           <div className="p-4 border-b border-gray-200">
             <form onSubmit={handleSearch} className="mb-3">
@@ -256,9 +489,16 @@ export default function Chat() {
                         {new Date(room.updatedAt).toLocaleDateString()}
                       </span>
                     </div>
-                    <p className="text-sm text-gray-500 truncate">
-                      {room.lastMessage || 'No messages yet'}
-                    </p>
+                    <div className="flex justify-between items-center">
+                      <p className="text-sm text-gray-500 truncate">
+                        {room.lastMessage?.content || 'No messages yet'}
+                      </p>
+                      {room.unreadCount > 0 && (
+                        <span className="ml-2 text-xs bg-primary text-white rounded-full px-2">
+                          {room.unreadCount}
+                        </span>
+                      )}
+                    </div>
                   </div>
                 </div>
               ))
@@ -286,6 +526,11 @@ export default function Chat() {
               {/* Chat header */}
               <div className="p-4 border-b border-gray-200 flex items-center">
                 <h2 className="font-medium flex-1">{activeRoom.title || 'Chat'}</h2>
+                {activeRoom.agreedPrice > 0 && (
+                  <span className="mr-2 px-2 py-1 bg-green-100 text-green-700 text-xs rounded-full">
+                    Agreed {formatVND(activeRoom.agreedPrice)}
+                  </span>
+                )}
                 {activeRoom.post && (
                   <span className="px-2 py-1 bg-gray-100 text-xs rounded-full">
                     {activeRoom.post.type === 'mua' ? 'Buying' : 'Selling'}
@@ -295,6 +540,11 @@ export default function Chat() {
 
               {/* Messages area */}
               <div className="flex-1 overflow-y-auto p-4 flex flex-col">
+                {olderCursor && (
+                  <button onClick={loadOlderMessages} className="self-center mb-2 text-xs text-primary hover:underline">
+                    Load earlier messages
+                  </button>
+                )}
                 {messages.length === 0 ? (
                   <div className="flex-1 flex items-center justify-center">
                     <p className="text-gray-500">No messages yet. Start the conversation!</p>
@@ -305,15 +555,43 @@ export default function Chat() {
                       key={msg.id} 
                       className={`flex ${msg.senderId === user?.id ? 'justify-end' : 'justify-start'}`}
                     >
-                      <div className={msg.senderId === user?.id ? 'chat-bubble-user' : 'chat-bubble-other'}>
-                        <p>{msg.content}</p>
-                        <div className="text-xs mt-1 opacity-70">
-                          {new Date(msg.createdAt).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' })}
+                      {msg.type === 'offer' && msg.offer ? (
+                        <div className="border-2 border-amber-400 bg-amber-50 rounded-lg p-3 my-1 max-w-xs">
+                          <div className="text-xs uppercase text-amber-700 font-semibold">
+                            {msg.offer.counterOf ? 'Counter-offer' : 'Offer'}
+                          </div>
+                          <div className="text-lg font-bold">{formatVND(msg.offer.price)}</div>
+                          <div className="text-xs text-gray-600">
+                            {OFFER_STATUS_LABELS[msg.offer.status] || msg.offer.status}
+                            {msg.offer.status === 'pending' && ` · until ${new Date(msg.offer.expiresAt).toLocaleString()}`}
+                          </div>
+                          {msg.offer.status === 'pending' && msg.senderId !== user?.id && new Date(msg.offer.expiresAt) > new Date() && (
+                            <div className="flex space-x-2 mt-2">
+                              <button onClick={() => respondToOffer(msg, 'accept')} className="px-2 py-1 text-xs bg-green-500 text-white rounded">Accept</button>
+                              <button onClick={() => respondToOffer(msg, 'counter')} className="px-2 py-1 text-xs bg-amber-500 text-white rounded">Counter</button>
+                              <button onClick={() => respondToOffer(msg, 'reject')} className="px-2 py-1 text-xs bg-gray-300 rounded">Reject</button>
+                            </div>
+                          )}
+                        </div>
+                      ) : (
+                        <div className={msg.senderId === user?.id ? 'chat-bubble-user' : 'chat-bubble-other'}>
+                          <p>{msg.content}</p>
+                          <div className="text-xs mt-1 opacity-70">
+                            {new Date(msg.createdAt).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' })}
+                            {msg.senderId === user?.id && msg.status && (
+                              <span className={`ml-1 ${msg.status === 'read' ? 'text-blue-300' : ''}`} title={msg.status}>
+                                {MESSAGE_STATUS_TICKS[msg.status]}
+                              </span>
+                            )}
+                          </div>
                         </div>
-                      </div>
+                      )}
                     </div>
                   ))
                 )}
+                {counterpartTyping && (
+                  <p className="text-xs text-gray-500 italic">Đang nhập...</p>
+                )}
                 <div ref={messagesEndRef} />
               </div>
 
@@ -322,7 +600,7 @@ export default function Chat() {
                 <input
                   type="text"
                   value={message}
-                  onChange={(e) => setMessage(e.target.value)}
+                  onChange={handleMessageChange}
                   placeholder="Type a message..."
                   className="input"
                 />
@@ -333,6 +611,15 @@ export default function Chat() {
                 >
                   Send
                 </button>
+                {activeRoom.buyerId === user?.id && (
+                  <button
+                    type="button"
+                    onClick={makeOffer}
+                    className="ml-2 px-4 bg-amber-500 hover:bg-amber-600 text-white rounded-md"
+                  >
+                    Offer
+                  </button>
+                )}
               </form>
             </>
           ) : (
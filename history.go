@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// defaultHistoryLimit is the number of messages returned per page of a room history
+	defaultHistoryLimit = 50
+	// maxHistoryLimit bounds the limit a client can ask for
+	maxHistoryLimit = 200
+)
+
+var ErrInvalidHistoryCursor = errors.New("before and after must be message IDs of this room, and cannot be combined")
+
+// HistoryPage is a page of a room history, in chronological order
+type HistoryPage struct {
+	Messages []Message `json:"messages"`
+	// HasMore tells whether more messages exist past the page in the direction it was read:
+	// older ones for the latest messages and "before" pages, newer ones for "after" pages
+	HasMore bool `json:"hasMore"`
+	// Before and After are the cursors of the first and last message, to read the
+	// older messages and to poll for newer ones
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// EnsureMessageIndexes creates the index room histories are read through.
+// _id breaks ties between messages created in the same millisecond.
+func EnsureMessageIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	return err
+}
+
+// DropChatRoomMessageLists removes the message ID lists rooms used to keep; messages
+// are read from the messages collection by room
+func DropChatRoomMessageLists(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("chatrooms").UpdateMany(ctx,
+		bson.M{"messages": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"messages": ""}},
+	)
+	return err
+}
+
+// parseHistoryLimit reads the limit query param, defaulting to defaultHistoryLimit
+func parseHistoryLimit(value string) int {
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return defaultHistoryLimit
+	}
+	return min(limit, maxHistoryLimit)
+}
+
+// FindRoomMessages reads a page of the history of a room ordered by (createdAt, _id).
+// Without cursor it returns the latest messages; before returns the messages older than
+// a message, after the ones newer than it.
+func FindRoomMessages(ctx context.Context, db *mongo.Database, roomID primitive.ObjectID, before, after string, limit int) (*HistoryPage, error) {
+	if before != "" && after != "" {
+		return nil, ErrInvalidHistoryCursor
+	}
+
+	filter := bson.M{"roomId": roomID}
+	order := -1
+	if cursor := before + after; cursor != "" {
+		id, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return nil, ErrInvalidHistoryCursor
+		}
+		var msg Message
+		err = db.Collection("messages").FindOne(ctx, bson.M{"_id": id, "roomId": roomID},
+			options.FindOne().SetProjection(bson.M{"createdAt": 1})).Decode(&msg)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidHistoryCursor
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		op := "$lt"
+		if after != "" {
+			op, order = "$gt", 1
+		}
+		filter["$or"] = []bson.M{
+			{"createdAt": bson.M{op: msg.CreatedAt}},
+			{"createdAt": msg.CreatedAt, "_id": bson.M{op: id}},
+		}
+	}
+
+	// One extra message tells whether there are more
+	cursor, err := db.Collection("messages").Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: order}, {Key: "_id", Value: order}}).
+			SetLimit(int64(limit+1)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	page := &HistoryPage{HasMore: len(messages) > limit}
+	if page.HasMore {
+		messages = messages[:limit]
+	}
+	if order < 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	page.Messages = messages
+	if len(messages) > 0 {
+		page.Before = messages[0].ID.Hex()
+		page.After = messages[len(messages)-1].ID.Hex()
+	}
+	return page, nil
+}
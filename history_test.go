@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestFindRoomMessages(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	roomID := primitive.NewObjectID()
+	start := time.Now().Truncate(time.Millisecond)
+	// m2 and m3 were created in the same millisecond, _id orders them
+	m1 := Message{ID: primitive.NewObjectID(), RoomID: roomID, Content: "còn hàng không", CreatedAt: start}
+	m2 := Message{ID: primitive.NewObjectID(), RoomID: roomID, Content: "còn bạn", CreatedAt: start.Add(time.Second)}
+	m3 := Message{ID: primitive.NewObjectID(), RoomID: roomID, Content: "giá 5tr", CreatedAt: start.Add(time.Second)}
+
+	ns := func(mt *mtest.T) string { return mt.DB.Name() + ".messages" }
+	// messagesCursor returns messages in the order the database sorted them
+	messagesCursor := func(mt *mtest.T, messages ...Message) bson.D {
+		docs := make([]bson.D, 0, len(messages))
+		for _, msg := range messages {
+			docs = append(docs, mockDocument(mt, msg))
+		}
+		return mtest.CreateCursorResponse(0, ns(mt), mtest.FirstBatch, docs...)
+	}
+	// ids lists the IDs of a page, in order
+	ids := func(page *HistoryPage) []primitive.ObjectID {
+		var ids []primitive.ObjectID
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.ID)
+		}
+		return ids
+	}
+	// findCommand returns the last find the function sent
+	findCommand := func(mt *mtest.T) bson.Raw {
+		events := mt.GetAllStartedEvents()
+		return events[len(events)-1].Command
+	}
+	// checkSort checks the find sorts by (createdAt, _id) in one direction
+	checkSort := func(mt *mtest.T, command bson.Raw, order int32, limit int64) {
+		sort := command.Lookup("sort").Document()
+		keys, _ := sort.Elements()
+		if len(keys) != 2 || keys[0].Key() != "createdAt" || keys[1].Key() != "_id" ||
+			keys[0].Value().Int32() != order || keys[1].Value().Int32() != order {
+			mt.Errorf("sort = %v, want createdAt and _id in order %d", sort, order)
+		}
+		if got := command.Lookup("limit").Int64(); got != limit {
+			mt.Errorf("limit = %d, want %d", got, limit)
+		}
+	}
+	// checkCursorFilter checks the find reads past a message with op, including the
+	// messages of its millisecond on the right side of its _id
+	checkCursorFilter := func(mt *mtest.T, command bson.Raw, op string, msg Message) {
+		branches, err := command.Lookup("filter", "$or").Array().Values()
+		if err != nil || len(branches) != 2 {
+			mt.Fatalf("filter = %v, want two $or branches", command.Lookup("filter"))
+		}
+		if got := branches[0].Document().Lookup("createdAt", op).Time(); !got.Equal(msg.CreatedAt) {
+			mt.Errorf("createdAt %s %v, want %v", op, got, msg.CreatedAt)
+		}
+		tie := branches[1].Document()
+		if !tie.Lookup("createdAt").Time().Equal(msg.CreatedAt) || tie.Lookup("_id", op).ObjectID() != msg.ID {
+			mt.Errorf("tie branch = %v, want the same createdAt and _id %s %s", tie, op, msg.ID.Hex())
+		}
+	}
+
+	mt.Run("first page", func(mt *mtest.T) {
+		mt.AddMockResponses(messagesCursor(mt, m3, m2, m1))
+		page, err := FindRoomMessages(context.Background(), mt.DB, roomID, "", "", 2)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if got := ids(page); len(got) != 2 || got[0] != m2.ID || got[1] != m3.ID {
+			mt.Errorf("messages = %v, want m2, m3", got)
+		}
+		if !page.HasMore || page.Before != m2.ID.Hex() || page.After != m3.ID.Hex() {
+			mt.Errorf("page = %+v, want more before m2", page)
+		}
+		command := findCommand(mt)
+		checkSort(mt, command, -1, 3)
+		if _, err := command.LookupErr("filter", "$or"); err == nil {
+			mt.Errorf("filter = %v, want the whole room", command.Lookup("filter"))
+		}
+	})
+
+	mt.Run("limit at the boundary", func(mt *mtest.T) {
+		mt.AddMockResponses(messagesCursor(mt, m3, m2, m1))
+		page, err := FindRoomMessages(context.Background(), mt.DB, roomID, "", "", 3)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if got := ids(page); len(got) != 3 || got[0] != m1.ID || got[2] != m3.ID {
+			mt.Errorf("messages = %v, want m1, m2, m3", got)
+		}
+		if page.HasMore {
+			mt.Errorf("hasMore with exactly limit messages")
+		}
+		checkSort(mt, findCommand(mt), -1, 4)
+	})
+
+	mt.Run("empty room", func(mt *mtest.T) {
+		mt.AddMockResponses(messagesCursor(mt))
+		page, err := FindRoomMessages(context.Background(), mt.DB, roomID, "", "", 2)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if page.Messages == nil || len(page.Messages) != 0 || page.HasMore || page.Before != "" || page.After != "" {
+			mt.Errorf("page = %+v, want an empty page", page)
+		}
+	})
+
+	mt.Run("before", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			messagesCursor(mt, m3),
+			messagesCursor(mt, m2, m1),
+		)
+		page, err := FindRoomMessages(context.Background(), mt.DB, roomID, m3.ID.Hex(), "", 2)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if got := ids(page); len(got) != 2 || got[0] != m1.ID || got[1] != m2.ID {
+			mt.Errorf("messages = %v, want m1, m2", got)
+		}
+		if page.HasMore {
+			mt.Errorf("hasMore before the first message")
+		}
+		command := findCommand(mt)
+		checkSort(mt, command, -1, 3)
+		checkCursorFilter(mt, command, "$lt", m3)
+	})
+
+	mt.Run("after", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			messagesCursor(mt, m1),
+			messagesCursor(mt, m2, m3),
+		)
+		page, err := FindRoomMessages(context.Background(), mt.DB, roomID, "", m1.ID.Hex(), 1)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if got := ids(page); len(got) != 1 || got[0] != m2.ID {
+			mt.Errorf("messages = %v, want m2", got)
+		}
+		if !page.HasMore || page.After != m2.ID.Hex() {
+			mt.Errorf("page = %+v, want more after m2", page)
+		}
+		command := findCommand(mt)
+		checkSort(mt, command, 1, 2)
+		checkCursorFilter(mt, command, "$gt", m1)
+	})
+
+	mt.Run("after a message sharing its millisecond", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			messagesCursor(mt, m2),
+			messagesCursor(mt, m3),
+		)
+		page, err := FindRoomMessages(context.Background(), mt.DB, roomID, "", m2.ID.Hex(), 2)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if got := ids(page); len(got) != 1 || got[0] != m3.ID || page.HasMore {
+			mt.Errorf("page = %+v, want m3 only", page)
+		}
+		checkCursorFilter(mt, findCommand(mt), "$gt", m2)
+	})
+
+	mt.Run("invalid cursors", func(mt *mtest.T) {
+		mt.AddMockResponses(messagesCursor(mt))
+		tests := []struct{ before, after string }{
+			{m1.ID.Hex(), m2.ID.Hex()},
+			{"not-an-id", ""},
+			// Unknown in this room: the lookup finds nothing
+			{primitive.NewObjectID().Hex(), ""},
+		}
+		for _, tt := range tests {
+			if _, err := FindRoomMessages(context.Background(), mt.DB, roomID, tt.before, tt.after, 2); err != ErrInvalidHistoryCursor {
+				mt.Errorf("before %q, after %q: err = %v, want ErrInvalidHistoryCursor", tt.before, tt.after, err)
+			}
+		}
+		lookup := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		if lookup.Lookup("roomId").ObjectID() != roomID {
+			mt.Errorf("cursor lookup = %v, want it limited to the room", lookup)
+		}
+	})
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// Time allowed to write a frame to the peer
+	wsWriteWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer
+	wsPongWait = 60 * time.Second
+	// Send pings with this period, must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// Maximum size of an incoming frame; clients only send small control events
+	wsMaxMessageSize = 4096
+	// Outgoing events buffered per connection before it is considered too slow
+	wsSendBuffer = 64
+	// Maximum number of missed messages replayed on reconnect
+	wsReplayLimit = 500
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkWSOrigin,
+}
+
+// checkWSOrigin accepts WebSocket handshakes from the Next.js app at FRONTEND_URL or
+// from the API's own origin. Requests without Origin do not come from a browser.
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if frontendURL != "" && strings.EqualFold(strings.TrimRight(origin, "/"), frontendURL) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// ChatEvent is the envelope pushed to WebSocket clients
+// type: "message" | "subscribed" | "truncated" | "match" | "offer" | "deal" | "receipt" | "typing"
+type ChatEvent struct {
+	Type    string               `json:"type"`
+	RoomID  string               `json:"roomId,omitempty"`
+	Message *Message             `json:"message,omitempty"`
+	Rooms   []primitive.ObjectID `json:"rooms,omitempty"`
+	Match   *Match               `json:"match,omitempty"`
+	Deal    *Deal                `json:"deal,omitempty"`
+	// UserID is the participant a receipt or typing event is about
+	UserID  string   `json:"userId,omitempty"`
+	Receipt *Receipt `json:"receipt,omitempty"`
+	Typing  *bool    `json:"typing,omitempty"`
+}
+
+// wsClient is a single WebSocket connection of a user
+type wsClient struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	userID primitive.ObjectID
+	send   chan []byte
+	// lastTyping throttles typing events per room; only used by readPump
+	lastTyping map[primitive.ObjectID]time.Time
+}
+
+// Hub keeps track of connected clients and fans out room events to them
+type Hub struct {
+	mu      sync.RWMutex
+	rooms   map[primitive.ObjectID]map[*wsClient]struct{}
+	users   map[primitive.ObjectID]map[*wsClient]struct{}
+	clients map[*wsClient][]primitive.ObjectID
+}
+
+// chatHub is the in-process hub used by the chat handlers
+var chatHub = NewHub()
+
+// NewHub creates an empty hub
+func NewHub() *Hub {
+	return &Hub{
+		rooms:   make(map[primitive.ObjectID]map[*wsClient]struct{}),
+		users:   make(map[primitive.ObjectID]map[*wsClient]struct{}),
+		clients: make(map[*wsClient][]primitive.ObjectID),
+	}
+}
+
+// register adds a client and subscribes it to the given rooms
+func (h *Hub) register(c *wsClient, roomIDs []primitive.ObjectID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.clients[c] = nil
+	if h.users[c.userID] == nil {
+		h.users[c.userID] = make(map[*wsClient]struct{})
+	}
+	h.users[c.userID][c] = struct{}{}
+
+	for _, roomID := range roomIDs {
+		h.subscribeLocked(c, roomID)
+	}
+}
+
+// unregister removes a client from every room and closes its send channel
+func (h *Hub) unregister(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	roomIDs, ok := h.clients[c]
+	if !ok {
+		return
+	}
+	for _, roomID := range roomIDs {
+		delete(h.rooms[roomID], c)
+		if len(h.rooms[roomID]) == 0 {
+			delete(h.rooms, roomID)
+		}
+	}
+	delete(h.users[c.userID], c)
+	if len(h.users[c.userID]) == 0 {
+		delete(h.users, c.userID)
+	}
+	delete(h.clients, c)
+	close(c.send)
+}
+
+func (h *Hub) subscribeLocked(c *wsClient, roomID primitive.ObjectID) {
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[*wsClient]struct{})
+	}
+	if _, ok := h.rooms[roomID][c]; ok {
+		return
+	}
+	h.rooms[roomID][c] = struct{}{}
+	h.clients[c] = append(h.clients[c], roomID)
+}
+
+// SubscribeUser subscribes every open connection of a user to a room,
+// so that rooms created after the user connected are delivered too
+func (h *Hub) SubscribeUser(userID, roomID primitive.ObjectID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.users[userID] {
+		h.subscribeLocked(c, roomID)
+	}
+}
+
+// isSubscribed reports whether a client receives the events of a room
+func (h *Hub) isSubscribed(c *wsClient, roomID primitive.ObjectID) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, ok := h.rooms[roomID][c]
+	return ok
+}
+
+// IsOnline reports whether the user has at least one open connection
+func (h *Hub) IsOnline(userID primitive.ObjectID) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.users[userID]) > 0
+}
+
+// Publish sends an event to every client subscribed to the room.
+// Clients whose buffer is full are dropped; they recover through replay on reconnect.
+func (h *Hub) Publish(roomID primitive.ObjectID, event ChatEvent) {
+	h.broadcast(event, func() map[*wsClient]struct{} { return h.rooms[roomID] })
+}
+
+// PublishUser sends an event to every open connection of a user
+func (h *Hub) PublishUser(userID primitive.ObjectID, event ChatEvent) {
+	h.broadcast(event, func() map[*wsClient]struct{} { return h.users[userID] })
+}
+
+// broadcast delivers an event to the clients returned by targets, called under the read lock
+func (h *Hub) broadcast(event ChatEvent, targets func() map[*wsClient]struct{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Warning: Error marshaling chat event: %v", err)
+		return
+	}
+
+	h.mu.RLock()
+	var slow []*wsClient
+	for c := range targets() {
+		select {
+		case c.send <- data:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range slow {
+		c.conn.Close()
+	}
+}
+
+// PublishMessage pushes a newly inserted message to the room subscribers
+func (h *Hub) PublishMessage(msg Message) {
+	h.Publish(msg.RoomID, ChatEvent{
+		Type:    "message",
+		RoomID:  msg.RoomID.Hex(),
+		Message: &msg,
+	})
+}
+
+// writeEvent writes a single event synchronously; only used before writePump starts
+func (c *wsClient) writeEvent(event ChatEvent) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(event)
+}
+
+// readPump consumes incoming frames: client events, pongs and close frames
+func (c *wsClient) readPump() {
+	defer func() {
+		c.hub.unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Warning: WebSocket read error: %v", err)
+			}
+			return
+		}
+		if messageType == websocket.TextMessage {
+			c.handleEvent(data)
+		}
+	}
+}
+
+// writePump writes queued events and periodic pings to the connection
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// findUserRoomIDs returns the IDs of every chat room the user takes part in
+func findUserRoomIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	cursor, err := chatroomCollection.Find(
+		ctx,
+		bson.M{"$or": []bson.M{{"buyerId": userID}, {"sellerId": userID}}},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rooms []ChatRoom
+	if err := cursor.All(ctx, &rooms); err != nil {
+		return nil, err
+	}
+
+	roomIDs := make([]primitive.ObjectID, 0, len(rooms))
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, room.ID)
+	}
+	return roomIDs, nil
+}
+
+// findMessagesAfter returns at most wsReplayLimit messages in the given rooms inserted after
+// lastSeenID, and whether more were left out
+func findMessagesAfter(ctx context.Context, roomIDs []primitive.ObjectID, lastSeenID primitive.ObjectID) ([]Message, bool, error) {
+	cursor, err := messageCollection.Find(
+		ctx,
+		bson.M{
+			"roomId": bson.M{"$in": roomIDs},
+			"_id":    bson.M{"$gt": lastSeenID},
+		},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(wsReplayLimit+1),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, err
+	}
+	if len(messages) > wsReplayLimit {
+		return messages[:wsReplayLimit], true, nil
+	}
+	return messages, false, nil
+}
+
+// handleChatWebSocket upgrades the connection and streams new messages of the user's chat rooms.
+// Query params: token (session token, browsers cannot set headers on WebSocket requests),
+// lastMessageId (optional, replays messages missed while offline)
+func handleChatWebSocket(c *gin.Context) {
+	userID := currentUser(c).ID
+
+	var err error
+	var lastSeenID primitive.ObjectID
+	if last := c.Query("lastMessageId"); last != "" {
+		lastSeenID, err = primitive.ObjectIDFromHex(last)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last message ID"})
+			return
+		}
+	}
+
+	ctx := context.Background()
+
+	roomIDs, err := findUserRoomIDs(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat rooms", "detail": err.Error()})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade has already written an HTTP error response
+		log.Printf("Warning: WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	client := &wsClient{
+		hub:        chatHub,
+		conn:       conn,
+		userID:     userID,
+		send:       make(chan []byte, wsSendBuffer),
+		lastTyping: make(map[primitive.ObjectID]time.Time),
+	}
+
+	// Subscribe before replaying so that nothing inserted in between is lost.
+	// Clients may therefore see a message twice and should dedupe by ID.
+	chatHub.register(client, roomIDs)
+
+	// Replay is written directly before the write pump starts; live events
+	// published meanwhile wait in the send buffer.
+	if err := client.writeEvent(ChatEvent{Type: "subscribed", Rooms: roomIDs}); err != nil {
+		conn.Close()
+		chatHub.unregister(client)
+		return
+	}
+	if !lastSeenID.IsZero() && len(roomIDs) > 0 {
+		missed, truncated, err := findMessagesAfter(ctx, roomIDs, lastSeenID)
+		if err != nil {
+			log.Printf("Warning: Error replaying missed messages: %v", err)
+		}
+		delivered := make(map[primitive.ObjectID]time.Time)
+		for i := range missed {
+			event := ChatEvent{Type: "message", RoomID: missed[i].RoomID.Hex(), Message: &missed[i]}
+			if err := client.writeEvent(event); err != nil {
+				conn.Close()
+				chatHub.unregister(client)
+				return
+			}
+			delivered[missed[i].RoomID] = missed[i].CreatedAt
+		}
+		// The client pages the rest of each room's history from its last message
+		if truncated {
+			if err := client.writeEvent(ChatEvent{Type: "truncated", Rooms: roomIDs}); err != nil {
+				conn.Close()
+				chatHub.unregister(client)
+				return
+			}
+		}
+		for roomID, at := range delivered {
+			if _, err := MarkDelivered(ctx, mongoDB, roomID, userID, at); err != nil {
+				log.Printf("Warning: Error marking room %s delivered: %v", roomID.Hex(), err)
+			}
+		}
+	}
+
+	go client.writePump()
+	client.readPump()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// gazetteerJSON lists the provinces (GSO codes) and the districts of the big cities
+// with the ways people write them in posts, and where each province capital is
+//
+//go:embed data/vn_gazetteer.json
+var gazetteerJSON []byte
+
+// Place is a canonical location: always a province, optionally a district within it
+type Place struct {
+	ProvinceCode string `json:"provinceCode"`
+	Province     string `json:"province"`
+	DistrictCode string `json:"districtCode,omitempty"`
+	District     string `json:"district,omitempty"`
+}
+
+// placeAlias is one way of writing a place
+type placeAlias struct {
+	alias  string
+	folded string
+	place  Place
+}
+
+type gazetteerEntry struct {
+	Code      string           `json:"code"`
+	Name      string           `json:"name"`
+	Lat       float64          `json:"lat,omitempty"`
+	Lon       float64          `json:"lon,omitempty"`
+	Aliases   []string         `json:"aliases"`
+	Districts []gazetteerEntry `json:"districts"`
+}
+
+// GeoPoint is a position as Elasticsearch geo_point fields take it
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// gazetteer holds every alias, districts first so "q7 sài gòn" resolves to the district,
+// then longest first so "tp hồ chí minh" is consumed before "hồ chí minh"
+var gazetteer = loadGazetteer(gazetteerJSON)
+
+// provinceCenters maps a province code to its capital, the position used for distances
+var provinceCenters = func() map[string]GeoPoint {
+	var doc struct {
+		Provinces []gazetteerEntry `json:"provinces"`
+	}
+	if err := json.Unmarshal(gazetteerJSON, &doc); err != nil {
+		panic("invalid gazetteer: " + err.Error())
+	}
+	centers := make(map[string]GeoPoint, len(doc.Provinces))
+	for _, p := range doc.Provinces {
+		if p.Lat != 0 || p.Lon != 0 {
+			centers[p.Code] = GeoPoint{Lat: p.Lat, Lon: p.Lon}
+		}
+	}
+	return centers
+}()
+
+func loadGazetteer(data []byte) []placeAlias {
+	var doc struct {
+		Provinces []gazetteerEntry `json:"provinces"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		panic("invalid gazetteer: " + err.Error())
+	}
+
+	var all []placeAlias
+	add := func(place Place, name string, extra []string) {
+		names := append([]string{name}, extra...)
+		// "TP. Thủ Đức" is also written without the prefix
+		if trimmed := strings.TrimPrefix(name, "TP. "); trimmed != name {
+			names = append(names, trimmed)
+		}
+		for _, alias := range names {
+			alias = normalizePlaceName(alias)
+			all = append(all, placeAlias{alias: alias, folded: foldVietnamese(alias), place: place})
+		}
+	}
+	for _, p := range doc.Provinces {
+		province := Place{ProvinceCode: p.Code, Province: p.Name}
+		aliases := p.Aliases
+		if !strings.HasPrefix(p.Name, "TP. ") {
+			aliases = append(aliases, "tỉnh "+p.Name)
+		}
+		add(province, p.Name, aliases)
+		for _, d := range p.Districts {
+			district := province
+			district.DistrictCode, district.District = d.Code, d.Name
+			add(district, d.Name, d.Aliases)
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		di, dj := all[i].place.DistrictCode != "", all[j].place.DistrictCode != ""
+		if di != dj {
+			return di
+		}
+		return len(strings.Fields(all[i].alias)) > len(strings.Fields(all[j].alias))
+	})
+	return all
+}
+
+// normalizePlaceName lowercases a place and joins its words the same way vietnameseText does
+func normalizePlaceName(s string) string {
+	return strings.Join(newVietnameseText(s).words, " ")
+}
+
+// LookupLocation resolves a location string such as "HCM", "Sài Gòn", "q7" or
+// "tp ho chi minh" to its canonical place, ignoring case and accents
+func LookupLocation(location string) (Place, bool) {
+	name := foldVietnamese(normalizePlaceName(location))
+	if name == "" {
+		return Place{}, false
+	}
+	for _, pa := range gazetteer {
+		if pa.folded == name {
+			return pa.place, true
+		}
+	}
+	// "Quận 7, TP.HCM" or "khu vực Hà Nội": look for a known place inside the text
+	return findPlace(newVietnameseText(location))
+}
+
+// findPlace returns the most specific place mentioned in the text and consumes its words
+func findPlace(text *vietnameseText) (Place, bool) {
+	for _, pa := range gazetteer {
+		if text.find(pa.alias, true) > 0 {
+			if pa.place.DistrictCode != "" {
+				// "Cầu Giấy Hà Nội": the province is part of the same place
+				for _, other := range gazetteer {
+					if other.place.DistrictCode == "" && other.place.ProvinceCode == pa.place.ProvinceCode {
+						text.find(other.alias, true)
+					}
+				}
+			}
+			return pa.place, true
+		}
+	}
+	return Place{}, false
+}
+
+// applyLocation replaces the free-text location with its canonical form.
+// When the classifier gave no usable location, or only a province, the content
+// itself is searched for a more specific place.
+func applyLocation(info *PostInfo, content string) {
+	if info.LocationCode != "" {
+		return
+	}
+	place, ok := LookupLocation(info.Location)
+	if !ok || place.DistrictCode == "" {
+		found, inContent := findPlace(newVietnameseText(content))
+		if inContent && (!ok || found.ProvinceCode == place.ProvinceCode) {
+			place, ok = found, true
+		}
+	}
+	if !ok {
+		// Unknown places are kept as written, without a code
+		info.Location = strings.TrimSpace(info.Location)
+		return
+	}
+	info.Location = place.Province
+	info.LocationCode = place.ProvinceCode
+	info.District = place.District
+	info.DistrictCode = place.DistrictCode
+}
+
+// locationFilter builds the Mongo filter for a location query param. Known places are
+// matched on their codes, anything else falls back to the stored display name.
+func locationFilter(location string) bson.M {
+	place, ok := LookupLocation(location)
+	if !ok {
+		return bson.M{"location": location}
+	}
+	filter := bson.M{"locationCode": place.ProvinceCode}
+	if place.DistrictCode != "" {
+		filter["districtCode"] = place.DistrictCode
+	}
+	return filter
+}
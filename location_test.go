@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLookupLocation(t *testing.T) {
+	hcm := Place{ProvinceCode: "79", Province: "TP. Hồ Chí Minh"}
+	hanoi := Place{ProvinceCode: "01", Province: "Hà Nội"}
+	tests := []struct {
+		location string
+		want     Place
+		ok       bool
+	}{
+		{"HCM", hcm, true},
+		{"Sài Gòn", hcm, true},
+		{"sai gon", hcm, true},
+		{"tp ho chi minh", hcm, true},
+		{"q7", Place{ProvinceCode: "79", Province: "TP. Hồ Chí Minh", DistrictCode: "778", District: "Quận 7"}, true},
+		{"Quận 7, TP.HCM", Place{ProvinceCode: "79", Province: "TP. Hồ Chí Minh", DistrictCode: "778", District: "Quận 7"}, true},
+		{"quận 1", Place{ProvinceCode: "79", Province: "TP. Hồ Chí Minh", DistrictCode: "760", District: "Quận 1"}, true},
+		{"Hà Nội", hanoi, true},
+		{"hn", hanoi, true},
+		{"Cầu Giấy Hà Nội", Place{ProvinceCode: "01", Province: "Hà Nội", DistrictCode: "005", District: "Cầu Giấy"}, true},
+		{"khu vực Đà Nẵng", Place{ProvinceCode: "48", Province: "Đà Nẵng"}, true},
+		{"Huế", Place{ProvinceCode: "46", Province: "Thừa Thiên Huế"}, true},
+		{"Mars", Place{}, false},
+		{"", Place{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := LookupLocation(tt.location)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("LookupLocation(%q) = %+v, %v; want %+v, %v", tt.location, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestApplyLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		content  string
+		want     PostInfo
+	}{
+		// The classifier location is normalized
+		{"Sài Gòn", "bán xe", PostInfo{Location: "TP. Hồ Chí Minh", LocationCode: "79"}},
+		// A district in the content refines the province
+		{"HCM", "bán xe ở q7", PostInfo{Location: "TP. Hồ Chí Minh", LocationCode: "79", District: "Quận 7", DistrictCode: "778"}},
+		// but not when it is in another province
+		{"Hà Nội", "bán xe ở q7", PostInfo{Location: "Hà Nội", LocationCode: "01"}},
+		// No classifier location: the content is searched
+		{"", "cần mua laptop ở Đà Nẵng", PostInfo{Location: "Đà Nẵng", LocationCode: "48"}},
+		// Unknown places are kept as written
+		{" Mars ", "bán xe", PostInfo{Location: "Mars"}},
+	}
+	for _, tt := range tests {
+		info := PostInfo{Location: tt.location}
+		applyLocation(&info, tt.content)
+		if !reflect.DeepEqual(info, tt.want) {
+			t.Errorf("applyLocation(%q, %q) = %+v, want %+v", tt.location, tt.content, info, tt.want)
+		}
+	}
+}
+
+func TestLocationFilter(t *testing.T) {
+	tests := []struct {
+		location string
+		want     bson.M
+	}{
+		{"HCM", bson.M{"locationCode": "79"}},
+		{"q7", bson.M{"locationCode": "79", "districtCode": "778"}},
+		{"Mars", bson.M{"location": "Mars"}},
+	}
+	for _, tt := range tests {
+		if got := locationFilter(tt.location); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("locationFilter(%q) = %v, want %v", tt.location, got, tt.want)
+		}
+	}
+}
@@ -7,13 +7,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sashabaranov/go-openai"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -24,7 +26,7 @@ import (
 
 var (
 	facebookOauthConfig = &oauth2.Config{
-		RedirectURL:  "http://localhost:8080/auth/facebook/callback",
+		RedirectURL:  getEnv("FACEBOOK_REDIRECT_URL", "http://localhost:8080/auth/facebook/callback"),
 		ClientID:     os.Getenv("FACEBOOK_CLIENT_ID"),
 		ClientSecret: os.Getenv("FACEBOOK_CLIENT_SECRET"),
 		Scopes:       []string{"email", "public_profile"},
@@ -36,9 +38,20 @@ var (
 	messageCollection  *mongo.Collection
 	chatroomCollection *mongo.Collection
 	mongoDB            *mongo.Database
+	// frontendURL is where users are sent back after login; empty returns JSON instead
+	frontendURL = strings.TrimRight(os.Getenv("FRONTEND_URL"), "/")
 )
 
-var ErrNoAPIKey = errors.New("OPENAI_API_KEY not set")
+// shutdownTimeout bounds the drain of requests and queued writes on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// getEnv returns the environment variable or the fallback when it is unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
 
 func main() {
 	// Example usage of models package
@@ -62,6 +75,79 @@ func main() {
 	postCollection = mongoDB.Collection("posts")
 	messageCollection = mongoDB.Collection("messages")
 	chatroomCollection = mongoDB.Collection("chatrooms")
+	mongoTransactions = SupportsTransactions(ctx, mongoClient)
+
+	if err := EnsureChatRoomIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create chat room indexes: %v", err)
+	}
+	if err := EnsureMessageIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create message indexes: %v", err)
+	}
+	if err := DropChatRoomMessageLists(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to drop chat room message lists: %v", err)
+	}
+	if err := EnsureSessionIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create session indexes: %v", err)
+	}
+	if err := EnsureOAuthStateIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create OAuth state indexes: %v", err)
+	}
+	if err := EnsurePostIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create post indexes: %v", err)
+	}
+	if err := EnsurePostRevisionIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create post revision indexes: %v", err)
+	}
+	if err := EnsureOfferIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create offer indexes: %v", err)
+	}
+	if err := EnsureDealIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create deal indexes: %v", err)
+	}
+	if err := EnsureRatingIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create rating indexes: %v", err)
+	}
+	if err := EnsureOutboxIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create outbox indexes: %v", err)
+	}
+	if err := EnsureSavedSearchIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create saved search indexes: %v", err)
+	}
+	if err := EnsurePhoneVerificationIndexes(ctx, mongoDB); err != nil {
+		log.Printf("Warning: Failed to create phone verification indexes: %v", err)
+	}
+
+	// `chat-buysell reindex` rebuilds the Elasticsearch indices from MongoDB instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		if err := runReindexCommand(mongoDB, os.Args[2:]); err != nil {
+			log.Fatalf("Reindex error: %v", err)
+		}
+		return
+	}
+
+	// Select the post classifier backend
+	postClassifier, err = NewClassifierFromEnv()
+	if err != nil {
+		log.Fatalf("Classifier config error: %v", err)
+	}
+
+	// Select the SMS backend
+	smsSender, err = NewSMSSenderFromEnv()
+	if err != nil {
+		log.Fatalf("SMS config error: %v", err)
+	}
+
+	// Select the attachment storage
+	blobStore, err = NewBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Blob store config error: %v", err)
+	}
+
+	// Select the push notification backend
+	pushTransport, err = NewPushTransportFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("Push config error: %v", err)
+	}
 
 	// Initialize Elasticsearch
 	if err := InitElasticsearch("http://localhost:9200"); err != nil {
@@ -71,6 +157,27 @@ func main() {
 		log.Println("Elasticsearch initialized successfully")
 	}
 
+	// Workers stop on SIGINT/SIGTERM, after the server
+	serveCtx, stopServe := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopServe()
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	outboxDone := make(chan struct{})
+	if ElasticClient != nil {
+		// Mirror MongoDB writes recorded in the outbox to Elasticsearch
+		go func() {
+			runOutbox(workerCtx, mongoDB)
+			close(outboxDone)
+		}()
+	} else {
+		close(outboxDone)
+	}
+
+	// Expire posts that were not renewed in time
+	go runPostExpiry(workerCtx, mongoDB)
+	go runOfferExpiry(workerCtx, mongoDB)
+
 	r := gin.Default()
 
 	// Auth routes
@@ -80,30 +187,128 @@ func main() {
 	// NLP routes
 	r.POST("/nlp/classify", handleNLPClassify)
 
-	// Chat routes
-	r.POST("/chat/message", handleCreateMessage)
-	r.GET("/chat/room/:id", handleGetChatRoom)
-
-	// Search routes
-	r.GET("/search/chat", handleSearchChat)
-	r.POST("/chat/classify", handleClassifyMessage)
-
 	// Matching routes
 	r.POST("/matching/find", handleFindMatches)
-	r.POST("/post/create", handleCreatePost)
 	r.GET("/post/type/:type", handleGetPostsByType)
 
-	r.Run(":8080")
+	// Post search with facets
+	r.GET("/search/posts", handleSearchPosts)
+
+	// Uploaded files
+	r.GET("/media/*key", handleGetMedia)
+
+	// Routes below derive the user from the session token
+	authorized := r.Group("/")
+	authorized.Use(AuthRequired())
+
+	authorized.POST("/uploads", handleUpload)
+	authorized.GET("/auth/me", handleGetMe)
+	authorized.POST("/auth/logout", handleLogout)
+	authorized.GET("/auth/me/phone", handleGetPhone)
+	authorized.POST("/auth/me/phone", handleStartPhoneVerification)
+	authorized.POST("/auth/me/phone/verify", handleConfirmPhoneVerification)
+	authorized.DELETE("/auth/me/phone", handleDeletePhone)
+	authorized.POST("/auth/me/devices", handleRegisterDevice)
+	authorized.DELETE("/auth/me/devices", handleUnregisterDevice)
+
+	// Chat routes
+	authorized.POST("/chat/message", handleCreateMessage)
+	authorized.GET("/chat/room/:id", handleGetChatRoom)
+	authorized.POST("/chat/room/create", handleCreateChatRoom)
+	authorized.GET("/chat/rooms", handleGetChatRooms)
+	authorized.GET(tokenQueryPath, handleChatWebSocket)
+	authorized.POST("/chat/room/:id/read", handleMarkRead)
+	authorized.POST("/chat/room/:id/typing", handleTyping)
+	authorized.POST("/chat/room/:id/offers", handleCreateOffer)
+	authorized.POST("/chat/room/:id/offers/:offerId/respond", handleRespondOffer)
+	authorized.GET("/chat/room/:id/deal", handleGetDeal)
+	authorized.POST("/chat/room/:id/deal", handleTransitionDeal)
+	authorized.POST("/chat/room/:id/deal/rating", handleRateDeal)
+
+	// Deal routes
+	authorized.GET("/deals", handleGetDeals)
+	authorized.GET("/stats/deals", handleGetDealStats)
+	authorized.GET("/stats/indexing", handleGetIndexingLag)
+	authorized.GET("/users/:id/ratings", handleGetUserRatings)
+
+	// Search routes
+	authorized.GET("/search/chat", handleSearchChat)
+	authorized.POST("/chat/classify", handleClassifyMessage)
+
+	// Post routes
+	authorized.POST("/post/create", handleCreatePost)
+	authorized.POST("/post/:id/status", handleSetPostStatus)
+	authorized.POST("/post/:id/renew", handleRenewPost)
+	authorized.PUT("/post/:id", handleUpdatePost)
+	authorized.DELETE("/post/:id", handleDeletePost)
+	authorized.GET("/post/:id/history", handleGetPostHistory)
+
+	// Saved search routes
+	authorized.POST("/searches", handleCreateSavedSearch)
+	authorized.GET("/searches", handleGetSavedSearches)
+	authorized.DELETE("/searches/:id", handleDeleteSavedSearch)
+	authorized.GET("/matches", handleGetMatches)
+
+	server := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+	<-serveCtx.Done()
+
+	// Finish the requests in flight, then the outbox events, then send the queued documents
+	log.Println("Shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: Error shutting down server: %v", err)
+	}
+	stopWorkers()
+	select {
+	case <-outboxDone:
+	case <-shutdownCtx.Done():
+	}
+	if searchIndexer != nil {
+		if err := searchIndexer.Close(shutdownCtx); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
 }
 
+// handleFacebookLogin starts the login with a random state and a PKCE challenge.
+// Query param redirect: frontend path to return to after login (default /chat)
 func handleFacebookLogin(c *gin.Context) {
-	url := facebookOauthConfig.AuthCodeURL("state", oauth2.AccessTypeOffline)
-	c.Redirect(http.StatusTemporaryRedirect, url)
+	verifier := oauth2.GenerateVerifier()
+	pending, err := CreateOAuthState(context.Background(), mongoDB, verifier, safeRedirectPath(c.DefaultQuery("redirect", "/chat")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	// Bind the state to this browser so a callback URL forged by someone else is rejected
+	secure := strings.HasPrefix(facebookOauthConfig.RedirectURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthStateCookie, pending.State, int(oauthStateTTL.Seconds()), "/auth/facebook", "", secure, true)
+
+	authURL := facebookOauthConfig.AuthCodeURL(pending.State, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	c.Redirect(http.StatusTemporaryRedirect, authURL)
 }
 
+// handleFacebookCallback completes the login and issues a session token.
+// When FRONTEND_URL is set the user is redirected to the Next.js app with the token
+// in the URL fragment, otherwise the token is returned as JSON.
 func handleFacebookCallback(c *gin.Context) {
 	state := c.Query("state")
-	if state != "state" {
+	cookieState, _ := c.Cookie(oauthStateCookie)
+	if state == "" || cookieState != state {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OAuth state"})
+		return
+	}
+	c.SetCookie(oauthStateCookie, "", -1, "/auth/facebook", "", false, true)
+
+	pending, err := ConsumeOAuthState(context.Background(), mongoDB, state)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OAuth state"})
 		return
 	}
@@ -112,7 +317,7 @@ func handleFacebookCallback(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Code not found"})
 		return
 	}
-	token, err := facebookOauthConfig.Exchange(context.Background(), code)
+	token, err := facebookOauthConfig.Exchange(context.Background(), code, oauth2.VerifierOption(pending.Verifier))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token exchange failed"})
 		return
@@ -152,7 +357,23 @@ func handleFacebookCallback(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB upsert failed"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"user": user})
+	// Reload to get the user's ID
+	if err := userCollection.FindOne(context.Background(), filter).Decode(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	authToken, session, err := CreateSession(context.Background(), mongoDB, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	if frontendURL != "" {
+		// The fragment is never sent to servers, so the token stays out of access logs
+		target := frontendURL + "/auth/callback?redirect=" + url.QueryEscape(pending.Redirect) + "#token=" + url.QueryEscape(authToken)
+		c.Redirect(http.StatusFound, target)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user, "token": authToken, "expiresAt": session.ExpiresAt})
 }
 
 func handleNLPClassify(c *gin.Context) {
@@ -175,9 +396,9 @@ func handleNLPClassify(c *gin.Context) {
 // handleCreateMessage creates a new chat message and indexes it in Elasticsearch
 func handleCreateMessage(c *gin.Context) {
 	var req struct {
-		RoomID   string `json:"roomId"`
-		SenderID string `json:"senderId"`
-		Content  string `json:"content"`
+		RoomID      string   `json:"roomId"`
+		Content     string   `json:"content"`
+		Attachments []string `json:"attachments"` // Attachment IDs from /uploads
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -192,69 +413,42 @@ func handleCreateMessage(c *gin.Context) {
 		return
 	}
 
-	senderID, err := primitive.ObjectIDFromHex(req.SenderID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sender ID"})
+	// The sender is always the authenticated user
+	senderID := currentUser(c).ID
+	chatRoom := loadRoomForParticipant(c, roomID, senderID)
+	if chatRoom == nil {
 		return
 	}
 
-	// Create message
-	msg := Message{
-		ID:        primitive.NewObjectID(),
-		RoomID:    roomID,
-		SenderID:  senderID,
-		Content:   req.Content,
-		CreatedAt: time.Now(),
-	}
-
 	ctx := context.Background()
 
-	// Insert into MongoDB
-	result, err := InsertMessage(ctx, mongoDB, msg)
+	attachments, err := resolveAttachments(ctx, mongoDB, senderID, req.Attachments)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message", "detail": err.Error()})
+		writeAttachmentError(c, err)
 		return
 	}
 
-	// Update chat room with message ID
-	_, err = chatroomCollection.UpdateOne(
-		ctx,
-		bson.M{"_id": roomID},
-		bson.M{"$push": bson.M{"messages": msg.ID}},
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat room"})
-		return
+	// Create message
+	msg := Message{
+		ID:          primitive.NewObjectID(),
+		RoomID:      roomID,
+		SenderID:    senderID,
+		Content:     req.Content,
+		Attachments: attachments,
+		CreatedAt:   time.Now(),
 	}
 
-	// Index in Elasticsearch (if enabled)
-	if ElasticClient != nil {
-		// Get chat room and post details for context
-		var chatRoom ChatRoom
-		err := chatroomCollection.FindOne(ctx, bson.M{"_id": roomID}).Decode(&chatRoom)
-		if err != nil && err != mongo.ErrNoDocuments {
-			log.Printf("Warning: Error getting chat room details: %v", err)
-		}
-
-		var post Post
-		if chatRoom.PostID != primitive.NilObjectID {
-			err = postCollection.FindOne(ctx, bson.M{"_id": chatRoom.PostID}).Decode(&post)
-			if err != nil && err != mongo.ErrNoDocuments {
-				log.Printf("Warning: Error getting post details: %v", err)
-			}
-		}
-
-		// Index the message with context
-		if err := IndexChatMessage(ctx, msg, &chatRoom, &post); err != nil {
-			log.Printf("Warning: Error indexing chat message in Elasticsearch: %v", err)
-			// Continue anyway, as Elasticsearch indexing should not block the API response
-		}
+	result, err := SendMessage(ctx, mongoDB, chatRoom, msg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message", "detail": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"messageId": msg.ID, "insertResult": result})
 }
 
-// handleGetChatRoom retrieves a chat room and its messages
+// handleGetChatRoom retrieves a chat room and a page of its messages.
+// Query params: before / after (message ID cursors), limit (default 50, at most 200)
 func handleGetChatRoom(c *gin.Context) {
 	roomID, err := primitive.ObjectIDFromHex(c.Param("id"))
 	if err != nil {
@@ -264,32 +458,40 @@ func handleGetChatRoom(c *gin.Context) {
 
 	ctx := context.Background()
 
-	var chatRoom ChatRoom
-	if err := chatroomCollection.FindOne(ctx, bson.M{"_id": roomID}).Decode(&chatRoom); err != nil {
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Chat room not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		}
+	chatRoom := loadRoomForParticipant(c, roomID, currentUser(c).ID)
+	if chatRoom == nil {
 		return
 	}
 
-	// Get messages in the chat room
-	cursor, err := messageCollection.Find(
-		ctx,
-		bson.M{"roomId": roomID},
-		options.Find().SetSort(bson.M{"createdAt": 1}),
-	)
+	// Get a page of the messages in the chat room
+	page, err := FindRoomMessages(ctx, mongoDB, roomID, c.Query("before"), c.Query("after"), parseHistoryLimit(c.Query("limit")))
+	if errors.Is(err, ErrInvalidHistoryCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages", "detail": err.Error()})
 		return
 	}
-	defer cursor.Close(ctx)
+	messages := page.Messages
 
-	var messages []Message
-	if err := cursor.All(ctx, &messages); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse messages"})
-		return
+	// The user now has every message of the room
+	userID := currentUser(c).ID
+	if len(messages) > 0 {
+		at := messages[len(messages)-1].CreatedAt
+		moved, err := MarkDelivered(ctx, mongoDB, roomID, userID, at)
+		if err != nil {
+			log.Printf("Warning: Error marking room %s delivered: %v", roomID.Hex(), err)
+		}
+		if moved {
+			if chatRoom.DeliveredAt == nil {
+				chatRoom.DeliveredAt = make(map[string]time.Time)
+			}
+			chatRoom.DeliveredAt[userID.Hex()] = at
+		}
+	}
+	for i := range messages {
+		messages[i].Status = chatRoom.MessageStatus(&messages[i])
 	}
 
 	// Get buyer and seller info
@@ -306,6 +508,9 @@ func handleGetChatRoom(c *gin.Context) {
 	response := gin.H{
 		"chatRoom": chatRoom,
 		"messages": messages,
+		"hasMore":  page.HasMore,
+		"before":   page.Before,
+		"after":    page.After,
 	}
 
 	if buyerErr == nil {
@@ -350,7 +555,7 @@ func handleSearchChat(c *gin.Context) {
 	from := (page - 1) * pageSize
 
 	ctx := c.Request.Context()
-	messages, total, err := SearchChatMessages(ctx, query, from, pageSize)
+	messages, total, err := SearchChatMessages(ctx, currentUser(c).ID.Hex(), query, from, pageSize)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed", "detail": err.Error()})
 		return
@@ -364,13 +569,8 @@ func handleSearchChat(c *gin.Context) {
 	})
 }
 
-// handleClassifyMessage classifies a chat message and updates its classification in Elasticsearch
+// handleClassifyMessage labels a chat message; the label is mirrored to Elasticsearch
 func handleClassifyMessage(c *gin.Context) {
-	if ElasticClient == nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Classification service not available"})
-		return
-	}
-
 	var req struct {
 		MessageID   string `json:"messageId"`
 		MessageType string `json:"messageType"`
@@ -400,8 +600,29 @@ func handleClassifyMessage(c *gin.Context) {
 		return
 	}
 
+	messageID, err := primitive.ObjectIDFromHex(req.MessageID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
 	ctx := c.Request.Context()
-	if err := ClassifyChatMessage(ctx, req.MessageID, req.MessageType); err != nil {
+
+	// Only participants of the message's room may label it
+	var msg Message
+	if err := messageCollection.FindOne(ctx, bson.M{"_id": messageID}).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	if loadRoomForParticipant(c, msg.RoomID, currentUser(c).ID) == nil {
+		return
+	}
+
+	if err := ClassifyChatMessage(ctx, mongoDB, messageID, req.MessageType); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Classification failed", "detail": err.Error()})
 		return
 	}
@@ -441,7 +662,7 @@ func handleFindMatches(c *gin.Context) {
 	}
 
 	// Use the classified information to find matching posts
-	matchResults, total, err := GetMatchingPosts(ctx, mongoDB, req.Content, req.Page, req.PageSize)
+	matchResults, total, err := GetMatchingPosts(ctx, mongoDB, postInfo, req.Page, req.PageSize)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find matches", "detail": err.Error()})
 		return
@@ -459,9 +680,9 @@ func handleFindMatches(c *gin.Context) {
 // handleCreatePost creates a new post with NLP classification
 func handleCreatePost(c *gin.Context) {
 	var req struct {
-		UserID  string `json:"userId" binding:"required"`
-		Content string `json:"content" binding:"required"`
-		Type    string `json:"type" binding:"required,oneof=mua ban"` // Explicit type override
+		Content string   `json:"content" binding:"required"`
+		Type    string   `json:"type" binding:"required,oneof=mua ban"` // Explicit type override
+		Images  []string `json:"images"`                                // Attachment IDs from /uploads
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -471,22 +692,12 @@ func handleCreatePost(c *gin.Context) {
 
 	ctx := context.Background()
 
-	// Parse user ID
-	userID, err := primitive.ObjectIDFromHex(req.UserID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
-		return
-	}
+	// The owner is always the authenticated user
+	userID := currentUser(c).ID
 
-	// Verify user exists
-	var user User
-	err = userCollection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+	images, err := resolveAttachments(ctx, mongoDB, userID, req.Images)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		}
+		writeAttachmentError(c, err)
 		return
 	}
 
@@ -499,51 +710,62 @@ func handleCreatePost(c *gin.Context) {
 			Type:     req.Type,
 			Category: "", // Empty fields will be filled by frontend
 		}
+		applyParsedPrice(postInfo, req.Content)
+		applyLocation(postInfo, req.Content)
 	} else {
 		// Override the NLP classification type with user's explicit choice if provided
 		postInfo.Type = req.Type
 	}
 
 	// Create and save the post
+	now := time.Now()
 	post := Post{
-		ID:        primitive.NewObjectID(),
-		Type:      postInfo.Type,
-		Content:   req.Content,
-		UserID:    userID,
-		CreatedAt: time.Now(),
-		Category:  postInfo.Category,
-		Location:  postInfo.Location,
-		Price:     postInfo.Price,
-		Condition: postInfo.Condition,
-		Keywords:  postInfo.Keywords,
-	}
-
-	result, err := InsertPost(ctx, mongoDB, post)
+		ID:           primitive.NewObjectID(),
+		Type:         postInfo.Type,
+		Content:      req.Content,
+		UserID:       userID,
+		CreatedAt:    now,
+		Category:     postInfo.Category,
+		Location:     postInfo.Location,
+		LocationCode: postInfo.LocationCode,
+		District:     postInfo.District,
+		DistrictCode: postInfo.DistrictCode,
+		PriceMin:     postInfo.PriceMin,
+		PriceMax:     postInfo.PriceMax,
+		Negotiable:   postInfo.Negotiable,
+		Condition:    postInfo.Condition,
+		Keywords:     postInfo.Keywords,
+		Status:       PostStatusActive,
+		ExpiresAt:    now.Add(postTTL),
+		BumpedAt:     now,
+		ManualFields: []string{manualType},
+		Images:       images,
+	}
+
+	// The post is indexed in Elasticsearch for matching through the outbox
+	var result *mongo.InsertOneResult
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if result, err = InsertPost(ctx, mongoDB, post); err != nil {
+			return err
+		}
+		return enqueueOutbox(ctx, mongoDB, OutboxIndexPost, post.ID)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create post", "detail": err.Error()})
 		return
 	}
+	wakeOutbox()
 
-	// Index the post in Elasticsearch for matching
-	if ElasticClient != nil {
-		// Create a mock message to index the post content
-		msg := Message{
-			ID:        primitive.NewObjectID(),
-			Content:   req.Content,
-			CreatedAt: time.Now(),
-		}
-
-		// Index in Elasticsearch
-		if err := IndexChatMessage(ctx, msg, nil, &post); err != nil {
-			log.Printf("Warning: Error indexing post in Elasticsearch: %v", err)
-			// Continue anyway, as Elasticsearch indexing should not block the API response
-		}
-	}
+	// Save the post as a search for counter-posts and alert the owners of saved
+	// searches this post satisfies
+	matches := matchNewPost(ctx, mongoDB, &post)
 
 	c.JSON(http.StatusOK, gin.H{
 		"post":       post,
 		"insertedID": result.InsertedID,
 		"postInfo":   postInfo,
+		"matches":    len(matches),
 	})
 }
 
@@ -572,31 +794,30 @@ func handleGetPostsByType(c *gin.Context) {
 	minPrice, _ := strconv.Atoi(c.DefaultQuery("minPrice", "0"))
 	maxPrice, _ := strconv.Atoi(c.DefaultQuery("maxPrice", "0"))
 
-	// Build filter
-	filter := bson.M{"type": postType}
+	// Build filter; sold, reserved and expired posts are not listed
+	filter := bson.M{"type": postType, "status": activePostFilter()}
 
 	if category != "" {
 		filter["category"] = category
 	}
 
 	if location != "" {
-		filter["location"] = location
+		// "HCM", "Sài Gòn" and "q7" all resolve to the same canonical codes
+		for k, v := range locationFilter(location) {
+			filter[k] = v
+		}
 	}
 
 	if minPrice > 0 || maxPrice > 0 {
-		priceFilter := bson.M{}
-		if minPrice > 0 {
-			priceFilter["$gte"] = minPrice
-		}
-		if maxPrice > 0 {
-			priceFilter["$lte"] = maxPrice
+		// Posts whose price range overlaps the requested one
+		for k, v := range priceOverlapFilter(minPrice, maxPrice) {
+			filter[k] = v
 		}
-		filter["price"] = priceFilter
 	}
 
 	// Options for sorting and pagination
 	findOptions := options.Find().
-		SetSort(bson.M{"createdAt": -1}).
+		SetSort(bson.D{{Key: "bumpedAt", Value: -1}, {Key: "createdAt", Value: -1}}).
 		SetSkip(int64((page - 1) * pageSize)).
 		SetLimit(int64(pageSize))
 
@@ -652,44 +873,3 @@ func handleGetPostsByType(c *gin.Context) {
 		"pageSize": pageSize,
 	})
 }
-
-// ClassifyPost sử dụng OpenAI để phân tích nội dung tin đăng
-func ClassifyPost(ctx context.Context, content string) (*PostInfo, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return nil, ErrNoAPIKey
-	}
-
-	client := openai.NewClient(apiKey)
-
-	systemContent := "Bạn là một AI phân loại tin đăng mua bán. Hãy trích xuất các trường dưới dạng JSON: type (mua|bán), category, location, price (số nguyên, nếu không có thì để 0), condition, keywords (mảng 3-5 từ khóa). Nếu không có trường nào thì để rỗng hoặc 0."
-	userContent := "Nội dung tin đăng: " + content + "\nHãy trả về kết quả JSON."
-
-	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model: openai.GPT4o,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: systemContent,
-			},
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: userContent,
-			},
-		},
-		Temperature: 0.3,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	var info PostInfo
-	jsonStr := resp.Choices[0].Message.Content
-	jsonStr = strings.TrimSpace(jsonStr)
-	err = json.Unmarshal([]byte(jsonStr), &info)
-	if err != nil {
-		return nil, err
-	}
-
-	return &info, nil
-}
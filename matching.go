@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// MatchClause explains one criterion of a match: whether the post satisfied it
+// and how much it added to the match percentage
+type MatchClause struct {
+	Field        string  `json:"field"` // category, location, district, condition, price, keywords, content
+	Matched      bool    `json:"matched"`
+	Weight       float64 `json:"weight"`
+	Contribution float64 `json:"contribution"` // share of the match percentage, 0 when not matched
+}
+
+// matchClause is a named should clause of the matching query
+type matchClause struct {
+	name   string
+	weight float64
+	query  map[string]interface{}
+}
+
+// buildMatchClauses turns the classified post into weighted criteria for posts of the
+// opposite type. Criteria the post says nothing about are left out.
+func buildMatchClauses(postInfo *PostInfo) []matchClause {
+	var clauses []matchClause
+	add := func(name string, weight float64, query map[string]interface{}) {
+		clauses = append(clauses, matchClause{name: name, weight: weight, query: query})
+	}
+	term := func(field string, value interface{}) map[string]interface{} {
+		return map[string]interface{}{"term": map[string]interface{}{field: value}}
+	}
+
+	if postInfo.Category != "" {
+		add("category", 3.0, term("category", postInfo.Category))
+	}
+
+	// Same province, with an extra weight for the same district
+	if postInfo.LocationCode != "" {
+		add("location", 2.0, term("location_code", postInfo.LocationCode))
+		if postInfo.DistrictCode != "" {
+			add("district", 1.0, term("district_code", postInfo.DistrictCode))
+		}
+	} else if postInfo.Location != "" {
+		add("location", 2.0, term("location", postInfo.Location))
+	}
+
+	if postInfo.Condition != "" {
+		add("condition", 1.5, term("condition", postInfo.Condition))
+	}
+
+	if postInfo.PriceMin > 0 || postInfo.PriceMax > 0 {
+		// A buyer accepts sellers asking up to their budget, and down to half of it.
+		// A seller accepts buyers offering at least their price, and up to 50% more.
+		lo, hi := int(float64(postInfo.PriceMin)*0.5), postInfo.PriceMax
+		if postInfo.Type != "mua" {
+			lo, hi = postInfo.PriceMin, int(float64(postInfo.PriceMax)*1.5)
+		}
+		add("price", 2.0, priceOverlapQuery(lo, hi))
+	}
+
+	if len(postInfo.Keywords) > 0 {
+		add("keywords", 2.0, map[string]interface{}{
+			"terms": map[string]interface{}{"keywords": postInfo.Keywords},
+		})
+		// Also search the content for the same terms
+		add("content", 1.0, map[string]interface{}{
+			"match": map[string]interface{}{"content": strings.Join(postInfo.Keywords, " ")},
+		})
+	}
+
+	return clauses
+}
+
+// shouldQueries wraps each clause in a named constant_score query, so a matched clause
+// adds exactly its weight to the score and is reported in the hit's matched_queries
+func shouldQueries(clauses []matchClause) []map[string]interface{} {
+	queries := make([]map[string]interface{}, len(clauses))
+	for i, clause := range clauses {
+		queries[i] = map[string]interface{}{
+			"constant_score": map[string]interface{}{
+				"filter": clause.query,
+				"boost":  clause.weight,
+				"_name":  clause.name,
+			},
+		}
+	}
+	return queries
+}
+
+// explainMatch builds the breakdown of a hit from its matched_queries and returns the
+// normalized 0-100 match percentage
+func explainMatch(clauses []matchClause, matchedQueries []string) ([]MatchClause, int) {
+	matched := make(map[string]bool, len(matchedQueries))
+	for _, name := range matchedQueries {
+		matched[name] = true
+	}
+
+	total := 0.0
+	for _, clause := range clauses {
+		total += clause.weight
+	}
+
+	breakdown := make([]MatchClause, len(clauses))
+	percent := 0.0
+	for i, clause := range clauses {
+		breakdown[i] = MatchClause{Field: clause.name, Matched: matched[clause.name], Weight: clause.weight}
+		if breakdown[i].Matched && total > 0 {
+			breakdown[i].Contribution = math.Round(clause.weight/total*1000) / 10
+			percent += clause.weight / total * 100
+		}
+	}
+	return breakdown, int(math.Round(percent))
+}
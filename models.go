@@ -9,6 +9,7 @@ import (
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -25,8 +26,15 @@ type User struct {
 	Avatar      string             `bson:"avatar" json:"avatar"`
 	Type        string             `bson:"type" json:"type"`
 	Email       string             `bson:"email" json:"email"`
-	AccessToken string             `bson:"accessToken" json:"accessToken"`
+	AccessToken string             `bson:"accessToken" json:"-"` // Facebook token, never sent to clients
 	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+	// Phone is in E.164 format and only used for SMS, it is never sent to other users
+	Phone         string `bson:"phone,omitempty" json:"-"`
+	PhoneVerified bool   `bson:"phoneVerified,omitempty" json:"-"`
+	// DeviceTokens are the FCM tokens push notifications are sent to
+	DeviceTokens []DeviceToken `bson:"deviceTokens,omitempty" json:"-"`
+	// Reputation is computed from ratings, deals and chats, see UpdateReputation
+	Reputation *Reputation `bson:"reputation,omitempty" json:"reputation,omitempty"`
 }
 
 // Post struct
@@ -38,59 +46,104 @@ type Post struct {
 	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
 	UserID    primitive.ObjectID `bson:"userId" json:"userId"`
 	Category  string             `json:"category"`
-	Location  string             `json:"location"`
-	Price     int                `json:"price"`
-	Condition string             `json:"condition"`
-	Keywords  []string           `json:"keywords"`
+	// Location is the canonical province name; the codes come from the gazetteer
+	Location     string `json:"location"`
+	LocationCode string `bson:"locationCode,omitempty" json:"locationCode,omitempty"`
+	District     string `bson:"district,omitempty" json:"district,omitempty"`
+	DistrictCode string `bson:"districtCode,omitempty" json:"districtCode,omitempty"`
+	// Price range in VND; PriceMax == 0 with PriceMin > 0 means no upper bound
+	PriceMin   int      `bson:"priceMin" json:"priceMin"`
+	PriceMax   int      `bson:"priceMax" json:"priceMax"`
+	Negotiable bool     `bson:"negotiable" json:"negotiable"`
+	Condition  string   `json:"condition"`
+	Keywords   []string `json:"keywords"`
+	Status     string   `bson:"status" json:"status"`
+	// Active posts expire at ExpiresAt unless renewed; BumpedAt orders the listings
+	ExpiresAt       time.Time `bson:"expiresAt" json:"expiresAt"`
+	BumpedAt        time.Time `bson:"bumpedAt" json:"bumpedAt"`
+	StatusChangedAt time.Time `bson:"statusChangedAt,omitempty" json:"statusChangedAt,omitempty"`
+	// ManualFields lists the fields the owner set by hand; re-classification keeps them
+	ManualFields []string     `bson:"manualFields,omitempty" json:"manualFields,omitempty"`
+	UpdatedAt    time.Time    `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	Images       []Attachment `bson:"images,omitempty" json:"images,omitempty"`
 }
 
+// PostStatusActive is the status of a post that can still be matched
+const PostStatusActive = "active"
+
 // PostInfo struct for NLP classification results
 type PostInfo struct {
-	Type      string   `json:"type"`
-	Category  string   `json:"category"`
-	Location  string   `json:"location"`
-	Price     int      `json:"price"`
-	Condition string   `json:"condition"`
-	Keywords  []string `json:"keywords"`
+	Type         string   `json:"type"`
+	Category     string   `json:"category"`
+	Location     string   `json:"location"`
+	LocationCode string   `json:"locationCode,omitempty"`
+	District     string   `json:"district,omitempty"`
+	DistrictCode string   `json:"districtCode,omitempty"`
+	Price        int      `json:"price"` // single amount, as returned by the LLM
+	PriceMin     int      `json:"priceMin"`
+	PriceMax     int      `json:"priceMax"`
+	Negotiable   bool     `json:"negotiable"`
+	Condition    string   `json:"condition"`
+	Keywords     []string `json:"keywords"`
 }
 
 // Message struct
 type Message struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	RoomID    primitive.ObjectID `bson:"roomId" json:"roomId"`
-	SenderID  primitive.ObjectID `bson:"senderId" json:"senderId"`
-	Content   string             `bson:"content" json:"content"`
-	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID      primitive.ObjectID `bson:"roomId" json:"roomId"`
+	SenderID    primitive.ObjectID `bson:"senderId" json:"senderId"`
+	Content     string             `bson:"content" json:"content"`
+	Attachments []Attachment       `bson:"attachments,omitempty" json:"attachments,omitempty"`
+	// Type is "offer" for price offers, empty for plain messages
+	Type      string    `bson:"type,omitempty" json:"type,omitempty"`
+	Offer     *Offer    `bson:"offer,omitempty" json:"offer,omitempty"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	// Classification is the label set by participants or by accepting an offer
+	Classification string `bson:"classification,omitempty" json:"classification,omitempty"`
+	// Status is computed from the recipient's cursors when a room is loaded, see MessageStatus
+	Status string `bson:"-" json:"status,omitempty"`
 }
 
 // ChatRoom struct
 type ChatRoom struct {
-	ID        primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
-	BuyerID   primitive.ObjectID   `bson:"buyerId" json:"buyerId"`
-	SellerID  primitive.ObjectID   `bson:"sellerId" json:"sellerId"`
-	PostID    primitive.ObjectID   `bson:"postId" json:"postId"`
-	Messages  []primitive.ObjectID `bson:"messages" json:"messages"`
-	CreatedAt time.Time            `bson:"createdAt" json:"createdAt"`
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	BuyerID   primitive.ObjectID `bson:"buyerId" json:"buyerId"`
+	SellerID  primitive.ObjectID `bson:"sellerId" json:"sellerId"`
+	PostID    primitive.ObjectID `bson:"postId" json:"postId"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	// LastMessageAt is used to sort rooms by recent activity
+	LastMessageAt time.Time `bson:"lastMessageAt" json:"lastMessageAt"`
+	// LastReadAt maps a participant's hex ID to the time they last read the room
+	LastReadAt map[string]time.Time `bson:"lastReadAt,omitempty" json:"lastReadAt,omitempty"`
+	// DeliveredAt maps a participant's hex ID to the time of the last message pushed to them
+	DeliveredAt map[string]time.Time `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+	// Set when an offer is accepted
+	AgreedPrice   int                 `bson:"agreedPrice,omitempty" json:"agreedPrice,omitempty"`
+	AgreedOfferID *primitive.ObjectID `bson:"agreedOfferId,omitempty" json:"agreedOfferId,omitempty"`
+	AgreedAt      *time.Time          `bson:"agreedAt,omitempty" json:"agreedAt,omitempty"`
 }
 
 // ChatMessageIndex represents the structure for chat messages in Elasticsearch
 type ChatMessageIndex struct {
-	ID          string    `json:"id"`
-	RoomID      string    `json:"room_id"`
-	SenderID    string    `json:"sender_id"`
-	Content     string    `json:"content"`
-	CreatedAt   time.Time `json:"created_at"`
-	PostType    string    `json:"post_type,omitempty"`    // "mua" or "ban"
-	Category    string    `json:"category,omitempty"`
-	Location    string    `json:"location,omitempty"`
-	Price       int       `json:"price,omitempty"`
-	Condition   string    `json:"condition,omitempty"`
-	Keywords    []string  `json:"keywords,omitempty"`
-	BuyerID     string    `json:"buyer_id,omitempty"`
-	SellerID    string    `json:"seller_id,omitempty"`
-	PostID      string    `json:"post_id,omitempty"`
-	Classified  bool      `json:"classified"`          // Whether this message has been classified
-	MessageType string    `json:"message_type"`        // "question", "negotiation", "agreement", etc.
+	ID           string    `json:"id"`
+	RoomID       string    `json:"room_id"`
+	SenderID     string    `json:"sender_id"`
+	Content      string    `json:"content"`
+	CreatedAt    time.Time `json:"created_at"`
+	PostType     string    `json:"post_type,omitempty"` // "mua" or "ban"
+	Category     string    `json:"category,omitempty"`
+	Location     string    `json:"location,omitempty"`
+	LocationCode string    `json:"location_code,omitempty"`
+	DistrictCode string    `json:"district_code,omitempty"`
+	PriceMin     int       `json:"price_min,omitempty"`
+	PriceMax     int       `json:"price_max,omitempty"`
+	Condition    string    `json:"condition,omitempty"`
+	Keywords     []string  `json:"keywords,omitempty"`
+	BuyerID      string    `json:"buyer_id,omitempty"`
+	SellerID     string    `json:"seller_id,omitempty"`
+	PostID       string    `json:"post_id,omitempty"`
+	Classified   bool      `json:"classified"`   // Whether this message has been classified
+	MessageType  string    `json:"message_type"` // "question", "negotiation", "agreement", etc.
 }
 
 // MatchingResult represents a matching post result with score
@@ -98,6 +151,9 @@ type MatchingResult struct {
 	Post  Post    `json:"post"`
 	User  User    `json:"user"`
 	Score float64 `json:"score"`
+	// MatchPercent is the share of the searched criteria the post satisfies, 0-100
+	MatchPercent int           `json:"matchPercent"`
+	Breakdown    []MatchClause `json:"breakdown"`
 }
 
 // ElasticClient holds the Elasticsearch client
@@ -122,58 +178,71 @@ func InitElasticsearch(url string) error {
 	}
 	defer res.Body.Close()
 	
-	// Ensure the index exists
-	if (err := createChatMessagesIndex(); err != nil) {
+	// Ensure the indices exist
+	if err := createChatMessagesIndex(); err != nil {
 		return fmt.Errorf("error creating chat messages index: %w", err)
 	}
+	if err := createPostsIndex(); err != nil {
+		return fmt.Errorf("error creating posts index: %w", err)
+	}
+	if err := createSavedSearchesIndex(); err != nil {
+		return fmt.Errorf("error creating saved searches index: %w", err)
+	}
+	
+	// Every document write goes through bulk requests
+	searchIndexer = NewBulkIndexer(ElasticClient, BulkIndexerConfigFromEnv())
 	
 	return nil
 }
 
-// createChatMessagesIndex creates the chat_messages index if it doesn't exist
-func createChatMessagesIndex() error {
-	// Define the mapping for chat messages
-	mapping := `{
-		"settings": {
-			"number_of_shards": 1,
-			"number_of_replicas": 0,
-			"analysis": {
-				"analyzer": {
-					"vietnamese_analyzer": {
-						"type": "custom",
-						"tokenizer": "standard",
-						"filter": ["lowercase", "asciifolding"]
-					}
-				}
-			}
-		},
-		"mappings": {
-			"properties": {
-				"id": { "type": "keyword" },
-				"room_id": { "type": "keyword" },
-				"sender_id": { "type": "keyword" },
-				"content": { 
-					"type": "text",
-					"analyzer": "vietnamese_analyzer" 
-				},
-				"created_at": { "type": "date" },
-				"post_type": { "type": "keyword" },
-				"category": { "type": "keyword" },
-				"location": { "type": "keyword" },
-				"price": { "type": "integer" },
-				"condition": { "type": "keyword" },
-				"keywords": { "type": "keyword" },
-				"buyer_id": { "type": "keyword" },
-				"seller_id": { "type": "keyword" },
-				"post_id": { "type": "keyword" },
-				"classified": { "type": "boolean" },
-				"message_type": { "type": "keyword" }
-			}
+// chatMessagesIndex is the alias searches and writes go through; it points to the
+// versioned index built with chatMessagesMapping, see the reindex command
+const chatMessagesIndex = "chat_messages"
+
+// chatMessagesVersion is bumped with every change to chatMessagesMapping
+const chatMessagesVersion = 4
+
+// chatMessagesMapping defines the settings and mapping of the chat messages index
+var chatMessagesMapping = withVietnameseAnalysis(`{
+	"settings": {
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings": {
+		"properties": {
+			"id": { "type": "keyword" },
+			"room_id": { "type": "keyword" },
+			"sender_id": { "type": "keyword" },
+			"content": { "type": "text" },
+			"created_at": { "type": "date" },
+			"post_type": { "type": "keyword" },
+			"category": { "type": "keyword" },
+			"location": { "type": "keyword" },
+			"location_code": { "type": "keyword" },
+			"district_code": { "type": "keyword" },
+			"price_min": { "type": "long" },
+			"price_max": { "type": "long" },
+			"condition": { "type": "keyword" },
+			"keywords": { "type": "keyword" },
+			"buyer_id": { "type": "keyword" },
+			"seller_id": { "type": "keyword" },
+			"post_id": { "type": "keyword" },
+			"classified": { "type": "boolean" },
+			"message_type": { "type": "keyword" }
 		}
-	}`
-	
+	}
+}`, "content")
+
+// createChatMessagesIndex creates the chat_messages index behind its alias if it doesn't exist
+func createChatMessagesIndex() error {
+	return ensureAliasedIndex(chatMessagesIndex, chatMessagesVersion, chatMessagesMapping)
+}
+
+// createIndexIfMissing creates an index with the given settings and mappings,
+// an index that already exists is left untouched
+func createIndexIfMissing(index, mapping string) error {
 	req := esapi.IndicesCreateRequest{
-		Index: "chat_messages",
+		Index: index,
 		Body:  bytes.NewReader([]byte(mapping)),
 	}
 	
@@ -186,7 +255,7 @@ func createChatMessagesIndex() error {
 	// If the index already exists, that's fine
 	if (res.StatusCode == 400) {
 		var r map[string]interface{}
-		if (err := json.NewDecoder(res.Body).Decode(&r); err != nil) {
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
 			return err
 		}
 		
@@ -205,12 +274,22 @@ func createChatMessagesIndex() error {
 	return nil
 }
 
-// IndexChatMessage indexes a chat message in Elasticsearch
+// IndexChatMessage indexes a chat message in Elasticsearch through the bulk indexer
 func IndexChatMessage(ctx context.Context, msg Message, chatRoom *ChatRoom, post *Post) error {
-	if (ElasticClient == nil) {
+	if (searchIndexer == nil) {
 		return fmt.Errorf("Elasticsearch client not initialized")
 	}
 	
+	chatMsg := newChatMessageIndex(msg, chatRoom, post)
+	if err := searchIndexer.Index(ctx, chatMessagesIndex, chatMsg.ID, chatMsg); err != nil {
+		return fmt.Errorf("error indexing chat message: %w", err)
+	}
+	
+	return nil
+}
+
+// newChatMessageIndex builds the document of a chat message, with the context of its room and post when given
+func newChatMessageIndex(msg Message, chatRoom *ChatRoom, post *Post) ChatMessageIndex {
 	// Create a document to index
 	chatMsg := ChatMessageIndex{
 		ID:         msg.ID.Hex(),
@@ -221,6 +300,15 @@ func IndexChatMessage(ctx context.Context, msg Message, chatRoom *ChatRoom, post
 		Classified: false, // Default to not classified
 	}
 	
+	// Offers are negotiation messages by construction, unless labelled otherwise
+	if (msg.Classification != "") {
+		chatMsg.Classified = true
+		chatMsg.MessageType = msg.Classification
+	} else if (msg.Type == MessageTypeOffer) {
+		chatMsg.Classified = true
+		chatMsg.MessageType = "negotiation"
+	}
+	
 	// Add additional context if ChatRoom is provided
 	if (chatRoom != nil) {
 		chatMsg.BuyerID = chatRoom.BuyerID.Hex()
@@ -233,40 +321,39 @@ func IndexChatMessage(ctx context.Context, msg Message, chatRoom *ChatRoom, post
 		chatMsg.PostType = post.Type
 		chatMsg.Category = post.Category
 		chatMsg.Location = post.Location
-		chatMsg.Price = post.Price
+		chatMsg.LocationCode = post.LocationCode
+		chatMsg.DistrictCode = post.DistrictCode
+		chatMsg.PriceMin = post.PriceMin
+		chatMsg.PriceMax = post.PriceMax
 		chatMsg.Condition = post.Condition
 		chatMsg.Keywords = post.Keywords
 	}
 	
-	// Convert to JSON
-	data, err := json.Marshal(chatMsg)
-	if (err != nil) {
-		return fmt.Errorf("error marshaling chat message: %w", err)
-	}
-	
-	// Index the document
-	req := esapi.IndexRequest{
-		Index:      "chat_messages",
-		DocumentID: chatMsg.ID,
-		Body:       bytes.NewReader(data),
-		Refresh:    "true",
-	}
-	
-	res, err := req.Do(ctx, ElasticClient)
-	if (err != nil) {
-		return fmt.Errorf("error indexing chat message: %w", err)
-	}
-	defer res.Body.Close()
-	
-	if (res.IsError()) {
-		return fmt.Errorf("error indexing document: %s", res.String())
+	return chatMsg
+}
+
+// chatMessageTextQuery matches the text of a chat search against the message content
+// and the details of the post the chat is about
+func chatMessageTextQuery(query string) map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []map[string]interface{}{
+				vietnameseContentQuery(query),
+				{
+					"multi_match": map[string]interface{}{
+						"query":  query,
+						"fields": []string{"category", "location", "keywords^2"},
+					},
+				},
+			},
+			"minimum_should_match": 1,
+		},
 	}
-	
-	return nil
 }
 
 // SearchChatMessages searches for chat messages in Elasticsearch
-func SearchChatMessages(ctx context.Context, query string, from, size int) ([]ChatMessageIndex, int, error) {
+// Only messages of rooms where userID is the buyer or the seller are returned
+func SearchChatMessages(ctx context.Context, userID string, query string, from, size int) ([]ChatMessageIndex, int, error) {
 	if (ElasticClient == nil) {
 		return nil, 0, fmt.Errorf("Elasticsearch client not initialized")
 	}
@@ -274,12 +361,24 @@ func SearchChatMessages(ctx context.Context, query string, from, size int) ([]Ch
 	// Build the search request
 	searchQuery := map[string]interface{}{
 		"query": map[string]interface{}{
-			"multi_match": map[string]interface{}{
-				"query":  query,
-				"fields": []string{"content", "category", "location", "keywords^2"},
+			"bool": map[string]interface{}{
+				"must": chatMessageTextQuery(query),
+				"filter": []map[string]interface{}{
+					{
+						"bool": map[string]interface{}{
+							"should": []map[string]interface{}{
+								{"term": map[string]interface{}{"buyer_id": userID}},
+								{"term": map[string]interface{}{"seller_id": userID}},
+							},
+							"minimum_should_match": 1,
+						},
+					},
+				},
 			},
 		},
+		// Best matches first, recent messages first among equals
 		"sort": []map[string]interface{}{
+			{"_score": map[string]interface{}{"order": "desc"}},
 			{
 				"created_at": map[string]interface{}{
 					"order": "desc",
@@ -299,7 +398,7 @@ func SearchChatMessages(ctx context.Context, query string, from, size int) ([]Ch
 	// Perform the search
 	res, err := ElasticClient.Search(
 		ElasticClient.Search.WithContext(ctx),
-		ElasticClient.Search.WithIndex("chat_messages"),
+		ElasticClient.Search.WithIndex(chatMessagesIndex),
 		ElasticClient.Search.WithBody(bytes.NewReader(data)),
 		ElasticClient.Search.WithTrackTotalHits(true),
 	)
@@ -314,7 +413,7 @@ func SearchChatMessages(ctx context.Context, query string, from, size int) ([]Ch
 	
 	// Parse the response
 	var result map[string]interface{}
-	if (err := json.NewDecoder(res.Body).Decode(&result); err != nil) {
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
 		return nil, 0, fmt.Errorf("error parsing search response: %w", err)
 	}
 	
@@ -335,7 +434,7 @@ func SearchChatMessages(ctx context.Context, query string, from, size int) ([]Ch
 			return nil, 0, fmt.Errorf("error marshaling hit source: %w", err)
 		}
 		
-		if (err := json.Unmarshal(data, &msg); err != nil) {
+		if err := json.Unmarshal(data, &msg); err != nil {
 			return nil, 0, fmt.Errorf("error unmarshaling hit source: %w", err)
 		}
 		
@@ -345,42 +444,24 @@ func SearchChatMessages(ctx context.Context, query string, from, size int) ([]Ch
 	return messages, total, nil
 }
 
-// ClassifyChatMessage classifies a chat message and updates its Elasticsearch document
-func ClassifyChatMessage(ctx context.Context, msgID string, messageType string) error {
-	if (ElasticClient == nil) {
-		return fmt.Errorf("Elasticsearch client not initialized")
-	}
-	
-	// Update document
-	updateDoc := map[string]interface{}{
-		"doc": map[string]interface{}{
-			"classified":   true,
-			"message_type": messageType,
-		},
-	}
-	
-	data, err := json.Marshal(updateDoc)
-	if (err != nil) {
-		return fmt.Errorf("error marshaling update doc: %w", err)
-	}
-	
-	req := esapi.UpdateRequest{
-		Index:      "chat_messages",
-		DocumentID: msgID,
-		Body:       bytes.NewReader(data),
-		Refresh:    "true",
-	}
-	
-	res, err := req.Do(ctx, ElasticClient)
+// ClassifyChatMessage stores the label of a chat message; its Elasticsearch document is
+// updated through the outbox
+func ClassifyChatMessage(ctx context.Context, db *mongo.Database, msgID primitive.ObjectID, messageType string) error {
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		_, err := db.Collection("messages").UpdateOne(ctx,
+			bson.M{"_id": msgID},
+			bson.M{"$set": bson.M{"classification": messageType}},
+		)
+		if (err != nil) {
+			return fmt.Errorf("error updating message: %w", err)
+		}
+		return enqueueOutbox(ctx, db, OutboxIndexMessage, msgID)
+	})
 	if (err != nil) {
-		return fmt.Errorf("error updating document: %w", err)
-	}
-	defer res.Body.Close()
-	
-	if (res.IsError()) {
-		return fmt.Errorf("error updating document: %s", res.String())
+		return err
 	}
 	
+	wakeOutbox()
 	return nil
 }
 
@@ -405,126 +486,43 @@ func SearchMatchingPosts(ctx context.Context, postInfo *PostInfo, page, pageSize
 	searchQuery := map[string]interface{}{
 		"query": map[string]interface{}{
 			"bool": map[string]interface{}{
-				"must": []map[string]interface{}{
+				// Filter only, so the score is the sum of the matched criteria
+				"filter": []map[string]interface{}{
+					{
+						"term": map[string]interface{}{
+							"type": oppositeType,
+						},
+					},
 					{
 						"term": map[string]interface{}{
-							"post_type": oppositeType,
+							"status": PostStatusActive,
 						},
 					},
 				},
 				"should": []map[string]interface{}{},
 			},
 		},
+		// Scores are sums of criteria weights, newer posts win ties
+		"sort": []interface{}{
+			"_score",
+			map[string]interface{}{"created_at": map[string]interface{}{"order": "desc"}},
+		},
 		"from": from,
 		"size": pageSize,
 	}
 	
-	// Add should clauses for boosting relevant matches
-	shouldClauses := []map[string]interface{}{}
-	
-	// Match on category with high boost
-	if postInfo.Category != "" {
-		shouldClauses = append(shouldClauses, map[string]interface{}{
-			"term": map[string]interface{}{
-				"category": map[string]interface{}{
-					"value": postInfo.Category,
-					"boost": 3.0,
-				},
-			},
-		})
-	}
-	
-	// Match on location
-	if postInfo.Location != "" {
-		shouldClauses = append(shouldClauses, map[string]interface{}{
-			"term": map[string]interface{}{
-				"location": map[string]interface{}{
-					"value": postInfo.Location,
-					"boost": 2.0,
-				},
-			},
-		})
-	}
-	
-	// Match on condition
-	if postInfo.Condition != "" {
-		shouldClauses = append(shouldClauses, map[string]interface{}{
-			"term": map[string]interface{}{
-				"condition": map[string]interface{}{
-					"value": postInfo.Condition,
-					"boost": 1.5,
-				},
-			},
-		})
-	}
-	
-	// Match on price range (if specified)
-	if postInfo.Price > 0 {
-		// For buying posts looking for selling posts, we want price <= the max the buyer is willing to pay
-		// For selling posts looking for buying posts, we want price >= the min the seller is asking
-		var priceQuery map[string]interface{}
-		
-		if postInfo.Type == "mua" {
-			// Buyer looking for sellers, want prices less than or equal
-			priceQuery = map[string]interface{}{
-				"range": map[string]interface{}{
-					"price": map[string]interface{}{
-						"lte": postInfo.Price,
-						// Allow some flexibility in price (about 10% higher)
-						"gte": int(float64(postInfo.Price) * 0.5),
-					},
-				},
-			}
-		} else {
-			// Seller looking for buyers, want prices greater than or equal
-			priceQuery = map[string]interface{}{
-				"range": map[string]interface{}{
-					"price": map[string]interface{}{
-						"gte": postInfo.Price,
-						// Allow some flexibility (about 50% higher)
-						"lte": int(float64(postInfo.Price) * 1.5),
-					},
-				},
-			}
-		}
-		
-		shouldClauses = append(shouldClauses, priceQuery)
-	}
-	
-	// Match on keywords
-	if len(postInfo.Keywords) > 0 {
-		keywordsQuery := map[string]interface{}{
-			"terms": map[string]interface{}{
-				"keywords": map[string]interface{}{
-					"terms": postInfo.Keywords,
-					"boost": 2.0,
-				},
-			},
-		}
-		shouldClauses = append(shouldClauses, keywordsQuery)
-		
-		// Also search in content field for similar terms
-		for _, keyword := range postInfo.Keywords {
-			contentQuery := map[string]interface{}{
-				"match": map[string]interface{}{
-					"content": map[string]interface{}{
-						"query": keyword,
-						"boost": 1.0,
-					},
-				},
-			}
-			shouldClauses = append(shouldClauses, contentQuery)
-		}
-	}
-	
-	// Add should clauses to query
-	searchQuery["query"].(map[string]interface{})["bool"].(map[string]interface{})["should"] = shouldClauses
+	// Each criterion is a named should clause so hits can be explained
+	clauses := buildMatchClauses(postInfo)
+	searchQuery["query"].(map[string]interface{})["bool"].(map[string]interface{})["should"] = shouldQueries(clauses)
 	
 	// Must have at least one should clause match
-	if len(shouldClauses) > 0 {
+	if len(clauses) > 0 {
 		searchQuery["query"].(map[string]interface{})["bool"].(map[string]interface{})["minimum_should_match"] = 1
 	}
 	
+	// Trusted owners rank higher among similar matches
+	searchQuery["query"] = reputationRankedQuery(searchQuery["query"].(map[string]interface{}))
+	
 	// Convert to JSON
 	data, err := json.Marshal(searchQuery)
 	if err != nil {
@@ -534,7 +532,7 @@ func SearchMatchingPosts(ctx context.Context, postInfo *PostInfo, page, pageSize
 	// Perform the search
 	res, err := ElasticClient.Search(
 		ElasticClient.Search.WithContext(ctx),
-		ElasticClient.Search.WithIndex("chat_messages"),
+		ElasticClient.Search.WithIndex(postsIndex),
 		ElasticClient.Search.WithBody(bytes.NewReader(data)),
 		ElasticClient.Search.WithTrackTotalHits(true),
 	)
@@ -560,80 +558,67 @@ func SearchMatchingPosts(ctx context.Context, postInfo *PostInfo, page, pageSize
 	hits := result["hits"].(map[string]interface{})["hits"].([]interface{})
 	matchResults := make([]MatchingResult, 0, len(hits))
 	
-	// Process each hit
+	// Process each hit; Post and User are filled from MongoDB by GetMatchingPosts
 	for _, hit := range hits {
-		source := hit.(map[string]interface{})["_source"].(map[string]interface{})
-		score := hit.(map[string]interface{})["_score"].(float64)
-		
-		var chatMsg ChatMessageIndex
-		// Convert to ChatMessageIndex
-		data, err := json.Marshal(source)
+		hitMap := hit.(map[string]interface{})
+		postID, err := primitive.ObjectIDFromHex(hitMap["_id"].(string))
 		if err != nil {
-			return nil, 0, fmt.Errorf("error marshaling hit source: %w", err)
-		}
-		
-		if err := json.Unmarshal(data, &chatMsg); err != nil {
-			return nil, 0, fmt.Errorf("error unmarshaling hit source: %w", err)
-		}
-		
-		// Skip if there's no post ID
-		if chatMsg.PostID == "" {
 			continue
 		}
 		
-		// Create a partial result with the score
-		matchResult := MatchingResult{
-			Score: score,
+		var matchedQueries []string
+		if names, ok := hitMap["matched_queries"].([]interface{}); ok {
+			for _, name := range names {
+				matchedQueries = append(matchedQueries, name.(string))
+			}
 		}
+		breakdown, percent := explainMatch(clauses, matchedQueries)
 		
-		// We'll fill in Post and User details later
-		
-		matchResults = append(matchResults, matchResult)
+		matchResults = append(matchResults, MatchingResult{
+			Post:         Post{ID: postID},
+			Score:        hitMap["_score"].(float64),
+			MatchPercent: percent,
+			Breakdown:    breakdown,
+		})
 	}
 	
 	return matchResults, total, nil
 }
 
-// GetMatchingPosts finds matching posts for the given post content
-// It first classifies the content, then searches for matching posts
-func GetMatchingPosts(ctx context.Context, db *mongo.Database, content string, page, pageSize int) ([]MatchingResult, int, error) {
-	// First, classify the post content
-	postInfo, err := ClassifyPost(ctx, content)
+// GetMatchingPosts finds matching posts for the classified post information
+// and loads the posts and their owners from MongoDB
+func GetMatchingPosts(ctx context.Context, db *mongo.Database, postInfo *PostInfo, page, pageSize int) ([]MatchingResult, int, error) {
+	matchResults, total, err := SearchMatchingPosts(ctx, postInfo, page, pageSize)
 	if err != nil {
-		return nil, 0, fmt.Errorf("error classifying post: %w", err)
+		return nil, 0, fmt.Errorf("error searching matching posts: %w", err)
+	}
+	if len(matchResults) == 0 {
+		return matchResults, total, nil
 	}
 	
-	// Now find matching posts in Elasticsearch
-	matchResults, total, err := SearchMatchingPosts(ctx, postInfo, page, pageSize)
+	// Load all matched posts and their owners
+	postIDs := make([]primitive.ObjectID, len(matchResults))
+	for i, result := range matchResults {
+		postIDs[i] = result.Post.ID
+	}
+	posts, users, err := loadPostsWithOwners(ctx, db, postIDs)
 	if err != nil {
-		return nil, 0, fmt.Errorf("error searching matching posts: %w", err)
+		return nil, 0, fmt.Errorf("error loading matched posts: %w", err)
 	}
 	
-	// Get details for each match from MongoDB
-	for i := range matchResults {
-		if i < len(matchResults) {
-			// Get post details
-			postID, err := primitive.ObjectIDFromHex(matchResults[i].Post.ID.Hex())
-			if err == nil {
-				var post Post
-				err = db.Collection("posts").FindOne(ctx, bson.M{"_id": postID}).Decode(&post)
-				if err == nil {
-					matchResults[i].Post = post
-				}
-			}
-			
-			// Get user details
-			if !matchResults[i].Post.UserID.IsZero() {
-				var user User
-				err = db.Collection("users").FindOne(ctx, bson.M{"_id": matchResults[i].Post.UserID}).Decode(&user)
-				if err == nil {
-					matchResults[i].User = user
-				}
-			}
+	// Keep the Elasticsearch order, dropping posts closed or deleted since they were indexed
+	hydrated := matchResults[:0]
+	for _, result := range matchResults {
+		post, ok := posts[result.Post.ID]
+		if !ok || statusOf(&post) != PostStatusActive {
+			continue
 		}
+		result.Post = post
+		result.User = users[post.UserID]
+		hydrated = append(hydrated, result)
 	}
 	
-	return matchResults, total, nil
+	return hydrated, total, nil
 }
 
 // Example: insert user
@@ -649,8 +634,11 @@ func InsertPost(ctx context.Context, db *mongo.Database, post Post) (*mongo.Inse
 }
 
 // Example: insert message
+// The creation time of the caller is kept, it is the one pushed to clients and cursors
 func InsertMessage(ctx context.Context, db *mongo.Database, msg Message) (*mongo.InsertOneResult, error) {
-	msg.CreatedAt = time.Now()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
 	return db.Collection("messages").InsertOne(ctx, msg)
 }
 
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// oauthStateTTL bounds how long a user may take to complete the Facebook login
+const oauthStateTTL = 10 * time.Minute
+
+// oauthStateCookie binds a pending login to the browser that started it
+const oauthStateCookie = "oauth_state"
+
+var ErrInvalidOAuthState = errors.New("invalid or expired OAuth state")
+
+// OAuthState struct
+// A pending login: the PKCE verifier and where to send the user afterwards
+type OAuthState struct {
+	State     string    `bson:"_id"`
+	Verifier  string    `bson:"verifier"`
+	Redirect  string    `bson:"redirect"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// EnsureOAuthStateIndexes lets Mongo purge abandoned logins
+func EnsureOAuthStateIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("oauth_states").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// CreateOAuthState stores a new random state with its PKCE verifier
+func CreateOAuthState(ctx context.Context, db *mongo.Database, verifier, redirect string) (*OAuthState, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	state := OAuthState{
+		State:     base64.RawURLEncoding.EncodeToString(buf),
+		Verifier:  verifier,
+		Redirect:  redirect,
+		CreatedAt: now,
+		ExpiresAt: now.Add(oauthStateTTL),
+	}
+	if _, err := db.Collection("oauth_states").InsertOne(ctx, state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// ConsumeOAuthState atomically removes and returns a pending state, so it can be used only once
+func ConsumeOAuthState(ctx context.Context, db *mongo.Database, state string) (*OAuthState, error) {
+	var pending OAuthState
+	err := db.Collection("oauth_states").FindOneAndDelete(ctx, bson.M{
+		"_id":       state,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&pending)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidOAuthState
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+// safeRedirectPath only accepts paths within the frontend, to avoid open redirects
+func safeRedirectPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, "\\") {
+		return "/chat"
+	}
+	return path
+}
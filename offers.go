@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MessageTypeOffer marks a message carrying a price offer; plain messages have no type
+const MessageTypeOffer = "offer"
+
+// Offer statuses. Only pending offers can be answered.
+const (
+	OfferStatusPending   = "pending"
+	OfferStatusAccepted  = "accepted"
+	OfferStatusRejected  = "rejected"
+	OfferStatusCountered = "countered"
+	OfferStatusExpired   = "expired"
+)
+
+const (
+	// defaultOfferTTL is how long an offer can be answered when no expiry is given
+	defaultOfferTTL = 24 * time.Hour
+	// maxOfferTTL bounds the expiry chosen by the proposer
+	maxOfferTTL = 7 * 24 * time.Hour
+	// offerExpiryInterval is how often expired offers are closed
+	offerExpiryInterval = time.Minute
+)
+
+var (
+	ErrOfferNotFound     = errors.New("offer not found")
+	ErrOfferClosed       = errors.New("offer is no longer pending")
+	ErrOfferPending      = errors.New("an offer is already pending in this room")
+	ErrOwnOffer          = errors.New("cannot answer your own offer")
+	ErrOfferNotBuyer     = errors.New("only the buyer can open an offer, the seller answers with a counter-offer")
+	ErrPostNotAvailable  = errors.New("post is no longer available")
+	ErrInvalidOfferPrice = errors.New("offer price must be positive")
+)
+
+// Offer is the price proposal carried by an offer message. The message sender is the proposer.
+type Offer struct {
+	Price       int                 `bson:"price" json:"price"`
+	Status      string              `bson:"status" json:"status"`
+	ExpiresAt   time.Time           `bson:"expiresAt" json:"expiresAt"`
+	CounterOf   *primitive.ObjectID `bson:"counterOf,omitempty" json:"counterOf,omitempty"`
+	RespondedBy *primitive.ObjectID `bson:"respondedBy,omitempty" json:"respondedBy,omitempty"`
+	RespondedAt *time.Time          `bson:"respondedAt,omitempty" json:"respondedAt,omitempty"`
+}
+
+// EnsureOfferIndexes creates the index used to find pending and expired offers, and
+// keeps one pending offer per room even when two are sent at once
+func EnsureOfferIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("messages").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "offer.status", Value: 1}, {Key: "offer.expiresAt", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"type": MessageTypeOffer}),
+		},
+		{
+			Keys: bson.D{{Key: "roomId", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+				"type": MessageTypeOffer, "offer.status": OfferStatusPending,
+			}),
+		},
+	})
+	return err
+}
+
+// offerContent is the text of an offer message, used in previews, notifications and search
+func offerContent(price int, counter bool) string {
+	if counter {
+		return "Trả giá: " + FormatVND(price)
+	}
+	return "Đề nghị giá: " + FormatVND(price)
+}
+
+// MakeOffer sends a new offer of the buyer. A room has at most one pending offer: a
+// pending offer past its expiry is closed first, and the unique index on pending offers
+// refuses an offer sent at the same time as another one.
+func MakeOffer(ctx context.Context, db *mongo.Database, room *ChatRoom, senderID primitive.ObjectID, price int, ttl time.Duration) (*Message, error) {
+	if senderID != room.BuyerID {
+		return nil, ErrOfferNotBuyer
+	}
+	var pending Message
+	err := db.Collection("messages").FindOne(ctx,
+		bson.M{"roomId": room.ID, "type": MessageTypeOffer, "offer.status": OfferStatusPending},
+	).Decode(&pending)
+	switch {
+	case err == nil && pending.Offer != nil && pending.Offer.ExpiresAt.After(time.Now()):
+		return nil, ErrOfferPending
+	case err == nil:
+		if _, err := closeOffer(ctx, db, pending.ID, OfferStatusExpired, nil); err != nil && err != ErrOfferClosed {
+			return nil, err
+		}
+	case err != mongo.ErrNoDocuments:
+		return nil, err
+	}
+	if _, err := loadAvailablePost(ctx, db, room); err != nil {
+		return nil, err
+	}
+	return sendOffer(ctx, db, room, senderID, price, ttl, nil)
+}
+
+// loadAvailablePost loads the post of a room; prices can only be agreed while it is active
+func loadAvailablePost(ctx context.Context, db *mongo.Database, room *ChatRoom) (*Post, error) {
+	var post Post
+	if err := db.Collection("posts").FindOne(ctx, bson.M{"_id": room.PostID}).Decode(&post); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrPostNotAvailable
+		}
+		return nil, err
+	}
+	if statusOf(&post) != PostStatusActive {
+		return nil, ErrPostNotAvailable
+	}
+	return &post, nil
+}
+
+// sendOffer stores and delivers an offer message
+func sendOffer(ctx context.Context, db *mongo.Database, room *ChatRoom, senderID primitive.ObjectID, price int, ttl time.Duration, counterOf *primitive.ObjectID) (*Message, error) {
+	if price <= 0 {
+		return nil, ErrInvalidOfferPrice
+	}
+	if ttl <= 0 || ttl > maxOfferTTL {
+		ttl = defaultOfferTTL
+	}
+
+	now := time.Now()
+	msg := Message{
+		ID:        primitive.NewObjectID(),
+		RoomID:    room.ID,
+		SenderID:  senderID,
+		Type:      MessageTypeOffer,
+		Content:   offerContent(price, counterOf != nil),
+		CreatedAt: now,
+		Offer: &Offer{
+			Price:     price,
+			Status:    OfferStatusPending,
+			ExpiresAt: now.Add(ttl),
+			CounterOf: counterOf,
+		},
+	}
+	if _, err := SendMessage(ctx, db, room, msg); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrOfferPending
+		}
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// closeOffer moves a pending offer to a final status, failing if it was answered or expired meanwhile
+func closeOffer(ctx context.Context, db *mongo.Database, offerID primitive.ObjectID, status string, by *primitive.ObjectID) (*Message, error) {
+	now := time.Now()
+	set := bson.M{"offer.status": status, "offer.respondedAt": now}
+	if by != nil {
+		set["offer.respondedBy"] = *by
+	}
+
+	filter := bson.M{"_id": offerID, "type": MessageTypeOffer, "offer.status": OfferStatusPending}
+	if status != OfferStatusExpired {
+		filter["offer.expiresAt"] = bson.M{"$gt": now}
+	}
+
+	var msg Message
+	err := db.Collection("messages").FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOfferClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	chatHub.Publish(msg.RoomID, ChatEvent{Type: "offer", RoomID: msg.RoomID.Hex(), Message: &msg})
+	return &msg, nil
+}
+
+// loadOffer loads an offer of a room and checks the user may answer it
+func loadOffer(ctx context.Context, db *mongo.Database, room *ChatRoom, offerID, userID primitive.ObjectID) (*Message, error) {
+	var msg Message
+	err := db.Collection("messages").FindOne(ctx, bson.M{"_id": offerID, "roomId": room.ID, "type": MessageTypeOffer}).Decode(&msg)
+	if err == mongo.ErrNoDocuments || (err == nil && msg.Offer == nil) {
+		return nil, ErrOfferNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg.SenderID == userID {
+		return nil, ErrOwnOffer
+	}
+	if msg.Offer.Status != OfferStatusPending {
+		return nil, ErrOfferClosed
+	}
+	if !msg.Offer.ExpiresAt.After(time.Now()) {
+		if _, err := closeOffer(ctx, db, offerID, OfferStatusExpired, nil); err != nil && err != ErrOfferClosed {
+			log.Printf("Warning: Error expiring offer %s: %v", offerID.Hex(), err)
+		}
+		return nil, ErrOfferClosed
+	}
+	return &msg, nil
+}
+
+// RejectOffer declines a pending offer of the other participant
+func RejectOffer(ctx context.Context, db *mongo.Database, room *ChatRoom, offerID, userID primitive.ObjectID) (*Message, error) {
+	if _, err := loadOffer(ctx, db, room, offerID, userID); err != nil {
+		return nil, err
+	}
+	return closeOffer(ctx, db, offerID, OfferStatusRejected, &userID)
+}
+
+// CounterOffer declines a pending offer and proposes another price in its place
+func CounterOffer(ctx context.Context, db *mongo.Database, room *ChatRoom, offerID, userID primitive.ObjectID, price int, ttl time.Duration) (*Message, error) {
+	if price <= 0 {
+		return nil, ErrInvalidOfferPrice
+	}
+	if _, err := loadOffer(ctx, db, room, offerID, userID); err != nil {
+		return nil, err
+	}
+	if _, err := loadAvailablePost(ctx, db, room); err != nil {
+		return nil, err
+	}
+	if _, err := closeOffer(ctx, db, offerID, OfferStatusCountered, &userID); err != nil {
+		return nil, err
+	}
+	return sendOffer(ctx, db, room, userID, price, ttl, &offerID)
+}
+
+// AcceptOffer agrees on the offered price: the post is reserved and the price is recorded on the room
+func AcceptOffer(ctx context.Context, db *mongo.Database, room *ChatRoom, offerID, userID primitive.ObjectID) (*Message, error) {
+	if _, err := loadOffer(ctx, db, room, offerID, userID); err != nil {
+		return nil, err
+	}
+
+	post, err := loadAvailablePost(ctx, db, room)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := closeOffer(ctx, db, offerID, OfferStatusAccepted, &userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SetPostStatus(ctx, db, post, PostStatusReserved); err != nil {
+		// The post was taken in the meantime: the offer is open again
+		_, undoErr := db.Collection("messages").UpdateOne(ctx,
+			bson.M{"_id": offerID, "offer.status": OfferStatusAccepted},
+			bson.M{
+				"$set":   bson.M{"offer.status": OfferStatusPending},
+				"$unset": bson.M{"offer.respondedBy": "", "offer.respondedAt": ""},
+			})
+		if undoErr != nil {
+			log.Printf("Warning: Error reopening offer %s: %v", offerID.Hex(), undoErr)
+		}
+		if err == ErrPostChanged || err == ErrInvalidPostTransition {
+			return nil, ErrPostNotAvailable
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	_, err = db.Collection("chatrooms").UpdateOne(ctx,
+		bson.M{"_id": room.ID},
+		bson.M{"$set": bson.M{"agreedPrice": msg.Offer.Price, "agreedOfferId": offerID, "agreedAt": now}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	room.AgreedPrice, room.AgreedOfferID, room.AgreedAt = msg.Offer.Price, &offerID, &now
+	agreeDealOnOffer(ctx, db, room, msg.SenderID, userID, msg.Offer.Price)
+
+	if err := ClassifyChatMessage(ctx, db, offerID, "agreement"); err != nil {
+		log.Printf("Warning: Error labelling accepted offer: %v", err)
+	}
+	return msg, nil
+}
+
+// ExpireOffers closes the pending offers past their expiry
+func ExpireOffers(ctx context.Context, db *mongo.Database) (int, error) {
+	cursor, err := db.Collection("messages").Find(ctx,
+		bson.M{"type": MessageTypeOffer, "offer.status": OfferStatusPending, "offer.expiresAt": bson.M{"$lte": time.Now()}},
+		options.Find().SetLimit(500).SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var offers []Message
+	if err := cursor.All(ctx, &offers); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, offer := range offers {
+		_, err := closeOffer(ctx, db, offer.ID, OfferStatusExpired, nil)
+		if err == ErrOfferClosed {
+			// Answered in the meantime
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// runOfferExpiry expires offers periodically until the context is cancelled
+func runOfferExpiry(ctx context.Context, db *mongo.Database) {
+	ticker := time.NewTicker(offerExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := ExpireOffers(ctx, db); err != nil {
+			log.Printf("Warning: Error expiring offers: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeOfferError maps offer errors to HTTP responses
+func writeOfferError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrOfferNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrOwnOffer), errors.Is(err, ErrOfferNotBuyer):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrOfferClosed), errors.Is(err, ErrOfferPending), errors.Is(err, ErrPostNotAvailable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidOfferPrice):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process offer", "detail": err.Error()})
+	}
+}
+
+// handleCreateOffer lets the buyer of a room propose a price.
+// Body: {"price": 15000000, "expiresInHours": 24}
+func handleCreateOffer(c *gin.Context) {
+	var req struct {
+		Price          int `json:"price" binding:"required"`
+		ExpiresInHours int `json:"expiresInHours"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	roomID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	userID := currentUser(c).ID
+	room := loadRoomForParticipant(c, roomID, userID)
+	if room == nil {
+		return
+	}
+
+	msg, err := MakeOffer(c.Request.Context(), mongoDB, room, userID, req.Price, time.Duration(req.ExpiresInHours)*time.Hour)
+	if err != nil {
+		writeOfferError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": msg})
+}
+
+// handleRespondOffer accepts, rejects or counters the pending offer of the other participant.
+// Body: {"action": "accept" | "reject" | "counter", "price": 14000000, "expiresInHours": 24}
+func handleRespondOffer(c *gin.Context) {
+	var req struct {
+		Action         string `json:"action" binding:"required,oneof=accept reject counter"`
+		Price          int    `json:"price"`
+		ExpiresInHours int    `json:"expiresInHours"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	roomID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	offerID, err := primitive.ObjectIDFromHex(c.Param("offerId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offer ID"})
+		return
+	}
+	userID := currentUser(c).ID
+	room := loadRoomForParticipant(c, roomID, userID)
+	if room == nil {
+		return
+	}
+
+	ctx := c.Request.Context()
+	var msg *Message
+	switch req.Action {
+	case "accept":
+		msg, err = AcceptOffer(ctx, mongoDB, room, offerID, userID)
+	case "reject":
+		msg, err = RejectOffer(ctx, mongoDB, room, offerID, userID)
+	case "counter":
+		msg, err = CounterOffer(ctx, mongoDB, room, offerID, userID, req.Price, time.Duration(req.ExpiresInHours)*time.Hour)
+	}
+	if err != nil {
+		writeOfferError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": msg, "chatRoom": room})
+}
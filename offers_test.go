@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// mockDocument converts a value to the document a mocked server returns
+func mockDocument(t testing.TB, v interface{}) bson.D {
+	t.Helper()
+	data, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestOfferContent(t *testing.T) {
+	tests := []struct {
+		price   int
+		counter bool
+		want    string
+	}{
+		{15000000, false, "Đề nghị giá: 15.000.000đ"},
+		{14500000, true, "Trả giá: 14.500.000đ"},
+	}
+	for _, tt := range tests {
+		if got := offerContent(tt.price, tt.counter); got != tt.want {
+			t.Errorf("offerContent(%d, %v) = %q, want %q", tt.price, tt.counter, got, tt.want)
+		}
+	}
+}
+
+func TestWriteOfferError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrOfferNotFound, http.StatusNotFound},
+		{ErrOwnOffer, http.StatusForbidden},
+		{ErrOfferNotBuyer, http.StatusForbidden},
+		{ErrOfferClosed, http.StatusConflict},
+		{ErrOfferPending, http.StatusConflict},
+		{fmt.Errorf("accepting: %w", ErrPostNotAvailable), http.StatusConflict},
+		{ErrInvalidOfferPrice, http.StatusBadRequest},
+		{errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeOfferError(c, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("writeOfferError(%v) = %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
+
+func TestOfferRules(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	buyerID, sellerID := primitive.NewObjectID(), primitive.NewObjectID()
+	room := &ChatRoom{ID: primitive.NewObjectID(), BuyerID: buyerID, SellerID: sellerID, PostID: primitive.NewObjectID()}
+	offer := func(senderID primitive.ObjectID, status string, expiresIn time.Duration) Message {
+		return Message{
+			ID:       primitive.NewObjectID(),
+			RoomID:   room.ID,
+			SenderID: senderID,
+			Type:     MessageTypeOffer,
+			Offer:    &Offer{Price: 15000000, Status: status, ExpiresAt: time.Now().Add(expiresIn)},
+		}
+	}
+	cursor := func(mt *mtest.T, docs ...bson.D) bson.D {
+		return mtest.CreateCursorResponse(0, mt.DB.Name()+".messages", mtest.FirstBatch, docs...)
+	}
+
+	mt.Run("only the buyer opens offers", func(mt *mtest.T) {
+		if _, err := MakeOffer(context.Background(), mt.DB, room, sellerID, 15000000, 0); !errors.Is(err, ErrOfferNotBuyer) {
+			mt.Errorf("err = %v, want ErrOfferNotBuyer", err)
+		}
+	})
+
+	mt.Run("one pending offer per room", func(mt *mtest.T) {
+		mt.AddMockResponses(cursor(mt, mockDocument(mt, offer(buyerID, OfferStatusPending, time.Hour))))
+		if _, err := MakeOffer(context.Background(), mt.DB, room, buyerID, 15000000, 0); !errors.Is(err, ErrOfferPending) {
+			mt.Errorf("err = %v, want ErrOfferPending", err)
+		}
+	})
+
+	mt.Run("concurrent offer is refused", func(mt *mtest.T) {
+		post := Post{ID: room.PostID, Status: PostStatusActive}
+		mt.AddMockResponses(
+			cursor(mt),
+			cursor(mt, mockDocument(mt, post)),
+			// The other offer was inserted between the check and this insert
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}),
+		)
+		if _, err := MakeOffer(context.Background(), mt.DB, room, buyerID, 15000000, 0); !errors.Is(err, ErrOfferPending) {
+			mt.Errorf("err = %v, want ErrOfferPending", err)
+		}
+	})
+
+	mt.Run("expired pending offer is closed first", func(mt *mtest.T) {
+		expired := offer(buyerID, OfferStatusPending, -time.Minute)
+		closed := expired
+		closed.Offer = &Offer{Price: expired.Offer.Price, Status: OfferStatusExpired, ExpiresAt: expired.Offer.ExpiresAt}
+		post := Post{ID: room.PostID, Status: PostStatusSold}
+		mt.AddMockResponses(
+			cursor(mt, mockDocument(mt, expired)),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, closed)}),
+			cursor(mt, mockDocument(mt, post)),
+		)
+		if _, err := MakeOffer(context.Background(), mt.DB, room, buyerID, 15000000, 0); !errors.Is(err, ErrPostNotAvailable) {
+			mt.Errorf("err = %v, want the post checked after the expired offer was closed", err)
+		}
+		events := mt.GetAllStartedEvents()
+		if len(events) < 2 || events[1].CommandName != "findAndModify" {
+			mt.Errorf("the expired offer was not closed")
+		}
+	})
+
+	mt.Run("post must be active", func(mt *mtest.T) {
+		post := Post{ID: room.PostID, Status: PostStatusSold}
+		mt.AddMockResponses(cursor(mt), cursor(mt, mockDocument(mt, post)))
+		if _, err := MakeOffer(context.Background(), mt.DB, room, buyerID, 15000000, 0); !errors.Is(err, ErrPostNotAvailable) {
+			mt.Errorf("err = %v, want ErrPostNotAvailable", err)
+		}
+	})
+
+	mt.Run("counter-offers need a price", func(mt *mtest.T) {
+		if _, err := CounterOffer(context.Background(), mt.DB, room, primitive.NewObjectID(), sellerID, 0, 0); !errors.Is(err, ErrInvalidOfferPrice) {
+			mt.Errorf("err = %v, want ErrInvalidOfferPrice", err)
+		}
+	})
+
+	answers := []struct {
+		name  string
+		offer *Message
+		err   error
+	}{
+		{"unknown offer", nil, ErrOfferNotFound},
+		{"own offer", ptr(offer(sellerID, OfferStatusPending, time.Hour)), ErrOwnOffer},
+		{"answered offer", ptr(offer(buyerID, OfferStatusAccepted, time.Hour)), ErrOfferClosed},
+		{"countered offer", ptr(offer(buyerID, OfferStatusCountered, time.Hour)), ErrOfferClosed},
+	}
+	for _, tt := range answers {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			if tt.offer == nil {
+				mt.AddMockResponses(cursor(mt))
+			} else {
+				mt.AddMockResponses(cursor(mt, mockDocument(mt, *tt.offer)))
+			}
+			if _, err := RejectOffer(context.Background(), mt.DB, room, primitive.NewObjectID(), sellerID); !errors.Is(err, tt.err) {
+				mt.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	mt.Run("expired offer is closed", func(mt *mtest.T) {
+		expired := offer(buyerID, OfferStatusPending, -time.Minute)
+		closed := expired
+		closed.Offer = &Offer{Price: 15000000, Status: OfferStatusExpired, ExpiresAt: expired.Offer.ExpiresAt}
+		mt.AddMockResponses(
+			cursor(mt, mockDocument(mt, expired)),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, closed)}),
+		)
+		if _, err := RejectOffer(context.Background(), mt.DB, room, expired.ID, sellerID); !errors.Is(err, ErrOfferClosed) {
+			mt.Errorf("err = %v, want ErrOfferClosed", err)
+		}
+		if started := mt.GetAllStartedEvents(); len(started) != 2 || started[1].CommandName != "findAndModify" {
+			mt.Errorf("the expired offer was not closed")
+		}
+	})
+
+	mt.Run("reject", func(mt *mtest.T) {
+		pending := offer(buyerID, OfferStatusPending, time.Hour)
+		rejected := pending
+		rejected.Offer = &Offer{Price: 15000000, Status: OfferStatusRejected, ExpiresAt: pending.Offer.ExpiresAt, RespondedBy: &sellerID}
+		mt.AddMockResponses(
+			cursor(mt, mockDocument(mt, pending)),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, rejected)}),
+		)
+		msg, err := RejectOffer(context.Background(), mt.DB, room, pending.ID, sellerID)
+		if err != nil {
+			mt.Fatalf("RejectOffer: %v", err)
+		}
+		if msg.Offer.Status != OfferStatusRejected || msg.Offer.RespondedBy == nil || *msg.Offer.RespondedBy != sellerID {
+			mt.Errorf("offer = %+v, want rejected by the seller", msg.Offer)
+		}
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outbox event types. Events only carry the ID of what changed: the worker reads the
+// current state from MongoDB, so replaying or reordering events is harmless.
+const (
+	OutboxIndexMessage       = "index_message"        // a chat message was created or classified
+	OutboxIndexPost          = "index_post"           // a post was created, edited or changed status
+	OutboxSyncPostMessages   = "sync_post_messages"   // the chat messages about a post need its new details
+	OutboxSyncUserReputation = "sync_user_reputation" // the posts of a user need their new reputation
+	OutboxIndexSavedSearch   = "index_saved_search"   // a saved search was created or deleted
+)
+
+// Outbox event statuses. Dead events failed too many times and wait for a reindex.
+const (
+	OutboxStatusPending    = "pending"
+	OutboxStatusProcessing = "processing"
+	OutboxStatusDone       = "done"
+	OutboxStatusDead       = "dead"
+)
+
+const (
+	// outboxPollInterval is how often the worker looks for due events when not woken up
+	outboxPollInterval = 5 * time.Second
+	// outboxLease is how long a claimed event is reserved before another worker may take it
+	outboxLease = time.Minute
+	// outboxMaxAttempts is the number of failures after which an event is dead-lettered
+	outboxMaxAttempts = 10
+	// outboxBaseDelay and outboxMaxDelay bound the exponential backoff between attempts
+	outboxBaseDelay = 2 * time.Second
+	outboxMaxDelay  = 10 * time.Minute
+	// outboxRetention is how long processed events are kept
+	outboxRetention = 7 * 24 * time.Hour
+	// outboxBatch is the number of events the worker drains before looking again
+	outboxBatch = 100
+	// outboxConcurrency is the number of events processed at once
+	outboxConcurrency = 32
+)
+
+// OutboxEvent struct
+// A change to mirror to Elasticsearch, recorded with the MongoDB write it comes from
+type OutboxEvent struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Type          string             `bson:"type" json:"type"`
+	AggregateID   primitive.ObjectID `bson:"aggregateId" json:"aggregateId"`
+	Status        string             `bson:"status" json:"status"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	LockedUntil   *time.Time         `bson:"lockedUntil,omitempty" json:"-"`
+	LastError     string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	ProcessedAt   *time.Time         `bson:"processedAt,omitempty" json:"processedAt,omitempty"`
+}
+
+// IndexingLag reports how far Elasticsearch is behind MongoDB
+type IndexingLag struct {
+	Pending         int64      `json:"pending"`
+	Retrying        int64      `json:"retrying"`
+	Dead            int64      `json:"dead"`
+	OldestPendingAt *time.Time `json:"oldestPendingAt,omitempty"`
+	// LagSeconds is the age of the oldest event not yet indexed, 0 when caught up
+	LagSeconds      float64       `json:"lagSeconds"`
+	LastProcessedAt *time.Time    `json:"lastProcessedAt,omitempty"`
+	RecentDead      []OutboxEvent `json:"recentDead"`
+	// Bulk reports the throughput and failures of the bulk indexer
+	Bulk *BulkIndexerStats `json:"bulk,omitempty"`
+}
+
+// mongoTransactions is set in main when MongoDB can run transactions (replica set or
+// sharded cluster); on a standalone server the writes are made one after the other
+var mongoTransactions bool
+
+// outboxWake nudges the worker after a commit, so events are indexed without waiting for the next poll
+var outboxWake = make(chan struct{}, 1)
+
+// EnsureOutboxIndexes creates the indexes used to claim events and report lag,
+// and expires processed events
+func EnsureOutboxIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("outbox").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "processedAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(outboxRetention.Seconds())),
+		},
+	})
+	return err
+}
+
+// SupportsTransactions reports whether the server is a replica set member or a mongos
+func SupportsTransactions(ctx context.Context, client *mongo.Client) bool {
+	var hello bson.M
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false
+	}
+	_, replicaSet := hello["setName"]
+	return replicaSet || hello["msg"] == "isdbgrid"
+}
+
+// withTransaction runs fn in a transaction when the server supports it, and directly
+// otherwise. fn may be run again when the transaction is retried.
+func withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !mongoTransactions {
+		return fn(ctx)
+	}
+	session, err := mongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// enqueueOutbox records an event, with the context of the write's transaction.
+// Nothing is recorded when Elasticsearch is not configured.
+func enqueueOutbox(ctx context.Context, db *mongo.Database, eventType string, aggregateID primitive.ObjectID) error {
+	if ElasticClient == nil {
+		return nil
+	}
+	now := time.Now()
+	_, err := db.Collection("outbox").InsertOne(ctx, OutboxEvent{
+		ID:            primitive.NewObjectID(),
+		Type:          eventType,
+		AggregateID:   aggregateID,
+		Status:        OutboxStatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	return err
+}
+
+// wakeOutbox tells the worker new events were committed
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// outboxBackoff is the delay before the next attempt after a number of failures,
+// doubling from outboxBaseDelay up to outboxMaxDelay, with jitter
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxMaxDelay
+	if attempts < 20 {
+		delay = min(outboxBaseDelay<<(attempts-1), outboxMaxDelay)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// claimOutboxEvent reserves the next due event, including events whose worker died
+func claimOutboxEvent(ctx context.Context, db *mongo.Database) (*OutboxEvent, error) {
+	now := time.Now()
+	var event OutboxEvent
+	err := db.Collection("outbox").FindOneAndUpdate(ctx,
+		bson.M{"$or": []bson.M{
+			{"status": OutboxStatusPending, "nextAttemptAt": bson.M{"$lte": now}},
+			{"status": OutboxStatusProcessing, "lockedUntil": bson.M{"$lte": now}},
+		}},
+		bson.M{"$set": bson.M{"status": OutboxStatusProcessing, "lockedUntil": now.Add(outboxLease)}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&event)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// processOutboxEvent mirrors the current MongoDB state of the event's aggregate to Elasticsearch
+func processOutboxEvent(ctx context.Context, db *mongo.Database, event *OutboxEvent) error {
+	switch event.Type {
+	case OutboxIndexMessage:
+		var msg Message
+		if err := db.Collection("messages").FindOne(ctx, bson.M{"_id": event.AggregateID}).Decode(&msg); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			return err
+		}
+		var room ChatRoom
+		if err := db.Collection("chatrooms").FindOne(ctx, bson.M{"_id": msg.RoomID}).Decode(&room); err != nil {
+			return err
+		}
+		var post Post
+		if err := db.Collection("posts").FindOne(ctx, bson.M{"_id": room.PostID}).Decode(&post); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		return IndexChatMessage(ctx, msg, &room, &post)
+
+	case OutboxIndexPost:
+		var post Post
+		err := db.Collection("posts").FindOne(ctx, bson.M{"_id": event.AggregateID}).Decode(&post)
+		if err == mongo.ErrNoDocuments || (err == nil && statusOf(&post) == PostStatusDeleted) {
+			return DeletePostIndex(ctx, event.AggregateID.Hex())
+		}
+		if err != nil {
+			return err
+		}
+		return IndexPost(ctx, &post)
+
+	case OutboxSyncPostMessages:
+		var post Post
+		if err := db.Collection("posts").FindOne(ctx, bson.M{"_id": event.AggregateID}).Decode(&post); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			return err
+		}
+		return updateChatMessagesPost(ctx, &post)
+
+	case OutboxSyncUserReputation:
+		var user User
+		if err := db.Collection("users").FindOne(ctx, bson.M{"_id": event.AggregateID}).Decode(&user); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			return err
+		}
+		return updatePostsReputation(ctx, user.ID, reputationScore(user.Reputation))
+
+	case OutboxIndexSavedSearch:
+		var search SavedSearch
+		err := db.Collection("saved_searches").FindOne(ctx, bson.M{"_id": event.AggregateID}).Decode(&search)
+		if err == mongo.ErrNoDocuments {
+			return deleteSavedSearchIndex(ctx, event.AggregateID.Hex())
+		}
+		if err != nil {
+			return err
+		}
+		return indexSavedSearch(ctx, &search)
+
+	default:
+		return fmt.Errorf("unknown outbox event type %q", event.Type)
+	}
+}
+
+// completeOutboxEvent records the result of an attempt: done, retried later with
+// backoff, or dead after outboxMaxAttempts failures
+func completeOutboxEvent(ctx context.Context, db *mongo.Database, event *OutboxEvent, failure error) error {
+	now := time.Now()
+	update := bson.M{"$unset": bson.M{"lockedUntil": ""}}
+	switch attempts := event.Attempts + 1; {
+	case failure == nil:
+		update["$set"] = bson.M{"status": OutboxStatusDone, "processedAt": now, "attempts": attempts}
+	case attempts >= outboxMaxAttempts:
+		update["$set"] = bson.M{"status": OutboxStatusDead, "attempts": attempts, "lastError": failure.Error()}
+	default:
+		update["$set"] = bson.M{
+			"status":        OutboxStatusPending,
+			"attempts":      attempts,
+			"lastError":     failure.Error(),
+			"nextAttemptAt": now.Add(outboxBackoff(attempts)),
+		}
+	}
+	_, err := db.Collection("outbox").UpdateOne(ctx, bson.M{"_id": event.ID, "status": OutboxStatusProcessing}, update)
+	return err
+}
+
+// DrainOutbox processes the due events, at most limit of them, and returns how many succeeded.
+// Up to outboxConcurrency events are processed at once so their documents share bulk
+// requests. Claimed events are finished even when ctx is cancelled.
+func DrainOutbox(ctx context.Context, db *mongo.Database, limit int) (int, error) {
+	var processed atomic.Int64
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var completeErr error
+	slots := make(chan struct{}, outboxConcurrency)
+	finishCtx := context.WithoutCancel(ctx)
+
+	var claimErr error
+	for i := 0; i < limit; i++ {
+		slots <- struct{}{}
+		event, err := claimOutboxEvent(ctx, db)
+		if err != nil {
+			<-slots
+			if err != mongo.ErrNoDocuments {
+				claimErr = err
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			eventCtx, cancel := context.WithTimeout(finishCtx, outboxLease/2)
+			failure := processOutboxEvent(eventCtx, db, event)
+			cancel()
+			if failure != nil {
+				log.Printf("Warning: Error processing outbox event %s (%s %s, attempt %d): %v",
+					event.ID.Hex(), event.Type, event.AggregateID.Hex(), event.Attempts+1, failure)
+			} else {
+				processed.Add(1)
+			}
+			if err := completeOutboxEvent(finishCtx, db, event, failure); err != nil {
+				mu.Lock()
+				completeErr = err
+				mu.Unlock()
+			}
+		}()
+
+		mu.Lock()
+		failed := completeErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+	}
+	wg.Wait()
+
+	if claimErr == nil {
+		claimErr = completeErr
+	}
+	return int(processed.Load()), claimErr
+}
+
+// runOutbox drains the outbox into Elasticsearch until the context is cancelled
+func runOutbox(ctx context.Context, db *mongo.Database) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep draining while full batches come back
+		for {
+			n, err := DrainOutbox(ctx, db, outboxBatch)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Warning: Error draining outbox: %v", err)
+			}
+			if err != nil || n < outboxBatch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-outboxWake:
+		}
+	}
+}
+
+// GetIndexingLag reports the events waiting to be indexed and the dead ones
+func GetIndexingLag(ctx context.Context, db *mongo.Database) (*IndexingLag, error) {
+	outbox := db.Collection("outbox")
+	notDone := bson.M{"$in": bson.A{OutboxStatusPending, OutboxStatusProcessing}}
+	lag := &IndexingLag{RecentDead: []OutboxEvent{}}
+
+	var err error
+	if lag.Pending, err = outbox.CountDocuments(ctx, bson.M{"status": notDone}); err != nil {
+		return nil, err
+	}
+	if lag.Retrying, err = outbox.CountDocuments(ctx, bson.M{"status": notDone, "attempts": bson.M{"$gt": 0}}); err != nil {
+		return nil, err
+	}
+	if lag.Dead, err = outbox.CountDocuments(ctx, bson.M{"status": OutboxStatusDead}); err != nil {
+		return nil, err
+	}
+
+	var oldest OutboxEvent
+	err = outbox.FindOne(ctx, bson.M{"status": notDone}, options.FindOne().SetSort(bson.M{"createdAt": 1})).Decode(&oldest)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if err == nil {
+		lag.OldestPendingAt = &oldest.CreatedAt
+		lag.LagSeconds = time.Since(oldest.CreatedAt).Seconds()
+	}
+
+	var last OutboxEvent
+	err = outbox.FindOne(ctx, bson.M{"status": OutboxStatusDone}, options.FindOne().SetSort(bson.M{"processedAt": -1})).Decode(&last)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if err == nil {
+		lag.LastProcessedAt = last.ProcessedAt
+	}
+
+	// Every user can read the report: the errors of dead events stay in the database and
+	// the logs, as they may hold internal details
+	cursor, err := outbox.Find(ctx, bson.M{"status": OutboxStatusDead}, options.Find().
+		SetSort(bson.M{"createdAt": -1}).
+		SetLimit(20).
+		SetProjection(bson.M{"lastError": 0}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &lag.RecentDead); err != nil {
+		return nil, err
+	}
+	return lag, nil
+}
+
+// handleGetIndexingLag reports how far the search indices are behind the database
+func handleGetIndexingLag(c *gin.Context) {
+	lag, err := GetIndexingLag(c.Request.Context(), mongoDB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute indexing lag", "detail": err.Error()})
+		return
+	}
+	if searchIndexer != nil {
+		stats := searchIndexer.Stats()
+		stats.LastError = ""
+		lag.Bulk = &stats
+	}
+	c.JSON(http.StatusOK, gin.H{"indexing": lag})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		min, max time.Duration
+	}{
+		{1, time.Second, 2 * time.Second},
+		{2, 2 * time.Second, 4 * time.Second},
+		{3, 4 * time.Second, 8 * time.Second},
+		{9, 256 * time.Second, 512 * time.Second},
+		{10, outboxMaxDelay / 2, outboxMaxDelay},
+		{19, outboxMaxDelay / 2, outboxMaxDelay},
+		// Past the shift guard the delay does not overflow
+		{20, outboxMaxDelay / 2, outboxMaxDelay},
+		{64, outboxMaxDelay / 2, outboxMaxDelay},
+	}
+	for _, tt := range tests {
+		// The jitter is random, sample it
+		for i := 0; i < 100; i++ {
+			if got := outboxBackoff(tt.attempts); got < tt.min || got > tt.max {
+				t.Errorf("outboxBackoff(%d) = %v, want between %v and %v", tt.attempts, got, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
+
+// outboxUpdate returns the filter and update of the last update sent to the outbox
+func outboxUpdate(mt *mtest.T) (filter, update bson.Raw) {
+	events := mt.GetAllStartedEvents()
+	last := events[len(events)-1]
+	if last.CommandName != "update" || last.Command.Lookup("update").StringValue() != "outbox" {
+		mt.Fatalf("last command = %s, want an outbox update", last.CommandName)
+	}
+	statement := last.Command.Lookup("updates").Array().Index(0).Value().Document()
+	return statement.Lookup("q").Document(), statement.Lookup("u").Document()
+}
+
+func TestCompleteOutboxEvent(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name     string
+		attempts int
+		failure  error
+		status   string
+	}{
+		{"success", 0, nil, OutboxStatusDone},
+		{"success after failures", 4, nil, OutboxStatusDone},
+		{"first failure", 0, errors.New("es down"), OutboxStatusPending},
+		{"retry failure", outboxMaxAttempts - 2, errors.New("es down"), OutboxStatusPending},
+		{"last failure", outboxMaxAttempts - 1, errors.New("es down"), OutboxStatusDead},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+			event := &OutboxEvent{ID: primitive.NewObjectID(), Type: OutboxIndexPost, Status: OutboxStatusProcessing, Attempts: tt.attempts}
+			before := time.Now().Truncate(time.Millisecond)
+			if err := completeOutboxEvent(context.Background(), mt.DB, event, tt.failure); err != nil {
+				mt.Fatal(err)
+			}
+
+			filter, update := outboxUpdate(mt)
+			if filter.Lookup("_id").ObjectID() != event.ID || filter.Lookup("status").StringValue() != OutboxStatusProcessing {
+				mt.Errorf("filter = %v, want the claimed event", filter)
+			}
+			if _, err := update.LookupErr("$unset", "lockedUntil"); err != nil {
+				mt.Errorf("update = %v, want the lease released", update)
+			}
+			set := update.Lookup("$set").Document()
+			if status := set.Lookup("status").StringValue(); status != tt.status {
+				mt.Errorf("status = %s, want %s", status, tt.status)
+			}
+			if attempts := set.Lookup("attempts").Int32(); int(attempts) != tt.attempts+1 {
+				mt.Errorf("attempts = %d, want %d", attempts, tt.attempts+1)
+			}
+
+			has := func(key string) bool {
+				_, err := set.LookupErr(key)
+				return err == nil
+			}
+			hasError, hasProcessedAt, hasNext := has("lastError"), has("processedAt"), has("nextAttemptAt")
+			switch tt.status {
+			case OutboxStatusDone:
+				if hasError || !hasProcessedAt || hasNext {
+					mt.Errorf("$set = %v, want processedAt only", set)
+				}
+			case OutboxStatusPending:
+				if !hasError || hasProcessedAt || !hasNext {
+					mt.Fatalf("$set = %v, want the error and the next attempt", set)
+				}
+				delay := set.Lookup("nextAttemptAt").Time().Sub(before)
+				backoff := min(outboxBaseDelay<<tt.attempts, outboxMaxDelay)
+				if delay < backoff/2-time.Millisecond || delay > backoff+time.Second {
+					mt.Errorf("next attempt in %v, want a backoff of up to %v", delay, backoff)
+				}
+			case OutboxStatusDead:
+				if !hasError || hasProcessedAt || hasNext {
+					mt.Errorf("$set = %v, want the error and no next attempt", set)
+				}
+			}
+		})
+	}
+}
+
+func TestDrainOutbox(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	// claimed returns the response of a claim finding event
+	claimed := func(mt *mtest.T, event OutboxEvent) bson.D {
+		event.Status = OutboxStatusProcessing
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, event)})
+	}
+	postID := primitive.NewObjectID()
+
+	mt.Run("nothing due", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		n, err := DrainOutbox(context.Background(), mt.DB, 10)
+		if n != 0 || err != nil {
+			mt.Errorf("DrainOutbox = %d, %v, want nothing", n, err)
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 1 {
+			mt.Errorf("commands = %d, want one claim", len(events))
+		}
+	})
+
+	// Each case drains one event so the claim and the update of the mock come in order
+	tests := []struct {
+		name      string
+		event     OutboxEvent
+		responses int // responses processing the event needs
+		processed int
+		status    string
+	}{
+		// The post is gone, there is nothing to sync
+		{"pending to done", OutboxEvent{Type: OutboxSyncPostMessages, AggregateID: postID}, 1, 1, OutboxStatusDone},
+		{"pending to retry", OutboxEvent{Type: "unknown"}, 0, 0, OutboxStatusPending},
+		{"retry to dead", OutboxEvent{Type: "unknown", Attempts: outboxMaxAttempts - 1}, 0, 0, OutboxStatusDead},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			tt.event.ID = primitive.NewObjectID()
+			responses := []bson.D{claimed(mt, tt.event)}
+			for i := 0; i < tt.responses; i++ {
+				responses = append(responses, mtest.CreateCursorResponse(0, mt.DB.Name()+".posts", mtest.FirstBatch))
+			}
+			responses = append(responses, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+			mt.AddMockResponses(responses...)
+
+			n, err := DrainOutbox(context.Background(), mt.DB, 1)
+			if err != nil {
+				mt.Fatal(err)
+			}
+			if n != tt.processed {
+				mt.Errorf("processed = %d, want %d", n, tt.processed)
+			}
+
+			claim := mt.GetStartedEvent()
+			if claim.CommandName != "findAndModify" {
+				mt.Fatalf("first command = %s, want the claim", claim.CommandName)
+			}
+			if status := claim.Command.Lookup("update", "$set", "status").StringValue(); status != OutboxStatusProcessing {
+				mt.Errorf("claimed as %s, want processing", status)
+			}
+			filter, update := outboxUpdate(mt)
+			if filter.Lookup("_id").ObjectID() != tt.event.ID {
+				mt.Errorf("completed %v, want the claimed event", filter)
+			}
+			if status := update.Lookup("$set", "status").StringValue(); status != tt.status {
+				mt.Errorf("status = %s, want %s", status, tt.status)
+			}
+		})
+	}
+
+	mt.Run("claim error", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11600, Message: "interrupted"}))
+		if _, err := DrainOutbox(context.Background(), mt.DB, 10); err == nil {
+			mt.Errorf("DrainOutbox ignored the claim error")
+		}
+	})
+}
+
+func TestGetIndexingLag(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("dead events without their errors", func(mt *mtest.T) {
+		ns := mt.DB.Name() + ".outbox"
+		count := func(n int) bson.D {
+			return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+		}
+		dead := OutboxEvent{ID: primitive.NewObjectID(), Type: OutboxIndexPost, Status: OutboxStatusDead, Attempts: outboxMaxAttempts}
+		mt.AddMockResponses(
+			count(2), count(1), count(1),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, mockDocument(mt, dead)),
+		)
+		lag, err := GetIndexingLag(context.Background(), mt.DB)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if lag.Pending != 2 || lag.Retrying != 1 || lag.Dead != 1 || len(lag.RecentDead) != 1 {
+			mt.Errorf("lag = %+v", lag)
+		}
+		events := mt.GetAllStartedEvents()
+		projection, err := events[len(events)-1].Command.LookupErr("projection", "lastError")
+		if err != nil || projection.Int32() != 0 {
+			mt.Errorf("dead events read with their lastError")
+		}
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// phoneCodeTTL is how long a verification code can be used
+	phoneCodeTTL = 10 * time.Minute
+	// phoneCodeResendDelay limits how often a code can be requested
+	phoneCodeResendDelay = time.Minute
+	// phoneCodeMaxAttempts bounds guesses before a new code must be requested
+	phoneCodeMaxAttempts = 5
+	// smsSendTimeout bounds notifications sent after the response
+	smsSendTimeout = 15 * time.Second
+)
+
+var (
+	ErrInvalidPhone     = errors.New("invalid Vietnamese phone number")
+	ErrInvalidPhoneCode = errors.New("invalid or expired verification code")
+	ErrPhoneCodeTooSoon = errors.New("a verification code was sent less than a minute ago")
+	ErrPhoneTaken       = errors.New("this phone number is already verified on another account")
+)
+
+// PhoneVerification struct
+// A pending phone number change, keyed by user; only the code hash is stored
+type PhoneVerification struct {
+	UserID    primitive.ObjectID `bson:"_id"`
+	Phone     string             `bson:"phone"`
+	CodeHash  string             `bson:"codeHash"`
+	Attempts  int                `bson:"attempts"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+// EnsurePhoneVerificationIndexes lets Mongo purge expired verification codes, and keeps
+// a phone number on one account at most
+func EnsurePhoneVerificationIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("phone_verifications").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "phone", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	return err
+}
+
+// normalizeVietnamesePhone converts "0912 345 678", "84912345678", "+84 912.345.678" or
+// "+84 0912 345 678" to E.164 ("+84912345678"). Only mobile prefixes are accepted.
+func normalizeVietnamesePhone(phone string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		if r == ' ' || r == '.' || r == '-' || r == '(' || r == ')' || r == '+' {
+			return -1
+		}
+		return 'x'
+	}, strings.TrimSpace(phone))
+
+	if strings.HasPrefix(digits, "84") && len(digits) > 10 {
+		digits = digits[2:]
+	}
+	// The trunk prefix is often kept after the country code
+	if strings.HasPrefix(digits, "0") {
+		digits = digits[1:]
+	}
+	if len(digits) != 9 || strings.ContainsRune(digits, 'x') || !strings.ContainsRune("35789", rune(digits[0])) {
+		return "", ErrInvalidPhone
+	}
+	return "+84" + digits, nil
+}
+
+// newPhoneCode returns a random 6 digit code
+func newPhoneCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// StartPhoneVerification sends a verification code to the phone number
+func StartPhoneVerification(ctx context.Context, db *mongo.Database, userID primitive.ObjectID, phone string) error {
+	phone, err := normalizeVietnamesePhone(phone)
+	if err != nil {
+		return err
+	}
+
+	var pending PhoneVerification
+	err = db.Collection("phone_verifications").FindOne(ctx, bson.M{"_id": userID}).Decode(&pending)
+	if err == nil && time.Since(pending.CreatedAt) < phoneCodeResendDelay {
+		return ErrPhoneCodeTooSoon
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	err = db.Collection("users").FindOne(ctx, bson.M{"phone": phone, "_id": bson.M{"$ne": userID}}).Err()
+	if err == nil {
+		return ErrPhoneTaken
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	code, err := newPhoneCode()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	verification := PhoneVerification{
+		UserID:    userID,
+		Phone:     phone,
+		CodeHash:  hashToken(code),
+		CreatedAt: now,
+		ExpiresAt: now.Add(phoneCodeTTL),
+	}
+	_, err = db.Collection("phone_verifications").ReplaceOne(ctx, bson.M{"_id": userID}, verification, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	if err := smsSender.Send(ctx, phone, renderSMS(smsTemplateVerification, map[string]string{"code": code})); err != nil {
+		// The code never arrived: the user may ask for another one right away
+		if _, delErr := db.Collection("phone_verifications").DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": userID, "codeHash": verification.CodeHash}); delErr != nil {
+			log.Printf("Warning: Error deleting unsent phone verification: %v", delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// ConfirmPhoneVerification checks the code and stores the verified phone number on the user
+func ConfirmPhoneVerification(ctx context.Context, db *mongo.Database, userID primitive.ObjectID, code string) (string, error) {
+	var pending PhoneVerification
+	err := db.Collection("phone_verifications").FindOneAndUpdate(ctx,
+		bson.M{"_id": userID, "expiresAt": bson.M{"$gt": time.Now()}, "attempts": bson.M{"$lt": phoneCodeMaxAttempts}},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+	).Decode(&pending)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidPhoneCode
+	}
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(pending.CodeHash), []byte(hashToken(strings.TrimSpace(code)))) != 1 {
+		return "", ErrInvalidPhoneCode
+	}
+
+	_, err = db.Collection("users").UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"phone": pending.Phone, "phoneVerified": true}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", ErrPhoneTaken
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Collection("phone_verifications").DeleteOne(ctx, bson.M{"_id": userID}); err != nil {
+		log.Printf("Warning: Error deleting phone verification: %v", err)
+	}
+	return pending.Phone, nil
+}
+
+// notifyChatRoomCreated texts the post owner when someone opens a chat about their post.
+// It runs in the background so the SMS provider never slows down the request.
+func notifyChatRoomCreated(post Post, initiator User) {
+	if post.UserID == initiator.ID {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), smsSendTimeout)
+		defer cancel()
+
+		var owner User
+		if err := userCollection.FindOne(ctx, bson.M{"_id": post.UserID}).Decode(&owner); err != nil {
+			log.Printf("Warning: Error loading post owner for SMS: %v", err)
+			return
+		}
+		if owner.Phone == "" || !owner.PhoneVerified {
+			return
+		}
+
+		name := initiator.Username
+		if name == "" {
+			name = "Một người dùng"
+		}
+		// A seller answering a "mua" post offers goods, anyone else is a buyer
+		template, role := smsTemplateBuyerInterest, "buyer"
+		if post.Type == "mua" {
+			template, role = smsTemplateSellerInterest, "seller"
+		}
+		body := renderSMS(template, map[string]string{
+			role:      name,
+			"content": truncateSMS(post.Content, smsContentLimit),
+		})
+		if err := smsSender.Send(ctx, owner.Phone, body); err != nil {
+			log.Printf("Warning: Error sending SMS to post owner: %v", err)
+		}
+	}()
+}
+
+// handleGetPhone returns the phone number of the current user
+func handleGetPhone(c *gin.Context) {
+	user := currentUser(c)
+	c.JSON(http.StatusOK, gin.H{"phone": user.Phone, "verified": user.PhoneVerified})
+}
+
+// handleStartPhoneVerification sends a verification code to a new phone number
+func handleStartPhoneVerification(c *gin.Context) {
+	var req struct {
+		Phone string `json:"phone" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	err := StartPhoneVerification(c.Request.Context(), mongoDB, currentUser(c).ID, req.Phone)
+	switch {
+	case errors.Is(err, ErrInvalidPhone):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPhoneCodeTooSoon):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPhoneTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code", "detail": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// handleConfirmPhoneVerification checks the code and saves the phone number
+func handleConfirmPhoneVerification(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	phone, err := ConfirmPhoneVerification(c.Request.Context(), mongoDB, currentUser(c).ID, req.Code)
+	if err != nil {
+		if errors.Is(err, ErrInvalidPhoneCode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else if errors.Is(err, ErrPhoneTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify phone", "detail": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"phone": phone, "verified": true})
+}
+
+// handleDeletePhone removes the phone number of the current user
+func handleDeletePhone(c *gin.Context) {
+	_, err := userCollection.UpdateOne(c.Request.Context(),
+		bson.M{"_id": currentUser(c).ID},
+		bson.M{"$unset": bson.M{"phone": "", "phoneVerified": ""}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove phone", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
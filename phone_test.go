@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestNormalizeVietnamesePhone(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" for ErrInvalidPhone
+	}{
+		{"0912345678", "+84912345678"},
+		{"0912 345 678", "+84912345678"},
+		{"84912345678", "+84912345678"},
+		{"+84912345678", "+84912345678"},
+		{"+84 912.345.678", "+84912345678"},
+		{"+84 0912 345 678", "+84912345678"},
+		{"(+84) 0912-345-678", "+84912345678"},
+		{"912345678", "+84912345678"},
+		{"845123456", "+84845123456"},
+		{"0845 123 456", "+84845123456"},
+		{" 0381234567 ", "+84381234567"},
+		{"0241234567", ""}, // landline
+		{"091234567", ""},  // too short
+		{"09123456789", ""},
+		{"0912a45678", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := normalizeVietnamesePhone(tt.in)
+		if tt.want == "" {
+			if err != ErrInvalidPhone {
+				t.Errorf("normalizeVietnamesePhone(%q) = %q, %v, want ErrInvalidPhone", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeVietnamesePhone(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// failingSMSSender fails every send
+type failingSMSSender struct{ sent int }
+
+func (s *failingSMSSender) Send(ctx context.Context, to, body string) error {
+	s.sent++
+	return errors.New("provider unavailable")
+}
+
+func TestPhoneVerification(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	userID := primitive.NewObjectID()
+
+	// setup swaps in a failing SMS backend
+	setup := func(mt *mtest.T) *failingSMSSender {
+		sender := &failingSMSSender{}
+		previous := smsSender
+		smsSender = sender
+		mt.Cleanup(func() { smsSender = previous })
+		return sender
+	}
+	ns := func(mt *mtest.T, coll string) string { return mt.DB.Name() + "." + coll }
+
+	mt.Run("unsent code is deleted", func(mt *mtest.T) {
+		sender := setup(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns(mt, "phone_verifications"), mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, ns(mt, "users"), mtest.FirstBatch),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+		err := StartPhoneVerification(context.Background(), mt.DB, userID, "0912 345 678")
+		if err == nil || sender.sent != 1 {
+			mt.Fatalf("err = %v after %d sends, want the provider error", err, sender.sent)
+		}
+		events := mt.GetAllStartedEvents()
+		if last := events[len(events)-1]; last.CommandName != "delete" {
+			mt.Fatalf("last command = %s, want the verification deleted", last.CommandName)
+		} else {
+			filter := last.Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q").Document()
+			if filter.Lookup("_id").ObjectID() != userID {
+				mt.Errorf("delete filter = %v, want the user's verification", filter)
+			}
+		}
+	})
+
+	mt.Run("resend too soon", func(mt *mtest.T) {
+		sender := setup(mt)
+		pending := PhoneVerification{UserID: userID, Phone: "+84912345678", CreatedAt: time.Now()}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns(mt, "phone_verifications"), mtest.FirstBatch, mockDocument(mt, pending)))
+		if err := StartPhoneVerification(context.Background(), mt.DB, userID, "0912345678"); err != ErrPhoneCodeTooSoon {
+			mt.Errorf("err = %v, want ErrPhoneCodeTooSoon", err)
+		}
+		if sender.sent != 0 {
+			mt.Errorf("sent %d codes, want none", sender.sent)
+		}
+	})
+
+	mt.Run("number of another account", func(mt *mtest.T) {
+		sender := setup(mt)
+		other := User{ID: primitive.NewObjectID(), Phone: "+84912345678", PhoneVerified: true}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns(mt, "phone_verifications"), mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, ns(mt, "users"), mtest.FirstBatch, mockDocument(mt, other)),
+		)
+		if err := StartPhoneVerification(context.Background(), mt.DB, userID, "+84 0912 345 678"); err != ErrPhoneTaken {
+			mt.Errorf("err = %v, want ErrPhoneTaken", err)
+		}
+		if sender.sent != 0 {
+			mt.Errorf("sent %d codes, want none", sender.sent)
+		}
+	})
+
+	mt.Run("confirm a taken number", func(mt *mtest.T) {
+		pending := PhoneVerification{UserID: userID, Phone: "+84912345678", CodeHash: hashToken("123456"), ExpiresAt: time.Now().Add(time.Minute)}
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, pending)}),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}),
+		)
+		_, err := ConfirmPhoneVerification(context.Background(), mt.DB, userID, "123456")
+		if err != ErrPhoneTaken {
+			mt.Errorf("err = %v, want ErrPhoneTaken", err)
+		}
+	})
+
+	mt.Run("confirm a wrong code", func(mt *mtest.T) {
+		pending := PhoneVerification{UserID: userID, Phone: "+84912345678", CodeHash: hashToken("123456"), ExpiresAt: time.Now().Add(time.Minute)}
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, pending)}))
+		if _, err := ConfirmPhoneVerification(context.Background(), mt.DB, userID, "654321"); err != ErrInvalidPhoneCode {
+			mt.Errorf("err = %v, want ErrInvalidPhoneCode", err)
+		}
+	})
+
+	mt.Run("confirm without a pending code", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		if _, err := ConfirmPhoneVerification(context.Background(), mt.DB, userID, "123456"); err != ErrInvalidPhoneCode {
+			mt.Errorf("err = %v, want ErrInvalidPhoneCode", err)
+		}
+	})
+}
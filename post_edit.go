@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fields a user can set by hand; classification never overwrites them afterwards
+const (
+	manualType      = "type"
+	manualCategory  = "category"
+	manualLocation  = "location"
+	manualPrice     = "price"
+	manualCondition = "condition"
+	manualKeywords  = "keywords"
+)
+
+// ErrInvalidPostUpdate is returned for edits that would leave the post invalid
+var ErrInvalidPostUpdate = errors.New("invalid post update")
+
+// PostRevision struct
+// One edit of a post with the old and new value of every changed field
+type PostRevision struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	PostID   primitive.ObjectID `bson:"postId" json:"postId"`
+	UserID   primitive.ObjectID `bson:"userId" json:"userId"`
+	Changes  []PostChange       `bson:"changes" json:"changes"`
+	EditedAt time.Time          `bson:"editedAt" json:"editedAt"`
+}
+
+// PostChange is a changed field of a post revision
+type PostChange struct {
+	Field string      `bson:"field" json:"field"`
+	Old   interface{} `bson:"old" json:"old"`
+	New   interface{} `bson:"new" json:"new"`
+}
+
+// PostUpdate holds the fields sent to PUT /post/:id; nil fields are left as they are
+type PostUpdate struct {
+	Content    *string   `json:"content"`
+	Category   *string   `json:"category"`
+	Location   *string   `json:"location"`
+	PriceMin   *int      `json:"priceMin"`
+	PriceMax   *int      `json:"priceMax"`
+	Negotiable *bool     `json:"negotiable"`
+	Condition  *string   `json:"condition"`
+	Keywords   *[]string `json:"keywords"`
+	Images     *[]string `json:"images"` // Attachment IDs, replacing the current images
+}
+
+// EnsurePostRevisionIndexes creates the index used to list the history of a post
+func EnsurePostRevisionIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("post_revisions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "postId", Value: 1}, {Key: "editedAt", Value: -1}},
+	})
+	return err
+}
+
+// isManual reports whether the user set a field of the post by hand
+func (post *Post) isManual(field string) bool {
+	for _, f := range post.ManualFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// markManual records that the user set a field by hand
+func (post *Post) markManual(field string) {
+	if !post.isManual(field) {
+		post.ManualFields = append(post.ManualFields, field)
+	}
+}
+
+// setLocation stores a place written by the user in its canonical form
+func (post *Post) setLocation(location string) {
+	post.Location, post.LocationCode, post.District, post.DistrictCode = strings.TrimSpace(location), "", "", ""
+	if place, ok := LookupLocation(location); ok {
+		post.Location, post.LocationCode = place.Province, place.ProvinceCode
+		post.District, post.DistrictCode = place.District, place.DistrictCode
+	}
+}
+
+// applyClassification copies the classified fields the user did not set by hand
+func (post *Post) applyClassification(info *PostInfo) {
+	if !post.isManual(manualCategory) {
+		post.Category = info.Category
+	}
+	if !post.isManual(manualLocation) {
+		post.Location, post.LocationCode = info.Location, info.LocationCode
+		post.District, post.DistrictCode = info.District, info.DistrictCode
+	}
+	if !post.isManual(manualPrice) {
+		post.PriceMin, post.PriceMax, post.Negotiable = info.PriceMin, info.PriceMax, info.Negotiable
+	}
+	if !post.isManual(manualCondition) {
+		post.Condition = info.Condition
+	}
+	if !post.isManual(manualKeywords) {
+		post.Keywords = info.Keywords
+	}
+}
+
+// diffPosts lists the editable fields that differ between two versions of a post
+func diffPosts(old, updated *Post) []PostChange {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"content", old.Content, updated.Content},
+		{"category", old.Category, updated.Category},
+		{"location", old.Location, updated.Location},
+		{"district", old.District, updated.District},
+		{"priceMin", old.PriceMin, updated.PriceMin},
+		{"priceMax", old.PriceMax, updated.PriceMax},
+		{"negotiable", old.Negotiable, updated.Negotiable},
+		{"condition", old.Condition, updated.Condition},
+		{"keywords", old.Keywords, updated.Keywords},
+		{"images", attachmentIDs(old.Images), attachmentIDs(updated.Images)},
+	}
+
+	var changes []PostChange
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.old, f.new) {
+			changes = append(changes, PostChange{Field: f.name, Old: f.old, New: f.new})
+		}
+	}
+	return changes
+}
+
+// UpdatePost applies an edit of the owner. Changed content is classified again, but the
+// fields the user set by hand are kept. Returns the changes, none if nothing changed.
+func UpdatePost(ctx context.Context, db *mongo.Database, post *Post, update PostUpdate) ([]PostChange, error) {
+	updated := *post
+	updated.ManualFields = append([]string(nil), post.ManualFields...)
+
+	// Explicit fields first, so that classification leaves them alone
+	if update.Category != nil {
+		updated.Category = strings.TrimSpace(*update.Category)
+		updated.markManual(manualCategory)
+	}
+	if update.Location != nil {
+		updated.setLocation(*update.Location)
+		updated.markManual(manualLocation)
+	}
+	if update.PriceMin != nil || update.PriceMax != nil || update.Negotiable != nil {
+		if update.PriceMin != nil {
+			updated.PriceMin = *update.PriceMin
+		}
+		if update.PriceMax != nil {
+			updated.PriceMax = *update.PriceMax
+		}
+		if update.Negotiable != nil {
+			updated.Negotiable = *update.Negotiable
+		}
+		if updated.PriceMin < 0 || updated.PriceMax < 0 || (updated.PriceMax > 0 && updated.PriceMax < updated.PriceMin) {
+			return nil, fmt.Errorf("%w: invalid price range", ErrInvalidPostUpdate)
+		}
+		updated.markManual(manualPrice)
+	}
+	if update.Condition != nil {
+		updated.Condition = strings.TrimSpace(*update.Condition)
+		updated.markManual(manualCondition)
+	}
+	if update.Keywords != nil {
+		updated.Keywords = *update.Keywords
+		updated.markManual(manualKeywords)
+	}
+
+	if update.Images != nil {
+		images, err := resolveAttachments(ctx, db, post.UserID, *update.Images)
+		if err != nil {
+			return nil, err
+		}
+		updated.Images = images
+	}
+
+	if update.Content != nil && strings.TrimSpace(*update.Content) != post.Content {
+		updated.Content = strings.TrimSpace(*update.Content)
+		if updated.Content == "" {
+			return nil, fmt.Errorf("%w: content cannot be empty", ErrInvalidPostUpdate)
+		}
+		info, err := ClassifyPost(ctx, updated.Content)
+		if err != nil {
+			log.Printf("Warning: Failed to classify edited post: %v", err)
+			// Keep the previous classification, only the price and place can be read offline
+			info = postInfoFromPost(post)
+			info.Location, info.LocationCode, info.District, info.DistrictCode = "", "", "", ""
+			applyParsedPrice(info, updated.Content)
+			applyLocation(info, updated.Content)
+		}
+		updated.applyClassification(info)
+	}
+
+	changes := diffPosts(post, &updated)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		return savePostEdit(ctx, db, post, &updated, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	wakeOutbox()
+
+	revision := PostRevision{
+		ID:       primitive.NewObjectID(),
+		PostID:   post.ID,
+		UserID:   post.UserID,
+		Changes:  changes,
+		EditedAt: now,
+	}
+	if _, err := db.Collection("post_revisions").InsertOne(ctx, revision); err != nil {
+		log.Printf("Warning: Error saving revision of post %s: %v", post.ID.Hex(), err)
+	}
+
+	syncEditedPost(ctx, db, post)
+	return changes, nil
+}
+
+// savePostEdit stores the edited fields if the post was not deleted meanwhile, and records
+// the reindexing of the post and of the chat messages about it in the outbox
+func savePostEdit(ctx context.Context, db *mongo.Database, post, updated *Post, now time.Time) error {
+	err := db.Collection("posts").FindOneAndUpdate(ctx,
+		bson.M{"_id": post.ID, "status": bson.M{"$ne": PostStatusDeleted}},
+		bson.M{"$set": bson.M{
+			"content":      updated.Content,
+			"category":     updated.Category,
+			"location":     updated.Location,
+			"locationCode": updated.LocationCode,
+			"district":     updated.District,
+			"districtCode": updated.DistrictCode,
+			"priceMin":     updated.PriceMin,
+			"priceMax":     updated.PriceMax,
+			"negotiable":   updated.Negotiable,
+			"condition":    updated.Condition,
+			"keywords":     updated.Keywords,
+			"manualFields": updated.ManualFields,
+			"images":       updated.Images,
+			"updatedAt":    now,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(post)
+	if err == mongo.ErrNoDocuments {
+		return ErrPostChanged
+	}
+	if err != nil {
+		return err
+	}
+	if err := enqueueOutbox(ctx, db, OutboxIndexPost, post.ID); err != nil {
+		return err
+	}
+	return enqueueOutbox(ctx, db, OutboxSyncPostMessages, post.ID)
+}
+
+// syncEditedPost refreshes the saved search of an edited post
+func syncEditedPost(ctx context.Context, db *mongo.Database, post *Post) {
+	if statusOf(post) != PostStatusActive {
+		return
+	}
+	if err := DeletePostSavedSearches(ctx, db, post.ID); err != nil {
+		log.Printf("Warning: Error removing saved search of post %s: %v", post.ID.Hex(), err)
+		return
+	}
+	search := SavedSearch{UserID: post.UserID, PostID: post.ID, Query: post.Content, Criteria: *postInfoFromPost(post)}
+	if err := CreateSavedSearch(ctx, db, &search); err != nil {
+		log.Printf("Warning: Error saving search for post %s: %v", post.ID.Hex(), err)
+	}
+}
+
+// updateChatMessagesPost copies the post details into the chat messages about the post
+func updateChatMessagesPost(ctx context.Context, post *Post) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"post_id": post.ID.Hex()},
+		},
+		"script": map[string]interface{}{
+			"lang": "painless",
+			"source": "ctx._source.category = params.category; ctx._source.location = params.location; " +
+				"ctx._source.location_code = params.location_code; ctx._source.district_code = params.district_code; " +
+				"ctx._source.price_min = params.price_min; ctx._source.price_max = params.price_max; " +
+				"ctx._source.condition = params.condition; ctx._source.keywords = params.keywords",
+			"params": map[string]interface{}{
+				"category":      post.Category,
+				"location":      post.Location,
+				"location_code": post.LocationCode,
+				"district_code": post.DistrictCode,
+				"price_min":     post.PriceMin,
+				"price_max":     post.PriceMax,
+				"condition":     post.Condition,
+				"keywords":      post.Keywords,
+			},
+		},
+	}
+	if err := updateByQuery(ctx, chatMessagesIndex, query); err != nil {
+		return fmt.Errorf("error updating chat messages: %w", err)
+	}
+	return nil
+}
+
+// handleUpdatePost edits a post of the current user
+func handleUpdatePost(c *gin.Context) {
+	var req PostUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	post := loadPostForOwner(c, currentUser(c).ID)
+	if post == nil {
+		return
+	}
+
+	changes, err := UpdatePost(c.Request.Context(), mongoDB, post, req)
+	if err != nil {
+		if errors.Is(err, ErrInvalidPostUpdate) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else if errors.Is(err, ErrUnknownAttachment) || errors.Is(err, ErrTooManyAttachments) {
+			writeAttachmentError(c, err)
+		} else {
+			writePostStatusError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"post": post, "changes": changes})
+}
+
+// handleDeletePost deletes a post of the current user. The post is kept as deleted
+// for the chat rooms about it, and removed from search.
+func handleDeletePost(c *gin.Context) {
+	post := loadPostForOwner(c, currentUser(c).ID)
+	if post == nil {
+		return
+	}
+	if err := SetPostStatus(c.Request.Context(), mongoDB, post, PostStatusDeleted); err != nil {
+		writePostStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleGetPostHistory lists the edits of a post of the current user, newest first
+func handleGetPostHistory(c *gin.Context) {
+	post := loadPostForOwner(c, currentUser(c).ID)
+	if post == nil {
+		return
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := mongoDB.Collection("post_revisions").Find(ctx,
+		bson.M{"postId": post.ID},
+		options.Find().SetSort(bson.M{"editedAt": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	revisions := []PostRevision{}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
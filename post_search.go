@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Sort options of the post search
+const (
+	PostSortRelevance = "relevance"
+	PostSortNewest    = "newest"
+	PostSortPriceAsc  = "price_asc"
+	PostSortPriceDesc = "price_desc"
+	PostSortDistance  = "distance"
+)
+
+const (
+	defaultPostSearchSize = 20
+	maxPostSearchSize     = 100
+	// defaultPriceInterval is the width of the price histogram buckets, in VND
+	defaultPriceInterval = 1000000
+	// minPriceInterval bounds the number of histogram buckets
+	minPriceInterval = 100000
+	// postFacetSize is the number of values returned per facet
+	postFacetSize = 20
+)
+
+// postedRanges are the buckets of the posted date facet. A post is counted in every
+// recent bucket it falls in, "older" holds the rest.
+var postedRanges = []struct {
+	key  string
+	from string
+	to   string
+}{
+	{key: "24h", from: "now-1d"},
+	{key: "7d", from: "now-7d"},
+	{key: "30d", from: "now-30d"},
+	{key: "older", to: "now-30d"},
+}
+
+var (
+	ErrInvalidSearchCursor = errors.New("invalid search cursor")
+	ErrNoDistanceOrigin    = errors.New("sorting by distance needs near, or lat and lon")
+)
+
+// PostSearchRequest is a search over the active posts. Values of the same facet are
+// alternatives, different facets must all match.
+type PostSearchRequest struct {
+	Query      string
+	Type       string
+	Categories []string
+	Locations  []string
+	Conditions []string
+	Posted     []string
+	PriceMin   int
+	PriceMax   int
+	// PriceInterval is the width of the price histogram buckets
+	PriceInterval int
+	Sort          string
+	// Origin is where distances are measured from when sorting by distance
+	Origin *GeoPoint
+	// After is the Next cursor of the previous page
+	After string
+	Size  int
+}
+
+// FacetValue is one value of a facet with the number of posts having it
+type FacetValue struct {
+	Value    string `json:"value"`
+	Count    int64  `json:"count"`
+	Selected bool   `json:"selected"`
+}
+
+// PriceBucket counts the posts asking from From up to To (excluded), in VND
+type PriceBucket struct {
+	From  int   `json:"from"`
+	To    int   `json:"to"`
+	Count int64 `json:"count"`
+}
+
+// PostFacets are the counts of the posts matching the search. The counts of a facet
+// ignore its own selection, so the other values can still be added to it.
+type PostFacets struct {
+	Category  []FacetValue  `json:"category"`
+	Location  []FacetValue  `json:"location"`
+	Condition []FacetValue  `json:"condition"`
+	Price     []PriceBucket `json:"price"`
+	Posted    []FacetValue  `json:"posted"`
+}
+
+// PostSearchHit is a post found by the search, with its owner
+type PostSearchHit struct {
+	Post  Post     `json:"post"`
+	User  User     `json:"user"`
+	Score *float64 `json:"score,omitempty"`
+	// DistanceKm is set when sorting by distance, from the capital of the post's province
+	DistanceKm *float64 `json:"distanceKm,omitempty"`
+}
+
+// PostSearchResult is a page of the post search
+type PostSearchResult struct {
+	Hits   []PostSearchHit `json:"hits"`
+	Total  int64           `json:"total"`
+	Facets PostFacets      `json:"facets"`
+	// Next is the cursor of the following page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// selectedLocations returns the province names the location facet shows for the
+// requested locations, as written when they are unknown
+func (req *PostSearchRequest) selectedLocations() []string {
+	names := make([]string, 0, len(req.Locations))
+	for _, location := range req.Locations {
+		if place, ok := LookupLocation(location); ok {
+			names = append(names, place.Province)
+		} else {
+			names = append(names, location)
+		}
+	}
+	return names
+}
+
+// facetFilters returns the filter of each facet with a selection
+func (req *PostSearchRequest) facetFilters() map[string]map[string]interface{} {
+	anyOf := func(queries []map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"bool": map[string]interface{}{"should": queries, "minimum_should_match": 1}}
+	}
+	term := func(field, value string) map[string]interface{} {
+		return map[string]interface{}{"term": map[string]interface{}{field: value}}
+	}
+
+	filters := map[string]map[string]interface{}{}
+	if len(req.Categories) > 0 {
+		filters["category"] = map[string]interface{}{"terms": map[string]interface{}{"category": req.Categories}}
+	}
+	if len(req.Locations) > 0 {
+		// Known places are matched on their codes, anything else on the stored name
+		queries := []map[string]interface{}{}
+		for _, location := range req.Locations {
+			place, ok := LookupLocation(location)
+			switch {
+			case !ok:
+				queries = append(queries, term("location", location))
+			case place.DistrictCode != "":
+				queries = append(queries, map[string]interface{}{"bool": map[string]interface{}{"filter": []map[string]interface{}{
+					term("location_code", place.ProvinceCode),
+					term("district_code", place.DistrictCode),
+				}}})
+			default:
+				queries = append(queries, term("location_code", place.ProvinceCode))
+			}
+		}
+		filters["location"] = anyOf(queries)
+	}
+	if len(req.Conditions) > 0 {
+		filters["condition"] = map[string]interface{}{"terms": map[string]interface{}{"condition": req.Conditions}}
+	}
+	if len(req.Posted) > 0 {
+		queries := []map[string]interface{}{}
+		for _, r := range postedRanges {
+			if !slices.Contains(req.Posted, r.key) {
+				continue
+			}
+			bounds := map[string]interface{}{}
+			if r.from != "" {
+				bounds["gte"] = r.from
+			}
+			if r.to != "" {
+				bounds["lt"] = r.to
+			}
+			queries = append(queries, map[string]interface{}{"range": map[string]interface{}{"created_at": bounds}})
+		}
+		filters["posted"] = anyOf(queries)
+	}
+	if req.PriceMin > 0 || req.PriceMax > 0 {
+		filters["price"] = priceOverlapQuery(req.PriceMin, req.PriceMax)
+	}
+	return filters
+}
+
+// sortClauses returns the sort of the search, ending with the post ID so every hit
+// has a distinct position for search_after
+func (req *PostSearchRequest) sortClauses() []interface{} {
+	newest := map[string]interface{}{"bumped_at": map[string]interface{}{"order": "desc"}}
+	tiebreaker := map[string]interface{}{"id": map[string]interface{}{"order": "asc"}}
+	switch req.Sort {
+	case PostSortRelevance:
+		return []interface{}{map[string]interface{}{"_score": map[string]interface{}{"order": "desc"}}, newest, tiebreaker}
+	case PostSortPriceAsc, PostSortPriceDesc:
+		order := "asc"
+		if req.Sort == PostSortPriceDesc {
+			order = "desc"
+		}
+		// Posts without a price come last either way
+		price := map[string]interface{}{"price_min": map[string]interface{}{"order": order, "missing": "_last"}}
+		return []interface{}{price, newest, tiebreaker}
+	case PostSortDistance:
+		distance := map[string]interface{}{"_geo_distance": map[string]interface{}{
+			"geo":             req.Origin,
+			"order":           "asc",
+			"unit":            "km",
+			"ignore_unmapped": true,
+		}}
+		return []interface{}{distance, newest, tiebreaker}
+	default:
+		return []interface{}{newest, tiebreaker}
+	}
+}
+
+// postFacetAggregations builds one aggregation per facet, each filtered by the
+// selections of the other facets
+func postFacetAggregations(req *PostSearchRequest, filters map[string]map[string]interface{}) map[string]interface{} {
+	postedBuckets := make([]map[string]interface{}, 0, len(postedRanges))
+	for _, r := range postedRanges {
+		bucket := map[string]interface{}{"key": r.key}
+		if r.from != "" {
+			bucket["from"] = r.from
+		}
+		if r.to != "" {
+			bucket["to"] = r.to
+		}
+		postedBuckets = append(postedBuckets, bucket)
+	}
+
+	facets := map[string]map[string]interface{}{
+		"category":  {"terms": map[string]interface{}{"field": "category", "size": postFacetSize}},
+		"location":  {"terms": map[string]interface{}{"field": "location", "size": postFacetSize}},
+		"condition": {"terms": map[string]interface{}{"field": "condition", "size": postFacetSize}},
+		"price": {"histogram": map[string]interface{}{
+			"field":         "price_min",
+			"interval":      req.PriceInterval,
+			"min_doc_count": 1,
+		}},
+		"posted": {"date_range": map[string]interface{}{"field": "created_at", "ranges": postedBuckets}},
+	}
+
+	aggs := map[string]interface{}{}
+	for name, agg := range facets {
+		others := []map[string]interface{}{}
+		for other, filter := range filters {
+			if other != name {
+				others = append(others, filter)
+			}
+		}
+		aggs[name] = map[string]interface{}{
+			"filter": map[string]interface{}{"bool": map[string]interface{}{"filter": others}},
+			"aggs":   map[string]interface{}{"values": agg},
+		}
+	}
+	return aggs
+}
+
+// encodeSearchCursor turns the sort values of the last hit into a page cursor
+func encodeSearchCursor(values []json.RawMessage) (string, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeSearchCursor returns the sort values of a page cursor
+func decodeSearchCursor(cursor string, sortLen int) ([]json.RawMessage, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidSearchCursor
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil || len(values) != sortLen {
+		return nil, ErrInvalidSearchCursor
+	}
+	return values, nil
+}
+
+// postSearchResponse is the part of the search response the post search reads
+type postSearchResponse struct {
+	Hits struct {
+		Total struct {
+			Value int64 `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			ID    string            `json:"_id"`
+			Score *float64          `json:"_score"`
+			Sort  []json.RawMessage `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Aggregations map[string]struct {
+		Values struct {
+			Buckets []struct {
+				Key      json.RawMessage `json:"key"`
+				DocCount int64           `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"values"`
+	} `json:"aggregations"`
+}
+
+// SearchPosts runs a faceted search over the active posts and loads the posts found
+// and their owners from MongoDB
+func SearchPosts(ctx context.Context, db *mongo.Database, req *PostSearchRequest) (*PostSearchResult, error) {
+	if ElasticClient == nil {
+		return nil, fmt.Errorf("Elasticsearch client not initialized")
+	}
+
+	filter := []map[string]interface{}{
+		{"term": map[string]interface{}{"status": PostStatusActive}},
+	}
+	if req.Type != "" {
+		filter = append(filter, map[string]interface{}{"term": map[string]interface{}{"type": req.Type}})
+	}
+	query := map[string]interface{}{"bool": map[string]interface{}{"filter": filter}}
+	if req.Query != "" {
+		query["bool"].(map[string]interface{})["must"] = postTextQuery(req.Query)
+		// Trusted owners rank higher among similar posts
+		query = reputationRankedQuery(query)
+	}
+
+	// Selections filter the hits but not the query, so the facets can count around them
+	filters := req.facetFilters()
+	selected := make([]map[string]interface{}, 0, len(filters))
+	for _, f := range filters {
+		selected = append(selected, f)
+	}
+
+	sort := req.sortClauses()
+	searchQuery := map[string]interface{}{
+		"query":            query,
+		"post_filter":      map[string]interface{}{"bool": map[string]interface{}{"filter": selected}},
+		"aggs":             postFacetAggregations(req, filters),
+		"sort":             sort,
+		"size":             req.Size,
+		"track_total_hits": true,
+		"_source":          false,
+	}
+	if req.After != "" {
+		after, err := decodeSearchCursor(req.After, len(sort))
+		if err != nil {
+			return nil, err
+		}
+		searchQuery["search_after"] = after
+	}
+
+	data, err := json.Marshal(searchQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling search query: %w", err)
+	}
+	res, err := ElasticClient.Search(
+		ElasticClient.Search.WithContext(ctx),
+		ElasticClient.Search.WithIndex(postsIndex),
+		ElasticClient.Search.WithBody(bytes.NewReader(data)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error searching: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error searching: %s", res.String())
+	}
+	var response postSearchResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("error parsing search response: %w", err)
+	}
+
+	result := &PostSearchResult{Total: response.Hits.Total.Value, Facets: parsePostFacets(req, &response)}
+	hits := response.Hits.Hits
+	if len(hits) == req.Size {
+		if result.Next, err = encodeSearchCursor(hits[len(hits)-1].Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(hits))
+	for _, hit := range hits {
+		if id, err := primitive.ObjectIDFromHex(hit.ID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	posts, users, err := loadPostsWithOwners(ctx, db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the Elasticsearch order, dropping posts closed or deleted since they were indexed
+	result.Hits = make([]PostSearchHit, 0, len(hits))
+	for _, hit := range hits {
+		id, _ := primitive.ObjectIDFromHex(hit.ID)
+		post, ok := posts[id]
+		if !ok || statusOf(&post) != PostStatusActive {
+			continue
+		}
+		item := PostSearchHit{Post: post, User: users[post.UserID], Score: hit.Score}
+		if req.Sort == PostSortDistance && len(hit.Sort) > 0 {
+			var km float64
+			// Posts without a known province have an infinite distance
+			if json.Unmarshal(hit.Sort[0], &km) == nil && km < 1e9 {
+				item.DistanceKm = &km
+			}
+		}
+		result.Hits = append(result.Hits, item)
+	}
+	return result, nil
+}
+
+// postTextQuery matches the text of a post search against the content and the
+// classified fields of the posts
+func postTextQuery(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []map[string]interface{}{
+				vietnameseContentQuery(text),
+				{
+					"multi_match": map[string]interface{}{
+						"query":  text,
+						"fields": []string{"category", "keywords^2"},
+					},
+				},
+			},
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+// parsePostFacets reads the facet aggregations. Selected values the search returned
+// no posts for are listed with a zero count.
+func parsePostFacets(req *PostSearchRequest, response *postSearchResponse) PostFacets {
+	values := func(name string, selected []string) []FacetValue {
+		facet := []FacetValue{}
+		for _, bucket := range response.Aggregations[name].Values.Buckets {
+			var value string
+			if json.Unmarshal(bucket.Key, &value) != nil {
+				continue
+			}
+			facet = append(facet, FacetValue{Value: value, Count: bucket.DocCount, Selected: slices.Contains(selected, value)})
+		}
+		for _, value := range selected {
+			if !slices.ContainsFunc(facet, func(v FacetValue) bool { return v.Value == value }) {
+				facet = append(facet, FacetValue{Value: value, Selected: true})
+			}
+		}
+		return facet
+	}
+
+	facets := PostFacets{
+		Category:  values("category", req.Categories),
+		Location:  values("location", req.selectedLocations()),
+		Condition: values("condition", req.Conditions),
+		Posted:    values("posted", req.Posted),
+		Price:     []PriceBucket{},
+	}
+	for _, bucket := range response.Aggregations["price"].Values.Buckets {
+		var from float64
+		if json.Unmarshal(bucket.Key, &from) != nil {
+			continue
+		}
+		facets.Price = append(facets.Price, PriceBucket{From: int(from), To: int(from) + req.PriceInterval, Count: bucket.DocCount})
+	}
+	return facets
+}
+
+// loadPostsWithOwners reads posts by ID and their owners
+func loadPostsWithOwners(ctx context.Context, db *mongo.Database, ids []primitive.ObjectID) (map[primitive.ObjectID]Post, map[primitive.ObjectID]User, error) {
+	posts := make(map[primitive.ObjectID]Post, len(ids))
+	users := make(map[primitive.ObjectID]User)
+	if len(ids) == 0 {
+		return posts, users, nil
+	}
+
+	cursor, err := db.Collection("posts").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading posts: %w", err)
+	}
+	var found []Post
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, nil, fmt.Errorf("error loading posts: %w", err)
+	}
+	userIDs := make([]primitive.ObjectID, 0, len(found))
+	for _, post := range found {
+		posts[post.ID] = post
+		userIDs = append(userIDs, post.UserID)
+	}
+
+	cursor, err = db.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": userIDs}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading post owners: %w", err)
+	}
+	var owners []User
+	if err := cursor.All(ctx, &owners); err != nil {
+		return nil, nil, fmt.Errorf("error loading post owners: %w", err)
+	}
+	for _, user := range owners {
+		users[user.ID] = user
+	}
+	return posts, users, nil
+}
+
+// parsePostSearchRequest reads the query params of the post search
+func parsePostSearchRequest(c *gin.Context) (*PostSearchRequest, error) {
+	req := &PostSearchRequest{
+		Query:      c.Query("q"),
+		Type:       c.Query("type"),
+		Categories: c.QueryArray("category"),
+		Locations:  c.QueryArray("location"),
+		Conditions: c.QueryArray("condition"),
+		Posted:     c.QueryArray("posted"),
+		Sort:       c.Query("sort"),
+		After:      c.Query("after"),
+		Size:       defaultPostSearchSize,
+	}
+	if req.Type != "" && req.Type != "mua" && req.Type != "ban" {
+		return nil, fmt.Errorf("type must be 'mua' or 'ban'")
+	}
+	for _, posted := range req.Posted {
+		if !slices.ContainsFunc(postedRanges, func(r struct{ key, from, to string }) bool { return r.key == posted }) {
+			return nil, fmt.Errorf("unknown posted range %q", posted)
+		}
+	}
+
+	positive := func(name string, fallback int) (int, error) {
+		raw := c.Query(name)
+		if raw == "" {
+			return fallback, nil
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s must be a positive number", name)
+		}
+		return n, nil
+	}
+	var err error
+	if req.PriceMin, err = positive("minPrice", 0); err != nil {
+		return nil, err
+	}
+	if req.PriceMax, err = positive("maxPrice", 0); err != nil {
+		return nil, err
+	}
+	if req.PriceInterval, err = positive("priceInterval", defaultPriceInterval); err != nil {
+		return nil, err
+	}
+	if req.PriceInterval == 0 {
+		req.PriceInterval = defaultPriceInterval
+	}
+	if req.PriceInterval < minPriceInterval {
+		return nil, fmt.Errorf("priceInterval must be at least %d", minPriceInterval)
+	}
+	if req.Size, err = positive("size", defaultPostSearchSize); err != nil {
+		return nil, err
+	}
+	if req.Size == 0 {
+		req.Size = defaultPostSearchSize
+	}
+	req.Size = min(req.Size, maxPostSearchSize)
+
+	// Where distances are measured from: a place, or coordinates
+	if near := c.Query("near"); near != "" {
+		place, ok := LookupLocation(near)
+		center, known := provinceCenters[place.ProvinceCode]
+		if !ok || !known {
+			return nil, fmt.Errorf("unknown location %q", near)
+		}
+		req.Origin = &center
+	} else if c.Query("lat") != "" || c.Query("lon") != "" {
+		lat, latErr := strconv.ParseFloat(c.Query("lat"), 64)
+		lon, lonErr := strconv.ParseFloat(c.Query("lon"), 64)
+		if latErr != nil || lonErr != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("lat and lon must be valid coordinates")
+		}
+		req.Origin = &GeoPoint{Lat: lat, Lon: lon}
+	}
+
+	switch req.Sort {
+	case "":
+		req.Sort = PostSortNewest
+		if req.Query != "" {
+			req.Sort = PostSortRelevance
+		}
+	case PostSortRelevance, PostSortNewest, PostSortPriceAsc, PostSortPriceDesc:
+	case PostSortDistance:
+		if req.Origin == nil {
+			return nil, ErrNoDistanceOrigin
+		}
+	default:
+		return nil, fmt.Errorf("unknown sort %q", req.Sort)
+	}
+	return req, nil
+}
+
+// handleSearchPosts searches the active posts and counts them per facet.
+// Query params: q, type (mua|ban); category, location, condition and posted
+// (24h|7d|30d|older), each repeatable for several values; minPrice, maxPrice,
+// priceInterval (histogram bucket width, default 1,000,000 VND, at least 100,000);
+// sort (relevance, default with q | newest, default without | price_asc | price_desc |
+// distance, from near=<place> or lat and lon); size (default 20, capped at 100);
+// after (next cursor)
+func handleSearchPosts(c *gin.Context) {
+	if ElasticClient == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Search service not available"})
+		return
+	}
+
+	req, err := parsePostSearchRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := SearchPosts(c.Request.Context(), mongoDB, req)
+	if errors.Is(err, ErrInvalidSearchCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
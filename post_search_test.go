@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParsePostSearchRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		query    string
+		size     int
+		interval int
+		sort     string
+		wantErr  bool
+	}{
+		{"", defaultPostSearchSize, defaultPriceInterval, PostSortNewest, false},
+		{"q=iphone", defaultPostSearchSize, defaultPriceInterval, PostSortRelevance, false},
+		{"size=50", 50, defaultPriceInterval, PostSortNewest, false},
+		{"size=0", defaultPostSearchSize, defaultPriceInterval, PostSortNewest, false},
+		{"size=101", maxPostSearchSize, defaultPriceInterval, PostSortNewest, false},
+		{"size=5000", maxPostSearchSize, defaultPriceInterval, PostSortNewest, false},
+		{"size=-1", 0, 0, "", true},
+		{"priceInterval=500000", defaultPostSearchSize, 500000, PostSortNewest, false},
+		{"priceInterval=100000", defaultPostSearchSize, minPriceInterval, PostSortNewest, false},
+		{"priceInterval=0", defaultPostSearchSize, defaultPriceInterval, PostSortNewest, false},
+		{"priceInterval=99999", 0, 0, "", true},
+		{"priceInterval=1", 0, 0, "", true},
+		{"sort=price_asc", defaultPostSearchSize, defaultPriceInterval, PostSortPriceAsc, false},
+		{"sort=distance", 0, 0, "", true},
+		{"sort=distance&near=Hà Nội", defaultPostSearchSize, defaultPriceInterval, PostSortDistance, false},
+		{"sort=cheapest", 0, 0, "", true},
+		{"type=trade", 0, 0, "", true},
+		{"posted=1y", 0, 0, "", true},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/search/posts", nil)
+		c.Request.URL.RawQuery = tt.query
+
+		req, err := parsePostSearchRequest(c)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.query, req)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if req.Size != tt.size || req.PriceInterval != tt.interval || req.Sort != tt.sort {
+			t.Errorf("%q: size %d, priceInterval %d, sort %q; want %d, %d, %q",
+				tt.query, req.Size, req.PriceInterval, req.Sort, tt.size, tt.interval, tt.sort)
+		}
+	}
+}
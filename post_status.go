@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Post statuses; only active posts are listed and matched
+const (
+	PostStatusReserved = "reserved"
+	PostStatusSold     = "sold"
+	PostStatusExpired  = "expired"
+	PostStatusDeleted  = "deleted"
+)
+
+// postTransitions lists the statuses a post may move to from each status.
+// Deleted is final; sold and expired posts can be reopened by their owner.
+var postTransitions = map[string][]string{
+	PostStatusActive:   {PostStatusReserved, PostStatusSold, PostStatusExpired, PostStatusDeleted},
+	PostStatusReserved: {PostStatusActive, PostStatusSold, PostStatusDeleted},
+	PostStatusSold:     {PostStatusActive, PostStatusDeleted},
+	PostStatusExpired:  {PostStatusActive, PostStatusDeleted},
+}
+
+const (
+	// postExpiryInterval is how often expired posts are looked for
+	postExpiryInterval = 10 * time.Minute
+	// postBumpInterval is the minimum time between two bumps of a post
+	postBumpInterval = 24 * time.Hour
+	// postExpiryBatch is the number of posts expired per query
+	postExpiryBatch = 500
+)
+
+// postTTL is how long a post stays active without being renewed (POST_TTL, default 30 days)
+var postTTL = func() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("POST_TTL", "720h"))
+	if err != nil || ttl <= 0 {
+		log.Printf("Warning: Invalid POST_TTL, using 30 days")
+		return 30 * 24 * time.Hour
+	}
+	return ttl
+}()
+
+var (
+	ErrInvalidPostTransition = errors.New("post status transition not allowed")
+	ErrPostChanged           = errors.New("post was modified concurrently")
+	ErrPostBumpedTooSoon     = errors.New("post was bumped less than a day ago")
+)
+
+// EnsurePostIndexes creates the indexes used by the listings and the expiry worker
+func EnsurePostIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("posts").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "status", Value: 1}, {Key: "bumpedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expiresAt", Value: 1}}},
+	})
+	return err
+}
+
+// statusOf returns the status of a post; posts created before statuses existed are active
+func statusOf(post *Post) string {
+	if post.Status == "" {
+		return PostStatusActive
+	}
+	return post.Status
+}
+
+// canTransitionPost reports whether a post may move from one status to another
+func canTransitionPost(from, to string) bool {
+	for _, allowed := range postTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// activePostFilter matches active posts, including the ones stored before statuses existed
+func activePostFilter() bson.M {
+	return bson.M{"$in": bson.A{PostStatusActive, nil}}
+}
+
+// statusFilter matches a post only while it still has the given status,
+// so concurrent transitions cannot both succeed
+func statusFilter(postID primitive.ObjectID, status string) bson.M {
+	if status == PostStatusActive {
+		return bson.M{"_id": postID, "status": activePostFilter()}
+	}
+	return bson.M{"_id": postID, "status": status}
+}
+
+// SetPostStatus moves a post to a new status, mirrored to Elasticsearch through the outbox.
+// Reactivated posts get a fresh expiry.
+func SetPostStatus(ctx context.Context, db *mongo.Database, post *Post, to string) error {
+	from := statusOf(post)
+	if !canTransitionPost(from, to) {
+		return ErrInvalidPostTransition
+	}
+
+	now := time.Now()
+	set := bson.M{"status": to, "statusChangedAt": now}
+	if to == PostStatusActive {
+		set["expiresAt"] = now.Add(postTTL)
+	}
+	if err := updatePostStatus(ctx, db, post, from, set); err != nil {
+		return err
+	}
+
+	syncPostStatus(ctx, db, post, from)
+	return nil
+}
+
+// updatePostStatus applies a status change if the post is still in status from, and
+// records the reindexing of the post in the outbox with it
+func updatePostStatus(ctx context.Context, db *mongo.Database, post *Post, from string, set bson.M) error {
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		err := db.Collection("posts").FindOneAndUpdate(ctx,
+			statusFilter(post.ID, from),
+			bson.M{"$set": set},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(post)
+		if err == mongo.ErrNoDocuments {
+			return ErrPostChanged
+		}
+		if err != nil {
+			return err
+		}
+		return enqueueOutbox(ctx, db, OutboxIndexPost, post.ID)
+	})
+	if err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// syncPostStatus mirrors a status change to the post's saved search; the posts index
+// follows through the outbox. Failures are logged: MongoDB stays the source of truth.
+func syncPostStatus(ctx context.Context, db *mongo.Database, post *Post, from string) {
+	to := statusOf(post)
+
+	// A post only looks for counter-posts while it is active
+	switch {
+	case from == PostStatusActive && to != PostStatusActive:
+		if err := DeletePostSavedSearches(ctx, db, post.ID); err != nil {
+			log.Printf("Warning: Error removing saved search of post %s: %v", post.ID.Hex(), err)
+		}
+	case from != PostStatusActive && to == PostStatusActive:
+		search := SavedSearch{UserID: post.UserID, PostID: post.ID, Query: post.Content, Criteria: *postInfoFromPost(post)}
+		if err := CreateSavedSearch(ctx, db, &search); err != nil {
+			log.Printf("Warning: Error saving search for post %s: %v", post.ID.Hex(), err)
+		}
+	}
+}
+
+// RenewPost bumps an active or expired post: it becomes active again with a fresh
+// expiry and moves back to the top of the listings
+func RenewPost(ctx context.Context, db *mongo.Database, post *Post) error {
+	from := statusOf(post)
+	if from != PostStatusActive && from != PostStatusExpired {
+		return ErrInvalidPostTransition
+	}
+	// An expired post can always come back, even with a POST_TTL under postBumpInterval
+	if from == PostStatusActive && time.Since(post.BumpedAt) < postBumpInterval {
+		return ErrPostBumpedTooSoon
+	}
+
+	now := time.Now()
+	set := bson.M{"status": PostStatusActive, "expiresAt": now.Add(postTTL), "bumpedAt": now}
+	if from != PostStatusActive {
+		set["statusChangedAt"] = now
+	}
+	if err := updatePostStatus(ctx, db, post, from, set); err != nil {
+		return err
+	}
+
+	syncPostStatus(ctx, db, post, from)
+	return nil
+}
+
+// ExpirePosts moves the active posts past their expiry to expired, a batch at a time
+// until a batch comes back short
+func ExpirePosts(ctx context.Context, db *mongo.Database) (int, error) {
+	now := time.Now()
+	expired := 0
+	for {
+		cursor, err := db.Collection("posts").Find(ctx,
+			bson.M{"status": activePostFilter(), "expiresAt": bson.M{"$lte": now}},
+			options.Find().SetLimit(postExpiryBatch))
+		if err != nil {
+			return expired, err
+		}
+		var posts []Post
+		if err := cursor.All(ctx, &posts); err != nil {
+			return expired, err
+		}
+
+		// Posts renewed or closed in the meantime no longer match the next query
+		for i := range posts {
+			err := SetPostStatus(ctx, db, &posts[i], PostStatusExpired)
+			if err == ErrPostChanged {
+				continue
+			}
+			if err != nil {
+				return expired, err
+			}
+			expired++
+		}
+
+		if len(posts) < postExpiryBatch {
+			return expired, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return expired, err
+		}
+	}
+}
+
+// runPostExpiry expires posts periodically until the context is cancelled
+func runPostExpiry(ctx context.Context, db *mongo.Database) {
+	ticker := time.NewTicker(postExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := ExpirePosts(ctx, db); err != nil {
+			log.Printf("Warning: Error expiring posts: %v", err)
+		} else if n > 0 {
+			log.Printf("Expired %d posts", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadPostForOwner loads a post and checks the user owns it.
+// On failure it writes the 400/404/403/500 response and returns nil.
+func loadPostForOwner(c *gin.Context, userID primitive.ObjectID) *Post {
+	postID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
+		return nil
+	}
+
+	var post Post
+	if err := postCollection.FindOne(c.Request.Context(), bson.M{"_id": postID}).Decode(&post); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return nil
+	}
+	if statusOf(&post) == PostStatusDeleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
+		return nil
+	}
+	if post.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not the owner of this post"})
+		return nil
+	}
+	return &post
+}
+
+// writePostStatusError maps lifecycle errors to HTTP responses
+func writePostStatusError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidPostTransition), errors.Is(err, ErrPostChanged):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPostBumpedTooSoon):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update post", "detail": err.Error()})
+	}
+}
+
+// handleSetPostStatus lets the owner mark a post reserved or sold, reopen it, or delete it.
+// Body: {"status": "active" | "reserved" | "sold" | "deleted"}
+func handleSetPostStatus(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required,oneof=active reserved sold deleted"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	post := loadPostForOwner(c, currentUser(c).ID)
+	if post == nil {
+		return
+	}
+	if err := SetPostStatus(c.Request.Context(), mongoDB, post, req.Status); err != nil {
+		writePostStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"post": post})
+}
+
+// handleRenewPost bumps a post of the current user
+func handleRenewPost(c *gin.Context) {
+	post := loadPostForOwner(c, currentUser(c).ID)
+	if post == nil {
+		return
+	}
+	if err := RenewPost(c.Request.Context(), mongoDB, post); err != nil {
+		writePostStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"post": post})
+}
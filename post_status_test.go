@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCanTransitionPost(t *testing.T) {
+	statuses := []string{PostStatusActive, PostStatusReserved, PostStatusSold, PostStatusExpired, PostStatusDeleted}
+	// allowed lists every permitted move; any other pair must be refused
+	allowed := map[[2]string]bool{
+		{PostStatusActive, PostStatusReserved}:  true,
+		{PostStatusActive, PostStatusSold}:      true,
+		{PostStatusActive, PostStatusExpired}:   true,
+		{PostStatusActive, PostStatusDeleted}:   true,
+		{PostStatusReserved, PostStatusActive}:  true,
+		{PostStatusReserved, PostStatusSold}:    true,
+		{PostStatusReserved, PostStatusDeleted}: true,
+		{PostStatusSold, PostStatusActive}:      true,
+		{PostStatusSold, PostStatusDeleted}:     true,
+		{PostStatusExpired, PostStatusActive}:   true,
+		{PostStatusExpired, PostStatusDeleted}:  true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[[2]string{from, to}]
+			if got := canTransitionPost(from, to); got != want {
+				t.Errorf("canTransitionPost(%q, %q) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+	if canTransitionPost("", PostStatusSold) || canTransitionPost(PostStatusActive, "archived") {
+		t.Errorf("unknown statuses must not transition")
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"", PostStatusActive},
+		{PostStatusActive, PostStatusActive},
+		{PostStatusSold, PostStatusSold},
+	}
+	for _, tt := range tests {
+		if got := statusOf(&Post{Status: tt.status}); got != tt.want {
+			t.Errorf("statusOf(%q) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRenewPost(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	recently := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		status   string
+		bumpedAt time.Time
+		want     error
+	}{
+		{"active bumped recently", PostStatusActive, recently, ErrPostBumpedTooSoon},
+		{"active bumped long ago", PostStatusActive, time.Now().Add(-2 * postBumpInterval), nil},
+		{"expired bumped recently", PostStatusExpired, recently, nil},
+		{"sold", PostStatusSold, time.Now().Add(-2 * postBumpInterval), ErrInvalidPostTransition},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			post := Post{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Type: "ban", Category: "xe máy", Status: tt.status, BumpedAt: tt.bumpedAt}
+			renewed := post
+			renewed.Status, renewed.BumpedAt = PostStatusActive, time.Now()
+			// The renewed post, then the saved search of a post active again
+			mt.AddMockResponses(
+				mtest.CreateSuccessResponse(bson.E{Key: "value", Value: mockDocument(mt, renewed)}),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			)
+
+			err := RenewPost(context.Background(), mt.DB, &post)
+			if err != tt.want {
+				mt.Fatalf("RenewPost = %v, want %v", err, tt.want)
+			}
+			if err == nil && post.Status != PostStatusActive {
+				mt.Errorf("status = %q, want active", post.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// postsIndex holds one document per post, keyed by the post ID. It is an alias of
+// the versioned index built with postsMapping, see the reindex command
+const postsIndex = "posts"
+
+// PostIndex represents the structure for posts in Elasticsearch
+type PostIndex struct {
+	ID           string   `json:"id"`
+	Type         string   `json:"type"` // "mua" or "ban"
+	Content      string   `json:"content"`
+	Category     string   `json:"category,omitempty"`
+	Location     string   `json:"location,omitempty"`
+	LocationCode string   `json:"location_code,omitempty"`
+	DistrictCode string   `json:"district_code,omitempty"`
+	PriceMin     int      `json:"price_min,omitempty"`
+	PriceMax     int      `json:"price_max,omitempty"`
+	Negotiable   bool     `json:"negotiable"`
+	Condition    string   `json:"condition,omitempty"`
+	Keywords     []string `json:"keywords,omitempty"`
+	UserID       string   `json:"user_id"`
+	// UserReputation is the owner's reputation score, a ranking signal for matches
+	UserReputation float64   `json:"user_reputation,omitempty"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+	// BumpedAt orders the newest posts first, like the listings
+	BumpedAt time.Time `json:"bumped_at"`
+	// Geo is the capital of the post's province, used to sort by distance
+	Geo *GeoPoint `json:"geo,omitempty"`
+}
+
+// postsVersion is bumped with every change to postsMapping
+const postsVersion = 5
+
+// postsMapping defines the settings and mapping of the posts index
+var postsMapping = withVietnameseAnalysis(`{
+	"settings": {
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings": {
+		"properties": {
+			"id": { "type": "keyword" },
+			"type": { "type": "keyword" },
+			"content": { "type": "text" },
+			"category": { "type": "keyword" },
+			"location": { "type": "keyword" },
+			"location_code": { "type": "keyword" },
+			"district_code": { "type": "keyword" },
+			"price_min": { "type": "long" },
+			"price_max": { "type": "long" },
+			"negotiable": { "type": "boolean" },
+			"condition": { "type": "keyword" },
+			"keywords": { "type": "keyword" },
+			"user_id": { "type": "keyword" },
+			"user_reputation": { "type": "float" },
+			"status": { "type": "keyword" },
+			"created_at": { "type": "date" },
+			"bumped_at": { "type": "date" },
+			"geo": { "type": "geo_point" }
+		}
+	}
+}`, "content")
+
+// createPostsIndex creates the posts index behind its alias if it doesn't exist
+func createPostsIndex() error {
+	return ensureAliasedIndex(postsIndex, postsVersion, postsMapping)
+}
+
+// newPostIndex builds the Elasticsearch document of a post
+func newPostIndex(post *Post) PostIndex {
+	status := post.Status
+	if status == "" {
+		// Posts created before statuses existed are active
+		status = PostStatusActive
+	}
+	bumpedAt := post.BumpedAt
+	if bumpedAt.IsZero() {
+		bumpedAt = post.CreatedAt
+	}
+	var geo *GeoPoint
+	if center, ok := provinceCenters[post.LocationCode]; ok {
+		geo = &center
+	}
+	return PostIndex{
+		ID:           post.ID.Hex(),
+		Type:         post.Type,
+		Content:      post.Content,
+		Category:     post.Category,
+		Location:     post.Location,
+		LocationCode: post.LocationCode,
+		DistrictCode: post.DistrictCode,
+		PriceMin:     post.PriceMin,
+		PriceMax:     post.PriceMax,
+		Negotiable:   post.Negotiable,
+		Condition:    post.Condition,
+		Keywords:     post.Keywords,
+		UserID:       post.UserID.Hex(),
+		Status:       status,
+		CreatedAt:    post.CreatedAt,
+		BumpedAt:     bumpedAt,
+		Geo:          geo,
+	}
+}
+
+// IndexPost creates or replaces the document of a post in the posts index
+func IndexPost(ctx context.Context, post *Post) error {
+	if searchIndexer == nil {
+		return fmt.Errorf("Elasticsearch client not initialized")
+	}
+
+	doc := newPostIndex(post)
+	doc.UserReputation = ownerReputation(ctx, post.UserID)
+	if err := searchIndexer.Index(ctx, postsIndex, doc.ID, doc); err != nil {
+		return fmt.Errorf("error indexing post: %w", err)
+	}
+	return nil
+}
+
+// DeletePostIndex removes the document of a post from the posts index
+func DeletePostIndex(ctx context.Context, postID string) error {
+	if searchIndexer == nil {
+		return fmt.Errorf("Elasticsearch client not initialized")
+	}
+
+	if err := searchIndexer.Delete(ctx, postsIndex, postID); err != nil {
+		return fmt.Errorf("error deleting post: %w", err)
+	}
+	return nil
+}
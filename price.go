@@ -0,0 +1,453 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/text/unicode/norm"
+)
+
+// PriceRange is a price or price range in VND extracted from text.
+// Max == 0 with Min > 0 means there is no upper bound ("trên 5tr").
+type PriceRange struct {
+	Min        int  `json:"min"`
+	Max        int  `json:"max"`
+	Negotiable bool `json:"negotiable"`
+}
+
+// IsZero reports whether no amount was found
+func (pr PriceRange) IsZero() bool {
+	return pr.Min == 0 && pr.Max == 0
+}
+
+// Mid returns a single representative amount of the range
+func (pr PriceRange) Mid() int {
+	if pr.Max == 0 {
+		return pr.Min
+	}
+	if pr.Min == 0 {
+		return pr.Max
+	}
+	return (pr.Min + pr.Max) / 2
+}
+
+// FormatVND writes an amount the Vietnamese way, "15.000.000đ"
+func FormatVND(amount int) string {
+	digits := strconv.Itoa(amount)
+	if amount < 0 {
+		digits = digits[1:]
+	}
+	var b strings.Builder
+	if amount < 0 {
+		b.WriteByte('-')
+	}
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte('.')
+		}
+		b.WriteRune(d)
+	}
+	b.WriteString("đ")
+	return b.String()
+}
+
+// priceUnitMultipliers maps the accent-free unit spellings to their value in VND
+var priceUnitMultipliers = map[string]int{
+	"d": 1, "dong": 1, "vnd": 1,
+	"k": 1e3, "nghin": 1e3, "ngan": 1e3, "ng": 1e3,
+	"lit": 1e5, "xi": 1e5, // slang: "2 lít" = 200k
+	"tr": 1e6, "trieu": 1e6, "cu": 1e6, "t": 1e6,
+	"ty": 1e9, "ti": 1e9,
+}
+
+// priceAmountPattern matches a number, an optional unit and optional trailing digits
+// that are a fraction of the unit ("1tr5" = 1.5 triệu, "1t2" = 1.2 triệu, "1ty2" = 1.2 tỷ).
+// It runs on accent-free lowercase text.
+var priceAmountPattern = regexp.MustCompile(`(\d+(?:[.,]\d+)*)(?:(\s*)(trieu|nghin|ngan|dong|vnd|tr|ty|ti|cu|lit|xi|ng|k|d|t)(\d{1,3})?)?`)
+
+var (
+	// Words before an amount that turn it into an upper or lower bound
+	priceMaxPrefixes = []string{"dưới", "không quá", "tối đa", "max", "<"}
+	priceMinPrefixes = []string{"trên", "tối thiểu", "min", "từ", ">"}
+	// Words after an amount that turn it into an upper or lower bound ("10tr đổ lại")
+	priceMaxSuffixes = []string{"đổ lại", "đổ xuống", "trở lại", "trở xuống", "max"}
+	priceMinSuffixes = []string{"đổ lên", "trở lên"}
+	// Word after a unit adding half of it ("5 triệu rưỡi" = 5.5 triệu)
+	priceHalfWord = "rưỡi"
+	// Separators between the two ends of a range
+	priceRangeSeparators = []string{"-", "~", "đến", "tới", "->"}
+	// Phrases meaning the price can be negotiated
+	negotiablePhrases = []string{"thương lượng", "tl", "bớt chút", "bớt", "fix nhẹ", "fix", "deal", "giá tốt", "thỏa thuận"}
+	// Word units that also start ordinary words ("đồng hồ", "lít xăng", "tỷ lệ", "củ khoai")
+	priceWordUnits = map[string]bool{"dong": true, "lit": true, "xi": true, "ty": true, "ti": true, "cu": true}
+	// Words that may follow a word unit in a price ("2 tỷ đồng", "5 củ thương lượng")
+	priceUnitFollowers = []string{"đồng", "vnd", priceHalfWord}
+)
+
+// priceAmount is one amount found in the text
+type priceAmount struct {
+	value     float64 // number before applying the unit
+	unit      string
+	start     int
+	end       int
+	separated bool // thousands separators were used ("15.000.000")
+}
+
+// ParsePrice extracts the first price or price range from Vietnamese text.
+// It understands shorthand units (k, nghìn, tr, t, triệu, củ, tỷ, lít), "1tr5", "1t2", "1tỷ2",
+// "5 triệu rưỡi", full amounts ("15.000.000đ"), ranges ("10-12tr", "từ 10 đến 12 triệu"),
+// bounds ("dưới 10tr", "trên 5 triệu", "10tr đổ lại") and "thương lượng".
+func ParsePrice(text string) PriceRange {
+	raw := strings.ToLower(norm.NFC.String(text))
+	folded := foldVietnamese(raw)
+	// Accent-free content can only be matched against accent-free words
+	accented := raw != folded
+
+	var pr PriceRange
+	pr.Negotiable = containsPhrase(raw, negotiablePhrases, accented)
+
+	amounts := findPriceAmounts(raw, folded)
+	for i := 0; i < len(amounts); i++ {
+		a := amounts[i]
+
+		// Range: "10-12tr", "10tr - 12tr", "từ 10 đến 12 triệu"
+		if i+1 < len(amounts) && isRangeSeparator(originalAt(raw, folded, a.end, amounts[i+1].start), accented) {
+			b := amounts[i+1]
+			if a.unit == "" {
+				a.unit = b.unit
+			}
+			lo, okA := a.vnd()
+			hi, okB := b.vnd()
+			if okA && okB {
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				pr.Min, pr.Max = lo, hi
+				return pr
+			}
+		}
+
+		// Compound amount: "1 tỷ 200 triệu", "1tr 500k", "1 tỷ 2"
+		value, ok := a.vnd()
+		if !ok {
+			continue
+		}
+		// Amounts with a fraction of the unit ("1tr5") take no "rưỡi"
+		end, unit := a.end, a.unit
+		if a.value != math.Trunc(a.value) {
+			unit = ""
+		}
+		if i+1 < len(amounts) && strings.TrimSpace(folded[a.end:amounts[i+1].start]) == "" {
+			b := amounts[i+1]
+			if extra, ok := b.vnd(); ok && b.unit != "" && priceUnitMultipliers[b.unit] < priceUnitMultipliers[a.unit] {
+				value += extra
+				end, unit = b.end, b.unit
+			} else if b.unit == "" && !b.separated && b.value < 1000 && priceUnitMultipliers[a.unit] >= 1e9 {
+				digits := strconv.Itoa(int(b.value))
+				value += int(b.value / math.Pow(10, float64(len(digits))) * float64(priceUnitMultipliers[a.unit]))
+				end, unit = b.end, ""
+			}
+		}
+
+		// "5 triệu rưỡi", "1 tỷ rưỡi"
+		suffix := priceWords(originalAt(raw, folded, end, len(folded)))
+		if unit != "" && hasPrefixWord(suffix, []string{priceHalfWord}, accented) {
+			value += priceUnitMultipliers[unit] / 2
+			suffix = suffix[1:]
+		}
+
+		prefix := strings.TrimSpace(originalAt(raw, folded, 0, a.start))
+		switch {
+		case hasSuffixWord(prefix, priceMaxPrefixes, accented), hasPrefixWord(suffix, priceMaxSuffixes, accented):
+			pr.Max = value
+		case hasSuffixWord(prefix, priceMinPrefixes, accented), hasPrefixWord(suffix, priceMinSuffixes, accented):
+			pr.Min = value
+		default:
+			pr.Min, pr.Max = value, value
+		}
+		return pr
+	}
+
+	return pr
+}
+
+// findPriceAmounts lists the number+unit matches that stand on their own
+func findPriceAmounts(raw, folded string) []priceAmount {
+	accented := raw != folded
+	var amounts []priceAmount
+	for _, m := range priceAmountPattern.FindAllStringSubmatchIndex(folded, -1) {
+		start, end := m[0], m[1]
+
+		// The number must not be part of a word ("m1", "ps5")
+		if start > 0 {
+			if r, _ := utf8.DecodeLastRuneInString(folded[:start]); unicode.IsLetter(r) {
+				continue
+			}
+		}
+
+		number := folded[m[2]:m[3]]
+		unit, tail := "", ""
+		if m[6] >= 0 {
+			unit = folded[m[6]:m[7]]
+			if m[8] >= 0 {
+				tail = folded[m[8]:m[9]]
+			}
+		}
+
+		// "cũ" (used) folds to "cu": only accept an accented "củ", or "cu" glued to the number
+		if unit == "cu" && m[4] != m[5] && originalAt(raw, folded, m[6], m[7]) != "củ" {
+			unit = ""
+		}
+		// A lone "t" is only a unit glued to the number ("1t2", "5t")
+		if unit == "t" && m[4] != m[5] {
+			unit = ""
+		}
+		// A unit followed by letters is the start of another word ("5 người")
+		if unit != "" && end < len(folded) {
+			if r, _ := utf8.DecodeRuneInString(folded[end:]); unicode.IsLetter(r) {
+				unit = ""
+			}
+		}
+		// "2 đồng hồ", "5 lít xăng": a word unit followed by another word is not a price,
+		// unless "giá" comes before it
+		if priceWordUnits[unit] && tail == "" && !isPriceUnitEnd(raw, folded, start, end, accented) {
+			continue
+		}
+		if unit == "" {
+			tail = ""
+			end = m[3]
+			// "256gb", "13pro"
+			if end < len(folded) {
+				if r, _ := utf8.DecodeRuneInString(folded[end:]); unicode.IsLetter(r) {
+					continue
+				}
+			}
+		}
+
+		value, separated, ok := parsePriceNumber(number, unit)
+		if !ok {
+			continue
+		}
+		if tail != "" {
+			value += mustAtof(tail) / math.Pow(10, float64(len(tail)))
+		}
+
+		amounts = append(amounts, priceAmount{
+			value:     value,
+			unit:      unit,
+			start:     start,
+			end:       end,
+			separated: separated,
+		})
+	}
+	return amounts
+}
+
+// isPriceUnitEnd reports whether the amount ending at end is the whole phrase: what
+// follows up to the next punctuation is another number or a price word. An amount
+// right after "giá" is always a price.
+func isPriceUnitEnd(raw, folded string, start, end int, accented bool) bool {
+	if hasSuffixWord(originalAt(raw, folded, 0, start), []string{"giá"}, accented) {
+		return true
+	}
+	phrase := originalAt(raw, folded, end, len(folded))
+	if i := strings.IndexFunc(phrase, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+	}); i >= 0 {
+		phrase = phrase[:i]
+	}
+	words := strings.Fields(phrase)
+	if len(words) == 0 || unicode.IsDigit([]rune(words[0])[0]) {
+		return true
+	}
+	for _, followers := range [][]string{priceUnitFollowers, priceMaxSuffixes, priceMinSuffixes, priceRangeSeparators, negotiablePhrases} {
+		if hasPrefixWord(words, followers, accented) {
+			return true
+		}
+	}
+	return false
+}
+
+// vnd converts the amount to VND; unit-less amounts are only trusted when written in full
+func (a priceAmount) vnd() (int, bool) {
+	multiplier, ok := priceUnitMultipliers[a.unit]
+	if a.unit == "" {
+		if !a.separated || a.value < 1000 {
+			return 0, false
+		}
+		multiplier, ok = 1, true
+	}
+	if !ok {
+		return 0, false
+	}
+	return int(math.Round(a.value * float64(multiplier))), true
+}
+
+// parsePriceNumber reads "15", "1.5", "1,5" or "15.000.000". A separator followed by
+// exactly three digits is a thousands separator unless the unit is large (tr, tỷ).
+func parsePriceNumber(number, unit string) (float64, bool, bool) {
+	groups := strings.FieldsFunc(number, func(r rune) bool { return r == '.' || r == ',' })
+	if len(groups) == 1 {
+		return mustAtof(number), false, true
+	}
+
+	thousands := len(groups) > 2 || (len(groups[1]) == 3 && priceUnitMultipliers[unit] < 1e6)
+	if thousands {
+		for _, g := range groups[1:] {
+			if len(g) != 3 {
+				return 0, false, false
+			}
+		}
+		return mustAtof(strings.Join(groups, "")), true, true
+	}
+	return mustAtof(groups[0] + "." + groups[1]), false, true
+}
+
+func mustAtof(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+// originalAt returns the accented text matching a byte range of the folded text.
+// raw is NFC and folding only drops combining marks and maps đ to d, so rune counts line up.
+func originalAt(raw, folded string, start, end int) string {
+	startRune := utf8.RuneCountInString(folded[:start])
+	length := utf8.RuneCountInString(folded[start:end])
+	rawRunes := []rune(raw)
+	if startRune+length > len(rawRunes) {
+		return ""
+	}
+	return string(rawRunes[startRune : startRune+length])
+}
+
+// samePriceWord compares a word of the content with an accented dictionary word;
+// accent-free content is compared with the accent-free word
+func samePriceWord(text, word string, accented bool) bool {
+	return text == word || (!accented && text == foldVietnamese(word))
+}
+
+func isRangeSeparator(between string, accented bool) bool {
+	between = strings.TrimSpace(between)
+	for _, sep := range priceRangeSeparators {
+		if samePriceWord(between, sep, accented) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSuffixWord reports whether text ends with one of the words
+func hasSuffixWord(text string, words []string, accented bool) bool {
+	fields := strings.Fields(text)
+	for _, w := range words {
+		n := len(strings.Fields(w))
+		if len(fields) >= n && samePriceWord(strings.Join(fields[len(fields)-n:], " "), w, accented) {
+			return true
+		}
+	}
+	return false
+}
+
+// priceWords splits text into words, dropping punctuation
+func priceWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// hasPrefixWord reports whether the words start with one of the dictionary words
+func hasPrefixWord(fields []string, words []string, accented bool) bool {
+	for _, w := range words {
+		n := len(strings.Fields(w))
+		if len(fields) >= n && samePriceWord(strings.Join(fields[:n], " "), w, accented) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPhrase reports whether one of the phrases appears as whole words
+func containsPhrase(text string, phrases []string, accented bool) bool {
+	fields := priceWords(text)
+	for _, p := range phrases {
+		n := len(strings.Fields(p))
+		for i := 0; i+n <= len(fields); i++ {
+			if samePriceWord(strings.Join(fields[i:i+n], " "), p, accented) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyParsedPrice post-processes classifier output: the parsed range from the content
+// wins over the single number guessed by the classifier
+func applyParsedPrice(info *PostInfo, content string) {
+	pr := ParsePrice(content)
+	if pr.IsZero() && info.Price > 0 {
+		pr.Min, pr.Max = info.Price, info.Price
+	}
+	info.PriceMin = pr.Min
+	info.PriceMax = pr.Max
+	info.Negotiable = pr.Negotiable
+	info.Price = pr.Mid()
+}
+
+// priceOverlapQuery builds an Elasticsearch query for documents whose [price_min, price_max]
+// overlaps [lo, hi]. A zero bound is open, and missing fields are open ends of the document range.
+func priceOverlapQuery(lo, hi int) map[string]interface{} {
+	must := []map[string]interface{}{
+		// The document must have a price at all
+		{
+			"bool": map[string]interface{}{
+				"should": []map[string]interface{}{
+					{"exists": map[string]interface{}{"field": "price_min"}},
+					{"exists": map[string]interface{}{"field": "price_max"}},
+				},
+				"minimum_should_match": 1,
+			},
+		},
+	}
+	if hi > 0 {
+		must = append(must, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": []map[string]interface{}{
+					{"range": map[string]interface{}{"price_min": map[string]interface{}{"lte": hi}}},
+					{"bool": map[string]interface{}{"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "price_min"}}}},
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	}
+	if lo > 0 {
+		must = append(must, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": []map[string]interface{}{
+					{"range": map[string]interface{}{"price_max": map[string]interface{}{"gte": lo}}},
+					{"bool": map[string]interface{}{"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "price_max"}}}},
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"must": must}}
+}
+
+// priceOverlapFilter is the MongoDB counterpart of priceOverlapQuery for posts
+func priceOverlapFilter(lo, hi int) bson.M {
+	and := []bson.M{
+		{"$or": []bson.M{{"priceMin": bson.M{"$gt": 0}}, {"priceMax": bson.M{"$gt": 0}}}},
+	}
+	if hi > 0 {
+		and = append(and, bson.M{"priceMin": bson.M{"$lte": hi}})
+	}
+	if lo > 0 {
+		and = append(and, bson.M{"$or": []bson.M{{"priceMax": bson.M{"$gte": lo}}, {"priceMax": 0}}})
+	}
+	return bson.M{"$and": and}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		text string
+		want PriceRange
+	}{
+		// Shorthand units
+		{"giá 15tr", PriceRange{Min: 15000000, Max: 15000000}},
+		{"500k", PriceRange{Min: 500000, Max: 500000}},
+		{"2 củ", PriceRange{Min: 2000000, Max: 2000000}},
+		{"2 lít", PriceRange{Min: 200000, Max: 200000}},
+		{"300 nghìn", PriceRange{Min: 300000, Max: 300000}},
+		{"2t", PriceRange{Min: 2000000, Max: 2000000}},
+		// Fractions of the unit
+		{"1tr5", PriceRange{Min: 1500000, Max: 1500000}},
+		{"1t2", PriceRange{Min: 1200000, Max: 1200000}},
+		{"1tỷ2", PriceRange{Min: 1200000000, Max: 1200000000}},
+		{"1,5 triệu", PriceRange{Min: 1500000, Max: 1500000}},
+		{"5 triệu rưỡi", PriceRange{Min: 5500000, Max: 5500000}},
+		{"1 ty ruoi", PriceRange{Min: 1500000000, Max: 1500000000}},
+		{"1tr5 rưỡi", PriceRange{Min: 1500000, Max: 1500000}},
+		// Compound and full amounts
+		{"1 tỷ 200 triệu", PriceRange{Min: 1200000000, Max: 1200000000}},
+		{"1tr 500k", PriceRange{Min: 1500000, Max: 1500000}},
+		{"15.000.000đ", PriceRange{Min: 15000000, Max: 15000000}},
+		// Ranges and bounds
+		{"10-12tr", PriceRange{Min: 10000000, Max: 12000000}},
+		{"từ 10 đến 12 triệu", PriceRange{Min: 10000000, Max: 12000000}},
+		{"dưới 10tr", PriceRange{Max: 10000000}},
+		{"trên 5 triệu", PriceRange{Min: 5000000}},
+		{"tầm 10tr đổ lại", PriceRange{Max: 10000000}},
+		{"tam 10tr do lai, ai co ib", PriceRange{Max: 10000000}},
+		{"10tr trở xuống", PriceRange{Max: 10000000}},
+		{"10tr trở lên", PriceRange{Min: 10000000}},
+		{"dưới 5 triệu rưỡi", PriceRange{Max: 5500000}},
+		// Negotiable
+		{"giá 500k thương lượng", PriceRange{Min: 500000, Max: 500000, Negotiable: true}},
+		{"1t2, fix nhẹ", PriceRange{Min: 1200000, Max: 1200000, Negotiable: true}},
+		// Numbers that are not prices
+		{"iphone 13 pro 256gb giá 15tr", PriceRange{Min: 15000000, Max: 15000000}},
+		{"bán 5 cái áo", PriceRange{}},
+		{"5 t", PriceRange{}},
+		{"máy cũ", PriceRange{}},
+		{"rưỡi", PriceRange{}},
+		// Word units starting ordinary words
+		{"bán 2 đồng hồ casio giá 500k", PriceRange{Min: 500000, Max: 500000}},
+		{"5 lít xăng", PriceRange{}},
+		{"2 tỷ lệ", PriceRange{}},
+		{"3 củ khoai", PriceRange{}},
+		{"ban 2 dong ho, gia 1tr2", PriceRange{Min: 1200000, Max: 1200000}},
+		{"giá 3 củ khoai", PriceRange{Min: 3000000, Max: 3000000}},
+		{"nhà 2 tỷ đồng", PriceRange{Min: 2000000000, Max: 2000000000}},
+		{"5 củ thương lượng", PriceRange{Min: 5000000, Max: 5000000, Negotiable: true}},
+		{"3 củ đổ lại", PriceRange{Max: 3000000}},
+		{"2 lít, bao ship", PriceRange{Min: 200000, Max: 200000}},
+	}
+	for _, tt := range tests {
+		if got := ParsePrice(tt.text); got != tt.want {
+			t.Errorf("ParsePrice(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPriceRangeMid(t *testing.T) {
+	tests := []struct {
+		pr   PriceRange
+		want int
+	}{
+		{PriceRange{}, 0},
+		{PriceRange{Min: 5, Max: 5}, 5},
+		{PriceRange{Min: 10, Max: 20}, 15},
+		{PriceRange{Min: 10}, 10},
+		{PriceRange{Max: 20}, 20},
+	}
+	for _, tt := range tests {
+		if got := tt.pr.Mid(); got != tt.want {
+			t.Errorf("%+v.Mid() = %d, want %d", tt.pr, got, tt.want)
+		}
+	}
+}
+
+func TestFormatVND(t *testing.T) {
+	tests := []struct {
+		amount int
+		want   string
+	}{
+		{0, "0đ"},
+		{500, "500đ"},
+		{1000, "1.000đ"},
+		{15000000, "15.000.000đ"},
+		{-250000, "-250.000đ"},
+	}
+	for _, tt := range tests {
+		if got := FormatVND(tt.amount); got != tt.want {
+			t.Errorf("FormatVND(%d) = %q, want %q", tt.amount, got, tt.want)
+		}
+	}
+}
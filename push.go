@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// pushSendTimeout bounds the notifications sent after a message is stored
+const pushSendTimeout = 15 * time.Second
+
+// pushPreviewLimit is the number of characters of the message shown in a notification
+const pushPreviewLimit = 100
+
+// ErrUnregisteredToken is returned by a transport when a device token is no longer valid
+var ErrUnregisteredToken = errors.New("device token is not registered")
+
+// DeviceToken is an FCM registration token of one of the user's devices
+type DeviceToken struct {
+	Token     string    `bson:"token" json:"token"`
+	Platform  string    `bson:"platform" json:"platform"` // web | android | ios
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// PushNotification is what a transport delivers to one device
+type PushNotification struct {
+	Title    string            `json:"title"`
+	Body     string            `json:"body"`
+	ImageURL string            `json:"imageUrl,omitempty"`
+	Link     string            `json:"link,omitempty"`
+	Data     map[string]string `json:"data"`
+}
+
+// PushTransport delivers notifications to device tokens
+type PushTransport interface {
+	Send(ctx context.Context, token string, notification PushNotification) error
+}
+
+// pushTransport is the backend used for chat notifications, selected in main by NewPushTransportFromEnv
+var pushTransport PushTransport = NewRecordingPushTransport()
+
+// NewPushTransportFromEnv selects the push backend from the PUSH_PROVIDER variable:
+// "fcm" (requires FCM_CREDENTIALS_FILE) or "memory" (default, records and logs notifications)
+func NewPushTransportFromEnv(ctx context.Context) (PushTransport, error) {
+	switch provider := getEnv("PUSH_PROVIDER", "memory"); provider {
+	case "fcm":
+		path := os.Getenv("FCM_CREDENTIALS_FILE")
+		if path == "" {
+			return nil, errors.New("FCM_CREDENTIALS_FILE must be set")
+		}
+		credentials, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return NewFCMTransport(ctx, credentials, os.Getenv("FCM_PROJECT_ID"))
+	case "memory":
+		return NewRecordingPushTransport(), nil
+	default:
+		return nil, fmt.Errorf("unknown push provider %q", provider)
+	}
+}
+
+// FCMTransport sends notifications with the Firebase Cloud Messaging HTTP v1 API
+type FCMTransport struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewFCMTransport authenticates with a service account JSON key. The project
+// is taken from the key unless projectID is given.
+func NewFCMTransport(ctx context.Context, credentialsJSON []byte, projectID string) (*FCMTransport, error) {
+	creds, err := google.CredentialsFromJSON(ctx, credentialsJSON, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return nil, fmt.Errorf("error reading FCM credentials: %w", err)
+	}
+	if projectID == "" {
+		projectID = creds.ProjectID
+	}
+	if projectID == "" {
+		return nil, errors.New("FCM project ID not found in credentials, set FCM_PROJECT_ID")
+	}
+
+	// The token source outlives the startup context
+	client := oauth2.NewClient(context.Background(), creds.TokenSource)
+	client.Timeout = 10 * time.Second
+	return &FCMTransport{
+		client:   client,
+		endpoint: fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", projectID),
+	}, nil
+}
+
+// Send delivers one notification; unknown tokens are reported as ErrUnregisteredToken
+func (ft *FCMTransport) Send(ctx context.Context, token string, notification PushNotification) error {
+	message := map[string]interface{}{
+		"token": token,
+		"notification": map[string]interface{}{
+			"title": notification.Title,
+			"body":  notification.Body,
+			"image": notification.ImageURL,
+		},
+		"data": notification.Data,
+	}
+	if notification.Link != "" {
+		// Web clients open the link when the notification is clicked
+		message["webpush"] = map[string]interface{}{
+			"fcm_options": map[string]interface{}{"link": notification.Link},
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"message": message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ft.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ft.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending push notification: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		if resp.StatusCode == http.StatusNotFound || strings.Contains(string(detail), "UNREGISTERED") {
+			return ErrUnregisteredToken
+		}
+		return fmt.Errorf("error sending push notification: %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// SentPush is a notification captured by RecordingPushTransport
+type SentPush struct {
+	Token        string
+	Notification PushNotification
+}
+
+// RecordingPushTransport keeps notifications in memory instead of sending them,
+// for development and tests
+type RecordingPushTransport struct {
+	mu   sync.Mutex
+	sent []SentPush
+}
+
+// NewRecordingPushTransport creates an empty recorder
+func NewRecordingPushTransport() *RecordingPushTransport {
+	return &RecordingPushTransport{}
+}
+
+// Send records the notification
+func (rt *RecordingPushTransport) Send(ctx context.Context, token string, notification PushNotification) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.sent = append(rt.sent, SentPush{Token: token, Notification: notification})
+	log.Printf("Push to %s: %s: %s", token, notification.Title, notification.Body)
+	return nil
+}
+
+// Sent returns a copy of the recorded notifications
+func (rt *RecordingPushTransport) Sent() []SentPush {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	return append([]SentPush(nil), rt.sent...)
+}
+
+// usernameShortcut returns the "@username" shortcut of a user; Facebook names
+// contain spaces, which are dropped
+func usernameShortcut(user User) string {
+	name := strings.Join(strings.Fields(user.Username), "")
+	if name == "" {
+		name = user.ID.Hex()
+	}
+	return "@" + name
+}
+
+// chatRoomLink is the frontend URL opening a chat room
+func chatRoomLink(roomID primitive.ObjectID) string {
+	return frontendURL + "/chat?room=" + roomID.Hex()
+}
+
+// buildMessagePush builds the notification of a new message for its recipient
+func buildMessagePush(room *ChatRoom, msg Message, sender User) PushNotification {
+	preview := truncateSMS(msg.Content, pushPreviewLimit)
+	if preview == "" && len(msg.Attachments) > 0 {
+		preview = "Đã gửi một hình ảnh"
+	}
+	shortcut := usernameShortcut(sender)
+	link := chatRoomLink(room.ID)
+	return PushNotification{
+		Title:    sender.Username,
+		Body:     preview,
+		ImageURL: sender.Avatar,
+		Link:     link,
+		Data: map[string]string{
+			"type":      "message",
+			"roomId":    room.ID.Hex(),
+			"messageId": msg.ID.Hex(),
+			"senderId":  sender.ID.Hex(),
+			"avatar":    sender.Avatar,
+			"preview":   preview,
+			"shortcut":  shortcut,
+			"link":      link,
+		},
+	}
+}
+
+// notifyOfflineParticipants pushes a new message to the room participants other than
+// the sender that have no open WebSocket. It runs in the background.
+func notifyOfflineParticipants(room *ChatRoom, msg Message) {
+	var recipients []primitive.ObjectID
+	for _, userID := range []primitive.ObjectID{room.BuyerID, room.SellerID} {
+		if userID != msg.SenderID && !chatHub.IsOnline(userID) {
+			recipients = append(recipients, userID)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pushSendTimeout)
+		defer cancel()
+
+		var sender User
+		if err := userCollection.FindOne(ctx, bson.M{"_id": msg.SenderID}).Decode(&sender); err != nil {
+			log.Printf("Warning: Error loading message sender for push: %v", err)
+			return
+		}
+		pushToUsers(ctx, recipients, buildMessagePush(room, msg, sender))
+	}()
+}
+
+// buildMatchPush builds the notification of a new post matching a saved search
+func buildMatchPush(match Match) PushNotification {
+	preview := ""
+	if match.Post != nil {
+		preview = truncateSMS(match.Post.Content, pushPreviewLimit)
+	}
+	link := frontendURL + "/matches"
+	return PushNotification{
+		Title: fmt.Sprintf("Tin mới phù hợp %d%% với tìm kiếm của bạn", match.MatchPercent),
+		Body:  preview,
+		Link:  link,
+		Data: map[string]string{
+			"type":          "match",
+			"matchId":       match.ID.Hex(),
+			"savedSearchId": match.SavedSearchID.Hex(),
+			"postId":        match.PostID.Hex(),
+			"preview":       preview,
+			"link":          link,
+		},
+	}
+}
+
+// notifyOfflineMatch pushes a match to the owner of the saved search when they have no
+// open WebSocket. It runs in the background.
+func notifyOfflineMatch(match Match) {
+	if chatHub.IsOnline(match.UserID) {
+		return
+	}
+	notification := buildMatchPush(match)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pushSendTimeout)
+		defer cancel()
+
+		pushToUsers(ctx, []primitive.ObjectID{match.UserID}, notification)
+	}()
+}
+
+// pushToUsers sends a notification to every registered device of the users, forgetting
+// the tokens the push service rejects
+func pushToUsers(ctx context.Context, userIDs []primitive.ObjectID, notification PushNotification) {
+	cursor, err := userCollection.Find(ctx, bson.M{
+		"_id":          bson.M{"$in": userIDs},
+		"deviceTokens": bson.M{"$exists": true, "$ne": bson.A{}},
+	})
+	if err != nil {
+		log.Printf("Warning: Error loading push recipients: %v", err)
+		return
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		log.Printf("Warning: Error loading push recipients: %v", err)
+		return
+	}
+
+	for _, user := range users {
+		for _, device := range user.DeviceTokens {
+			err := pushTransport.Send(ctx, device.Token, notification)
+			if errors.Is(err, ErrUnregisteredToken) {
+				if err := removeDeviceToken(ctx, user.ID, device.Token); err != nil {
+					log.Printf("Warning: Error removing device token: %v", err)
+				}
+			} else if err != nil {
+				log.Printf("Warning: Error sending push notification: %v", err)
+			}
+		}
+	}
+}
+
+// removeDeviceToken forgets a token the push service no longer accepts
+func removeDeviceToken(ctx context.Context, userID primitive.ObjectID, token string) error {
+	_, err := userCollection.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$pull": bson.M{"deviceTokens": bson.M{"token": token}}},
+	)
+	return err
+}
+
+// handleRegisterDevice registers a push token for the current user. A token belongs to
+// one device, so it is removed from any other account first.
+func handleRegisterDevice(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Platform string `json:"platform" binding:"omitempty,oneof=web android ios"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+	if req.Platform == "" {
+		req.Platform = "web"
+	}
+
+	ctx := c.Request.Context()
+	userID := currentUser(c).ID
+	_, err := userCollection.UpdateMany(ctx,
+		bson.M{"deviceTokens.token": req.Token},
+		bson.M{"$pull": bson.M{"deviceTokens": bson.M{"token": req.Token}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register device", "detail": err.Error()})
+		return
+	}
+
+	device := DeviceToken{Token: req.Token, Platform: req.Platform, CreatedAt: time.Now()}
+	_, err = userCollection.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$push": bson.M{"deviceTokens": device}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register device", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"device": device})
+}
+
+// handleUnregisterDevice removes a push token of the current user, e.g. on logout
+func handleUnregisterDevice(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	if err := removeDeviceToken(c.Request.Context(), currentUser(c).ID, req.Token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unregister device", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
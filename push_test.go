@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUsernameShortcut(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		user User
+		want string
+	}{
+		{User{ID: id, Username: "lan"}, "@lan"},
+		{User{ID: id, Username: "Nguyễn Văn An"}, "@NguyễnVănAn"},
+		{User{ID: id, Username: "  "}, "@" + id.Hex()},
+	}
+	for _, tt := range tests {
+		if got := usernameShortcut(tt.user); got != tt.want {
+			t.Errorf("usernameShortcut(%q) = %q, want %q", tt.user.Username, got, tt.want)
+		}
+	}
+}
+
+func TestBuildMessagePush(t *testing.T) {
+	previous := frontendURL
+	frontendURL = "https://chobuy.vn"
+	t.Cleanup(func() { frontendURL = previous })
+
+	room := &ChatRoom{ID: primitive.NewObjectID()}
+	sender := User{ID: primitive.NewObjectID(), Username: "Trần Minh", Avatar: "https://cdn.example/avatar.jpg"}
+	link := "https://chobuy.vn/chat?room=" + room.ID.Hex()
+
+	tests := []struct {
+		name    string
+		msg     Message
+		preview string
+	}{
+		{"text", Message{ID: primitive.NewObjectID(), Content: "Còn hàng không bạn?"}, "Còn hàng không bạn?"},
+		{"long text", Message{ID: primitive.NewObjectID(), Content: strings.Repeat("a", 150)}, truncateSMS(strings.Repeat("a", 150), pushPreviewLimit)},
+		{"image only", Message{ID: primitive.NewObjectID(), Attachments: []Attachment{{}}}, "Đã gửi một hình ảnh"},
+	}
+	for _, tt := range tests {
+		got := buildMessagePush(room, tt.msg, sender)
+		if got.Title != "Trần Minh" || got.ImageURL != sender.Avatar || got.Link != link || got.Body != tt.preview {
+			t.Errorf("%s: notification = %+v", tt.name, got)
+		}
+		want := map[string]string{
+			"type":      "message",
+			"roomId":    room.ID.Hex(),
+			"messageId": tt.msg.ID.Hex(),
+			"senderId":  sender.ID.Hex(),
+			"avatar":    sender.Avatar,
+			"preview":   tt.preview,
+			"shortcut":  "@TrầnMinh",
+			"link":      link,
+		}
+		for key, value := range want {
+			if got.Data[key] != value {
+				t.Errorf("%s: data[%q] = %q, want %q", tt.name, key, got.Data[key], value)
+			}
+		}
+	}
+}
+
+func TestNotifyOfflineParticipants(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	buyer := User{ID: primitive.NewObjectID(), Username: "buyer", Avatar: "https://cdn.example/buyer.jpg"}
+	seller := User{ID: primitive.NewObjectID(), Username: "seller"}
+	room := &ChatRoom{ID: primitive.NewObjectID(), BuyerID: buyer.ID, SellerID: seller.ID}
+	sellerDoc := bson.D{
+		{Key: "_id", Value: seller.ID},
+		{Key: "username", Value: seller.Username},
+		{Key: "deviceTokens", Value: bson.A{
+			bson.D{{Key: "token", Value: "seller-phone"}, {Key: "platform", Value: "android"}},
+			bson.D{{Key: "token", Value: "seller-web"}, {Key: "platform", Value: "web"}},
+		}},
+	}
+	buyerDoc := bson.D{
+		{Key: "_id", Value: buyer.ID},
+		{Key: "username", Value: buyer.Username},
+		{Key: "avatar", Value: buyer.Avatar},
+	}
+
+	// setup swaps in a recording transport and the mocked users collection
+	setup := func(mt *mtest.T) *RecordingPushTransport {
+		recorder := NewRecordingPushTransport()
+		previousTransport, previousUsers := pushTransport, userCollection
+		pushTransport, userCollection = recorder, mt.Coll
+		mt.Cleanup(func() { pushTransport, userCollection = previousTransport, previousUsers })
+		return recorder
+	}
+
+	mt.Run("offline recipient", func(mt *mtest.T) {
+		recorder := setup(mt)
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, buyerDoc),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, sellerDoc),
+		)
+
+		msg := Message{ID: primitive.NewObjectID(), RoomID: room.ID, SenderID: buyer.ID, Content: "Giá 15tr được không?"}
+		notifyOfflineParticipants(room, msg)
+
+		sent := waitForPushes(recorder, 2)
+		if len(sent) != 2 || sent[0].Token != "seller-phone" || sent[1].Token != "seller-web" {
+			mt.Fatalf("sent = %+v, want the seller's two devices", sent)
+		}
+		n := sent[0].Notification
+		if n.Title != "buyer" || n.Body != msg.Content || n.ImageURL != buyer.Avatar || n.Data["shortcut"] != "@buyer" {
+			mt.Errorf("notification = %+v", n)
+		}
+		if n.Link != chatRoomLink(room.ID) || n.Data["link"] != chatRoomLink(room.ID) {
+			mt.Errorf("link = %q, want %q", n.Link, chatRoomLink(room.ID))
+		}
+	})
+
+	mt.Run("online recipient", func(mt *mtest.T) {
+		recorder := setup(mt)
+		client := &wsClient{hub: chatHub, userID: seller.ID, send: make(chan []byte, wsSendBuffer)}
+		chatHub.register(client, nil)
+		mt.Cleanup(func() { chatHub.unregister(client) })
+
+		notifyOfflineParticipants(room, Message{ID: primitive.NewObjectID(), RoomID: room.ID, SenderID: buyer.ID, Content: "alo"})
+
+		// No recipient is left, so nothing is loaded nor sent in the background
+		if sent := recorder.Sent(); len(sent) != 0 {
+			mt.Errorf("sent = %+v, want nothing for an online recipient", sent)
+		}
+	})
+
+	mt.Run("sender is skipped", func(mt *mtest.T) {
+		recorder := setup(mt)
+		client := &wsClient{hub: chatHub, userID: buyer.ID, send: make(chan []byte, wsSendBuffer)}
+		chatHub.register(client, nil)
+		mt.Cleanup(func() { chatHub.unregister(client) })
+
+		// The seller writes while offline and the buyer is online
+		notifyOfflineParticipants(room, Message{ID: primitive.NewObjectID(), RoomID: room.ID, SenderID: seller.ID, Content: "alo"})
+
+		if sent := recorder.Sent(); len(sent) != 0 {
+			mt.Errorf("sent = %+v, want nothing sent to the sender", sent)
+		}
+	})
+}
+
+// waitForPushes waits for the background sends of notifyOfflineParticipants
+func waitForPushes(recorder *RecordingPushTransport, n int) []SentPush {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if sent := recorder.Sent(); len(sent) >= n {
+			return sent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return recorder.Sent()
+}
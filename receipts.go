@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Message statuses, seen from the recipient: stored, pushed to one of their devices, read
+const (
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+// typingThrottle drops typing events a connection sends faster than this for a room.
+// Clients hide the indicator when no event came for a few seconds.
+const typingThrottle = 2 * time.Second
+
+var ErrMessageNotInRoom = errors.New("message not found in this chat room")
+
+// Receipt tells the room how far a participant has received and read it
+type Receipt struct {
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty"`
+}
+
+// clientEvent is a frame sent by a WebSocket client
+// type: "typing" | "read"
+type clientEvent struct {
+	Type      string `json:"type"`
+	RoomID    string `json:"roomId"`
+	Typing    bool   `json:"typing"`
+	MessageID string `json:"messageId"`
+}
+
+// recipientOf returns the participant a message of the room is addressed to
+func (room *ChatRoom) recipientOf(msg *Message) primitive.ObjectID {
+	if msg.SenderID == room.BuyerID {
+		return room.SellerID
+	}
+	return room.BuyerID
+}
+
+// MessageStatus tells whether the recipient of a message has received and read it
+func (room *ChatRoom) MessageStatus(msg *Message) string {
+	key := room.recipientOf(msg).Hex()
+	if at, ok := room.LastReadAt[key]; ok && !at.Before(msg.CreatedAt) {
+		return MessageStatusRead
+	}
+	if at, ok := room.DeliveredAt[key]; ok && !at.Before(msg.CreatedAt) {
+		return MessageStatusDelivered
+	}
+	return MessageStatusSent
+}
+
+// advanceCursor moves a cursor of a participant ("lastReadAt" or "deliveredAt") forward
+// to at. Cursors never move back; the boolean reports whether it moved.
+func advanceCursor(ctx context.Context, db *mongo.Database, roomID, userID primitive.ObjectID, cursor string, at time.Time) (bool, error) {
+	key := cursor + "." + userID.Hex()
+	result, err := db.Collection("chatrooms").UpdateOne(ctx,
+		bson.M{"_id": roomID, "$or": []bson.M{{key: bson.M{"$exists": false}}, {key: bson.M{"$lt": at}}}},
+		bson.M{"$set": bson.M{key: at}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// MarkDelivered records that a participant received the messages of a room up to at,
+// and tells the room
+func MarkDelivered(ctx context.Context, db *mongo.Database, roomID, userID primitive.ObjectID, at time.Time) (bool, error) {
+	moved, err := advanceCursor(ctx, db, roomID, userID, "deliveredAt", at)
+	if err != nil || !moved {
+		return false, err
+	}
+	chatHub.Publish(roomID, ChatEvent{Type: "receipt", RoomID: roomID.Hex(), UserID: userID.Hex(), Receipt: &Receipt{DeliveredAt: &at}})
+	return true, nil
+}
+
+// MarkRead records that a participant read the messages of a room up to at, which
+// implies they received them, and tells the room
+func MarkRead(ctx context.Context, db *mongo.Database, roomID, userID primitive.ObjectID, at time.Time) (bool, error) {
+	if _, err := advanceCursor(ctx, db, roomID, userID, "deliveredAt", at); err != nil {
+		return false, err
+	}
+	moved, err := advanceCursor(ctx, db, roomID, userID, "lastReadAt", at)
+	if err != nil || !moved {
+		return false, err
+	}
+	chatHub.Publish(roomID, ChatEvent{Type: "receipt", RoomID: roomID.Hex(), UserID: userID.Hex(), Receipt: &Receipt{DeliveredAt: &at, ReadAt: &at}})
+	return true, nil
+}
+
+// readUpTo returns the time a read cursor moves to: the given message, or the last
+// message of the room when none is given
+func readUpTo(ctx context.Context, db *mongo.Database, roomID primitive.ObjectID, messageID string) (time.Time, error) {
+	filter := bson.M{"roomId": roomID}
+	if messageID != "" {
+		id, err := primitive.ObjectIDFromHex(messageID)
+		if err != nil {
+			return time.Time{}, ErrMessageNotInRoom
+		}
+		filter["_id"] = id
+	}
+
+	var msg Message
+	err := db.Collection("messages").FindOne(ctx, filter,
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}),
+	).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		if messageID != "" {
+			return time.Time{}, ErrMessageNotInRoom
+		}
+		return time.Now(), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return msg.CreatedAt, nil
+}
+
+// countUnread counts the messages of the other participant after the user's read cursor
+func countUnread(ctx context.Context, room *ChatRoom, userID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"roomId": room.ID, "senderId": bson.M{"$ne": userID}}
+	if lastRead, ok := room.LastReadAt[userID.Hex()]; ok {
+		filter["createdAt"] = bson.M{"$gt": lastRead}
+	}
+	return messageCollection.CountDocuments(ctx, filter)
+}
+
+// PublishTyping tells a room that a participant started or stopped typing.
+// Typing events are not stored.
+func PublishTyping(roomID, userID primitive.ObjectID, typing bool) {
+	chatHub.Publish(roomID, ChatEvent{Type: "typing", RoomID: roomID.Hex(), UserID: userID.Hex(), Typing: &typing})
+}
+
+// handleEvent processes a frame of the client: typing indicators and read receipts
+// for the rooms it is subscribed to. Invalid frames are ignored.
+func (c *wsClient) handleEvent(data []byte) {
+	var event clientEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	roomID, err := primitive.ObjectIDFromHex(event.RoomID)
+	if err != nil || !c.hub.isSubscribed(c, roomID) {
+		return
+	}
+
+	switch event.Type {
+	case "typing":
+		if event.Typing {
+			if time.Since(c.lastTyping[roomID]) < typingThrottle {
+				return
+			}
+			c.lastTyping[roomID] = time.Now()
+		} else {
+			delete(c.lastTyping, roomID)
+		}
+		PublishTyping(roomID, c.userID, event.Typing)
+	case "read":
+		ctx := context.Background()
+		at, err := readUpTo(ctx, mongoDB, roomID, event.MessageID)
+		if err == nil {
+			_, err = MarkRead(ctx, mongoDB, roomID, c.userID, at)
+		}
+		if err != nil && err != ErrMessageNotInRoom {
+			log.Printf("Warning: Error marking room %s read: %v", roomID.Hex(), err)
+		}
+	}
+}
+
+// handleMarkRead moves the read cursor of the current user in a room.
+// Body (optional): {"messageId": "..."}, the last message read; defaults to the last message of the room
+func handleMarkRead(c *gin.Context) {
+	var req struct {
+		MessageID string `json:"messageId"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+			return
+		}
+	}
+
+	room := loadRoomFromParam(c)
+	if room == nil {
+		return
+	}
+	userID := currentUser(c).ID
+	ctx := c.Request.Context()
+
+	at, err := readUpTo(ctx, mongoDB, room.ID, req.MessageID)
+	if err == ErrMessageNotInRoom {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+	if _, err := MarkRead(ctx, mongoDB, room.ID, userID, at); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark room read", "detail": err.Error()})
+		return
+	}
+
+	// Reload the cursor: an earlier message does not move it back
+	if err := chatroomCollection.FindOne(ctx, bson.M{"_id": room.ID}).Decode(room); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+	unread, err := countUnread(ctx, room, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"lastReadAt": room.LastReadAt[userID.Hex()], "unreadCount": unread})
+}
+
+// handleTyping publishes a typing indicator for clients that do not send it over the WebSocket.
+// Body: {"typing": true}
+func handleTyping(c *gin.Context) {
+	var req struct {
+		Typing bool `json:"typing"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	room := loadRoomFromParam(c)
+	if room == nil {
+		return
+	}
+
+	PublishTyping(room.ID, currentUser(c).ID, req.Typing)
+	c.Status(http.StatusNoContent)
+}
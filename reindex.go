@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reindex job statuses
+const (
+	ReindexStatusRunning = "running"
+	ReindexStatusDone    = "done"
+)
+
+// defaultReindexBatch is the number of documents read from MongoDB and sent per bulk request
+const defaultReindexBatch = 500
+
+// ReindexJob struct
+// Progress of the build of a versioned index, kept to resume it after an interruption
+type ReindexJob struct {
+	ID    string `bson:"_id" json:"index"` // the versioned index, e.g. chat_messages_v2
+	Alias string `bson:"alias" json:"alias"`
+	// Backfill jobs write into the index the alias already points to, nothing is swapped
+	Backfill bool   `bson:"backfill" json:"backfill"`
+	Status   string `bson:"status" json:"status"`
+	// LastID is the last MongoDB document sent; documents are streamed in _id order
+	LastID      primitive.ObjectID `bson:"lastId,omitempty" json:"lastId,omitempty"`
+	Indexed     int64              `bson:"indexed" json:"indexed"`
+	StartedAt   time.Time          `bson:"startedAt" json:"startedAt"`
+	UpdatedAt   time.Time          `bson:"updatedAt" json:"updatedAt"`
+	CompletedAt *time.Time         `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+}
+
+// bulkDocument is a document to index with the bulk API
+type bulkDocument struct {
+	ID     string
+	Source interface{}
+}
+
+// reindexSource describes how an index is rebuilt from MongoDB
+type reindexSource struct {
+	alias      string
+	version    int
+	mapping    string
+	collection string
+	// eventTypes are the outbox events that write to the index
+	eventTypes []string
+	// load reads up to limit documents after the given _id and returns them with
+	// the _id of the last one read, which is after itself once the collection is exhausted
+	load func(ctx context.Context, db *mongo.Database, after primitive.ObjectID, limit int) ([]bulkDocument, primitive.ObjectID, error)
+}
+
+// reindexSources are the indices the reindex command rebuilds, in order
+var reindexSources = []reindexSource{
+	{
+		alias: chatMessagesIndex, version: chatMessagesVersion, mapping: chatMessagesMapping, collection: "messages",
+		eventTypes: []string{OutboxIndexMessage, OutboxSyncPostMessages}, load: loadChatMessageDocuments,
+	},
+	{
+		alias: postsIndex, version: postsVersion, mapping: postsMapping, collection: "posts",
+		eventTypes: []string{OutboxIndexPost, OutboxSyncUserReputation}, load: loadPostDocuments,
+	},
+	{
+		alias: savedSearchesIndex, version: savedSearchesVersion, mapping: savedSearchesMapping, collection: "saved_searches",
+		eventTypes: []string{OutboxIndexSavedSearch}, load: loadSavedSearchDocuments,
+	},
+}
+
+// versionedIndex returns the name of the index an alias points to for a mapping version
+func versionedIndex(alias string, version int) string {
+	return fmt.Sprintf("%s_v%d", alias, version)
+}
+
+// indexBody returns the index creation body of a mapping, with the alias pointing to
+// the index when given. Indices being built are not refreshed until the build is done.
+func indexBody(mapping, alias string, building bool) (string, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+		return "", fmt.Errorf("error parsing mapping: %w", err)
+	}
+	if alias != "" {
+		body["aliases"] = map[string]interface{}{alias: map[string]interface{}{}}
+	}
+	if building {
+		settings, _ := body["settings"].(map[string]interface{})
+		if settings == nil {
+			settings = map[string]interface{}{}
+			body["settings"] = settings
+		}
+		settings["refresh_interval"] = "-1"
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// indexExists tells whether an index or alias exists
+func indexExists(ctx context.Context, name string) (bool, error) {
+	req := esapi.IndicesExistsRequest{Index: []string{name}}
+	res, err := req.Do(ctx, ElasticClient)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return false, nil
+	}
+	if res.IsError() {
+		return false, fmt.Errorf("error checking index %s: %s", name, res.String())
+	}
+	return true, nil
+}
+
+// aliasTargets returns the indices an alias points to. concrete reports that the name
+// is an index instead, as created before indices were versioned.
+func aliasTargets(ctx context.Context, alias string) (targets []string, concrete bool, err error) {
+	req := esapi.IndicesGetAliasRequest{Name: []string{alias}}
+	res, err := req.Do(ctx, ElasticClient)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		concrete, err := indexExists(ctx, alias)
+		return nil, concrete, err
+	}
+	if res.IsError() {
+		return nil, false, fmt.Errorf("error getting alias %s: %s", alias, res.String())
+	}
+
+	var indices map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, false, err
+	}
+	for index := range indices {
+		targets = append(targets, index)
+	}
+	sort.Strings(targets)
+	return targets, false, nil
+}
+
+// ensureAliasedIndex creates the current version of an index with the alias pointing to
+// it when the alias doesn't exist. An alias pointing elsewhere is left alone until the
+// reindex command rebuilds it.
+func ensureAliasedIndex(alias string, version int, mapping string) error {
+	ctx := context.Background()
+	targets, concrete, err := aliasTargets(ctx, alias)
+	if err != nil {
+		return err
+	}
+
+	index := versionedIndex(alias, version)
+	if !concrete && len(targets) == 0 {
+		body, err := indexBody(mapping, alias, false)
+		if err != nil {
+			return err
+		}
+		return createIndexIfMissing(index, body)
+	}
+	if concrete || !slices.Contains(targets, index) {
+		log.Printf("Warning: %s is not on %s, run `chat-buysell reindex -index %s` to rebuild it", alias, index, alias)
+	}
+	return nil
+}
+
+// deleteIndex removes an index, if it exists
+func deleteIndex(ctx context.Context, index string) error {
+	req := esapi.IndicesDeleteRequest{Index: []string{index}}
+	res, err := req.Do(ctx, ElasticClient)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() && res.StatusCode != 404 {
+		return fmt.Errorf("error deleting index %s: %s", index, res.String())
+	}
+	return nil
+}
+
+// finishIndexBuild restores the refresh interval of a built index and refreshes it
+func finishIndexBuild(ctx context.Context, index string) error {
+	settings := esapi.IndicesPutSettingsRequest{
+		Index: []string{index},
+		Body:  strings.NewReader(`{"index": {"refresh_interval": null}}`),
+	}
+	res, err := settings.Do(ctx, ElasticClient)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error updating settings of %s: %s", index, res.String())
+	}
+
+	return refreshIndex(ctx, index)
+}
+
+// refreshIndex makes the documents written to an index searchable
+func refreshIndex(ctx context.Context, index string) error {
+	req := esapi.IndicesRefreshRequest{Index: []string{index}}
+	res, err := req.Do(ctx, ElasticClient)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error refreshing %s: %s", index, res.String())
+	}
+	return nil
+}
+
+// updateByQuery runs a script over the documents of an index matching a query. It is
+// how outbox events copy a change into documents owned by other events, which may have
+// been written with the old state: update by query only sees refreshed documents, and
+// bulk writes are not refreshed, so the index is refreshed first. Documents written
+// while the update runs are version conflicts and fail the call, so the event is retried.
+func updateByQuery(ctx context.Context, index string, query map[string]interface{}) error {
+	data, err := json.Marshal(query)
+	if err != nil {
+		return fmt.Errorf("error marshaling update query: %w", err)
+	}
+	if err := refreshIndex(ctx, index); err != nil {
+		return err
+	}
+
+	req := esapi.UpdateByQueryRequest{
+		Index:     []string{index},
+		Body:      bytes.NewReader(data),
+		Conflicts: "proceed",
+	}
+	res, err := req.Do(ctx, ElasticClient)
+	if err != nil {
+		return fmt.Errorf("error updating %s: %w", index, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error updating %s: %s", index, res.String())
+	}
+	var result struct {
+		Updated          int `json:"updated"`
+		VersionConflicts int `json:"version_conflicts"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error parsing update response: %w", err)
+	}
+	if result.VersionConflicts > 0 {
+		return fmt.Errorf("error updating %s: %d documents changed during the update", index, result.VersionConflicts)
+	}
+	return nil
+}
+
+// swapAlias points an alias to index and away from the indices it pointed to, in one
+// atomic request. A concrete index holding the alias name is deleted in the same request.
+func swapAlias(ctx context.Context, alias, index string, targets []string, concrete bool) error {
+	actions := []map[string]interface{}{}
+	for _, target := range targets {
+		if target != index {
+			actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": target, "alias": alias}})
+		}
+	}
+	if concrete {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": alias}})
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": index, "alias": alias}})
+
+	data, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	req := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(data)}
+	res, err := req.Do(ctx, ElasticClient)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error swapping alias %s: %s", alias, res.String())
+	}
+	return nil
+}
+
+// findAfter reads up to limit documents of a collection after the given _id, in _id order
+func findAfter(ctx context.Context, collection *mongo.Collection, after primitive.ObjectID, limit int, results interface{}) error {
+	filter := bson.M{}
+	if !after.IsZero() {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+	cursor, err := collection.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+// loadChatMessageDocuments reads a batch of messages with the rooms and posts they belong to
+func loadChatMessageDocuments(ctx context.Context, db *mongo.Database, after primitive.ObjectID, limit int) ([]bulkDocument, primitive.ObjectID, error) {
+	var messages []Message
+	if err := findAfter(ctx, db.Collection("messages"), after, limit, &messages); err != nil {
+		return nil, after, err
+	}
+	if len(messages) == 0 {
+		return nil, after, nil
+	}
+
+	roomIDs := []primitive.ObjectID{}
+	for _, msg := range messages {
+		roomIDs = append(roomIDs, msg.RoomID)
+	}
+	var roomList []ChatRoom
+	cursor, err := db.Collection("chatrooms").Find(ctx, bson.M{"_id": bson.M{"$in": roomIDs}})
+	if err != nil {
+		return nil, after, err
+	}
+	if err := cursor.All(ctx, &roomList); err != nil {
+		return nil, after, err
+	}
+	rooms := map[primitive.ObjectID]*ChatRoom{}
+	postIDs := []primitive.ObjectID{}
+	for i := range roomList {
+		rooms[roomList[i].ID] = &roomList[i]
+		postIDs = append(postIDs, roomList[i].PostID)
+	}
+
+	var postList []Post
+	cursor, err = db.Collection("posts").Find(ctx, bson.M{"_id": bson.M{"$in": postIDs}})
+	if err != nil {
+		return nil, after, err
+	}
+	if err := cursor.All(ctx, &postList); err != nil {
+		return nil, after, err
+	}
+	posts := map[primitive.ObjectID]*Post{}
+	for i := range postList {
+		posts[postList[i].ID] = &postList[i]
+	}
+
+	docs := make([]bulkDocument, 0, len(messages))
+	for _, msg := range messages {
+		room := rooms[msg.RoomID]
+		var post *Post
+		if room != nil {
+			post = posts[room.PostID]
+		}
+		docs = append(docs, bulkDocument{ID: msg.ID.Hex(), Source: newChatMessageIndex(msg, room, post)})
+	}
+	return docs, messages[len(messages)-1].ID, nil
+}
+
+// loadPostDocuments reads a batch of posts with the reputation of their owners.
+// Deleted posts are skipped.
+func loadPostDocuments(ctx context.Context, db *mongo.Database, after primitive.ObjectID, limit int) ([]bulkDocument, primitive.ObjectID, error) {
+	var posts []Post
+	if err := findAfter(ctx, db.Collection("posts"), after, limit, &posts); err != nil {
+		return nil, after, err
+	}
+	if len(posts) == 0 {
+		return nil, after, nil
+	}
+
+	userIDs := []primitive.ObjectID{}
+	for _, post := range posts {
+		userIDs = append(userIDs, post.UserID)
+	}
+	var users []User
+	cursor, err := db.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": userIDs}},
+		options.Find().SetProjection(bson.M{"reputation": 1}))
+	if err != nil {
+		return nil, after, err
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, after, err
+	}
+	reputations := map[primitive.ObjectID]float64{}
+	for _, user := range users {
+		reputations[user.ID] = reputationScore(user.Reputation)
+	}
+
+	docs := make([]bulkDocument, 0, len(posts))
+	for i := range posts {
+		if posts[i].Status == PostStatusDeleted {
+			continue
+		}
+		doc := newPostIndex(&posts[i])
+		doc.UserReputation = reputationPriorMean
+		if score, ok := reputations[posts[i].UserID]; ok {
+			doc.UserReputation = score
+		}
+		docs = append(docs, bulkDocument{ID: doc.ID, Source: doc})
+	}
+	return docs, posts[len(posts)-1].ID, nil
+}
+
+// loadSavedSearchDocuments reads a batch of saved searches as percolator queries
+func loadSavedSearchDocuments(ctx context.Context, db *mongo.Database, after primitive.ObjectID, limit int) ([]bulkDocument, primitive.ObjectID, error) {
+	var searches []SavedSearch
+	if err := findAfter(ctx, db.Collection("saved_searches"), after, limit, &searches); err != nil {
+		return nil, after, err
+	}
+	if len(searches) == 0 {
+		return nil, after, nil
+	}
+
+	docs := make([]bulkDocument, 0, len(searches))
+	for i := range searches {
+		docs = append(docs, bulkDocument{ID: searches[i].ID.Hex(), Source: newSavedSearchDocument(&searches[i])})
+	}
+	return docs, searches[len(searches)-1].ID, nil
+}
+
+// replayOutboxSince makes the outbox worker mirror again the writes to an index recorded
+// since its build started: they reached the previous index only, or were overwritten by
+// older state streamed by the build. Dead events from before are covered by the build.
+// Events of the other indices are left alone.
+func replayOutboxSince(ctx context.Context, db *mongo.Database, source reindexSource, since time.Time) (int64, error) {
+	outbox := db.Collection("outbox")
+	types := bson.M{"$in": source.eventTypes}
+	now := time.Now()
+	if _, err := outbox.UpdateMany(ctx,
+		bson.M{"type": types, "status": OutboxStatusDead, "createdAt": bson.M{"$lt": since}},
+		bson.M{"$set": bson.M{"status": OutboxStatusDone, "processedAt": now}},
+	); err != nil {
+		return 0, err
+	}
+	result, err := outbox.UpdateMany(ctx,
+		bson.M{"type": types, "status": bson.M{"$in": []string{OutboxStatusDone, OutboxStatusDead}}, "createdAt": bson.M{"$gte": since}},
+		bson.M{
+			"$set":   bson.M{"status": OutboxStatusPending, "attempts": 0, "nextAttemptAt": now},
+			"$unset": bson.M{"processedAt": "", "lastError": ""},
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// Reindex rebuilds an index from MongoDB. When the alias does not point to the current
+// version yet, the versioned index is built from scratch then the alias is swapped to it;
+// otherwise the documents are written again into the live index. Progress is saved after
+// every batch and an interrupted job resumes where it stopped, unless restart is set.
+func Reindex(ctx context.Context, db *mongo.Database, source reindexSource, batch int, restart bool) error {
+	index := versionedIndex(source.alias, source.version)
+	jobs := db.Collection("reindex_jobs")
+
+	targets, concrete, err := aliasTargets(ctx, source.alias)
+	if err != nil {
+		return err
+	}
+	live := !concrete && slices.Contains(targets, index)
+
+	var job ReindexJob
+	err = jobs.FindOne(ctx, bson.M{"_id": index}).Decode(&job)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err == nil && job.Status == ReindexStatusDone && live && !restart {
+		log.Printf("%s is already built, use -restart to write its documents again", index)
+		return nil
+	}
+
+	fresh := restart || err == mongo.ErrNoDocuments || job.Status == ReindexStatusDone
+	if !fresh && !job.Backfill {
+		exists, err := indexExists(ctx, index)
+		if err != nil {
+			return err
+		}
+		fresh = !exists
+	}
+	if fresh {
+		now := time.Now()
+		job = ReindexJob{ID: index, Alias: source.alias, Backfill: live, Status: ReindexStatusRunning, StartedAt: now, UpdatedAt: now}
+		if !live {
+			// Leftovers of a build that was started over
+			if err := deleteIndex(ctx, index); err != nil {
+				return err
+			}
+			body, err := indexBody(source.mapping, "", true)
+			if err != nil {
+				return err
+			}
+			if err := createIndexIfMissing(index, body); err != nil {
+				return err
+			}
+		}
+		if _, err := jobs.ReplaceOne(ctx, bson.M{"_id": index}, job, options.Replace().SetUpsert(true)); err != nil {
+			return err
+		}
+		log.Printf("Building %s from %s", index, source.collection)
+	} else {
+		log.Printf("Resuming %s after %d documents", index, job.Indexed)
+	}
+
+	for {
+		docs, lastID, err := source.load(ctx, db, job.LastID, batch)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", source.collection, err)
+		}
+		if lastID == job.LastID {
+			break
+		}
+		if len(docs) > 0 {
+			if err := searchIndexer.IndexBatch(ctx, index, docs); err != nil {
+				return err
+			}
+		}
+
+		job.LastID = lastID
+		job.Indexed += int64(len(docs))
+		job.UpdatedAt = time.Now()
+		if _, err := jobs.UpdateOne(ctx, bson.M{"_id": index}, bson.M{"$set": bson.M{
+			"lastId": job.LastID, "indexed": job.Indexed, "updatedAt": job.UpdatedAt,
+		}}); err != nil {
+			return err
+		}
+		log.Printf("%s: %d documents indexed", index, job.Indexed)
+	}
+
+	if !job.Backfill {
+		if err := finishIndexBuild(ctx, index); err != nil {
+			return err
+		}
+		// The alias may have moved during the build
+		targets, concrete, err := aliasTargets(ctx, source.alias)
+		if err != nil {
+			return err
+		}
+		if err := swapAlias(ctx, source.alias, index, targets, concrete); err != nil {
+			return err
+		}
+		log.Printf("%s now points to %s", source.alias, index)
+		for _, target := range targets {
+			if target != index {
+				log.Printf("Previous index %s is kept, delete it once %s is checked", target, index)
+			}
+		}
+	}
+
+	replayed, err := replayOutboxSince(ctx, db, source, job.StartedAt)
+	if err != nil {
+		return fmt.Errorf("error replaying outbox: %w", err)
+	}
+	log.Printf("%d outbox events since the build started will be mirrored again", replayed)
+
+	now := time.Now()
+	_, err = jobs.UpdateOne(ctx, bson.M{"_id": index}, bson.M{"$set": bson.M{
+		"status": ReindexStatusDone, "updatedAt": now, "completedAt": now,
+	}})
+	return err
+}
+
+// runReindexCommand runs `chat-buysell reindex [-index chat_messages|posts|saved_searches|all] [-batch n] [-restart]`.
+// Interrupting it stops after the current batch is saved; running it again resumes.
+func runReindexCommand(db *mongo.Database, args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	only := flags.String("index", "all", "index to rebuild: chat_messages, posts, saved_searches or all")
+	batch := flags.Int("batch", defaultReindexBatch, "documents per bulk request")
+	restart := flags.Bool("restart", false, "start over instead of resuming an interrupted build")
+	flags.Parse(args)
+	if *batch <= 0 {
+		return fmt.Errorf("batch must be positive")
+	}
+
+	if err := InitElasticsearch("http://localhost:9200"); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	matched := false
+	for _, source := range reindexSources {
+		if *only != "all" && *only != source.alias {
+			continue
+		}
+		matched = true
+		if err := Reindex(ctx, db, source, *batch, *restart); err != nil {
+			return fmt.Errorf("%s: %w", source.alias, err)
+		}
+	}
+	if !matched {
+		return fmt.Errorf("unknown index %q", *only)
+	}
+	return nil
+}
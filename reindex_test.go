@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestReplayOutboxSince(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	for _, source := range reindexSources {
+		mt.Run(source.alias, func(mt *mtest.T) {
+			mt.AddMockResponses(
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}, bson.E{Key: "nModified", Value: 3}),
+			)
+			replayed, err := replayOutboxSince(context.Background(), mt.DB, source, time.Now().Add(-time.Hour))
+			if err != nil {
+				mt.Fatal(err)
+			}
+			if replayed != 3 {
+				mt.Errorf("replayed = %d, want 3", replayed)
+			}
+
+			// Both the dead events marked done and the events replayed are the index's own
+			events := mt.GetAllStartedEvents()
+			if len(events) != 2 {
+				mt.Fatalf("commands = %d, want 2 updates", len(events))
+			}
+			for _, event := range events {
+				filter := event.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q").Document()
+				values, err := filter.Lookup("type", "$in").Array().Values()
+				if err != nil {
+					mt.Fatalf("filter %v has no type", filter)
+				}
+				var types []string
+				for _, value := range values {
+					types = append(types, value.StringValue())
+				}
+				if !slices.Equal(types, source.eventTypes) {
+					mt.Errorf("filter types = %v, want %v", types, source.eventTypes)
+				}
+			}
+		})
+	}
+}
+
+func TestReindexSourcesCoverOutbox(t *testing.T) {
+	owners := map[string]string{}
+	for _, source := range reindexSources {
+		for _, eventType := range source.eventTypes {
+			if owner, ok := owners[eventType]; ok {
+				t.Errorf("%s is replayed by both %s and %s", eventType, owner, source.alias)
+			}
+			owners[eventType] = source.alias
+		}
+	}
+	for _, eventType := range []string{OutboxIndexMessage, OutboxIndexPost, OutboxSyncPostMessages, OutboxSyncUserReputation, OutboxIndexSavedSearch} {
+		if _, ok := owners[eventType]; !ok {
+			t.Errorf("%s is not replayed by any index", eventType)
+		}
+	}
+}
+
+func TestUpdateByQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		conflicts int
+		wantErr   bool
+	}{
+		{"updated", 0, false},
+		{"documents written meanwhile", 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				w.Header().Set("X-Elastic-Product", "Elasticsearch")
+				w.Header().Set("Content-Type", "application/json")
+				if strings.HasSuffix(r.URL.Path, "/_update_by_query") {
+					fmt.Fprintf(w, `{"updated": 3, "version_conflicts": %d}`, tt.conflicts)
+					return
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			previous := ElasticClient
+			ElasticClient = client
+			t.Cleanup(func() { ElasticClient = previous })
+
+			err = updateByQuery(context.Background(), postsIndex, map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			// Documents bulk writes left unrefreshed are updated too
+			want := []string{"POST /" + postsIndex + "/_refresh", "POST /" + postsIndex + "/_update_by_query"}
+			if !slices.Equal(requests, want) {
+				t.Errorf("requests = %q, want %q", requests, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// reputationPriorMean and reputationPriorWeight shrink the average of users with few
+	// ratings towards a neutral score: the prior counts as that many ratings of that value
+	reputationPriorMean   = 3.5
+	reputationPriorWeight = 5
+	// reputationRankWeight is how much reputation moves a match: the best and worst
+	// scores move the match score by about 9% either way
+	reputationRankWeight = 0.25
+	// maxRatingComment bounds the comment length, in runes
+	maxRatingComment = 1000
+)
+
+var (
+	ErrDealNotCompleted = errors.New("only deals both sides confirmed completed can be rated")
+	ErrAlreadyRated     = errors.New("you already rated this deal")
+)
+
+// Rating struct
+// The score a participant of a completed deal gives the other one
+type Rating struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	DealID    primitive.ObjectID `bson:"dealId" json:"dealId"`
+	RoomID    primitive.ObjectID `bson:"roomId" json:"roomId"`
+	RaterID   primitive.ObjectID `bson:"raterId" json:"raterId"`
+	RateeID   primitive.ObjectID `bson:"rateeId" json:"rateeId"`
+	Role      string             `bson:"role" json:"role"` // role of the rated user: buyer | seller
+	Score     int                `bson:"score" json:"score"`
+	Comment   string             `bson:"comment,omitempty" json:"comment,omitempty"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// Reputation is the trust signal stored on a user
+type Reputation struct {
+	// Score is the Bayesian average of the ratings, between 1 and 5
+	Score          float64 `bson:"score" json:"score"`
+	RatingAverage  float64 `bson:"ratingAverage" json:"ratingAverage"`
+	RatingCount    int     `bson:"ratingCount" json:"ratingCount"`
+	CompletedDeals int     `bson:"completedDeals" json:"completedDeals"`
+	// ResponseRate is the share of chats the user answered after the other side wrote
+	ResponseRate float64   `bson:"responseRate" json:"responseRate"`
+	UpdatedAt    time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// EnsureRatingIndexes makes a participant rate a deal at most once
+func EnsureRatingIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("ratings").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "dealId", Value: 1}, {Key: "raterId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "rateeId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	})
+	return err
+}
+
+// bayesianAverage shrinks an average of n ratings towards the prior
+func bayesianAverage(sum float64, n int) float64 {
+	return (reputationPriorMean*reputationPriorWeight + sum) / float64(reputationPriorWeight+n)
+}
+
+// ratingTotals sums the ratings of a user, overall and per rater
+type ratingTotals struct {
+	Sum   float64 `bson:"sum"`
+	Count int     `bson:"count"`
+	// RaterAverage sums the average rating of each rater, Raters counts them
+	RaterAverage float64 `bson:"raterAverage"`
+	Raters       int     `bson:"raters"`
+}
+
+// score is the Bayesian average over raters rather than ratings
+func (t ratingTotals) score() float64 {
+	return bayesianAverage(t.RaterAverage, t.Raters)
+}
+
+// reputationScore returns the score used for ranking; users without a reputation get the prior
+func reputationScore(rep *Reputation) float64 {
+	if rep == nil || rep.Score == 0 {
+		return reputationPriorMean
+	}
+	return rep.Score
+}
+
+// RateDeal records the rating of the other participant of a deal both sides confirmed
+// completed and updates their reputation. A participant rates each deal once.
+func RateDeal(ctx context.Context, db *mongo.Database, room *ChatRoom, raterID primitive.ObjectID, score int, comment string) (*Rating, error) {
+	var deal Deal
+	if err := db.Collection("deals").FindOne(ctx, bson.M{"roomId": room.ID}).Decode(&deal); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrDealNotCompleted
+		}
+		return nil, err
+	}
+	if deal.State != DealStateCompleted || !deal.confirmedByBoth(DealStateCompleted) {
+		return nil, ErrDealNotCompleted
+	}
+
+	rateeID, role := deal.SellerID, "seller"
+	if raterID == deal.SellerID {
+		rateeID, role = deal.BuyerID, "buyer"
+	}
+	// The unique index enforces this too, the check covers databases where it could
+	// not be built over older duplicate ratings
+	err := db.Collection("ratings").FindOne(ctx, bson.M{"dealId": deal.ID, "raterId": raterID}).Err()
+	if err == nil {
+		return nil, ErrAlreadyRated
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if runes := []rune(strings.TrimSpace(comment)); len(runes) > maxRatingComment {
+		comment = string(runes[:maxRatingComment])
+	}
+
+	rating := Rating{
+		ID:        primitive.NewObjectID(),
+		DealID:    deal.ID,
+		RoomID:    room.ID,
+		RaterID:   raterID,
+		RateeID:   rateeID,
+		Role:      role,
+		Score:     score,
+		Comment:   strings.TrimSpace(comment),
+		CreatedAt: time.Now(),
+	}
+	if _, err := db.Collection("ratings").InsertOne(ctx, rating); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrAlreadyRated
+		}
+		return nil, err
+	}
+
+	if _, err := UpdateReputation(ctx, db, rateeID); err != nil {
+		log.Printf("Warning: Error updating reputation of %s: %v", rateeID.Hex(), err)
+	}
+	return &rating, nil
+}
+
+// UpdateReputation recomputes the reputation of a user from their ratings, deals and chats,
+// stores it on the user and, through the outbox, mirrors the score to their indexed posts
+func UpdateReputation(ctx context.Context, db *mongo.Database, userID primitive.ObjectID) (*Reputation, error) {
+	rep := &Reputation{UpdatedAt: time.Now()}
+
+	// Ratings. The score counts each rater once, with the average of their ratings, so
+	// repeated small deals with the same person cannot inflate it.
+	cursor, err := db.Collection("ratings").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"rateeId": userID}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     "$raterId",
+			"sum":     bson.M{"$sum": "$score"},
+			"count":   bson.M{"$sum": 1},
+			"average": bson.M{"$avg": "$score"},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          nil,
+			"sum":          bson.M{"$sum": "$sum"},
+			"count":        bson.M{"$sum": "$count"},
+			"raterAverage": bson.M{"$sum": "$average"},
+			"raters":       bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ratings []ratingTotals
+	if err := cursor.All(ctx, &ratings); err != nil {
+		return nil, err
+	}
+	var totals ratingTotals
+	if len(ratings) > 0 {
+		totals = ratings[0]
+	}
+	rep.RatingCount = totals.Count
+	if totals.Count > 0 {
+		rep.RatingAverage = math.Round(totals.Sum/float64(totals.Count)*100) / 100
+	}
+	rep.Score = math.Round(totals.score()*100) / 100
+
+	// Completed deals, on either side
+	completed, err := db.Collection("deals").CountDocuments(ctx, bson.M{
+		"state": DealStateCompleted,
+		"$or":   []bson.M{{"buyerId": userID}, {"sellerId": userID}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep.CompletedDeals = int(completed)
+
+	if rep.ResponseRate, err = responseRate(ctx, db, userID); err != nil {
+		return nil, err
+	}
+
+	err = withTransaction(ctx, func(ctx context.Context) error {
+		_, err := db.Collection("users").UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"reputation": rep}})
+		if err != nil {
+			return err
+		}
+		return enqueueOutbox(ctx, db, OutboxSyncUserReputation, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	wakeOutbox()
+	return rep, nil
+}
+
+// responseRate is the share of the user's chat rooms where they wrote after the first
+// message of the other participant. Rooms where only the user wrote are not counted.
+func responseRate(ctx context.Context, db *mongo.Database, userID primitive.ObjectID) (float64, error) {
+	roomIDs, err := findUserRoomIDs(ctx, userID)
+	if err != nil || len(roomIDs) == 0 {
+		return 0, err
+	}
+
+	cursor, err := db.Collection("messages").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"roomId": bson.M{"$in": roomIDs}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": "$roomId",
+			// $min and $max ignore the nulls of the other sender
+			"firstOther": bson.M{"$min": bson.M{"$cond": bson.A{bson.M{"$ne": bson.A{"$senderId", userID}}, "$createdAt", nil}}},
+			"lastOwn":    bson.M{"$max": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$senderId", userID}}, "$createdAt", nil}}},
+		}}},
+		{{Key: "$match", Value: bson.M{"firstOther": bson.M{"$ne": nil}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"rooms": bson.M{"$sum": 1},
+			"answered": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$lastOwn", "$firstOther"}}, 1, 0,
+			}}},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var counts []struct {
+		Rooms    int `bson:"rooms"`
+		Answered int `bson:"answered"`
+	}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return 0, err
+	}
+	if len(counts) == 0 || counts[0].Rooms == 0 {
+		return 0, nil
+	}
+	return math.Round(float64(counts[0].Answered)/float64(counts[0].Rooms)*100) / 100, nil
+}
+
+// ownerReputation returns the ranking score of a post owner
+func ownerReputation(ctx context.Context, userID primitive.ObjectID) float64 {
+	var user User
+	err := userCollection.FindOne(ctx, bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"reputation": 1})).Decode(&user)
+	if err != nil {
+		return reputationPriorMean
+	}
+	return reputationScore(user.Reputation)
+}
+
+// updatePostsReputation copies a user's reputation score into their indexed posts
+func updatePostsReputation(ctx context.Context, userID primitive.ObjectID, score float64) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"user_id": userID.Hex()},
+		},
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": "ctx._source.user_reputation = params.score",
+			"params": map[string]interface{}{"score": score},
+		},
+	}
+	if err := updateByQuery(ctx, postsIndex, query); err != nil {
+		return fmt.Errorf("error updating posts: %w", err)
+	}
+	return nil
+}
+
+// reputationRankedQuery scales the score of a posts query by the owner's reputation
+func reputationRankedQuery(query map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"script_score": map[string]interface{}{
+			"query": query,
+			"script": map[string]interface{}{
+				"source": "double rep = doc.containsKey('user_reputation') && doc['user_reputation'].size() > 0 ? doc['user_reputation'].value : params.prior; " +
+					"return _score * (1 + params.weight * (rep - params.prior) / 4);",
+				"params": map[string]interface{}{
+					"prior":  reputationPriorMean,
+					"weight": reputationRankWeight,
+				},
+			},
+		},
+	}
+}
+
+// updateDealReputations refreshes the reputation of both sides when a deal completes
+func updateDealReputations(ctx context.Context, db *mongo.Database, deal *Deal) {
+	for _, userID := range []primitive.ObjectID{deal.BuyerID, deal.SellerID} {
+		if _, err := UpdateReputation(ctx, db, userID); err != nil {
+			log.Printf("Warning: Error updating reputation of %s: %v", userID.Hex(), err)
+		}
+	}
+}
+
+// handleRateDeal rates the other participant of the completed deal of a chat room.
+// Body: {"score": 1-5, "comment": "..."}
+func handleRateDeal(c *gin.Context) {
+	var req struct {
+		Score   int    `json:"score" binding:"required,min=1,max=5"`
+		Comment string `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+
+	room := loadRoomFromParam(c)
+	if room == nil {
+		return
+	}
+
+	rating, err := RateDeal(c.Request.Context(), mongoDB, room, currentUser(c).ID, req.Score, req.Comment)
+	switch {
+	case errors.Is(err, ErrDealNotCompleted), errors.Is(err, ErrAlreadyRated):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save rating", "detail": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"rating": rating})
+	}
+}
+
+// handleGetUserRatings lists the ratings a user received, newest first, with their reputation
+func handleGetUserRatings(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var user User
+	if err := userCollection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+
+	cursor, err := mongoDB.Collection("ratings").Find(ctx, bson.M{"rateeId": userID},
+		options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(50))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+	ratings := []Rating{}
+	if err := cursor.All(ctx, &ratings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reputation": user.Reputation, "ratings": ratings})
+}
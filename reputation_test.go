@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRateDeal(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	buyerID, sellerID := primitive.NewObjectID(), primitive.NewObjectID()
+	room := &ChatRoom{ID: primitive.NewObjectID(), BuyerID: buyerID, SellerID: sellerID}
+	confirmed := func(userIDs ...primitive.ObjectID) []DealConfirmation {
+		var confirmations []DealConfirmation
+		for _, id := range userIDs {
+			confirmations = append(confirmations, DealConfirmation{State: DealStateCompleted, UserID: id})
+		}
+		return confirmations
+	}
+
+	tests := []struct {
+		name          string
+		state         string
+		confirmations []DealConfirmation
+		// ratedBefore is a previous rating of the seller by the buyer, in the same deal
+		ratedBefore bool
+		err         error
+	}{
+		{"negotiating", DealStateNegotiating, nil, false, ErrDealNotCompleted},
+		{"completed without confirmations", DealStateCompleted, nil, false, ErrDealNotCompleted},
+		{"completed by one side", DealStateCompleted, confirmed(buyerID), false, ErrDealNotCompleted},
+		{"deal already rated", DealStateCompleted, confirmed(buyerID, sellerID), true, ErrAlreadyRated},
+		{"confirmed by both", DealStateCompleted, confirmed(sellerID, buyerID), false, nil},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			deal := Deal{ID: primitive.NewObjectID(), RoomID: room.ID, BuyerID: buyerID, SellerID: sellerID, State: tt.state, Confirmations: tt.confirmations}
+			var previous []bson.D
+			if tt.ratedBefore {
+				previous = append(previous, mockDocument(mt, Rating{ID: primitive.NewObjectID(), DealID: deal.ID, RaterID: buyerID, RateeID: sellerID, Score: 5}))
+			}
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, mt.DB.Name()+".deals", mtest.FirstBatch, mockDocument(mt, deal)),
+				mtest.CreateCursorResponse(0, mt.DB.Name()+".ratings", mtest.FirstBatch, previous...),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			)
+
+			rating, err := RateDeal(context.Background(), mt.DB, room, buyerID, 4, "  giao hàng nhanh  ")
+			if !errors.Is(err, tt.err) {
+				mt.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if rating.RateeID != sellerID || rating.Role != "seller" || rating.Comment != "giao hàng nhanh" || rating.DealID != deal.ID {
+				mt.Errorf("rating = %+v", rating)
+			}
+			// Earlier deals with the same seller do not count
+			filter := mt.GetAllStartedEvents()[1].Command.Lookup("filter").Document()
+			if filter.Lookup("dealId").ObjectID() != deal.ID || filter.Lookup("raterId").ObjectID() != buyerID {
+				mt.Errorf("rating lookup = %v, want the rater's rating of this deal", filter)
+			}
+		})
+	}
+
+	mt.Run("concurrent rating", func(mt *mtest.T) {
+		deal := Deal{ID: primitive.NewObjectID(), RoomID: room.ID, BuyerID: buyerID, SellerID: sellerID, State: DealStateCompleted, Confirmations: confirmed(buyerID, sellerID)}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, mt.DB.Name()+".deals", mtest.FirstBatch, mockDocument(mt, deal)),
+			mtest.CreateCursorResponse(0, mt.DB.Name()+".ratings", mtest.FirstBatch),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}),
+		)
+		if _, err := RateDeal(context.Background(), mt.DB, room, sellerID, 5, ""); !errors.Is(err, ErrAlreadyRated) {
+			mt.Errorf("err = %v, want ErrAlreadyRated", err)
+		}
+	})
+}
+
+func TestBayesianAverage(t *testing.T) {
+	tests := []struct {
+		sum  float64
+		n    int
+		want float64
+	}{
+		{0, 0, reputationPriorMean},
+		{5, 1, (reputationPriorMean*reputationPriorWeight + 5) / (reputationPriorWeight + 1)},
+		{500, 100, (reputationPriorMean*reputationPriorWeight + 500) / (reputationPriorWeight + 100)},
+	}
+	for _, tt := range tests {
+		if got := bayesianAverage(tt.sum, tt.n); got != tt.want {
+			t.Errorf("bayesianAverage(%v, %d) = %v, want %v", tt.sum, tt.n, got, tt.want)
+		}
+	}
+
+	// Three 5-star ratings from the same buyer weigh like one
+	repeated := ratingTotals{Sum: 15 + 2, Count: 4, RaterAverage: 5 + 2, Raters: 2}
+	if got, want := repeated.score(), bayesianAverage(7, 2); got != want {
+		t.Errorf("score of repeated ratings = %v, want %v", got, want)
+	}
+	if reputationScore(nil) != reputationPriorMean || reputationScore(&Reputation{Score: 4.2}) != 4.2 {
+		t.Errorf("reputationScore does not fall back to the prior")
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// savedSearchesIndex is the percolator index: one stored query per saved search,
+// run in reverse against every new post. It is an alias of the versioned index built
+// with savedSearchesMapping, see the reindex command
+const savedSearchesIndex = "saved_searches"
+
+// defaultAlertPercent is the match percentage from which a new post triggers an alert
+const defaultAlertPercent = 50
+
+// SavedSearch struct
+// Created automatically for every post, or explicitly from a search query
+type SavedSearch struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID primitive.ObjectID `bson:"userId" json:"userId"`
+	// PostID is set when the search was created from the user's own post
+	PostID     primitive.ObjectID `bson:"postId,omitempty" json:"postId,omitempty"`
+	Query      string             `bson:"query" json:"query"`
+	PostType   string             `bson:"postType" json:"postType"` // type of the posts wanted: "mua" or "ban"
+	Criteria   PostInfo           `bson:"criteria" json:"criteria"`
+	MinPercent int                `bson:"minPercent" json:"minPercent"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// Match struct
+// A new post that satisfied someone's saved search
+type Match struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SavedSearchID primitive.ObjectID `bson:"savedSearchId" json:"savedSearchId"`
+	// UserID owns the saved search and is the one notified
+	UserID       primitive.ObjectID `bson:"userId" json:"userId"`
+	SearchPostID primitive.ObjectID `bson:"searchPostId,omitempty" json:"searchPostId,omitempty"`
+	PostID       primitive.ObjectID `bson:"postId" json:"postId"`
+	PostUserID   primitive.ObjectID `bson:"postUserId" json:"postUserId"`
+	Score        float64            `bson:"score" json:"score"`
+	MatchPercent int                `bson:"matchPercent" json:"matchPercent"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+	// Post is attached to notifications and listings, it is not stored
+	Post *Post `bson:"-" json:"post,omitempty"`
+}
+
+// savedSearchDocument is the percolator document of a saved search
+type savedSearchDocument struct {
+	Query       map[string]interface{} `json:"query"`
+	SearchID    string                 `json:"search_id"`
+	OwnerID     string                 `json:"owner_id"`
+	PostType    string                 `json:"post_type"`
+	TotalWeight float64                `json:"total_weight"`
+	MinPercent  int                    `json:"min_percent"`
+}
+
+// EnsureSavedSearchIndexes creates the lookup indexes; a post is matched once per saved search
+func EnsureSavedSearchIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("saved_searches").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "postId", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("matches").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "savedSearchId", Value: 1}, {Key: "postId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	})
+	return err
+}
+
+// savedSearchesVersion is bumped with every change to savedSearchesMapping
+const savedSearchesVersion = 2
+
+// savedSearchesMapping defines the percolator index. The post fields are mapped like
+// in the posts index so the stored queries can be parsed.
+var savedSearchesMapping = withVietnameseAnalysis(`{
+	"settings": {
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings": {
+		"properties": {
+			"query": { "type": "percolator" },
+			"search_id": { "type": "keyword" },
+			"owner_id": { "type": "keyword" },
+			"post_type": { "type": "keyword" },
+			"total_weight": { "type": "float" },
+			"min_percent": { "type": "integer" },
+			"type": { "type": "keyword" },
+			"content": { "type": "text" },
+			"category": { "type": "keyword" },
+			"location": { "type": "keyword" },
+			"location_code": { "type": "keyword" },
+			"district_code": { "type": "keyword" },
+			"price_min": { "type": "long" },
+			"price_max": { "type": "long" },
+			"negotiable": { "type": "boolean" },
+			"condition": { "type": "keyword" },
+			"keywords": { "type": "keyword" },
+			"id": { "type": "keyword" },
+			"user_id": { "type": "keyword" },
+			"status": { "type": "keyword" },
+			"created_at": { "type": "date" },
+			"bumped_at": { "type": "date" },
+			"geo": { "type": "geo_point" }
+		}
+	}
+}`, "content")
+
+// createSavedSearchesIndex creates the percolator index behind its alias if it doesn't exist
+func createSavedSearchesIndex() error {
+	return ensureAliasedIndex(savedSearchesIndex, savedSearchesVersion, savedSearchesMapping)
+}
+
+// postInfoFromPost returns the classified fields of a stored post
+func postInfoFromPost(post *Post) *PostInfo {
+	return &PostInfo{
+		Type:         post.Type,
+		Category:     post.Category,
+		Location:     post.Location,
+		LocationCode: post.LocationCode,
+		District:     post.District,
+		DistrictCode: post.DistrictCode,
+		PriceMin:     post.PriceMin,
+		PriceMax:     post.PriceMax,
+		Negotiable:   post.Negotiable,
+		Condition:    post.Condition,
+		Keywords:     post.Keywords,
+	}
+}
+
+// oppositePostType returns the type of the posts a "mua" or "ban" post is looking for
+func oppositePostType(postType string) string {
+	if postType == "mua" {
+		return "ban"
+	}
+	return "mua"
+}
+
+// CreateSavedSearch stores a saved search; its percolator query follows through the outbox
+func CreateSavedSearch(ctx context.Context, db *mongo.Database, search *SavedSearch) error {
+	if len(buildMatchClauses(&search.Criteria)) == 0 {
+		return errors.New("search has no criteria to match on")
+	}
+	if search.ID.IsZero() {
+		search.ID = primitive.NewObjectID()
+	}
+	if search.MinPercent <= 0 {
+		search.MinPercent = defaultAlertPercent
+	}
+	search.PostType = oppositePostType(search.Criteria.Type)
+	search.CreatedAt = time.Now()
+
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		if _, err := db.Collection("saved_searches").InsertOne(ctx, search); err != nil {
+			return err
+		}
+		return enqueueOutbox(ctx, db, OutboxIndexSavedSearch, search.ID)
+	})
+	if err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// newSavedSearchDocument returns the percolator query of a saved search
+func newSavedSearchDocument(search *SavedSearch) savedSearchDocument {
+	clauses := buildMatchClauses(&search.Criteria)
+	total := 0.0
+	for _, clause := range clauses {
+		total += clause.weight
+	}
+	return savedSearchDocument{
+		Query: map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should":               shouldQueries(clauses),
+				"minimum_should_match": 1,
+			},
+		},
+		SearchID:    search.ID.Hex(),
+		OwnerID:     search.UserID.Hex(),
+		PostType:    search.PostType,
+		TotalWeight: total,
+		MinPercent:  search.MinPercent,
+	}
+}
+
+// indexSavedSearch stores the search criteria as a percolator query
+func indexSavedSearch(ctx context.Context, search *SavedSearch) error {
+	if searchIndexer == nil {
+		return fmt.Errorf("Elasticsearch client not initialized")
+	}
+
+	if err := searchIndexer.Index(ctx, savedSearchesIndex, search.ID.Hex(), newSavedSearchDocument(search)); err != nil {
+		return fmt.Errorf("error indexing saved search: %w", err)
+	}
+	return nil
+}
+
+// deleteSavedSearchIndex removes the percolator query of a deleted saved search
+func deleteSavedSearchIndex(ctx context.Context, searchID string) error {
+	if searchIndexer == nil {
+		return fmt.Errorf("Elasticsearch client not initialized")
+	}
+
+	if err := searchIndexer.Delete(ctx, savedSearchesIndex, searchID); err != nil {
+		return fmt.Errorf("error deleting saved search: %w", err)
+	}
+	return nil
+}
+
+// DeleteSavedSearch removes a saved search of the user; its percolator query follows through the outbox
+func DeleteSavedSearch(ctx context.Context, db *mongo.Database, userID, searchID primitive.ObjectID) error {
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		res, err := db.Collection("saved_searches").DeleteOne(ctx, bson.M{"_id": searchID, "userId": userID})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		return enqueueOutbox(ctx, db, OutboxIndexSavedSearch, searchID)
+	})
+	if err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// DeletePostSavedSearches removes the saved searches created from a post
+func DeletePostSavedSearches(ctx context.Context, db *mongo.Database, postID primitive.ObjectID) error {
+	cursor, err := db.Collection("saved_searches").Find(ctx, bson.M{"postId": postID})
+	if err != nil {
+		return err
+	}
+	var searches []SavedSearch
+	if err := cursor.All(ctx, &searches); err != nil {
+		return err
+	}
+	for _, search := range searches {
+		if err := DeleteSavedSearch(ctx, db, search.UserID, search.ID); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	return nil
+}
+
+// percolateHit is a saved search whose query matched a new post
+type percolateHit struct {
+	Score  float64             `json:"_score"`
+	Source savedSearchDocument `json:"_source"`
+}
+
+// percolatePost runs the saved searches of other users that want this type of post
+func percolatePost(ctx context.Context, post *Post) ([]percolateHit, error) {
+	searchQuery := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"percolate": map[string]interface{}{
+						"field":    "query",
+						"document": newPostIndex(post),
+					},
+				},
+				"filter": []map[string]interface{}{
+					{"term": map[string]interface{}{"post_type": post.Type}},
+				},
+				"must_not": []map[string]interface{}{
+					{"term": map[string]interface{}{"owner_id": post.UserID.Hex()}},
+				},
+			},
+		},
+		"size": 500,
+	}
+	data, err := json.Marshal(searchQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling percolate query: %w", err)
+	}
+
+	res, err := ElasticClient.Search(
+		ElasticClient.Search.WithContext(ctx),
+		ElasticClient.Search.WithIndex(savedSearchesIndex),
+		ElasticClient.Search.WithBody(bytes.NewReader(data)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error percolating post: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error percolating post: %s", res.String())
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []percolateHit `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing percolate response: %w", err)
+	}
+	return result.Hits.Hits, nil
+}
+
+// ReverseMatchPost finds the saved searches a new post satisfies, records a Match for
+// each of them and notifies their owners. The stored queries are the named constant_score
+// clauses of the matching query, so a hit's score is the sum of its matched weights.
+func ReverseMatchPost(ctx context.Context, db *mongo.Database, post *Post) ([]Match, error) {
+	if ElasticClient == nil {
+		return nil, nil
+	}
+
+	hits, err := percolatePost(ctx, post)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Match
+	for _, hit := range hits {
+		if hit.Source.TotalWeight <= 0 {
+			continue
+		}
+		percent := int(math.Round(hit.Score / hit.Source.TotalWeight * 100))
+		if percent > 100 {
+			percent = 100
+		}
+		if percent < hit.Source.MinPercent {
+			continue
+		}
+
+		var search SavedSearch
+		searchID, _ := primitive.ObjectIDFromHex(hit.Source.SearchID)
+		if err := db.Collection("saved_searches").FindOne(ctx, bson.M{"_id": searchID}).Decode(&search); err != nil {
+			// The search was deleted after being percolated
+			continue
+		}
+
+		match := Match{
+			ID:            primitive.NewObjectID(),
+			SavedSearchID: search.ID,
+			UserID:        search.UserID,
+			SearchPostID:  search.PostID,
+			PostID:        post.ID,
+			PostUserID:    post.UserID,
+			Score:         hit.Score,
+			MatchPercent:  percent,
+			CreatedAt:     time.Now(),
+		}
+		if _, err := db.Collection("matches").InsertOne(ctx, match); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return matches, err
+		}
+
+		match.Post = post
+		notifyMatch(match)
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// notifyMatch tells the owner of the saved search about the new post, by push
+// notification when they are offline. The match itself is listed by /matches.
+func notifyMatch(match Match) {
+	chatHub.PublishUser(match.UserID, ChatEvent{Type: "match", Match: &match})
+	notifyOfflineMatch(match)
+}
+
+// matchNewPost saves the post as a search for counter-posts and runs the existing
+// searches against it. Failures are logged, they must not block the post creation.
+func matchNewPost(ctx context.Context, db *mongo.Database, post *Post) []Match {
+	search := SavedSearch{
+		UserID:   post.UserID,
+		PostID:   post.ID,
+		Query:    post.Content,
+		Criteria: *postInfoFromPost(post),
+	}
+	if err := CreateSavedSearch(ctx, db, &search); err != nil {
+		log.Printf("Warning: Error saving search for post %s: %v", post.ID.Hex(), err)
+	}
+
+	matches, err := ReverseMatchPost(ctx, db, post)
+	if err != nil {
+		log.Printf("Warning: Error reverse matching post %s: %v", post.ID.Hex(), err)
+	}
+	return matches
+}
+
+// handleCreateSavedSearch saves a search query of the current user
+func handleCreateSavedSearch(c *gin.Context) {
+	var req struct {
+		Query      string `json:"query" binding:"required"`
+		MinPercent int    `json:"minPercent"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "detail": err.Error()})
+		return
+	}
+	if req.MinPercent < 0 || req.MinPercent > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "minPercent must be between 0 and 100"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	postInfo, err := ClassifyPost(ctx, req.Query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to classify search", "detail": err.Error()})
+		return
+	}
+
+	search := SavedSearch{
+		UserID:     currentUser(c).ID,
+		Query:      req.Query,
+		Criteria:   *postInfo,
+		MinPercent: req.MinPercent,
+	}
+	if err := CreateSavedSearch(ctx, mongoDB, &search); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to save search", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"savedSearch": search})
+}
+
+// handleGetSavedSearches lists the saved searches of the current user
+func handleGetSavedSearches(c *gin.Context) {
+	ctx := c.Request.Context()
+	cursor, err := mongoDB.Collection("saved_searches").Find(ctx,
+		bson.M{"userId": currentUser(c).ID},
+		options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	searches := []SavedSearch{}
+	if err := cursor.All(ctx, &searches); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"savedSearches": searches})
+}
+
+// handleDeleteSavedSearch removes a saved search of the current user
+func handleDeleteSavedSearch(c *gin.Context) {
+	searchID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid saved search ID"})
+		return
+	}
+
+	if err := DeleteSavedSearch(c.Request.Context(), mongoDB, currentUser(c).ID, searchID); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Saved search not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete saved search", "detail": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleGetMatches lists the posts that matched the current user's saved searches, newest first
+func handleGetMatches(c *gin.Context) {
+	ctx := c.Request.Context()
+	cursor, err := mongoDB.Collection("matches").Find(ctx,
+		bson.M{"userId": currentUser(c).ID},
+		options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(100))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	matches := []Match{}
+	if err := cursor.All(ctx, &matches); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+		return
+	}
+
+	// Attach the matched posts in one query
+	postIDs := make([]primitive.ObjectID, len(matches))
+	for i, match := range matches {
+		postIDs[i] = match.PostID
+	}
+	posts := map[primitive.ObjectID]*Post{}
+	if len(postIDs) > 0 {
+		cursor, err := postCollection.Find(ctx, bson.M{"_id": bson.M{"$in": postIDs}})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+			return
+		}
+		var found []Post
+		if err := cursor.All(ctx, &found); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "detail": err.Error()})
+			return
+		}
+		for i := range found {
+			posts[found[i].ID] = &found[i]
+		}
+	}
+	for i := range matches {
+		matches[i].Post = posts[matches[i].PostID]
+	}
+
+	c.JSON(http.StatusOK, gin.H{"matches": matches})
+}
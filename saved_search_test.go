@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSavedSearchOutbox(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	// The percolator is only written by the outbox worker, which never runs here
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{"http://127.0.0.1:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := ElasticClient
+	ElasticClient = client
+	t.Cleanup(func() { ElasticClient = previous })
+
+	// outboxEvent returns the event inserted by the second command sent
+	outboxEvent := func(mt *mtest.T) bson.Raw {
+		events := mt.GetAllStartedEvents()
+		if len(events) != 2 || events[1].CommandName != "insert" {
+			mt.Fatalf("commands = %d, want the write then the outbox insert", len(events))
+		}
+		if coll := events[1].Command.Lookup("insert").StringValue(); coll != "outbox" {
+			mt.Fatalf("second insert into %q, want outbox", coll)
+		}
+		return events[1].Command.Lookup("documents").Array().Index(0).Value().Document()
+	}
+
+	mt.Run("create", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+		search := SavedSearch{UserID: primitive.NewObjectID(), Query: "cần mua iphone", Criteria: PostInfo{Type: "mua", Category: "điện thoại"}}
+		if err := CreateSavedSearch(context.Background(), mt.DB, &search); err != nil {
+			mt.Fatal(err)
+		}
+		if search.PostType != "ban" || search.MinPercent != defaultAlertPercent {
+			mt.Errorf("search = %+v, want post type ban and the default alert percent", search)
+		}
+		event := outboxEvent(mt)
+		if event.Lookup("type").StringValue() != OutboxIndexSavedSearch || event.Lookup("aggregateId").ObjectID() != search.ID {
+			mt.Errorf("outbox event = %v, want %s of %s", event, OutboxIndexSavedSearch, search.ID.Hex())
+		}
+	})
+
+	mt.Run("create without criteria", func(mt *mtest.T) {
+		search := SavedSearch{UserID: primitive.NewObjectID(), Query: "alo"}
+		if err := CreateSavedSearch(context.Background(), mt.DB, &search); err == nil {
+			mt.Error("CreateSavedSearch without criteria succeeded")
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			mt.Errorf("commands = %d, want nothing written", len(events))
+		}
+	})
+
+	mt.Run("delete", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+		searchID := primitive.NewObjectID()
+		if err := DeleteSavedSearch(context.Background(), mt.DB, primitive.NewObjectID(), searchID); err != nil {
+			mt.Fatal(err)
+		}
+		event := outboxEvent(mt)
+		if event.Lookup("type").StringValue() != OutboxIndexSavedSearch || event.Lookup("aggregateId").ObjectID() != searchID {
+			mt.Errorf("outbox event = %v, want %s of %s", event, OutboxIndexSavedSearch, searchID.Hex())
+		}
+	})
+
+	mt.Run("delete missing", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+		err := DeleteSavedSearch(context.Background(), mt.DB, primitive.NewObjectID(), primitive.NewObjectID())
+		if err != mongo.ErrNoDocuments {
+			mt.Errorf("DeleteSavedSearch = %v, want ErrNoDocuments", err)
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 1 {
+			mt.Errorf("commands = %d, want no outbox event", len(events))
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMSSender delivers a text message to a phone number in E.164 format
+type SMSSender interface {
+	Send(ctx context.Context, to, body string) error
+}
+
+// smsSender is the backend used for notifications, selected in main by NewSMSSenderFromEnv
+var smsSender SMSSender = NewFileSMSSender("")
+
+// Vietnamese SMS templates; placeholders are replaced by renderSMS
+const (
+	smsTemplateBuyerInterest  = "{buyer} đã quan tâm đến tin đăng của bạn: {content}"
+	smsTemplateSellerInterest = "{seller} có hàng phù hợp với tin cần mua của bạn: {content}"
+	smsTemplateVerification   = "Mã xác minh Chat Buy Sell của bạn là {code}. Mã có hiệu lực trong 10 phút."
+)
+
+// smsContentLimit keeps notifications within a couple of SMS segments
+const smsContentLimit = 80
+
+// renderSMS fills the {name} placeholders of a template
+func renderSMS(template string, vars map[string]string) string {
+	pairs := make([]string, 0, len(vars)*2)
+	for name, value := range vars {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// truncateSMS shortens a post content to limit runes, ending with an ellipsis
+func truncateSMS(content string, limit int) string {
+	runes := []rune(strings.Join(strings.Fields(content), " "))
+	if len(runes) <= limit {
+		return string(runes)
+	}
+	return strings.TrimSpace(string(runes[:limit-1])) + "…"
+}
+
+// NewSMSSenderFromEnv selects the SMS backend from the SMS_PROVIDER variable:
+// "twilio", or "file" (default) which writes messages to SMS_FILE, or to the log when unset
+func NewSMSSenderFromEnv() (SMSSender, error) {
+	switch provider := getEnv("SMS_PROVIDER", "file"); provider {
+	case "twilio":
+		accountSID := os.Getenv("TWILIO_ACCOUNT_SID")
+		authToken := os.Getenv("TWILIO_AUTH_TOKEN")
+		from := os.Getenv("TWILIO_FROM_NUMBER")
+		if accountSID == "" || authToken == "" || from == "" {
+			return nil, fmt.Errorf("TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM_NUMBER must be set")
+		}
+		return NewTwilioSMSSender(getEnv("TWILIO_API_URL", "https://api.twilio.com"), accountSID, authToken, from), nil
+	case "file":
+		return NewFileSMSSender(os.Getenv("SMS_FILE")), nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", provider)
+	}
+}
+
+// TwilioSMSSender sends messages through the Twilio Messages API, or any provider
+// exposing the same endpoint under another base URL
+type TwilioSMSSender struct {
+	client     *http.Client
+	baseURL    string
+	accountSID string
+	authToken  string
+	from       string
+}
+
+// NewTwilioSMSSender creates a Twilio compatible sender
+func NewTwilioSMSSender(baseURL, accountSID, authToken, from string) *TwilioSMSSender {
+	return &TwilioSMSSender{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+	}
+}
+
+// Send posts the message to /2010-04-01/Accounts/{sid}/Messages.json
+func (ts *TwilioSMSSender) Send(ctx context.Context, to, body string) error {
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", ts.from)
+	form.Set("Body", body)
+
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", ts.baseURL, url.PathEscape(ts.accountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(ts.accountSID, ts.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending SMS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("error sending SMS: %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// FileSMSSender is the development backend: messages are appended as JSON lines
+// to a file, or written to the log when no path is set
+type FileSMSSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileSMSSender creates a sender writing to path, or to the log if path is empty
+func NewFileSMSSender(path string) *FileSMSSender {
+	return &FileSMSSender{path: path}
+}
+
+// Send records the message instead of delivering it
+func (fs *FileSMSSender) Send(ctx context.Context, to, body string) error {
+	if fs.path == "" {
+		log.Printf("SMS to %s: %s", to, body)
+		return nil
+	}
+
+	line, err := json.Marshal(map[string]interface{}{
+		"to":     to,
+		"body":   body,
+		"sentAt": time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, err := os.OpenFile(fs.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderSMS(t *testing.T) {
+	tests := []struct {
+		template string
+		vars     map[string]string
+		want     string
+	}{
+		{smsTemplateVerification, map[string]string{"code": "012345"}, "Mã xác minh Chat Buy Sell của bạn là 012345. Mã có hiệu lực trong 10 phút."},
+		{smsTemplateBuyerInterest, map[string]string{"buyer": "Lan", "content": "iphone 12"}, "Lan đã quan tâm đến tin đăng của bạn: iphone 12"},
+		{smsTemplateSellerInterest, map[string]string{"seller": "Minh", "content": "xe máy"}, "Minh có hàng phù hợp với tin cần mua của bạn: xe máy"},
+		// Unknown placeholders are kept, values are not expanded again
+		{"{a} {b}", map[string]string{"a": "{b}"}, "{b} {b}"},
+		{"no placeholder", nil, "no placeholder"},
+	}
+	for _, tt := range tests {
+		if got := renderSMS(tt.template, tt.vars); got != tt.want {
+			t.Errorf("renderSMS(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateSMS(t *testing.T) {
+	tests := []struct {
+		content string
+		limit   int
+		want    string
+	}{
+		{"ngắn", 10, "ngắn"},
+		{"  nhiều   khoảng\ntrắng ", 80, "nhiều khoảng trắng"},
+		{"điện thoại", 10, "điện thoại"},
+		{"điện thoại cũ", 10, "điện thoạ…"},
+		{"bán xe máy", 5, "bán…"},
+		{strings.Repeat("ă", 100), smsContentLimit, strings.Repeat("ă", smsContentLimit-1) + "…"},
+	}
+	for _, tt := range tests {
+		got := truncateSMS(tt.content, tt.limit)
+		if got != tt.want {
+			t.Errorf("truncateSMS(%q, %d) = %q, want %q", tt.content, tt.limit, got, tt.want)
+		}
+		if n := len([]rune(got)); n > tt.limit {
+			t.Errorf("truncateSMS(%q, %d) has %d runes", tt.content, tt.limit, n)
+		}
+	}
+}